@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/perfile"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+)
+
+// runListContents prints the entries of the archive at key in R2 or --dest, one per line,
+// without downloading it to disk.
+func runListContents(ctx context.Context, opts options, key string, w io.Writer) error {
+	dest, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	names, err := listContents(ctx, dest, key, backup.ArchiveOptions{
+		Encrypter:   opts.encrypter,
+		MemoryLimit: opts.memLimit,
+		Suffix:      opts.archiveSuffix,
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+	return nil
+}
+
+// listContents returns the entry names of the archive at key. Tar archives are streamed
+// through the decompressor and never touch the disk, though the whole object is still
+// read. Zip needs random access and is downloaded to a temporary file first. A per-file
+// manifest key lists the snapshot from the manifest alone.
+func listContents(ctx context.Context, dest store.Store, key string, aopts backup.ArchiveOptions) ([]string, error) {
+	if perfile.IsManifest(key) {
+		m, err := perfile.ReadManifest(ctx, dest, perfile.Prefix(key))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, e := range m.Entries {
+			name := e.Path
+			if e.Type == perfile.TypeDir {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		return names, nil
+	}
+	name := backup.TrimArchiveSuffix(key, aopts.Suffix)
+	if !backup.IsArchive(name) {
+		return nil, fmt.Errorf("%s is not an archive", key)
+	}
+
+	r, err := dest.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	names, err := backup.ListStream(r, key, aopts)
+	r.Close()
+	if !errors.Is(err, backup.ErrNotStreamable) {
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", key, err)
+		}
+		return names, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "k8s-cf-backup-list-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	local := filepath.Join(tmpDir, filepath.Base(key))
+	if err := dest.Download(ctx, key, local); err != nil {
+		return nil, err
+	}
+	if names, err = backup.ArchiverFor(name).List(local, aopts); err != nil {
+		return nil, fmt.Errorf("listing %s: %w", key, err)
+	}
+	return names, nil
+}
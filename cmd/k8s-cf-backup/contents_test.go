@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/perfile"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+)
+
+// streamOnlyStore fails every Download, proving an archive was listed without a local copy.
+type streamOnlyStore struct {
+	store.Store
+}
+
+func (streamOnlyStore) Download(ctx context.Context, key, destPath string) error {
+	return errors.New("download not allowed")
+}
+
+func writeContentsTree(t *testing.T) string {
+	t.Helper()
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "data", "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestListContents_StreamsTar(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	src := writeContentsTree(t)
+	key := "ns/rel/ns_rel_20240101-000000_data.tar.gz"
+	archivePath := filepath.Join(t.TempDir(), filepath.Base(key))
+	if _, err := backup.ArchiverFor(key).Create(ctx, archivePath, src, backup.ArchiveOptions{Manifest: true}); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := store.NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Upload(ctx, archivePath, key); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := listContents(ctx, streamOnlyStore{fs}, key, backup.ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("listContents: %v", err)
+	}
+	if !slices.Equal(names, []string{"./", "data/", "data/file.txt"}) {
+		t.Errorf("listContents() = %v, want [./ data/ data/file.txt]", names)
+	}
+
+	var buf bytes.Buffer
+	if err := runListContents(ctx, options{dest: "fs://" + root}, key, &buf); err != nil {
+		t.Fatalf("runListContents: %v", err)
+	}
+	if got := buf.String(); got != "./\ndata/\ndata/file.txt\n" {
+		t.Errorf("output = %q", got)
+	}
+}
+
+func TestListContents_ZipAndPerFile(t *testing.T) {
+	ctx := context.Background()
+	src := writeContentsTree(t)
+	fs, err := store.NewFS(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zipKey := "ns/rel/data.zip"
+	archivePath := filepath.Join(t.TempDir(), "data.zip")
+	if _, err := backup.ArchiverFor(zipKey).Create(ctx, archivePath, src, backup.ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Upload(ctx, archivePath, zipKey); err != nil {
+		t.Fatal(err)
+	}
+	names, err := listContents(ctx, fs, zipKey, backup.ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("listContents(zip): %v", err)
+	}
+	if !slices.Contains(names, "data/file.txt") {
+		t.Errorf("listContents(zip) = %v, want data/file.txt", names)
+	}
+
+	if _, err := perfile.Upload(ctx, fs, src, "snap/", false); err != nil {
+		t.Fatal(err)
+	}
+	names, err = listContents(ctx, fs, "snap/"+perfile.ManifestName, backup.ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("listContents(manifest): %v", err)
+	}
+	if !slices.Equal(names, []string{"data/", "data/file.txt"}) {
+		t.Errorf("listContents(manifest) = %v, want [data/ data/file.txt]", names)
+	}
+
+	if _, err := listContents(ctx, fs, "ns/rel/notes.txt", backup.ArchiveOptions{}); err == nil || !strings.Contains(err.Error(), "not an archive") {
+		t.Errorf("listContents(notes.txt) error = %v, want not an archive", err)
+	}
+}
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/crypt"
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/discovery"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/perfile"
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/scaler"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/snapshot"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
 
 	flag "github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -28,30 +45,253 @@ const defaultOutputFormat = "{namespace}_{release}_{date}_{pvc}.tar.gz"
 type restoreTask struct {
 	archivePath string
 	pvc         types.PVCInfo
+	subtree     string // the PVC's directory in a combined archive; empty for a per-PVC archive
+	perFile     bool   // archivePath is the key prefix of an --object-per-file snapshot
 }
 
-func main() {
-	var (
-		namespace     string
-		release       string
-		outputFormat  string
-		outputDir     string
-		dryRun        bool
-		verbose       bool
-		kubeconfig    string
-		r2Credentials string
-		keepLast      int
-	)
+// options holds the parsed command-line flags.
+type options struct {
+	namespace      string
+	allNamespaces  bool
+	labelKeys      []string // --label-key; PVCs carrying any of them belong to the release
+	release        string
+	releases       []string // every --release when it names more than one; backup only
+	outputFormat   string
+	nameTemplate   *backup.NameTemplate // --name-template or --name-template-file; replaces outputFormat for new archives
+	restoreFormats []string
+	fromFormat     string
+	toRelease      string
+	toR2Creds      string
+	toDest         string
+	deleteSource   bool
+	outputDir      string
+	compression    string
+	archiveSuffix  string
+	pvcOpts        map[string]backup.PVCOptions // --pvc-opts by PVC name
+	tarFormat      tar.Format
+	memLimit       uint64
+	dictPath       string           // --compression-dict
+	dict           *backup.ZstdDict // loaded from dictPath, or trained on the first backup
+	streamBuffer   int
+	xattrs         bool
+	owner          *backup.OwnerMap
+	modeMask       os.FileMode
+	reproducible   bool
+	excludeEmpty   bool              // --exclude-empty-dirs
+	exclude        *backup.Excludes  // --exclude
+	oneFileSystem  bool              // --exclude-mount-boundaries
+	parallelGzip   bool              // --parallel-compress on backup, --parallel-decompress on restore
+	compressLevel  int               // --compression-level; 0 = codec default
+	dateSource     backup.DateSource // --archive-mtime-source
+	quota          int64             // --r2-quota in bytes; 0 = none
+	quotaPrefix    string            // --r2-quota-prefix
+	lockDays       int               // --object-lock-days; 0 = uploads are not locked
+	minFreeAfter   int64             // --min-free-after in bytes; 0 = no check
+	force          bool
+	dryRun         bool
+	verbose        bool
+	kubeconfig     string
+	as             string
+	asGroups       []string
+	r2Credentials  string
+	r2Secret       string
+	r2Creds        *r2.Credentials // loaded from r2Secret once the client exists
+	r2Region       string          // --r2-region, for credentials with an endpoint
+	r2PathStyle    bool            // --r2-path-style, for credentials with an endpoint
+	dest           string
+	keepLast       int
+	keepDays       int
+	gfs            store.GFS
+	checksumMode   r2.ChecksumMode
+	kms            string
+	ageRecipients  []string
+	ageIdentity    string
+	encrypter      backup.Encrypter
+	allowedRoot    string
+	strictPaths    bool
+	pathRoots      []string // --allowed-path-roots; empty allows every host path
+	pvcTimeout     time.Duration
+	readOnly       bool
+	failFast       bool
+	combined       bool
+	skipMissing    bool
+	matchByMeta    bool // --match-by-metadata
+	objectPerFile  bool
+	dedupStore     bool // --dedup-store; implies objectPerFile
+	stateFile      string
+	state          *backup.State        // loaded from stateFile by run
+	unchangedFile  string               // --skip-unchanged
+	fingerprints   *backup.Fingerprints // loaded from unchangedFile by loadFingerprints
+	continueFrom   string
+	skipExisting   bool
+	pipelineDepth  int  // --pipeline-depth; 0 uploads after every PVC is backed up
+	parallel       int  // --parallel; PVCs archived at once
+	stream         bool // --stream; archives go straight to R2 or --dest, never to disk
+
+	excludeOrphans  bool
+	ordinals        []int // --ordinals; empty keeps every StatefulSet ordinal
+	onlyOrphans     bool
+	requireWorkload bool     // --require-workload
+	pvs             []string // --pv: PVs backed up directly instead of discovering PVCs
+	handleHPA       bool
+	scaleTargets    map[string]int32 // --scale-to replicas by scaler.TargetKey
+	useCSISnapshot  bool
+	snapshotter     *snapshot.Snapshotter // built by main with --use-csi-snapshot
+	pvcOrder        []string
+	restoreAfter    restoreDeps // --restore-after; restores run in parallel when set
+	restoreVersion  int
+	listVersions    bool
+	restoreAll      bool // --restore-all; needs yes
+	verifyChecksum  bool
+	yes             bool
+	waitReady       bool
+	readyKey        string // --ready-annotation key; empty when not waited for
+	readyValue      string
+	postDelay       time.Duration // --post-restore-delay
+	planHash        bool
+	requirePlan     string
+	targetsFile     string    // --targets
+	targetParallel  int       // --target-parallel
+	targets         []target  // loaded from targetsFile
+	out             io.Writer // a concurrent target's own buffer; see output
+	json            bool
+	summaryFile     string
+}
+
+// out receives progress and summary output. With --json it is stderr, leaving stdout for the
+// machine-readable report.
+var out io.Writer = os.Stdout
+
+// output is where a backup run writes its progress: out, unless the run is a --targets
+// target running alongside others, which writes into a buffer of its own.
+func (o options) output() io.Writer {
+	if o.out != nil {
+		return o.out
+	}
+	return out
+}
+
+// stdoutDir is the --output-dir value that streams the archive to stdout.
+const stdoutDir = "-"
 
-	flag.StringVarP(&namespace, "namespace", "n", "", "Kubernetes namespace (required)")
-	flag.StringVarP(&release, "release", "r", "", "Helm release name (required)")
-	flag.StringVarP(&outputFormat, "output-format", "o", defaultOutputFormat, "Archive filename template")
-	flag.StringVarP(&outputDir, "output-dir", "d", ".", "Output directory for archives")
-	flag.BoolVar(&dryRun, "dry-run", false, "Show what would be done without doing it")
-	flag.BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
-	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig (default: in-cluster or ~/.kube/config)")
-	flag.StringVar(&r2Credentials, "r2-credentials", "", "Path to R2 credentials JSON (enables R2 upload/download)")
-	flag.IntVar(&keepLast, "keep-last", 0, "Number of backups to keep per PVC in R2 (0 = unlimited)")
+func main() {
+	var opts options
+	var checksumMode string
+	var releases []string
+
+	flag.StringVarP(&opts.namespace, "namespace", "n", "", "Kubernetes namespace (required unless --all-namespaces)")
+	flag.BoolVarP(&opts.allNamespaces, "all-namespaces", "A", false, "Discover labelled PVCs across all namespaces (backup only)")
+	flag.StringArrayVar(&opts.labelKeys, "label-key", []string{"app.kubernetes.io/instance"}, "Label whose value is the release name; repeat to find PVCs carrying any of them")
+	flag.StringSliceVarP(&releases, "release", "r", nil, "Helm release name (required unless --all-namespaces); comma-separate or repeat to back up several of the namespace (backup only)")
+	flag.StringVarP(&opts.outputFormat, "output-format", "o", defaultOutputFormat, "Archive filename template")
+	var nameTemplate, nameTemplateFile string
+	flag.StringVar(&nameTemplate, "name-template", "", "Go text/template for archive names, replacing --output-format for new backups")
+	flag.StringVar(&nameTemplateFile, "name-template-file", "", "Read --name-template from a file")
+	flag.StringArrayVar(&opts.restoreFormats, "restore-format", nil, "Older --output-format to try when a restore archive doesn't match the current one (repeatable, tried in order)")
+	flag.StringVar(&opts.fromFormat, "from-format", "", "Key template the archives were written with (migrate only; default: --output-format)")
+	flag.StringVar(&opts.toRelease, "to-release", "", "Release name to re-key archives to (migrate only; default: --release)")
+	flag.StringVar(&opts.toR2Creds, "to-r2-credentials", "", "R2 credentials JSON of the bucket to migrate to (migrate only; default: the source)")
+	flag.StringVar(&opts.toDest, "to-dest", "", "Migrate to a mounted filesystem instead (fs:///mnt/backups, migrate only)")
+	flag.BoolVar(&opts.deleteSource, "delete-source", false, "Delete each archive after it is migrated (migrate only)")
+	flag.StringVarP(&opts.outputDir, "output-dir", "d", ".", "Output directory for archives, or - to write the single archive of a one-PVC release to stdout")
+	flag.StringVar(&opts.compression, "compression", "", "Tar compression: gzip, zstd or none (default: from --output-format extension)")
+	flag.StringVar(&opts.archiveSuffix, "archive-suffix", "", "Suffix appended to archive names after the extension and any encryption suffix, e.g. .bak")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "Show what would be done without doing it")
+	flag.BoolVarP(&opts.verbose, "verbose", "v", false, "Verbose output, ending with how long each phase took")
+	flag.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to kubeconfig (default: in-cluster or ~/.kube/config)")
+	flag.StringVar(&opts.as, "as", "", "Username or service account (system:serviceaccount:<ns>:<name>) to impersonate")
+	flag.StringArrayVar(&opts.asGroups, "as-group", nil, "Group to impersonate; repeat for multiple groups (requires --as)")
+	flag.StringVar(&opts.r2Credentials, "r2-credentials", "", "Path to R2 credentials JSON (enables R2 upload/download)")
+	flag.StringVar(&opts.r2Secret, "r2-credentials-secret", "", "Read R2 credentials from this Kubernetes Secret (namespace/name) instead of a file")
+	flag.StringVar(&opts.r2Region, "r2-region", "", "Region to sign requests for when the credentials name an S3-compatible endpoint, e.g. us-east-1")
+	flag.BoolVar(&opts.r2PathStyle, "r2-path-style", false, "Address buckets as endpoint/bucket when the credentials name an S3-compatible endpoint (MinIO, Ceph RGW)")
+	flag.StringVar(&opts.dest, "dest", "", "Copy archives to a mounted filesystem instead of R2 (fs:///mnt/backups)")
+	flag.IntVar(&opts.keepLast, "keep-last", 0, "Number of backups to keep per PVC in R2 or --dest (0 = unlimited)")
+	flag.IntVar(&opts.gfs.Daily, "retention-daily", 0, "Keep the newest backup of each of the last N days that have one, per PVC")
+	flag.IntVar(&opts.gfs.Weekly, "retention-weekly", 0, "Keep the newest backup of each of the last N ISO weeks that have one, per PVC")
+	flag.IntVar(&opts.gfs.Monthly, "retention-monthly", 0, "Keep the newest backup of each of the last N months that have one, per PVC")
+	flag.IntVar(&opts.keepDays, "keep-days", 0, "Keep backups younger than this many days per PVC in R2 or --dest (0 = unlimited)")
+	var tarFormat, memLimit, streamBuffer, quota, minFreeAfter string
+	flag.StringVar(&quota, "r2-quota", "", "Refuse to upload when R2 (or --dest) would exceed this size after rotation, e.g. 500Gi")
+	flag.StringVar(&opts.quotaPrefix, "r2-quota-prefix", "", "Key prefix whose objects count toward --r2-quota (default: the whole bucket)")
+	flag.BoolVar(&opts.force, "force", false, "Upload even when --r2-quota would be exceeded, with a warning")
+	flag.IntVar(&opts.lockDays, "object-lock-days", 0, "Upload archives under S3 object lock (compliance mode) for this many days; the bucket must have object lock enabled")
+	flag.StringVar(&minFreeAfter, "min-free-after", "", "Refuse to back up when the archives could leave less than this much free space in --output-dir, e.g. 10Gi (backup only)")
+	flag.BoolVar(&opts.stream, "stream", false, "Upload each archive to R2 (or --dest) as it is created, without writing it to --output-dir (backup only)")
+	flag.IntVar(&opts.pipelineDepth, "pipeline-depth", 0, "Upload each archive while the next PVC is backed up, with at most this many finished archives waiting (0 = upload after all backups)")
+	var pvcOpts []string
+	flag.StringArrayVar(&pvcOpts, "pvc-opts", nil, "Override archive settings of one PVC as pvc=codec:<gzip|zstd|none>,encrypt:<true|false> (repeatable)")
+	flag.StringVar(&memLimit, "compression-memlimit", "", "Bound zstd memory on backup and restore, e.g. 8Mi (default: codec defaults)")
+	flag.StringVar(&opts.dictPath, "compression-dict", "", "zstd dictionary file; backup trains one from the PVCs when it does not exist yet, restore requires it")
+	flag.StringVar(&streamBuffer, "stream-buffer-size", "", "Buffer size for archives streamed with --output-dir -, e.g. 256Ki (default 1Mi)")
+	flag.StringVar(&tarFormat, "tar-format", "pax", "Tar header format: pax, gnu or ustar (for legacy extractors)")
+	var excludes []string
+	flag.StringArrayVar(&excludes, "exclude", nil, "Leave files and directories matching this glob out of archives, e.g. tmp/ or *.sock (repeatable, backup only)")
+	flag.BoolVar(&opts.excludeEmpty, "exclude-empty-dirs", false, "Leave directories that hold no files anywhere below them out of archives (backup only)")
+	flag.BoolVar(&opts.oneFileSystem, "exclude-mount-boundaries", false, "Don't descend into filesystems mounted below a host path, like tar --one-file-system (backup only, Linux)")
+	var dateSource string
+	flag.StringVar(&dateSource, "archive-mtime-source", string(backup.DateNow), "Time {date} records: now, newest-file (newest file in the volume) or snapshot (when the release was stopped) (backup only)")
+	var parallelCompress, parallelDecompress bool
+	flag.BoolVar(&parallelCompress, "parallel-compress", false, "Compress .tar.gz archives on every core with pgzip (backup only)")
+	flag.IntVar(&opts.compressLevel, "compression-level", 0, "Compression level from 1 (fastest) to 9 (smallest) for gzip, zstd and zip archives (backup only; default: codec default)")
+	flag.BoolVar(&parallelDecompress, "parallel-decompress", false, "Decompress .tar.gz archives with pgzip, ahead of extraction in its own goroutine (restore only)")
+	flag.BoolVar(&opts.reproducible, "reproducible", false, "Pin the gzip header (no name, comment or time, OS unknown) so unchanged data archives byte-for-byte identically")
+	flag.BoolVar(&opts.xattrs, "preserve-xattrs", false, "Back up and restore extended attributes such as SELinux labels and ACLs (tar only, Linux)")
+	var chown string
+	var uidMap, gidMap []string
+	flag.StringVar(&chown, "chown", "", "Give every restored file this owner, as uid:gid, instead of the archived one")
+	flag.StringArrayVar(&uidMap, "uid-map", nil, "Restore files archived with uid old as uid new, given as old:new (repeatable)")
+	flag.StringArrayVar(&gidMap, "gid-map", nil, "Restore files archived with gid old as gid new, given as old:new (repeatable)")
+	var modeMask string
+	flag.StringVar(&modeMask, "restore-mode-mask", "", "Octal mask ANDed with the permissions of every restored file and directory, e.g. 0700 (default: keep archived modes)")
+	flag.StringVar(&opts.kms, "kms", "", "Envelope-encrypt archives with a per-archive key wrapped by this KMS key (vault://<mount>/<key>)")
+	flag.StringSliceVar(&opts.ageRecipients, "encrypt-recipient", nil, "Encrypt archives with age to this X25519 public key, age1... (repeatable)")
+	flag.StringVar(&opts.ageIdentity, "decrypt-identity", "", "age identity file to decrypt --encrypt-recipient archives with on restore and list-contents")
+	flag.BoolVar(&opts.verifyChecksum, "verify-checksum", false, "Fail the restore of any archive without a recorded SHA-256 instead of restoring it unchecked (restore only)")
+	flag.StringVar(&checksumMode, "checksum-mode", string(r2.ChecksumNone), "Where to record archive SHA-256 sums: none, sidecar, metadata or embedded")
+	flag.StringVar(&opts.allowedRoot, "allowed-root", "", "Warn when a PV host path resolves (following symlinks) outside this directory")
+	flag.BoolVar(&opts.strictPaths, "strict-paths", false, "Fail the backup of a PVC whose host path is a symlink or escapes --allowed-root instead of warning")
+	flag.StringArrayVar(&opts.pathRoots, "allowed-path-roots", nil, "Refuse to back up or restore a host path that is not below this directory, symlinks resolved or not (repeatable)")
+	flag.BoolVar(&opts.readOnly, "readonly-snapshot", false, "Archive each host path through a read-only bind mount (Linux, needs CAP_SYS_ADMIN; falls back with a warning)")
+	flag.BoolVar(&opts.failFast, "fail-fast", false, "Stop backing up after the first PVC that fails instead of continuing with the rest")
+	flag.IntVar(&opts.parallel, "parallel", 1, "Archive this many PVCs of a release at once (backup only)")
+	flag.DurationVar(&opts.pvcTimeout, "pvc-timeout", 0, "Fail the backup of a PVC that takes longer than this, e.g. 30m, and move on (0 = no limit)")
+	flag.BoolVar(&opts.excludeOrphans, "exclude-pvc-without-workload", false, "Skip PVCs that no Deployment/StatefulSet mounts (backup only)")
+	flag.IntSliceVar(&opts.ordinals, "ordinals", nil, "Comma-separated StatefulSet ordinals whose per-ordinal PVCs (e.g. data-db-0) to back up; other PVCs are unaffected (backup only)")
+	flag.BoolVar(&opts.onlyOrphans, "only-orphans", false, "Back up only PVCs that no Deployment/StatefulSet mounts (backup only)")
+	flag.BoolVar(&opts.requireWorkload, "require-workload", false, "Fail before scaling anything when a selected PVC has no Deployment/StatefulSet mounting it (backup only)")
+	flag.StringArrayVar(&opts.pvs, "pv", nil, "Back up this PV directly, e.g. a Retain PV whose PVC was deleted, archived under the PV's name with no scaling (repeatable, backup only)")
+	flag.BoolVar(&opts.useCSISnapshot, "use-csi-snapshot", false, "Take a CSI VolumeSnapshot of CSI-backed PVCs instead of scaling down and archiving them, falling back to that if the snapshot fails (backup only)")
+	flag.BoolVar(&opts.handleHPA, "handle-hpa", false, "Pause scale-up of HorizontalPodAutoscalers targeting scaled-down workloads until they are scaled back")
+	var scaleTo []string
+	flag.StringArrayVar(&scaleTo, "scale-to", nil, "Scale this workload to N replicas instead of 0, given as kind/name=N, e.g. StatefulSet/db=1 (repeatable; its remaining pods keep running)")
+	flag.StringSliceVar(&opts.pvcOrder, "pvc-order", nil, "Comma-separated PVC names to process first, in this order (others follow in discovery order)")
+	var restoreAfter []string
+	flag.StringArrayVar(&restoreAfter, "restore-after", nil, "Restore PVCs in parallel, this one only after the others are in place, given as pvc=dep[,dep...] (repeatable, restore only)")
+	var restoreVersion string
+	flag.StringVar(&restoreVersion, "restore-version", "latest", "Backup to restore per PVC from R2 or --dest: latest or latest-N (see --list-versions)")
+	flag.BoolVar(&opts.combined, "combined", false, "Restore archive files holding one top-level directory per PVC, named after it (restore only)")
+	flag.BoolVar(&opts.skipMissing, "skip-missing", false, "Skip, with a warning, directories of a --combined archive that match no PVC instead of failing")
+	flag.BoolVar(&opts.matchByMeta, "match-by-metadata", false, "Find R2 backups by the namespace and PVC stored in their metadata, whatever release they were taken under (restore only)")
+	flag.BoolVar(&opts.objectPerFile, "object-per-file", false, "Store each file as its own R2 (or --dest) object under a per-backup prefix instead of uploading one archive")
+	flag.BoolVar(&opts.dedupStore, "dedup-store", false, "Like --object-per-file, but store each file once by content hash under "+perfile.BlobPrefix+", shared by every backup (backup only)")
+	flag.StringVar(&opts.stateFile, "state-file", "", "Record each completed PVC in this file and skip the recorded ones when rerun after an interruption (backup only)")
+	flag.StringVar(&opts.unchangedFile, "skip-unchanged", "", "Skip PVCs whose content fingerprint matches the one recorded in this file by the last backup (backup only)")
+	flag.StringVar(&opts.continueFrom, "continue-from", "", "Start the backup at this PVC, skipping those before it in --pvc-order/discovery order")
+	flag.BoolVar(&opts.skipExisting, "skip-existing", false, "Don't upload an archive whose key already exists in R2 (or --dest) with the same size")
+	flag.BoolVar(&opts.restoreAll, "restore-all", false, "Restore the latest backup of every PVC of the release from R2 or --dest, printing the plan first (restore only; requires --yes)")
+	flag.BoolVar(&opts.yes, "yes", false, "Confirm --restore-all")
+	flag.BoolVar(&opts.waitReady, "wait-ready", false, "After scaling back, wait until the workloads have all their replicas ready (restore only)")
+	var readyAnnotation string
+	flag.StringVar(&readyAnnotation, "ready-annotation", "", "With --wait-ready, also wait until every pod of the workloads carries this annotation, given as key=value")
+	flag.DurationVar(&opts.postDelay, "post-restore-delay", 0, "With --wait-ready, wait this much longer once the workloads are ready, e.g. 2m")
+	flag.BoolVar(&opts.listVersions, "list-versions", false, "List the backups restore can select per PVC, newest first, and exit (restore only)")
+	flag.BoolVar(&opts.planHash, "plan-hash", false, "Print a hash of the discovered PVCs, host paths, workloads and replicas (use with --dry-run)")
+	flag.StringVar(&opts.targetsFile, "targets", "", "Back up every target listed in this JSON file, using the other flags as defaults (backup only)")
+	flag.IntVar(&opts.targetParallel, "target-parallel", 1, "Back up this many --targets at once")
+	flag.StringVar(&opts.requirePlan, "require-plan", "", "Abort before changing anything unless the discovered plan has this --plan-hash")
+	flag.BoolVar(&opts.json, "json", false, "Print a JSON report to stdout (progress goes to stderr)")
+	flag.StringVar(&opts.summaryFile, "summary-file", "", "Append the run's report to this file as one JSON line, even when it fails (backup and restore)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Backup and restore Kubernetes PersistentVolume host paths for a Helm release.
@@ -59,21 +299,480 @@ func main() {
 Usage:
   k8s-cf-backup [flags] backup
   k8s-cf-backup [flags] restore [archive-files...]
+  k8s-cf-backup [flags] migrate
+  k8s-cf-backup [flags] selftest
+  k8s-cf-backup [flags] list-contents <key>
 
 Subcommands:
-  backup    Create tar.gz archives of PV host paths (default)
-  restore   Restore from local archives or R2 storage
+  backup    Create archives of PV host paths (default)
+  restore   Restore from local archives, R2 storage or --dest
+  migrate   Re-key the R2 (or --dest) archives of a release
+  selftest  Back up and restore a scratch directory to check the pipeline
+  list-contents
+            Print the entries of an archive in R2 or --dest
+
+Archive names given to restore must match --output-format. After a naming
+change, pass the old template with --restore-format (repeatable); formats are
+tried in order, --output-format first.
 
 The restore subcommand accepts optional positional arguments:
-  - With --r2-credentials and no arguments: restores latest backup per PVC from R2
+  - With --r2-credentials (or --r2-credentials-secret) and no arguments: restores
+    the latest backup per PVC from R2
   - With --r2-credentials and arguments: downloads and restores specified R2 keys
-  - Without --r2-credentials: restores from local archive file paths
+  - With --dest instead of --r2-credentials: the same, reading from the destination
+  - Without either: restores from local archive file paths
+
+list-contents prints the files and directories of one archive in R2 (or
+--dest) without saving it: tar archives are read as a stream, though the whole
+object is still transferred. Zip needs random access and is downloaded to a
+temporary file. A per-file manifest key lists that snapshot. Encrypted
+archives need --kms or --decrypt-identity.
+
+migrate copies every archive of --namespace/--release in R2 (or --dest) that
+matches --from-format to the key --output-format gives it, keeping its PVC,
+date and extension. --to-release renames the release, --to-r2-credentials or
+--to-dest copy to another bucket or share, and --delete-source removes each
+original once copied. Copies within one R2 account are done server-side.
+Checksum sidecars move with their archive. Archives already at their new key
+are skipped, so an interrupted migrate can be rerun. Use --dry-run to review
+the mapping first. No Kubernetes access is needed unless the credentials come
+from --r2-credentials-secret.
+
+--r2-credentials-secret namespace/name reads the credentials from a Secret
+instead of a file, either as the keys account_id, access_key_id,
+secret_access_key and bucket or as a single key holding the credentials JSON.
+A bare name is looked up in --namespace. The runner needs get on that Secret.
+
+Temporary (STS-style) credentials add a session_token next to their keys, in
+the JSON or as a Secret key. Static keys leave it out.
+
+An endpoint in the credentials (host:port, or an http:// or https:// URL)
+points them at another S3-compatible store such as MinIO or Ceph RGW instead of
+R2; account_id is then not needed. Such stores often want --r2-region (e.g.
+us-east-1) and --r2-path-style, which addresses buckets as endpoint/bucket.
+Both apply to credentials with an endpoint only; R2 keeps its defaults, so a
+migrate from MinIO to R2 can use them.
+
+--restore-version latest-N restores the Nth backup before the latest of each
+PVC instead of the latest. restore --list-versions prints those indices with
+dates and sizes (as JSON with --json) without restoring anything. Archives
+too small to be complete, left by interrupted uploads, are not counted, and a
+selected archive that has changed or gone by the time it is fetched falls back
+to the next older one.
+
+restore --restore-all --yes is the disaster-recovery form of a restore
+without archives: it prints the plan (each PVC, the key of its latest backup
+and the host path it clears) and then restores all of them. PVCs without a
+backup are skipped. Without --yes it refuses to run; --dry-run shows the plan
+instead. --wait-ready then waits until the scaled-back workloads have all
+their replicas ready; if they don't, the run exits with 3.
+
+A workload whose readiness probe passes before it has loaded the restored data
+can tell --wait-ready so. Pod readiness gates count already: a pod is not ready
+until its gates pass. --ready-annotation example.com/loaded=true also waits
+until every pod of each workload carries that annotation, which the
+application or an operator sets once the data is in use. --post-restore-delay
+2m waits that much longer after everything is ready. Both need --wait-ready and
+fall under its timeout and exit code.
+
+Backups uploaded to R2 record their namespace, release and PVC as object
+metadata. After a release is renamed, restore --match-by-metadata (also with
+--list-versions) lists every archive of the namespace and picks each PVC's
+backups by that metadata instead of by key, so archives written under the old
+release name are found. Other releases of the namespace with PVCs of the same
+name match too. Archives uploaded before this metadata existed are not found.
+
+restore --combined takes local archives that hold several PVCs, one top-level
+directory each, named after the PVC. Every directory is restored into the
+host path of its PVC, which is cleared first; PVCs without a directory are
+left alone. A directory that matches no PVC of the release fails the restore
+before anything is changed, unless --skip-missing skips it with a warning.
+
+--state-file path records every PVC backup completes, with its archive, in a
+small JSON file that is replaced atomically after each PVC. Rerunning an
+interrupted backup with the same --state-file skips the recorded PVCs whose
+archives are still in --output-dir and uploads them with the rest; add
+--skip-existing to leave out archives already in R2 or --dest with the same
+size. The file is removed once a run completes. --continue-from <pvc> instead
+skips every PVC before the named one in --pvc-order/discovery order.
+
+--skip-unchanged path fingerprints each host path from the names, sizes,
+permissions and modification times of its files, without reading them, and
+skips the PVCs whose fingerprint matches the one recorded in path by the last
+backup, reporting them as unchanged. Fingerprints are recorded only once a
+release's archives are uploaded, so a failed upload is retried next run, and
+saved when the run ends. --targets share one set, however many run at once.
+
+--object-per-file stores every file of a PVC as its own gzipped object under
+the archive name without its extension plus "/", e.g. ns_rel_<date>_data/,
+with a manifest of directories, symlinks and permissions written last. No
+archive is built locally. Rotation deletes whole snapshots, and restore
+fetches the selected snapshot of each PVC file by file. It needs R2 or --dest
+and cannot be combined with encryption, --checksum-mode or --r2-quota.
+
+--dedup-store is --object-per-file with every file stored once, gzipped, under
+blobs/sha256/<sha256 of its content>.gz instead of below the snapshot prefix,
+so identical files across PVCs, releases and backups are uploaded only once.
+Restore with --object-per-file as usual. Rotation deletes snapshot manifests
+but never blobs, which other snapshots may share.
+
+--dest fs:///mnt/backups copies archives to a mounted NFS/SMB share with the
+same rotation as R2. --keep-last and --keep-days combine: an archive is kept if
+either rule keeps it, and the newest archive per PVC is never rotated away.
+Both need {date} in --output-format, which backup checks at startup.
+After uploading, backup points the release's latest.json at the new archives;
+restore picks the archive it names as latest, and rotation never deletes it.
+
+--retention-daily, --retention-weekly and --retention-monthly add
+grandfather-father-son tiers, e.g. 7/4/12 keeps the newest backup of each of the
+last 7 days, 4 ISO weeks and 12 months that have one. Tiers go by the {date} in
+the key (the file time without one) and combine with --keep-last/--keep-days.
+With --dry-run, backup lists the keys each rule would delete per PVC, counting
+the archive the run would upload as the newest; nothing is deleted.
+
+backup --dry-run with R2 or --dest also checks that the credentials may write
+and delete: it uploads a tiny object under .permcheck/ and deletes it again,
+and fails the dry run when either is refused. Nothing else is written.
+
+--r2-quota 500Gi checks before uploading that the bucket (or --dest) stays
+within the given size: what is stored now, minus what rotation will delete,
+plus the new archives. Over the quota nothing is uploaded and the run fails;
+--force uploads anyway with a warning. Only objects under --r2-quota-prefix
+count, the whole bucket by default. Checksum sidecars are not counted.
+
+--object-lock-days 90 uploads archives and sidecars under S3 object lock in
+compliance mode, so nobody can delete or overwrite them for 90 days. The bucket
+must have been created with object lock enabled; otherwise every upload fails.
+Rotation leaves archives under lock or legal hold in place, with a SKIP line,
+whether or not this run set the flag, and deletes them on a later run once the
+lock has expired. Needs --r2-credentials.
+
+--min-free-after 10Gi checks before scaling anything down that writing the
+archives leaves at least that much free space in --output-dir, for nodes shared
+with other workloads. The archives are counted at the size of the data they
+hold, as if nothing compressed, so the check errs on the safe side. Below the
+minimum the run fails; --dry-run shows the numbers. Linux only, and not with
+--object-per-file or --output-dir -.
+
+--stream uploads each archive to R2 (or --dest) as it is created and never
+writes it to --output-dir, for nodes with less free disk than their volumes.
+Sizes are confirmed after the upload as usual. Cannot be combined with
+--checksum-mode sidecar or metadata, --object-per-file, --pipeline-depth,
+--r2-quota, --skip-existing, --state-file, --min-free-after or --output-dir -.
+
+--pipeline-depth N uploads each archive as soon as it is written, while the
+next PVC is archived, instead of after the last one. Up to N finished archives
+wait for the upload; beyond that archiving pauses. Rotation still runs once,
+after every upload, and is skipped when a backup failed. Cannot be combined
+with --r2-quota, --object-per-file or --output-dir -.
+
+With --all-namespaces (and no --namespace), backup lists PVCs labelled
+app.kubernetes.io/instance cluster-wide and backs up each namespace/release
+group separately. --release optionally narrows this to a single release name.
+This mode needs cluster-scoped RBAC to list PVCs in every namespace.
+
+--release shop,blog (or --release shop --release blog) backs up several
+releases of one namespace in a single backup run. Every release is discovered
+first, then each is scaled down, archived, uploaded, rotated and scaled back
+on its own, under its own ##### namespace/release ##### heading; a release
+that fails does not stop the others. Archive names and rotation stay per
+release and PVC. Cannot be combined with --all-namespaces, --pv, --targets,
+--continue-from or --output-dir -.
+
+--targets file.json backs up a list of targets in one process instead of one
+--namespace/--release:
+  {"targets": [{"name": "shop", "namespace": "prod", "releases": ["shop"],
+                "keep_last": 7, "r2_credentials": "/etc/r2/shop.json"}]}
+A target may also set release, output_dir, output_format, keep_days and dest;
+everything else, and whatever a target leaves out, comes from the flags. A
+failed target or release does not stop the others, and a Targets Summary
+lists them all. --target-parallel N runs N targets at once; the output of each
+is held back until it and the targets before it are done.
+
+--label-key names the label whose value is the release, by default
+app.kubernetes.io/instance. Repeat it for a release labelled inconsistently,
+e.g. --label-key app.kubernetes.io/instance --label-key release after a chart
+upgrade: PVCs carrying any of the keys with the release as value belong to it
+(an OR, each PVC counted once). PVCs a StatefulSet of the release created from
+its volumeClaimTemplates, named <template>-<statefulset>-<ordinal>, belong to
+it even without the label.
+
+--pvc-order data,wal processes the listed PVCs first, in that order, for
+backup, upload and restore alike; PVCs not listed follow in discovery order.
+Use it when volumes must be captured or restored in a dependency order.
+
+--restore-after wal=data restores the release's PVCs in parallel instead of one
+by one, except that wal starts only once data is fully in place; it is skipped
+as failed if data fails. Give several dependencies as wal=data,config and
+repeat the flag for more PVCs. Unknown PVCs and cycles fail before anything is
+downloaded or scaled down.
+
+--require-workload fails a backup before anything is scaled down or archived
+when a selected PVC has no Deployment or StatefulSet mounting it, listing those
+PVCs, instead of backing them up while they may be in use. PVCs skipped by
+--exclude-pvc-without-workload or --continue-from are not selected.
+
+--ordinals 0 backs up only ordinal 0 of each StatefulSet, e.g. data-db-0 but
+not data-db-1. Only PVCs named <template>-<statefulset>-<ordinal> after the
+StatefulSet that mounts them are filtered. The StatefulSet still scales to 0
+as a whole, so its other ordinals stop during the backup too; a warning says
+so.
+
+--plan-hash prints a hash of what discovery found: PVCs, PVs, host paths,
+workloads and their replicas. Review a --dry-run --plan-hash, then pass the hash
+to the real run with --require-plan; it aborts before scaling anything if the
+cluster no longer matches the reviewed plan.
+
+--as and --as-group make every API request impersonate that identity, like
+kubectl --as. The runner's own identity needs the impersonate verb on users,
+groups or serviceaccounts; the audit log records both identities.
+
+--kms encrypts each archive with a fresh AES-256-GCM data key, wraps that key
+with the given KMS key and stores it in the archive header; encrypted archives
+get a .enc suffix. Restore needs the same --kms to unwrap the key. For
+vault://<mount>/<key> (Vault transit), VAULT_ADDR and VAULT_TOKEN (and
+optionally VAULT_NAMESPACE) are read from the environment.
+
+--encrypt-recipient age1... encrypts each archive with age to that public key
+instead, with no KMS involved; repeat it to let any of several keys decrypt.
+Archives get a .age suffix and can also be decrypted with the age tool.
+Restore and list-contents read them with --decrypt-identity, an age key file
+as written by age-keygen. It cannot be combined with --kms.
+
+Host paths are resolved with symlinks followed before archiving. A symlinked
+host path is reported as a warning; with --allowed-root only a path resolving
+outside that directory is. --strict-paths turns the warning into a failure for
+that PVC, which is advisable on multi-tenant nodes.
+
+--allowed-path-roots /data --allowed-path-roots /mnt/disks is the hard version:
+backup and restore refuse, with a FAIL line, any host path that is not below
+one of the roots, both as the PV gives it and with symlinks resolved, before
+reading or clearing it. A PV pointing at /etc can then do no harm.
+
+Two PVCs resolving to the same host path point at a provisioner misconfiguration:
+their archives hold the same data and restoring one overwrites the other. This
+is reported as a warning naming the PVCs; --strict-paths aborts the run instead.
+
+backup --pv pv-1234 skips discovery and archives that PV's host path under the
+PV name, without scaling anything. It rescues the data of a Retain PV whose PVC
+was deleted; a PV still bound to a claim is refused.
+
+--readonly-snapshot bind-mounts each host path read-only on a temporary
+directory and archives from there, unmounting afterwards, so nothing can be
+written through the tree the backup reads. It complements scaling down but does
+not block writers that use the host path directly. It needs Linux and
+CAP_SYS_ADMIN (a privileged container or root on the node, with the host path
+visible in the runner's mount namespace). Without them the PVC is archived
+directly and the summary shows a warning.
+
+--parallel N archives up to N PVCs of a release at once, shortening the time
+its workloads stay scaled down when the disks and CPU have room for it. Each
+PVC still gets its own archive and its own result; the summary keeps the
+discovery order, and a failed PVC does not stop the others unless --fail-fast
+is set, in which case no further PVC is started. Output to --output-dir - is
+one stream and stays sequential.
+
+--pvc-timeout 30m bounds the time spent archiving each PVC, so a volume on a
+failing disk doesn't keep every workload scaled down. A PVC that runs over is
+reported as failed, its partial archive is removed and the remaining PVCs are
+still backed up; workloads are scaled back as usual afterwards.
+
+A HorizontalPodAutoscaler targeting a scaled-down workload may scale it back
+up mid-backup, so each one found is warned about. --handle-hpa pauses their
+scale-up instead (behavior.scaleUp.selectPolicy: Disabled) and puts their
+original behavior back after the scale-back. It needs get and update on
+horizontalpodautoscalers.
+
+--scale-to StatefulSet/db=1 scales the StatefulSet db to 1 replica instead of
+0, e.g. to keep its primary running while its read replicas stop. The kind,
+Deployment or StatefulSet, tells workloads of the same name apart. A run fails
+when an entry names no workload of the PVCs it selected, so a typo cannot scale
+the workload it meant to 0; with --targets that is only a warning. The pods
+left running can write to their volumes while they are backed up or restored,
+so only use it for PVCs they do not write to; every run warns about it.
+
+--use-csi-snapshot takes a VolumeSnapshot (snapshot.storage.k8s.io/v1) of
+each PVC on a CSI volume instead of scaling its workload down and archiving it.
+The snapshot uses the default VolumeSnapshotClass of the driver and is left in
+the cluster as the backup; nothing is uploaded for it. A snapshot that fails or
+is not ready within 5 minutes is deleted and the PVC is archived as usual.
+
+By default every PVC is backed up even when an earlier one fails. --fail-fast
+stops at the first failure instead, for quick feedback in CI: the remaining
+PVCs are listed as skipped, nothing is uploaded and workloads are still scaled
+back.
+
+--output-dir - streams the archive to stdout instead of writing a file, for
+piping into other tools (e.g. | aws s3 cp - s3://bucket/key). The release must
+have exactly one PVC to back up, all progress goes to stderr, and the format
+still follows the --output-format extension. It cannot be combined with
+uploads to R2 or --dest.
+
+Streamed output is collected in a buffer of --stream-buffer-size bytes (1Mi by
+default) before it is written on. The buffer is the only memory streaming adds:
+a slow consumer stalls archiving instead of growing it. On small nodes pair a
+smaller buffer with --compression zstd --compression-memlimit to bound the
+compressor as well.
+
+selftest checks the whole pipeline without touching real data, e.g. in CI. It
+fills a temporary directory with a few files, backs it up as PVC "selftest" of
+--namespace/--release using the archive flags given, uploads it to and
+downloads it from R2 or --dest when one is set, restores it into a second
+temporary directory and compares the two trees. The archive is fetched back
+by its key and deleted from the destination afterwards; the release's
+latest.json is never written and rotation is never applied, so backups of a
+real release are left as they were. The cluster is not contacted, so workloads
+are never scaled.
+
+Exit codes:
+  0  Success
+  1  A phase failed (discovery, scale-down, backup/restore, upload/download)
+  3  Scale-back failed: workloads may have been left at 0 replicas
 
 Format placeholders for --output-format:
-  {namespace}  Kubernetes namespace
-  {release}    Helm release name
-  {pvc}        PersistentVolumeClaim name
-  {date}       Timestamp (YYYYMMdd-HHmmss)
+  {namespace}     Kubernetes namespace
+  {release}       Helm release name
+  {pvc}           PersistentVolumeClaim name
+  {storageClass}  The PVC's storage class, or "default" when it has none
+  {date}          Timestamp (YYYYMMdd-HHmmss)
+
+{storageClass} groups keys by class, e.g. for R2 lifecycle rules per class with
+{storageClass}/{namespace}/{release}/{pvc}/{date}.tar.gz. Restore and rotation
+match any class in the key, so a PVC whose class changed still finds its
+earlier backups.
+
+The extension of --output-format selects the archive format: .tar.gz/.tgz,
+.tar.zst, .tar or .zip. Other extensions are written as tar.gz. Restore picks
+the format from the archive's content, falling back to its extension.
+
+--compression overrides the extension of --output-format: gzip writes .tar.gz,
+zstd writes .tar.zst and none writes an uncompressed .tar, which is fastest for
+volumes on already-compressed filesystems. Restore and R2 rotation match any
+archive extension, so switching compression keeps finding older backups.
+
+--name-template names new archives with a Go text/template instead of
+--output-format, e.g. '{{.Namespace | lower}}-{{.Node}}-{{.PVC | trunc 20}}-
+{{.Date.Format "2006-01-02"}}.tar.zst'. Fields: .Namespace, .Release, .PVC,
+.PVName, .Node (the node the PV is pinned to, or empty), .Date (a time.Time)
+and .StorageClass. Helpers: lower, upper, trunc N and replace OLD NEW. The name
+must be a plain file name with an archive extension. --name-template-file
+reads a longer template from a file. Templated names cannot be parsed back
+into PVCs, so rotation, --object-per-file and --compression are refused, and
+restore finds the archives only with --match-by-metadata.
+
+--exclude leaves matching entries out of tar and zip archives, e.g.
+--exclude tmp/ --exclude '*.sock' --exclude lost+found for regenerable caches.
+Patterns are globs matched against the path inside the archive, relative to
+the volume. One without a "/" matches the name at any depth; a trailing "/"
+matches directories only. An excluded directory is not descended into, so
+large caches cost nothing to skip. Restores lack the excluded entries.
+
+--exclude-empty-dirs leaves out of tar and zip archives every directory with
+no file, symlink or other entry anywhere below it, e.g. the thousands of unused
+shards of a cache layout that bloat the archive and slow its restore. A
+directory's entry is written only once something turns up below it, so the
+walk stays single-pass. Restores then lack those directories; applications
+that expect them must recreate them. Off by default, so archives keep the
+exact tree.
+
+--exclude-mount-boundaries keeps archives on the filesystem of the host path,
+like tar --one-file-system: a directory with another filesystem mounted on it,
+e.g. a tmpfs for sockets, is archived empty, and bind-mounted files are left
+out. Linux only.
+
+--archive-mtime-source sets the time {date} (and .Date of a name template)
+records. now, the default, is when each archive is named. newest-file is the
+modification time of the newest file in the volume, found by walking it before
+archiving, so the name says how recent the data is; a volume whose files did
+not change between runs gets the same key again and replaces its archive.
+snapshot is when the release's backup began, right after its workloads were
+stopped, and is shared by all of its PVCs. Restore and rotation read {date}
+from the key either way.
+
+--archive-suffix .bak appends a suffix to every archive name, after the
+extension and any .enc, without touching --output-format. It must start with
+"." and cannot itself be an archive extension or .enc. Restore, rotation and
+--list-versions recognise archives with and without it.
+
+--pvc-opts pvc=codec:none,encrypt:false overrides the codec or encryption of
+a single PVC, e.g. store-only for a media volume while the rest stay
+compressed and encrypted. Global flags set the defaults. encrypt:true requires
+--kms or --encrypt-recipient. Restore detects each archive's settings on its own.
+
+--tar-format selects the tar header format. pax (default) handles long names,
+large files and sub-second mtimes; gnu and ustar suit older extractors that
+trip over PAX extended headers. A file that ustar cannot represent (name over
+100 bytes plus a 155-byte directory prefix, or over 8 GiB) fails the backup.
+
+--compression-memlimit caps the memory zstd may use, for small nodes. Backups
+use a compression window of at most that size, which costs some ratio on large
+volumes. Restores refuse archives needing a larger window instead of allocating
+it: the default window is 8Mi, so lower limits only restore archives that were
+written with a limit at or below them. Gzip and tar are unaffected.
+
+--compression-dict primes zstd with a dictionary, which pays off for many
+small, similar PVCs (per-tenant config trees of one app): each archive is too
+short for zstd to learn the common content itself, and a dictionary trained
+across them commonly saves a quarter or more. Large PVCs gain next to nothing. When the file
+does not exist, backup trains a dictionary from up to 16Mi of the files of at
+most 128Ki in the release's PVCs and saves it there; later runs reuse it.
+Every archive records the dictionary's id and cannot be restored without the
+same file, so keep it with the credentials, not only next to the backups.
+
+--parallel-compress compresses .tar.gz archives with pgzip, in blocks on every
+core, and restore --parallel-decompress inflates them with pgzip's read-ahead
+reader, in a goroutine of its own while the tar is extracted, which speeds up
+large restores on multi-core nodes. The archives are ordinary gzip: either
+flag works without the other, and on archives written by gzip or pigz, whose
+concatenated members restores always read in full.
+
+--compression-level N compresses gzip, zstd and zip archives at level N, from
+1 (fastest) to 9 (smallest). Data that barely compresses, such as media or
+already compressed files, backs up much faster at 1 for a few percent more
+size. zstd maps the level onto its own speed classes. Uncompressed .tar
+archives ignore it; restore needs no flag.
+
+--reproducible writes the gzip header of .tar.gz archives with fixed values:
+no file name, comment or timestamp, and the OS byte set to "unknown" rather
+than the platform's. Archives of unchanged data then hash the same on every
+run and machine, given the same Go version and compression level: the
+header's XFL byte follows the level, and the compressed bytes can change
+between Go releases. Tar entries always carry each file's own mtime, owner
+and mode, so those must be unchanged too.
+
+--preserve-xattrs stores extended attributes (SELinux labels, POSIX ACLs,
+user.* attributes) as PAX records and sets them again on restore, for volumes
+that break under enforcing SELinux without their labels. Restore needs the flag
+too, and setting security.* and trusted.* attributes needs a privileged runner.
+It requires --tar-format pax and a tar archive, and works on Linux only. File
+capabilities are the security.capability attribute, so privileged helper
+binaries keep theirs only with this flag. Setuid, setgid and sticky bits are
+always restored as archived, after any owner change that would clear them.
+Modification times of files and directories are restored as archived as
+well; directories get theirs once the whole archive is extracted.
+
+Restores leave extracted files owned by the user running the restore unless
+--chown or --uid-map/--gid-map is given. --chown uid:gid gives every file that
+owner, e.g. when restoring into a namespace whose pods run as another user.
+--uid-map old:new and --gid-map old:new keep the archived ids but replace the
+listed ones, and may be repeated; unlisted ids are kept as archived. Zip
+archives record no owners, so only --chown applies to them. Changing owners
+needs a root or CAP_CHOWN runner.
+
+--restore-mode-mask 0700 ANDs the permissions of every restored file and
+directory with the octal mask, e.g. to strip group and other access when
+production data is restored into a shared environment. Masked modes are set
+exactly, not through the umask. Without it the archived modes are kept.
+
+Checksum modes for --checksum-mode:
+  none      No checksums (default)
+  sidecar   Upload <key>.sha256 next to each archive in R2 (sha256sum -c format)
+  metadata  Store the archive's SHA-256 as x-amz-meta-sha256 on the R2 object
+  embedded  Add a .k8s-cf-backup.sha256 manifest of every file inside the archive
+Sidecars never count toward --keep-last and are deleted with their archive.
+Restore verifies every archive that has a metadata or sidecar sum;
+--verify-checksum also fails one that has neither. Local archives are then
+checked against a <file>.sha256 next to them.
 
 Flags:
 `)
@@ -82,162 +781,2188 @@ Flags:
 
 	flag.Parse()
 
-	if namespace == "" || release == "" {
+	seenRelease := make(map[string]bool)
+	for _, r := range releases {
+		if r != "" && !seenRelease[r] {
+			seenRelease[r] = true
+			opts.releases = append(opts.releases, r)
+		}
+	}
+	if len(opts.releases) == 1 {
+		opts.release, opts.releases = opts.releases[0], nil
+	} else if len(opts.releases) > 1 {
+		// The first stands in wherever a single release is checked for
+		opts.release = opts.releases[0]
+	}
+
+	if opts.allNamespaces {
+		if opts.namespace != "" {
+			fmt.Fprintln(os.Stderr, "Error: --namespace and --all-namespaces are mutually exclusive")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if (opts.namespace == "" || opts.release == "") && flag.Arg(0) != "list-contents" && opts.targetsFile == "" {
+		// list-contents names its archive by key
 		fmt.Fprintln(os.Stderr, "Error: --namespace and --release are required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	mode, err := r2.ParseChecksumMode(checksumMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	opts.checksumMode = mode
+
+	if memLimit != "" {
+		q, err := resource.ParseQuantity(memLimit)
+		if err != nil || q.Sign() <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: --compression-memlimit: invalid size %q (want e.g. 8Mi)\n", memLimit)
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts.memLimit = uint64(q.Value())
+	}
+
+	if streamBuffer != "" {
+		q, err := resource.ParseQuantity(streamBuffer)
+		if err != nil || q.Sign() <= 0 || q.Value() > math.MaxInt32 {
+			fmt.Fprintf(os.Stderr, "Error: --stream-buffer-size: invalid size %q (want e.g. 256Ki)\n", streamBuffer)
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts.streamBuffer = int(q.Value())
+	}
+
+	if quota != "" {
+		q, err := resource.ParseQuantity(quota)
+		if err != nil || q.Sign() <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: --r2-quota: invalid size %q (want e.g. 500Gi)\n", quota)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if !opts.useR2() && opts.dest == "" {
+			fmt.Fprintln(os.Stderr, "Error: --r2-quota requires --r2-credentials or --dest")
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts.quota = q.Value()
+	}
+
+	if opts.tarFormat, err = backup.ParseTarFormat(tarFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --tar-format: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.kms != "" {
+		provider, err := crypt.ProviderFromURI(opts.kms)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --kms: %v\n", err)
+			os.Exit(1)
+		}
+		opts.encrypter = crypt.NewEnvelope(provider)
+	}
+
+	if len(opts.ageRecipients) > 0 || opts.ageIdentity != "" {
+		if opts.kms != "" {
+			fmt.Fprintln(os.Stderr, "Error: --encrypt-recipient and --decrypt-identity cannot be combined with --kms")
+			flag.Usage()
+			os.Exit(1)
+		}
+		a, err := crypt.NewAge(opts.ageRecipients, opts.ageIdentity)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.encrypter = a
+	}
+
+	if opts.r2Credentials != "" && opts.r2Secret != "" {
+		fmt.Fprintln(os.Stderr, "Error: --r2-credentials and --r2-credentials-secret are mutually exclusive")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (opts.r2Region != "" || opts.r2PathStyle) && !opts.useR2() && opts.toR2Creds == "" {
+		fmt.Fprintln(os.Stderr, "Error: --r2-region and --r2-path-style require --r2-credentials or --to-r2-credentials")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.dest != "" && opts.useR2() {
+		fmt.Fprintln(os.Stderr, "Error: --dest and --r2-credentials are mutually exclusive")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(opts.asGroups) > 0 && opts.as == "" {
+		fmt.Fprintln(os.Stderr, "Error: --as-group requires --as")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.compression != "" {
+		format, err := applyCompression(opts.outputFormat, opts.compression)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts.outputFormat = format
+	}
+
+	if err := backup.ValidateArchiveSuffix(opts.archiveSuffix); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --archive-suffix: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	for _, o := range pvcOpts {
+		pvc, po, err := backup.ParsePVCOptions(o)
+		if err == nil && po.Encrypt != nil && *po.Encrypt && opts.kms == "" && len(opts.ageRecipients) == 0 {
+			err = fmt.Errorf("PVC %s: encrypt:true requires --kms or --encrypt-recipient", pvc)
+		}
+		if _, ext := backup.SplitArchiveExtension(opts.outputFormat); err == nil && po.Compression != "" && strings.EqualFold(ext, ".zip") {
+			err = fmt.Errorf("PVC %s: codec cannot be combined with a .zip --output-format", pvc)
+		}
+		if _, dup := opts.pvcOpts[pvc]; err == nil && dup {
+			err = fmt.Errorf("PVC %s is given twice", pvc)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --pvc-opts: %v\n", err)
+			os.Exit(1)
+		}
+		if opts.pvcOpts == nil {
+			opts.pvcOpts = make(map[string]backup.PVCOptions)
+		}
+		opts.pvcOpts[pvc] = po
+	}
+
+	if chown != "" && (len(uidMap) > 0 || len(gidMap) > 0) {
+		fmt.Fprintln(os.Stderr, "Error: --chown cannot be combined with --uid-map or --gid-map")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if chown != "" {
+		if opts.owner, err = backup.ParseOwner(chown); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --chown: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(uidMap) > 0 || len(gidMap) > 0 {
+		opts.owner = &backup.OwnerMap{UID: -1, GID: -1}
+		if opts.owner.UIDs, err = backup.ParseIDMap(uidMap); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --uid-map: %v\n", err)
+			os.Exit(1)
+		}
+		if opts.owner.GIDs, err = backup.ParseIDMap(gidMap); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --gid-map: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if modeMask != "" {
+		if opts.modeMask, err = backup.ParseModeMask(modeMask); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --restore-mode-mask: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.xattrs {
+		if opts.tarFormat != tar.FormatPAX {
+			fmt.Fprintln(os.Stderr, "Error: --preserve-xattrs requires --tar-format pax")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if _, ext := backup.SplitArchiveExtension(opts.outputFormat); strings.EqualFold(ext, ".zip") {
+			fmt.Fprintln(os.Stderr, "Error: --preserve-xattrs is not supported for zip archives")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.restoreVersion, err = parseRestoreVersion(restoreVersion); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.excludeOrphans && opts.onlyOrphans {
+		fmt.Fprintln(os.Stderr, "Error: --exclude-pvc-without-workload and --only-orphans are mutually exclusive")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Subcommand routing: first positional arg is "backup" or "restore"
 	args := flag.Args()
 	subcommand := "backup"
-	if len(args) > 0 && (args[0] == "backup" || args[0] == "restore") {
+	if len(args) > 0 && (args[0] == "backup" || args[0] == "restore" || args[0] == "migrate" || args[0] == "selftest" || args[0] == "list-contents") {
 		subcommand = args[0]
 		args = args[1:]
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
+	if opts.verifyChecksum && subcommand != "restore" {
+		fmt.Fprintln(os.Stderr, "Error: --verify-checksum is only supported by restore")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	client, err := buildClient(kubeconfig)
-	if err != nil {
-		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	if subcommand == "backup" && opts.ageIdentity != "" && len(opts.ageRecipients) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: --decrypt-identity only decrypts; backup encrypts with --encrypt-recipient")
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	switch subcommand {
-	case "backup":
-		if err := run(ctx, client, namespace, release, outputDir, outputFormat, r2Credentials, keepLast, dryRun, verbose); err != nil {
-			log.Fatalf("Error: %v", err)
+	if subcommand == "restore" {
+		if opts.allNamespaces {
+			fmt.Fprintln(os.Stderr, "Error: restore does not support --all-namespaces")
+			flag.Usage()
+			os.Exit(1)
 		}
-	case "restore":
-		if len(args) == 0 && r2Credentials == "" {
-			fmt.Fprintln(os.Stderr, "Error: restore requires archive files or --r2-credentials")
+		if len(args) == 0 && !opts.useR2() && opts.dest == "" {
+			fmt.Fprintln(os.Stderr, "Error: restore requires archive files, --r2-credentials or --dest")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if len(args) > 0 && (opts.restoreVersion != 0 || opts.listVersions) {
+			fmt.Fprintln(os.Stderr, "Error: --restore-version and --list-versions cannot be combined with explicit archives")
 			flag.Usage()
 			os.Exit(1)
 		}
-		if err := runRestore(ctx, client, namespace, release, outputFormat, r2Credentials, args, dryRun, verbose); err != nil {
-			log.Fatalf("Error: %v", err)
+		if opts.matchByMeta && (len(args) > 0 || !opts.useR2()) {
+			fmt.Fprintln(os.Stderr, "Error: --match-by-metadata requires --r2-credentials and no explicit archives (only R2 objects carry metadata)")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if opts.combined && (len(args) == 0 || opts.useR2() || opts.dest != "") {
+			fmt.Fprintln(os.Stderr, "Error: --combined restores local archive files only")
+			flag.Usage()
+			os.Exit(1)
 		}
+	} else if opts.listVersions {
+		fmt.Fprintln(os.Stderr, "Error: --list-versions is only supported by restore")
+		flag.Usage()
+		os.Exit(1)
+	} else if opts.combined || opts.matchByMeta {
+		fmt.Fprintln(os.Stderr, "Error: --combined and --match-by-metadata are only supported by restore")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if opts.skipMissing && !opts.combined {
+		fmt.Fprintln(os.Stderr, "Error: --skip-missing requires --combined")
+		flag.Usage()
+		os.Exit(1)
 	}
-}
-
-func run(ctx context.Context, client kubernetes.Interface, namespace, release, outputDir, outputFormat, r2Credentials string, keepLast int, dryRun, verbose bool) error {
-	disc := discovery.New(client, verbose)
-	sc := scaler.New(client, verbose)
-	bk := backup.New(outputDir, outputFormat, verbose)
 
-	// Step 1: Discover PVCs
-	fmt.Printf("Discovering PVCs for release %q in namespace %q...\n", release, namespace)
-	pvcs, err := disc.Discover(ctx, namespace, release)
-	if err != nil {
-		return fmt.Errorf("discovery: %w", err)
+	if opts.dedupStore {
+		if subcommand != "backup" {
+			fmt.Fprintln(os.Stderr, "Error: --dedup-store is only supported by backup; restore reads deduplicated snapshots with --object-per-file")
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts.objectPerFile = true
 	}
 
-	fmt.Printf("Found %d PVC(s):\n", len(pvcs))
-	for _, pvc := range pvcs {
-		workloadStr := "(no workload found)"
-		if pvc.Workload != nil {
-			workloadStr = fmt.Sprintf("%s/%s (%d replicas)", pvc.Workload.Kind, pvc.Workload.Name, pvc.Workload.OriginalReplicas)
+	if opts.objectPerFile {
+		var problem string
+		switch {
+		case subcommand != "backup" && subcommand != "restore":
+			problem = "is only supported by backup and restore"
+		case !opts.useR2() && opts.dest == "":
+			problem = "requires --r2-credentials or --dest"
+		case len(args) > 0:
+			problem = "restores the --restore-version of each PVC and takes no explicit keys"
+		case opts.outputDir == stdoutDir || opts.combined || opts.matchByMeta:
+			problem = "cannot be combined with --output-dir -, --combined or --match-by-metadata"
+		case opts.encrypter != nil || (opts.checksumMode != r2.ChecksumNone && opts.checksumMode != "") || opts.verifyChecksum:
+			problem = "cannot be combined with --kms, --encrypt-recipient, --checksum-mode or --verify-checksum"
+		case opts.quota > 0:
+			problem = "cannot be combined with --r2-quota"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --object-per-file %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
 		}
-		fmt.Printf("  - %s -> PV %s -> %s [%s]\n", pvc.PVCName, pvc.PVName, pvc.HostPath, workloadStr)
 	}
 
-	// Collect unique workloads
-	workloads := uniqueWorkloads(pvcs)
+	if nameTemplate != "" && nameTemplateFile != "" {
+		fmt.Fprintln(os.Stderr, "Error: --name-template and --name-template-file are mutually exclusive")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if nameTemplateFile != "" {
+		data, err := os.ReadFile(nameTemplateFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --name-template-file: %v\n", err)
+			os.Exit(1)
+		}
+		nameTemplate = strings.TrimRight(string(data), "\r\n")
+	}
+	if nameTemplate != "" {
+		if opts.nameTemplate, err = checkNameTemplate(opts, subcommand, nameTemplate); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
 
-	if dryRun {
-		printDryRun(pvcs, workloads, outputDir, outputFormat, namespace, release, r2Credentials, keepLast)
-		return nil
+	if subcommand == "backup" && opts.nameTemplate == nil {
+		if err := checkRotationFormat(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
 
-	// Step 2: Scale down (with deferred scale-back)
-	if len(workloads) > 0 {
-		fmt.Printf("\nScaling down %d workload(s)...\n", len(workloads))
-		// Always scale back, even if backup fails
-		defer func() {
-			fmt.Println("\nRestoring workload replicas...")
-			if err := sc.ScaleBack(ctx, workloads); err != nil {
-				log.Printf("WARNING: Failed to restore some workloads: %v", err)
-			} else {
-				fmt.Println("All workloads restored.")
+	if len(scaleTo) > 0 {
+		var problem string
+		if subcommand != "backup" && subcommand != "restore" {
+			problem = "is only supported by backup and restore"
+		} else if opts.scaleTargets, err = scaler.ParseScaleTargets(scaleTo); err != nil {
+			problem = err.Error()
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --scale-to %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+		for name, n := range opts.scaleTargets {
+			if n > 0 {
+				log.Printf("WARNING: --scale-to keeps %d pod(s) of %s running; they can write to their volumes during the %s", n, name, subcommand)
 			}
-		}()
+		}
+	}
 
-		if err := sc.ScaleDown(ctx, workloads); err != nil {
-			return fmt.Errorf("scale down: %w", err)
+	if minFreeAfter != "" {
+		q, err := resource.ParseQuantity(minFreeAfter)
+		var problem string
+		switch {
+		case err != nil || q.Sign() <= 0:
+			problem = fmt.Sprintf("invalid size %q (want e.g. 10Gi)", minFreeAfter)
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.objectPerFile || opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --object-per-file or --output-dir -"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --min-free-after %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
 		}
-		fmt.Println("All workloads scaled to 0.")
+		opts.minFreeAfter = q.Value()
 	}
 
-	// Step 3: Backup
-	fmt.Printf("\nBacking up %d PVC(s)...\n", len(pvcs))
-	results := bk.BackupAll(pvcs, namespace, release)
+	if len(opts.pathRoots) > 0 {
+		var problem string
+		switch {
+		case subcommand != "backup" && subcommand != "restore":
+			problem = "is only supported by backup and restore"
+		case slices.ContainsFunc(opts.pathRoots, func(root string) bool { return !filepath.IsAbs(root) }):
+			problem = "takes absolute paths"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --allowed-path-roots %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
 
-	// Step 4: Report
-	fmt.Println("\n=== Backup Summary ===")
-	var hasError bool
-	for _, r := range results {
-		if r.Err != nil {
-			fmt.Printf("  FAIL  %s: %v\n", r.PVCName, r.Err)
-			hasError = true
-		} else {
-			fmt.Printf("  OK    %s -> %s (%s)\n", r.PVCName, r.ArchivePath, formatSize(r.Size))
+	if parallelCompress && subcommand != "backup" {
+		fmt.Fprintln(os.Stderr, "Error: --parallel-compress is only supported by backup")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if parallelDecompress && subcommand != "restore" {
+		fmt.Fprintln(os.Stderr, "Error: --parallel-decompress is only supported by restore")
+		flag.Usage()
+		os.Exit(1)
+	}
+	opts.parallelGzip = parallelCompress || parallelDecompress
+
+	if opts.compressLevel != 0 {
+		var problem string
+		switch {
+		case opts.compressLevel < 1 || opts.compressLevel > 9:
+			problem = fmt.Sprintf("must be between 1 and 9, got %d", opts.compressLevel)
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --compression-level %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
 		}
 	}
 
-	if hasError {
-		return fmt.Errorf("some backups failed (see above)")
+	if len(excludes) > 0 {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.objectPerFile:
+			problem = "cannot be combined with --object-per-file"
+		default:
+			if opts.exclude, err = backup.ParseExcludes(excludes); err != nil {
+				problem = err.Error()
+			}
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --exclude %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if opts.excludeEmpty && subcommand != "backup" {
+		fmt.Fprintln(os.Stderr, "Error: --exclude-empty-dirs is only supported by backup")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if opts.oneFileSystem {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.objectPerFile:
+			problem = "cannot be combined with --object-per-file or --dedup-store"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --exclude-mount-boundaries %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
 
-	// Step 5: R2 upload + rotation
-	if r2Credentials != "" {
-		creds, err := r2.LoadCredentials(r2Credentials)
-		if err != nil {
-			return fmt.Errorf("r2 credentials: %w", err)
+	if opts.dateSource, err = backup.ParseDateSource(dateSource); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --archive-mtime-source: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if opts.dateSource != backup.DateNow && subcommand != "backup" {
+		fmt.Fprintln(os.Stderr, "Error: --archive-mtime-source is only supported by backup")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(restoreAfter) > 0 {
+		var problem string
+		if subcommand != "restore" {
+			problem = "is only supported by restore"
+		} else if opts.restoreAfter, err = parseRestoreAfter(restoreAfter); err != nil {
+			problem = err.Error()
 		}
-		r2Client, err := r2.New(creds, verbose)
-		if err != nil {
-			return err
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --restore-after %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
 
-		fmt.Println("\n=== R2 Upload ===")
-		for _, r := range results {
-			if r.Err != nil {
-				continue
-			}
-			key := filepath.Base(r.ArchivePath)
-			if err := r2Client.Upload(ctx, r.ArchivePath, key); err != nil {
-				fmt.Printf("  FAIL  %s: %v\n", key, err)
-			} else {
-				fmt.Printf("  OK    %s uploaded\n", key)
-			}
+	if opts.lockDays != 0 {
+		var problem string
+		switch {
+		case opts.lockDays < 0:
+			problem = "must not be negative"
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case !opts.useR2():
+			problem = "requires --r2-credentials (files cannot be locked)"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --object-lock-days %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
+
+	if opts.dictPath != "" {
+		var problem string
+		_, exists := os.Stat(opts.dictPath)
+		switch {
+		case subcommand != "backup" && subcommand != "restore":
+			problem = "is only supported by backup and restore"
+		case subcommand == "backup" && !usesZstd(opts):
+			problem = "requires zstd archives (--compression zstd or a --pvc-opts codec:zstd)"
+		case exists == nil:
+			if opts.dict, err = backup.LoadZstdDict(opts.dictPath); err != nil {
+				problem = err.Error()
+			}
+		case subcommand == "restore":
+			problem = exists.Error()
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --compression-dict %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.restoreAll {
+		var problem string
+		switch {
+		case subcommand != "restore":
+			problem = "is only supported by restore"
+		case len(args) > 0 || (!opts.useR2() && opts.dest == ""):
+			problem = "restores from --r2-credentials or --dest and takes no explicit archives"
+		case opts.restoreVersion != 0 || opts.listVersions:
+			problem = "restores the latest backups and cannot be combined with --restore-version or --list-versions"
+		case !opts.yes && !opts.dryRun:
+			problem = "overwrites every PVC of the release and requires --yes (or --dry-run to see the plan)"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --restore-all %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if opts.yes {
+		fmt.Fprintln(os.Stderr, "Error: --yes only confirms --restore-all")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(opts.pvs) > 0 {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.allNamespaces:
+			problem = "cannot be combined with --all-namespaces"
+		case opts.excludeOrphans || len(opts.ordinals) > 0:
+			problem = "cannot be combined with --exclude-pvc-without-workload or --ordinals, as a PV has no workload"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --pv %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.waitReady && subcommand != "restore" {
+		fmt.Fprintln(os.Stderr, "Error: --wait-ready is only supported by restore")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if readyAnnotation != "" || opts.postDelay != 0 {
+		key, value, ok := strings.Cut(readyAnnotation, "=")
+		var problem string
+		switch {
+		case !opts.waitReady:
+			problem = "require --wait-ready"
+		case opts.postDelay < 0:
+			problem = "need a --post-restore-delay that is not negative"
+		case readyAnnotation != "" && (!ok || key == ""):
+			problem = fmt.Sprintf("need a --ready-annotation given as key=value, not %q", readyAnnotation)
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --ready-annotation and --post-restore-delay %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+		opts.readyKey, opts.readyValue = key, value
+	}
+
+	if opts.stateFile != "" || opts.continueFrom != "" || opts.skipExisting {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "are only supported by backup"
+		case opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --output-dir -"
+		case opts.continueFrom != "" && opts.allNamespaces:
+			problem = "cannot be combined with --all-namespaces when --continue-from is set"
+		case opts.skipExisting && !opts.useR2() && opts.dest == "":
+			problem = "need --r2-credentials or --dest when --skip-existing is set"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --state-file, --continue-from and --skip-existing %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.unchangedFile != "" {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --output-dir -"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --skip-unchanged %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.targetsFile != "" {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.targetParallel < 1:
+			problem = "needs a --target-parallel of at least 1"
+		case opts.allNamespaces || len(opts.pvs) > 0 || opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --all-namespaces, --pv or --output-dir -"
+		case opts.stateFile != "" || opts.continueFrom != "" || opts.planHash || opts.requirePlan != "":
+			problem = "cannot be combined with --state-file, --continue-from, --plan-hash or --require-plan, which describe a single release"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --targets %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if opts.targets, err = loadTargets(opts.targetsFile, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else if opts.targetParallel != 1 {
+		fmt.Fprintln(os.Stderr, "Error: --target-parallel requires --targets")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(opts.releases) > 1 {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.allNamespaces || len(opts.pvs) > 0 || opts.targetsFile != "":
+			problem = "cannot be combined with --all-namespaces, --pv or --targets"
+		case opts.continueFrom != "" || opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --continue-from or --output-dir -"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: more than one --release %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.parallel != 1 {
+		var problem string
+		switch {
+		case opts.parallel < 1:
+			problem = "must be at least 1"
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --output-dir -, which writes every archive to one stream"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --parallel %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.pipelineDepth != 0 {
+		var problem string
+		switch {
+		case opts.pipelineDepth < 0:
+			problem = "must not be negative"
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case !opts.useR2() && opts.dest == "":
+			problem = "requires --r2-credentials or --dest"
+		case opts.quota > 0 || opts.objectPerFile || opts.outputDir == stdoutDir:
+			problem = "cannot be combined with --r2-quota, --object-per-file or --output-dir -"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --pipeline-depth %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.stream {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case !opts.useR2() && opts.dest == "":
+			problem = "requires --r2-credentials or --dest"
+		case opts.objectPerFile || opts.outputDir == stdoutDir || opts.pipelineDepth > 0:
+			problem = "cannot be combined with --object-per-file, --output-dir - or --pipeline-depth"
+		case opts.checksumMode == r2.ChecksumSidecar || opts.checksumMode == r2.ChecksumMetadata:
+			problem = "cannot be combined with --checksum-mode sidecar or metadata, as the checksum is only known once the upload is done"
+		case opts.quota > 0 || opts.skipExisting || opts.stateFile != "" || opts.minFreeAfter > 0:
+			problem = "cannot be combined with --r2-quota, --skip-existing, --state-file or --min-free-after, which need the archive on disk"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --stream %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.requireWorkload {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.onlyOrphans:
+			problem = "cannot be combined with --only-orphans"
+		case len(opts.pvs) > 0:
+			problem = "cannot be combined with --pv, as a PV has no workload"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --require-workload %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if len(opts.ordinals) > 0 {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case slices.Min(opts.ordinals) < 0:
+			problem = "must not be negative"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --ordinals %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.useCSISnapshot && subcommand != "backup" {
+		fmt.Fprintln(os.Stderr, "Error: --use-csi-snapshot is only supported by backup")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if subcommand == "list-contents" {
+		var problem string
+		switch {
+		case len(args) != 1:
+			problem = "takes exactly one archive key"
+		case !opts.useR2() && opts.dest == "":
+			problem = "requires --r2-credentials or --dest"
+		case opts.allNamespaces:
+			problem = "does not support --all-namespaces"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: list-contents %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if subcommand == "selftest" && opts.allNamespaces {
+		fmt.Fprintln(os.Stderr, "Error: selftest does not support --all-namespaces")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if subcommand == "migrate" {
+		if opts.allNamespaces {
+			fmt.Fprintln(os.Stderr, "Error: migrate does not support --all-namespaces")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if !opts.useR2() && opts.dest == "" {
+			fmt.Fprintln(os.Stderr, "Error: migrate requires --r2-credentials or --dest")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if opts.toR2Creds != "" && opts.toDest != "" {
+			fmt.Fprintln(os.Stderr, "Error: --to-r2-credentials and --to-dest are mutually exclusive")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if opts.fromFormat != "" || opts.toRelease != "" || opts.toR2Creds != "" || opts.toDest != "" || opts.deleteSource {
+		fmt.Fprintln(os.Stderr, "Error: --from-format, --to-release, --to-r2-credentials, --to-dest and --delete-source are only supported by migrate")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.outputDir == stdoutDir {
+		var problem string
+		switch {
+		case subcommand != "backup":
+			problem = "is only supported by backup"
+		case opts.allNamespaces:
+			problem = "cannot be combined with --all-namespaces"
+		case opts.useR2() || opts.dest != "":
+			problem = "cannot be combined with --r2-credentials or --dest"
+		case opts.json:
+			problem = "cannot be combined with --json"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: --output-dir - %s\n", problem)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if opts.summaryFile != "" && subcommand != "backup" && subcommand != "restore" {
+		fmt.Fprintln(os.Stderr, "Error: --summary-file is only supported by backup and restore")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if opts.json || opts.outputDir == stdoutDir {
+		out = os.Stderr
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// migrate, selftest and list-contents only talk to the cluster to read
+	// --r2-credentials-secret
+	var client kubernetes.Interface
+	if (subcommand == "backup" || subcommand == "restore") || opts.r2Secret != "" {
+		if client, err = buildClient(opts); err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v", err)
+		}
+	}
+
+	if opts.useCSISnapshot {
+		if opts.snapshotter, err = buildSnapshotter(opts); err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %v", err)
+		}
+	}
+
+	if opts.r2Secret != "" {
+		if opts.r2Creds, err = loadSecretCredentials(ctx, client, opts.r2Secret, opts.namespace); err != nil {
+			log.Fatalf("Failed to load R2 credentials: %v", err)
+		}
+	}
+
+	if opts.listVersions {
+		if err := runListVersions(ctx, client, opts, os.Stdout); err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(exitFailed)
+		}
+		os.Exit(exitOK)
+	}
+
+	if subcommand == "migrate" {
+		if err := runMigrate(ctx, opts); err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(exitFailed)
+		}
+		os.Exit(exitOK)
+	}
+
+	if subcommand == "list-contents" {
+		if err := runListContents(ctx, opts, args[0], os.Stdout); err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(exitFailed)
+		}
+		os.Exit(exitOK)
+	}
+
+	if subcommand == "selftest" {
+		if err := runSelftest(ctx, opts); err != nil {
+			log.Printf("Error: self-test failed: %v", err)
+			os.Exit(exitFailed)
+		}
+		os.Exit(exitOK)
+	}
+
+	rep := newRunReport(subcommand)
+	switch subcommand {
+	case "backup":
+		if len(opts.targets) > 0 {
+			err = runTargets(ctx, client, opts, opts.targets, rep)
+		} else {
+			err = run(ctx, client, opts, rep)
+		}
+	case "restore":
+		err = runRestore(ctx, client, opts, args, rep)
+	}
+
+	rep.finish(err)
+	if err != nil {
+		log.Printf("Error: %v", err)
+	}
+	rep.print(out)
+	if opts.verbose {
+		rep.printTiming(out)
+	}
+	if opts.json {
+		if err := rep.writeJSON(os.Stdout); err != nil {
+			log.Printf("Error: writing JSON report: %v", err)
+		}
+	}
+	if opts.summaryFile != "" {
+		if err := rep.appendSummary(opts.summaryFile); err != nil {
+			log.Printf("Error: writing --summary-file: %v", err)
+		}
+	}
+	os.Exit(rep.ExitCode)
+}
+
+// checkWriteAccess has a dry run prove that R2 or --dest accepts the writes the real run
+// makes and the deletes its rotation makes, with a probe object under
+// store.PermCheckPrefix. Without a destination there is nothing to check.
+func checkWriteAccess(ctx context.Context, opts options) error {
+	w := opts.output()
+	if !opts.useR2() && opts.dest == "" {
+		return nil
+	}
+	dest, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	// A probe under object lock could not be deleted
+	if c, ok := dest.(*r2.Client); ok {
+		c.SetObjectLock(0)
+	}
+	fmt.Fprintf(w, "\nChecking write access to %s...\n", destName(opts))
+	key, err := store.ProbeWrite(ctx, dest)
+	if err != nil {
+		fmt.Fprintf(w, "  FAIL  %s: %v\n", key, err)
+		return fmt.Errorf("%s refused the write check: %w", destName(opts), err)
+	}
+	fmt.Fprintf(w, "  OK    wrote and deleted %s\n", key)
+	return nil
+}
+
+// releaseGroup is the set of PVCs belonging to one release in one namespace.
+type releaseGroup struct {
+	namespace string
+	release   string
+	pvcs      []types.PVCInfo
+}
+
+func run(ctx context.Context, client kubernetes.Interface, opts options, rep *runReport) error {
+	if opts.fingerprints == nil {
+		save, err := loadFingerprints(&opts)
+		if err != nil {
+			return err
+		}
+		defer save()
+	}
+	if opts.stateFile == "" {
+		if err := discoverAndBackup(ctx, client, opts, rep); err != nil || !opts.dryRun {
+			return err
+		}
+		return checkWriteAccess(ctx, opts)
+	}
+
+	var err error
+	if opts.state, err = backup.LoadState(opts.stateFile); err != nil {
+		return err
+	}
+	if n := len(opts.state.Completed); n > 0 {
+		fmt.Fprintf(opts.output(), "Resuming: %s records %d completed PVC(s).\n", opts.stateFile, n)
+	}
+	if err := discoverAndBackup(ctx, client, opts, rep); err != nil {
+		return err
+	}
+	if opts.dryRun {
+		return checkWriteAccess(ctx, opts)
+	}
+	// The run is complete, so the next one starts from scratch
+	if err := opts.state.Remove(); err != nil {
+		log.Printf("WARNING: removing state file: %v", err)
+	}
+	return nil
+}
+
+// discoverAndBackup discovers the PVCs of the release, or of every release with
+// --all-namespaces, and backs each release up.
+func discoverAndBackup(ctx context.Context, client kubernetes.Interface, opts options, rep *runReport) error {
+	w := opts.output()
+	disc := newDiscoverer(client, opts)
+	if len(opts.releases) > 1 {
+		return backupReleases(ctx, client, disc, opts, rep)
+	}
+
+	// Step 1: Discover PVCs
+	if len(opts.pvs) > 0 {
+		rel := rep.add(opts.namespace, opts.release)
+		fmt.Fprintf(w, "Resolving %d PV(s) for release %q in namespace %q...\n", len(opts.pvs), opts.release, opts.namespace)
+		rel.start(phaseDiscover)
+		pvcs, err := resolvePVs(ctx, disc, opts)
+		rel.set(phaseDiscover, err)
+		if err != nil {
+			return fmt.Errorf("discovery: %w", err)
+		}
+		if err := checkHostPaths(opts, pvcs); err != nil {
+			return err
+		}
+		if err := checkPlan(opts, rep, pvcs); err != nil {
+			return err
+		}
+		if err := checkScaleTargets(opts, pvcs); err != nil {
+			return err
+		}
+		return backupRelease(ctx, client, opts, rel, pvcs)
+	}
+	if !opts.allNamespaces {
+		rel := rep.add(opts.namespace, opts.release)
+		fmt.Fprintf(w, "Discovering PVCs for release %q in namespace %q...\n", opts.release, opts.namespace)
+		rel.start(phaseDiscover)
+		pvcs, err := disc.Discover(ctx, opts.namespace, opts.release)
+		rel.set(phaseDiscover, err)
+		if err != nil {
+			return fmt.Errorf("discovery: %w", err)
+		}
+		if err := checkHostPaths(opts, pvcs); err != nil {
+			return err
+		}
+		if err := checkPlan(opts, rep, pvcs); err != nil {
+			return err
+		}
+		if err := checkScaleTargets(opts, pvcs); err != nil {
+			return err
+		}
+		return backupRelease(ctx, client, opts, rel, pvcs)
+	}
+
+	if opts.release != "" {
+		fmt.Fprintf(w, "Discovering PVCs for release %q in all namespaces...\n", opts.release)
+	} else {
+		fmt.Fprintln(w, "Discovering PVCs for all releases in all namespaces...")
+	}
+	discoverStart := time.Now()
+	pvcs, err := disc.DiscoverAll(ctx, opts.release)
+	if err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	if err := checkHostPaths(opts, pvcs); err != nil {
+		return err
+	}
+	if err := checkPlan(opts, rep, pvcs); err != nil {
+		return err
+	}
+	if err := checkScaleTargets(opts, pvcs); err != nil {
+		return err
+	}
+
+	groups := groupByRelease(pvcs)
+	fmt.Fprintf(w, "Found %d release(s) across the cluster.\n", len(groups))
+
+	// Each group is scaled, archived and scaled back on its own so that a failure in one
+	// namespace never leaves another namespace's workloads scaled down.
+	var failed []string
+	for _, g := range groups {
+		fmt.Fprintf(w, "\n##### %s/%s #####\n", g.namespace, g.release)
+		rel := rep.add(g.namespace, g.release)
+		rel.startAt(phaseDiscover, discoverStart)
+		rel.set(phaseDiscover, nil)
+		if err := backupRelease(ctx, client, opts, rel, g.pvcs); err != nil {
+			log.Printf("ERROR: %s/%s: %v", g.namespace, g.release, err)
+			failed = append(failed, g.namespace+"/"+g.release)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("backup failed for %d release(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// backupReleases discovers the PVCs of every --release of the namespace, then backs each
+// release up in turn, as --all-namespaces does with its groups. All of them are discovered
+// first, so a misspelled release fails the run before any workload is scaled down.
+func backupReleases(ctx context.Context, client kubernetes.Interface, disc *discovery.Discoverer, opts options, rep *runReport) error {
+	w := opts.output()
+	rels := make([]*releaseReport, len(opts.releases))
+	found := make([][]types.PVCInfo, len(opts.releases))
+	var all []types.PVCInfo
+	for i, release := range opts.releases {
+		rels[i] = rep.add(opts.namespace, release)
+		fmt.Fprintf(w, "Discovering PVCs for release %q in namespace %q...\n", release, opts.namespace)
+		rels[i].start(phaseDiscover)
+		pvcs, err := disc.Discover(ctx, opts.namespace, release)
+		rels[i].set(phaseDiscover, err)
+		if err != nil {
+			return fmt.Errorf("discovery of release %s: %w", release, err)
+		}
+		found[i] = pvcs
+		all = append(all, pvcs...)
+	}
+	if err := checkHostPaths(opts, all); err != nil {
+		return err
+	}
+	if err := checkPlan(opts, rep, all); err != nil {
+		return err
+	}
+	if err := checkScaleTargets(opts, all); err != nil {
+		return err
+	}
+
+	var failed []string
+	for i, release := range opts.releases {
+		fmt.Fprintf(w, "\n##### %s/%s #####\n", opts.namespace, release)
+		if err := backupRelease(ctx, client, opts, rels[i], found[i]); err != nil {
+			log.Printf("ERROR: %s/%s: %v", opts.namespace, release, err)
+			failed = append(failed, opts.namespace+"/"+release)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("backup failed for %d release(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// resolvePVs describes each --pv for backup in place of the release's PVCs. They are
+// archived under the PV name and, having no workload, back up without scaling.
+func resolvePVs(ctx context.Context, disc *discovery.Discoverer, opts options) ([]types.PVCInfo, error) {
+	var pvcs []types.PVCInfo
+	for _, name := range opts.pvs {
+		info, err := disc.ResolvePV(ctx, opts.namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		info.Release = opts.release
+		pvcs = append(pvcs, *info)
+	}
+	return pvcs, nil
+}
+
+// pvStillExists returns a check that fails a PVC whose PV was deleted after discovery, or
+// is being deleted. Other API errors are only logged: the host path is still checked, and
+// a flaky API server shouldn't fail a backup that can go ahead.
+func pvStillExists(client kubernetes.Interface) func(context.Context, types.PVCInfo) error {
+	return func(ctx context.Context, pvc types.PVCInfo) error {
+		if pvc.PVName == "" {
+			return nil
+		}
+		pv, err := client.CoreV1().PersistentVolumes().Get(ctx, pvc.PVName, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			return fmt.Errorf("PV %s was deleted since discovery", pvc.PVName)
+		case err != nil:
+			log.Printf("WARNING: re-checking PV %s: %v", pvc.PVName, err)
+		case pv.DeletionTimestamp != nil:
+			return fmt.Errorf("PV %s was marked for deletion since discovery", pvc.PVName)
+		}
+		return nil
+	}
+}
+
+// checkHostPaths warns about PVCs that share a host path, which a hostpath provisioner
+// only does when misconfigured: their archives would hold the same data and restoring one
+// overwrites the other. With --strict-paths it refuses to go on instead.
+func checkHostPaths(opts options, pvcs []types.PVCInfo) error {
+	shared := discovery.SharedHostPaths(pvcs)
+	if len(shared) == 0 {
+		return nil
+	}
+	lines := discovery.FormatSharedHostPaths(shared)
+	if opts.strictPaths {
+		return fmt.Errorf("PVCs share a host path: %s", strings.Join(lines, "; "))
+	}
+	for _, line := range lines {
+		log.Printf("WARNING: PVCs share a host path: %s", line)
+	}
+	return nil
+}
+
+// checkPlan prints the plan hash of the discovered PVCs with --plan-hash and, with
+// --require-plan, refuses to go on when it differs from the approved one.
+func checkPlan(opts options, rep *runReport, pvcs []types.PVCInfo) error {
+	if !opts.planHash && opts.requirePlan == "" {
+		return nil
+	}
+	hash := discovery.PlanHash(pvcs)
+	rep.PlanHash = hash
+	if opts.planHash {
+		fmt.Fprintf(opts.output(), "Plan hash: %s\n", hash)
+	}
+	if opts.requirePlan != "" && hash != opts.requirePlan {
+		return fmt.Errorf("plan hash %s does not match --require-plan %s: the cluster changed since the plan was reviewed", hash, opts.requirePlan)
+	}
+	return nil
+}
+
+// checkScaleTargets refuses --scale-to entries that name no workload of pvcs: a misspelt
+// one would leave the workload it meant scaled to 0. With --targets an entry may be meant
+// for another target, so it is only warned about.
+func checkScaleTargets(opts options, pvcs []types.PVCInfo) error {
+	if len(opts.scaleTargets) == 0 {
+		return nil
+	}
+	found := make(map[string]bool)
+	for _, w := range uniqueWorkloads(pvcs) {
+		found[scaler.TargetKey(w)] = true
+	}
+	var unknown []string
+	for key := range opts.scaleTargets {
+		if !found[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	slices.Sort(unknown)
+	msg := fmt.Sprintf("--scale-to %s matches no workload of the selected PVCs", strings.Join(unknown, ", "))
+	if len(opts.targets) > 0 {
+		log.Printf("WARNING: %s", msg)
+		return nil
+	}
+	return errors.New(msg)
+}
+
+// groupByRelease splits PVCs into per-namespace, per-release groups, preserving the order in
+// which each group first appears.
+func groupByRelease(pvcs []types.PVCInfo) []releaseGroup {
+	index := make(map[string]int)
+	var groups []releaseGroup
+	for _, pvc := range pvcs {
+		key := pvc.Namespace + "/" + pvc.Release
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, releaseGroup{namespace: pvc.Namespace, release: pvc.Release})
+		}
+		groups[i].pvcs = append(groups[i].pvcs, pvc)
+	}
+	return groups
+}
+
+// backupRelease scales down, archives, uploads and rotates the PVCs of a single release,
+// recording the outcome of each phase in rel.
+func backupRelease(ctx context.Context, client kubernetes.Interface, opts options, rel *releaseReport, pvcs []types.PVCInfo) error {
+	w := opts.output()
+	namespace, release := rel.Namespace, rel.Release
+	sc := newScaler(client, opts)
+	if opts.dictPath != "" && opts.dict == nil && !opts.dryRun {
+		dict, err := zstdDict(w, opts.dictPath, pvcs, opts.pathRoots)
+		if err != nil {
+			return err
+		}
+		opts.dict = dict
+	}
+	bopts := append(backupOptions(opts), backup.WithPVCheck(pvStillExists(client)))
+	if opts.objectPerFile {
+		dest, err := openStore(opts)
+		if err != nil {
+			return err
+		}
+		upload := perfile.Upload
+		if opts.dedupStore {
+			upload = perfile.UploadDedup
+		}
+		bopts = append(bopts, backup.WithObjectPerFile(func(ctx context.Context, dir, prefix string) (int64, error) {
+			return upload(ctx, dest, dir, prefix, opts.verbose)
+		}))
+	}
+	if opts.stream {
+		dest, err := openStore(opts)
+		if err != nil {
+			return err
+		}
+		bopts = append(bopts, backup.WithStreamUpload(func(ctx context.Context, pvc types.PVCInfo, r io.Reader, name string) error {
+			labels := r2.Labels{Namespace: namespace, Release: release, PVC: pvc.PVCName}
+			return store.StreamArchive(ctx, dest, filepath.Base(name), r, labels)
+		}))
+	}
+	if opts.state != nil {
+		bopts = append(bopts, backup.WithState(opts.state))
+	}
+	if opts.fingerprints != nil {
+		bopts = append(bopts, backup.WithFingerprints(opts.fingerprints))
+	}
+
+	fmt.Fprintf(w, "Found %d PVC(s):\n", len(pvcs))
+	for _, pvc := range pvcs {
+		workloadStr := "(no workload found)"
+		if pvc.Workload != nil {
+			workloadStr = fmt.Sprintf("%s/%s (%d replicas)", pvc.Workload.Kind, pvc.Workload.Name, pvc.Workload.OriginalReplicas)
+		}
+		fmt.Fprintf(w, "  - %s -> PV %s -> %s [%s]\n", pvc.PVCName, pvc.PVName, pvc.HostPath, workloadStr)
+	}
+
+	pvcs, skipped := filterByWorkload(pvcs, opts.excludeOrphans, opts.onlyOrphans)
+	if len(opts.ordinals) > 0 {
+		var other []skippedPVC
+		pvcs, other = filterByOrdinal(pvcs, opts.ordinals)
+		warnPartialStatefulSets(pvcs, other)
+		skipped = append(skipped, other...)
+	}
+	pvcs = orderPVCs(pvcs, opts.pvcOrder, func(p types.PVCInfo) string { return p.PVCName })
+	if opts.continueFrom != "" {
+		i := slices.IndexFunc(pvcs, func(p types.PVCInfo) bool { return p.PVCName == opts.continueFrom })
+		if i < 0 {
+			return fmt.Errorf("--continue-from %s: no such PVC among the ones selected for backup", opts.continueFrom)
+		}
+		for _, pvc := range pvcs[:i] {
+			skipped = append(skipped, skippedPVC{pvc: pvc, reason: "before --continue-from " + opts.continueFrom})
+		}
+		pvcs = pvcs[i:]
+	}
+	if opts.requireWorkload {
+		if err := requireWorkloads(pvcs); err != nil {
+			return err
+		}
+	}
+
+	if opts.outputDir == stdoutDir && len(pvcs) != 1 {
+		return fmt.Errorf("--output-dir - writes a single archive to stdout, but %d PVC(s) are selected", len(pvcs))
+	}
+
+	// CSI-backed PVCs are snapshotted instead, so their workloads need not scale down
+	var csi []types.PVCInfo
+	if opts.useCSISnapshot {
+		var rest []types.PVCInfo
+		csi, rest = splitCSI(pvcs)
+		if opts.dryRun {
+			pvcs = rest
+		} else if len(csi) > 0 {
+			taken := takeSnapshots(ctx, opts, rel, csi)
+			pvcs = slices.DeleteFunc(slices.Clone(pvcs), func(p types.PVCInfo) bool { return taken[p.PVCName] })
+		}
+	}
+
+	// Collect unique workloads
+	workloads := uniqueWorkloads(pvcs)
+	warnHPAs(workloads, opts)
+
+	if opts.dryRun {
+		printDryRun(ctx, pvcs, csi, skipped, workloads, opts, namespace, release)
+		return nil
+	}
+
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "\nSkipping %d PVC(s):\n", len(skipped))
+		for _, sk := range skipped {
+			fmt.Fprintf(w, "  - %s: %s\n", sk.pvc.PVCName, sk.reason)
+		}
+	}
+	if len(pvcs) == 0 {
+		fmt.Fprintln(w, "No PVCs left to back up.")
+		return nil
+	}
+	if opts.minFreeAfter > 0 {
+		fmt.Fprintln(w)
+		if err := checkMinFreeAfter(pvcs, opts); err != nil {
+			return err
+		}
+	}
+
+	// Step 2: Scale down (with deferred scale-back)
+	if len(workloads) > 0 {
+		fmt.Fprintf(w, "\nScaling down %d workload(s)...\n", len(workloads))
+		// Always scale back, even if backup fails
+		defer func() {
+			fmt.Fprintln(w, "\nRestoring workload replicas...")
+			rel.start(phaseScaleBack)
+			err := sc.ScaleBack(ctx, workloads)
+			rel.set(phaseScaleBack, err)
+			if err != nil {
+				log.Printf("ERROR: Failed to restore some workloads: %v", err)
+			} else {
+				fmt.Fprintln(w, "All workloads restored.")
+			}
+		}()
+
+		rel.start(phaseScaleDown)
+		err := sc.ScaleDown(ctx, workloads)
+		rel.set(phaseScaleDown, err)
+		if err != nil {
+			return fmt.Errorf("scale down: %w", err)
+		}
+		fmt.Fprintln(w, "All workloads scaled down.")
+	}
+
+	// Step 3: Backup, with --pipeline-depth uploading each archive as soon as it is written
+	var pipe *uploadPipeline
+	if opts.pipelineDepth > 0 {
+		dest, err := openStore(opts)
+		if err != nil {
+			return err
+		}
+		pipe = startUploadPipeline(ctx, dest, opts, namespace, release)
+		bopts = append(bopts, backup.WithOnResult(pipe.add))
+		rel.start(phaseUpload)
+	}
+	bk := backup.New(opts.outputDir, opts.outputFormat, opts.verbose, bopts...)
+	fmt.Fprintf(w, "\nBacking up %d PVC(s)...\n", len(pvcs))
+	rel.start(phaseBackup)
+	results := bk.BackupAll(ctx, pvcs, namespace, release)
+	if pipe != nil {
+		pipe.wait()
+	}
+
+	// Step 4: Report
+	fmt.Fprintln(w, "\n=== Backup Summary ===")
+	var hasError bool
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "  FAIL  %s: %v\n", r.PVCName, r.Err)
+			hasError = true
+		} else if r.Unchanged {
+			fmt.Fprintf(w, "  SKIP  %s: unchanged since the last backup\n", r.PVCName)
+		} else {
+			resumed := ""
+			if r.Resumed {
+				resumed = ", completed by an earlier run"
+			}
+			fmt.Fprintf(w, "  OK    %s -> %s (%s%s)\n", r.PVCName, r.ArchivePath, formatSize(r.Size), resumed)
+			rel.PVCs = append(rel.PVCs, r.PVCName)
+			rel.Bytes += r.Size
+			if r.SHA256 != "" {
+				fmt.Fprintf(w, "        sha256 %s\n", r.SHA256)
+			}
+			for _, warning := range r.Warnings {
+				fmt.Fprintf(w, "        warning: %s\n", warning)
+			}
+		}
+	}
+	for _, pvc := range pvcs[len(results):] {
+		fmt.Fprintf(w, "  SKIP  %s: not attempted (--fail-fast)\n", pvc.PVCName)
+	}
+
+	if pipe != nil {
+		fmt.Fprintf(w, "\n=== %s Upload ===\n", destName(opts))
+		w.Write(pipe.output.Bytes())
+	}
+
+	if hasError {
+		err := fmt.Errorf("some backups failed (see above)")
+		rel.set(phaseBackup, err)
+		if pipe != nil {
+			// Without a new archive for every PVC, rotating could leave one with too few
+			fmt.Fprintln(w, "  SKIP  rotation: some backups failed")
+			failed := pipe.failed + writeLatest(ctx, pipe.dest, opts, namespace, release, pipe.uploaded)
+			rel.set(phaseUpload, uploadError(failed))
+		}
+		return err
+	}
+	rel.set(phaseBackup, nil)
+
+	// Step 5: R2 (or --dest) upload + rotation
+	if pipe != nil {
+		err := rotateUploaded(ctx, pipe.dest, opts, namespace, release, pvcs, pipe.uploaded, pipe.failed)
+		rel.set(phaseUpload, err)
+		if err != nil {
+			return err
+		}
+	} else if opts.useR2() || opts.dest != "" {
+		rel.start(phaseUpload)
+		err := uploadAndRotate(ctx, opts, namespace, release, pvcs, results)
+		rel.set(phaseUpload, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	recordFingerprints(opts, namespace, release, results)
+	return nil
+}
+
+// recordFingerprints records the fingerprints of the PVCs just backed up for
+// --skip-unchanged to compare the next run against. It only runs once every archive is
+// stored, so a PVC whose upload failed is backed up again rather than skipped.
+func recordFingerprints(opts options, namespace, release string, results []types.BackupResult) {
+	if opts.fingerprints == nil {
+		return
+	}
+	for _, r := range results {
+		if r.Err == nil && r.Fingerprint != "" {
+			opts.fingerprints.Set(namespace, release, r.PVCName, r.Fingerprint)
+		}
+	}
+}
+
+// loadFingerprints loads the --skip-unchanged file into opts.fingerprints and returns the
+// function that saves it once the backups are done. Parallel --targets share what it loads,
+// as each saving a copy of its own would drop the fingerprints of the others.
+func loadFingerprints(opts *options) (save func(), err error) {
+	if opts.unchangedFile == "" {
+		return func() {}, nil
+	}
+	if opts.fingerprints, err = backup.LoadFingerprints(opts.unchangedFile); err != nil {
+		return nil, err
+	}
+	if opts.dryRun {
+		return func() {}, nil
+	}
+	f := opts.fingerprints
+	return func() {
+		if err := f.Save(); err != nil {
+			log.Printf("WARNING: %v; the next run backs these PVCs up again", err)
+		}
+	}, nil
+}
+
+// openStore returns the configured destination: R2 with --r2-credentials, otherwise --dest.
+func openStore(opts options) (store.Store, error) {
+	if !opts.useR2() {
+		return store.Open(opts.dest, opts.verbose)
+	}
+	creds := opts.r2Creds
+	if creds == nil {
+		var err error
+		if creds, err = r2.LoadCredentials(opts.r2Credentials); err != nil {
+			return nil, fmt.Errorf("r2 credentials: %w", err)
+		}
+	}
+	c, err := newR2Client(creds, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.SetObjectLock(opts.lockDays)
+	c.SetArchiveSuffix(opts.archiveSuffix)
+	return c, nil
+}
+
+// newR2Client connects to the bucket of creds, applying --r2-region and --r2-path-style
+// when the credentials name an endpoint other than R2.
+func newR2Client(creds *r2.Credentials, opts options) (*r2.Client, error) {
+	var ropts []r2.Option
+	if creds.Endpoint != "" {
+		if opts.r2Region != "" {
+			ropts = append(ropts, r2.WithRegion(opts.r2Region))
+		}
+		if opts.r2PathStyle {
+			ropts = append(ropts, r2.WithPathStyle())
+		}
+	}
+	return r2.New(creds, opts.verbose, ropts...)
+}
+
+// useR2 reports whether R2 credentials were given, as a file or a Secret.
+func (o options) useR2() bool {
+	return o.r2Credentials != "" || o.r2Secret != ""
+}
+
+// loadSecretCredentials reads R2 credentials from the Secret named by ref, given as
+// namespace/name or as a name in --namespace.
+func loadSecretCredentials(ctx context.Context, client kubernetes.Interface, ref, namespace string) (*r2.Credentials, error) {
+	name := ref
+	if ns, n, ok := strings.Cut(ref, "/"); ok {
+		namespace, name = ns, n
+	}
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid secret reference %q (want namespace/name)", ref)
+	}
+
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("reading secret %s/%s: %w", namespace, name, err)
+	}
+	creds, err := r2.CredentialsFromSecretData(secret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s/%s: %w", namespace, name, err)
+	}
+	return creds, nil
+}
+
+// destName labels the configured destination in progress output.
+func destName(opts options) string {
+	if opts.useR2() {
+		return "R2"
+	}
+	return "Destination"
+}
+
+// keyFormat is the template of the keys that mark one backup in R2 or --dest: the archive
+// name, or with --object-per-file the manifest below the snapshot prefix.
+func (o options) keyFormat() string {
+	if !o.objectPerFile {
+		return o.outputFormat
+	}
+	base, _ := backup.SplitArchiveExtension(o.outputFormat)
+	return base + "/" + perfile.ManifestName
+}
+
+func (o options) retention() store.Retention {
+	return store.Retention{KeepLast: o.keepLast, KeepDays: o.keepDays, GFS: o.gfs}
+}
+
+// checkNameTemplate parses the --name-template text for subcommand, failing when the
+// other options rule templated names out.
+func checkNameTemplate(opts options, subcommand, text string) (*backup.NameTemplate, error) {
+	var problem string
+	switch {
+	case subcommand != "backup" && subcommand != "restore":
+		problem = "is only supported by backup and restore"
+	case subcommand == "restore" && !opts.matchByMeta:
+		problem = "requires --match-by-metadata on restore, as templated names cannot be parsed back into PVCs"
+	case opts.objectPerFile || opts.compression != "":
+		problem = "cannot be combined with --object-per-file or --compression"
+	case opts.retention().Enabled():
+		problem = "cannot be combined with --keep-last, --keep-days, --retention-daily, --retention-weekly or --retention-monthly, as rotation finds backups by name"
+	}
+	if problem != "" {
+		return nil, fmt.Errorf("--name-template %s", problem)
+	}
+	tmpl, err := backup.ParseNameTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("--name-template %w", err)
+	}
+	return tmpl, nil
+}
+
+// checkRotationFormat fails when retention is set but --output-format has no {date}. Every
+// backup of a PVC then gets the same key and replaces the one before, so there is only
+// ever one backup and the retention rules would silently do nothing.
+func checkRotationFormat(opts options) error {
+	if !opts.retention().Enabled() || strings.Contains(opts.outputFormat, "{date}") {
+		return nil
+	}
+	return fmt.Errorf("--keep-last, --keep-days and --retention-* need {date} in --output-format %q: without it each backup of a PVC overwrites the last and there is nothing to rotate", opts.outputFormat)
+}
+
+// uploadAndRotate uploads successful archives to R2 or --dest and applies --keep-last and
+// --keep-days rotation. Individual failures are reported as they happen; the returned error
+// summarises them. --object-per-file snapshots are already stored, so only rotation runs.
+func uploadAndRotate(ctx context.Context, opts options, namespace, release string, pvcs []types.PVCInfo, results []types.BackupResult) error {
+	w := opts.output()
+	dest, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+
+	var failedUploads int
+	uploaded := make(map[string]string)
+	if opts.objectPerFile {
+		for _, r := range results {
+			if r.Err == nil && !r.Unchanged {
+				uploaded[r.PVCName] = r.ArchivePath + perfile.ManifestName
+			}
+		}
+		results = nil
+	} else {
+		fmt.Fprintf(w, "\n=== %s Upload ===\n", destName(opts))
+	}
+	if opts.quota > 0 {
+		if err := checkQuota(ctx, dest, opts, namespace, release, pvcs, results); err != nil {
+			if !opts.force {
+				return err
+			}
+			log.Printf("WARNING: %v; uploading anyway (--force)", err)
+		}
+	}
+	for _, r := range results {
+		if !uploadResult(ctx, w, dest, opts, namespace, release, r) {
+			failedUploads++
+		} else if r.Err == nil && !r.Unchanged {
+			uploaded[r.PVCName] = filepath.Base(r.ArchivePath)
+		}
+	}
+	return rotateUploaded(ctx, dest, opts, namespace, release, pvcs, uploaded, failedUploads)
+}
+
+// uploadResult uploads the archive of a successful backup result and confirms its size
+// (and checksum) in dest, reporting to w. It returns false when the upload failed. Failed
+// and unchanged results have no archive and are left out.
+func uploadResult(ctx context.Context, w io.Writer, dest store.Store, opts options, namespace, release string, r types.BackupResult) bool {
+	if r.Err != nil || r.Unchanged {
+		return true
+	}
+	key := filepath.Base(r.ArchivePath)
+	if opts.stream {
+		// Uploaded while it was created; only what landed is left to check
+		if err := confirmUpload(ctx, dest, opts, key, r); err != nil {
+			fmt.Fprintf(w, "  FAIL  %s: %v\n", key, err)
+			return false
+		}
+		fmt.Fprintf(w, "  OK    %s (%s, streamed)\n", dest.ObjectURL(key), formatSize(r.Size))
+		return true
+	}
+	if opts.skipExisting {
+		if obj, err := dest.Stat(ctx, key); err == nil && obj.Size == r.Size {
+			fmt.Fprintf(w, "  SKIP  %s: already uploaded (%s)\n", dest.ObjectURL(key), formatSize(obj.Size))
+			return true
+		}
+	}
+	start := time.Now()
+	labels := r2.Labels{Namespace: namespace, Release: release, PVC: r.PVCName}
+	if err := store.UploadArchive(ctx, dest, r.ArchivePath, key, r.SHA256, opts.checksumMode, labels); err != nil {
+		fmt.Fprintf(w, "  FAIL  %s: %v\n", key, err)
+		return false
+	}
+	elapsed := time.Since(start)
+
+	if err := confirmUpload(ctx, dest, opts, key, r); err != nil {
+		fmt.Fprintf(w, "  FAIL  %s: %v\n", key, err)
+		return false
+	}
+	fmt.Fprintf(w, "  OK    %s (%s in %s)\n", dest.ObjectURL(key), formatSize(r.Size), formatDuration(elapsed))
+	return true
+}
+
+// confirmUpload checks what actually landed in dest under key rather than trusting the
+// upload: the size of the archive of r, and with --checksum-mode metadata its checksum.
+func confirmUpload(ctx context.Context, dest store.Store, opts options, key string, r types.BackupResult) error {
+	obj, err := dest.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("uploaded but could not be confirmed: %w", err)
+	}
+	if obj.Size != r.Size {
+		return fmt.Errorf("uploaded size %d does not match archive size %d", obj.Size, r.Size)
+	}
+	if opts.checksumMode == r2.ChecksumMetadata && obj.SHA256 != r.SHA256 {
+		return fmt.Errorf("stored checksum %q does not match archive checksum %s", obj.SHA256, r.SHA256)
+	}
+	return nil
+}
+
+// rotateUploaded points the release's latest.json at the archives uploaded, keyed by PVC
+// name, then applies retention, and fails when any upload or rotation step did.
+func rotateUploaded(ctx context.Context, dest store.Store, opts options, namespace, release string, pvcs []types.PVCInfo, uploaded map[string]string, failedUploads int) error {
+	w := opts.output()
+	failedUploads += writeLatest(ctx, dest, opts, namespace, release, uploaded)
+	var failedRotations int
+	if retention := opts.retention(); retention.Enabled() {
+		fmt.Fprintf(w, "\n=== %s Rotation (%s) ===\n", destName(opts), retention)
+		plan, err := rotationPlan(ctx, dest, opts, namespace, release, pvcs, nil)
+		if err != nil {
+			fmt.Fprintf(w, "  FAIL  %s/%s: %v\n", namespace, release, err)
+			failedRotations++
+		}
+		for _, pvc := range pvcs {
+			keys, locked := store.SkipLocked(ctx, dest, plan[pvc.PVCName], time.Now())
+			for _, obj := range locked {
+				fmt.Fprintf(w, "  SKIP  %s (%s)\n", obj.Key, lockReason(obj))
+			}
+			for _, key := range keys {
+				deleted, err := store.DeleteBackup(ctx, dest, key)
+				if err != nil {
+					fmt.Fprintf(w, "  FAIL  %s: %v\n", key, err)
+					failedRotations++
+				} else if perfile.IsManifest(key) {
+					fmt.Fprintf(w, "  DEL   %s (%d object(s))\n", perfile.Prefix(key), len(deleted))
+				} else {
+					fmt.Fprintf(w, "  DEL   %s\n", key)
+				}
+			}
+		}
+	}
+
+	if err := uploadError(failedUploads); err != nil {
+		return err
+	}
+	if failedRotations > 0 {
+		return fmt.Errorf("%d rotation step(s) failed (see above)", failedRotations)
+	}
+	return nil
+}
+
+// writeLatest points the release's latest.json at the archives uploaded, keyed by PVC name,
+// keeping what it says about the other PVCs. It reports to opts.output(), never the global
+// out, as parallel --targets call it at once, and returns the number of failed uploads: 1
+// when the pointer could not be written, otherwise 0.
+func writeLatest(ctx context.Context, dest store.Store, opts options, namespace, release string, uploaded map[string]string) int {
+	w := opts.output()
+	if len(uploaded) == 0 {
+		return 0
+	}
+	key := latestKey(opts, namespace, release)
+	latest, err := dest.GetLatest(ctx, key)
+	if err != nil {
+		log.Printf("WARNING: %v; writing a new %s", err, r2.LatestName)
+	}
+	if latest == nil || latest.PVCs == nil {
+		latest = &r2.Latest{PVCs: make(map[string]string, len(uploaded))}
+	}
+	for pvc, archive := range uploaded {
+		latest.PVCs[pvc] = archive
+	}
+	latest.Updated = time.Now().UTC()
+	if err := dest.SetLatest(ctx, key, *latest); err != nil {
+		fmt.Fprintf(w, "  FAIL  %s: %v\n", key, err)
+		return 1
+	}
+	fmt.Fprintf(w, "  OK    %s (%d PVC(s) updated)\n", dest.ObjectURL(key), len(uploaded))
+	return 0
+}
+
+// uploadError is the error for failed uploads, or nil when there were none.
+func uploadError(failedUploads int) error {
+	if failedUploads > 0 {
+		return fmt.Errorf("%d upload(s) failed (see above)", failedUploads)
+	}
+	return nil
+}
+
+// uploadPipeline uploads archives as BackupAll writes them, so one PVC uploads while the
+// next is archived. Results queue up to --pipeline-depth deep; a full queue blocks add,
+// and with it archiving, which bounds the disk finished archives take up. Upload output
+// is kept until wait returns and printed after the backup summary, as without pipelining.
+type uploadPipeline struct {
+	dest     store.Store
+	results  chan types.BackupResult
+	done     chan struct{}
+	output   bytes.Buffer
+	failed   int
+	uploaded map[string]string // archive key by PVC name
+}
+
+// startUploadPipeline starts the uploader of a release's archives.
+func startUploadPipeline(ctx context.Context, dest store.Store, opts options, namespace, release string) *uploadPipeline {
+	p := &uploadPipeline{
+		dest:     dest,
+		results:  make(chan types.BackupResult, opts.pipelineDepth),
+		done:     make(chan struct{}),
+		uploaded: make(map[string]string),
+	}
+	go func() {
+		defer close(p.done)
+		for r := range p.results {
+			if !uploadResult(ctx, &p.output, dest, opts, namespace, release, r) {
+				p.failed++
+			} else if r.Err == nil && !r.Unchanged {
+				p.uploaded[r.PVCName] = filepath.Base(r.ArchivePath)
+			}
+		}
+	}()
+	return p
+}
+
+// add queues a backup result for upload.
+func (p *uploadPipeline) add(r types.BackupResult) {
+	p.results <- r
+}
+
+// wait closes the queue and returns once every queued archive has been uploaded.
+func (p *uploadPipeline) wait() {
+	close(p.results)
+	<-p.done
+}
+
+// checkQuota fails when uploading the successful results would take the objects under
+// --r2-quota-prefix past --r2-quota, after rotation deletes what it plans to. An upload
+// that replaces an existing key only adds the difference.
+func checkQuota(ctx context.Context, dest store.Store, opts options, namespace, release string, pvcs []types.PVCInfo, results []types.BackupResult) error {
+	objects, err := dest.ListByPrefix(ctx, opts.quotaPrefix)
+	if err != nil {
+		return fmt.Errorf("checking --r2-quota: %w", err)
+	}
+	sizes := make(map[string]int64, len(objects))
+	var used int64
+	for _, obj := range objects {
+		sizes[obj.Key] = obj.Size
+		used += obj.Size
+	}
+
+	var added int64
+	pending := make(map[string]r2.ObjectInfo)
+	for _, r := range results {
+		if r.Err != nil || r.Unchanged {
+			continue
+		}
+		key := filepath.Base(r.ArchivePath)
+		pending[r.PVCName] = r2.ObjectInfo{Key: key, Size: r.Size, LastModified: time.Now()}
+		added += r.Size - sizes[key]
+	}
+
+	var freed int64
+	if opts.retention().Enabled() {
+		plan, err := rotationPlan(ctx, dest, opts, namespace, release, pvcs, pending)
+		if err != nil {
+			return fmt.Errorf("checking --r2-quota: %w", err)
+		}
+		for _, keys := range plan {
+			for _, key := range keys {
+				freed += sizes[key]
+			}
+		}
+	}
+
+	after := used - freed + added
+	fmt.Fprintf(opts.output(), "  Quota: %s stored, %s to upload, %s freed by rotation: %s of %s\n",
+		formatSize(used), formatSize(added), formatSize(freed), formatSize(after), formatSize(opts.quota))
+	if after > opts.quota {
+		return fmt.Errorf("uploading would store %s, %s over the --r2-quota of %s", formatSize(after), formatSize(after-opts.quota), formatSize(opts.quota))
+	}
+	return nil
+}
+
+// freeSpace reports the space left on the filesystem holding a directory. Tests replace
+// it to simulate a full disk.
+var freeSpace = backup.FreeSpace
+
+// checkMinFreeAfter fails when archiving pvcs into --output-dir could leave less than
+// --min-free-after free, counting each archive at the uncompressed size of its PVC.
+func checkMinFreeAfter(pvcs []types.PVCInfo, opts options) error {
+	free, err := freeSpace(opts.outputDir)
+	if err != nil {
+		return fmt.Errorf("checking --min-free-after: %w", err)
+	}
+	var needed int64
+	for _, pvc := range pvcs {
+		size, err := backup.EstimateSize(pvc.HostPath)
+		if err != nil {
+			return fmt.Errorf("checking --min-free-after: %w", err)
+		}
+		needed += size
+	}
+
+	after := free - needed
+	fmt.Fprintf(opts.output(), "  Disk: %s free in %s, up to %s of archives: %s left of at least %s\n",
+		formatSize(free), opts.outputDir, formatSize(needed), formatSize(max(after, 0)), formatSize(opts.minFreeAfter))
+	if after < opts.minFreeAfter {
+		return fmt.Errorf("backing up could leave %s free in %s, under the --min-free-after of %s", formatSize(max(after, 0)), opts.outputDir, formatSize(opts.minFreeAfter))
+	}
+	return nil
+}
+
+// rotationPlan returns the keys rotation would delete from dest for each PVC, deleting
+// nothing. pending holds archives about to be uploaded, by PVC name; they count as each
+// PVC's newest backup, so a dry run previews what the real run deletes after uploading.
+// The archives latest.json points at (or will, once pending are uploaded) and their
+// sidecars are never deleted.
+func rotationPlan(ctx context.Context, dest store.Store, opts options, namespace, release string, pvcs []types.PVCInfo, pending map[string]r2.ObjectInfo) (map[string][]string, error) {
+	listed, err := pvcObjects(ctx, dest, opts.keyFormat(), namespace, release, pvcNames(pvcs))
+	if err != nil {
+		return nil, err
+	}
+	latest, err := dest.GetLatest(ctx, latestKey(opts, namespace, release))
+	if err != nil {
+		return nil, err
+	}
+	pointed := make(map[string]string)
+	if latest != nil {
+		maps.Copy(pointed, latest.PVCs)
+	}
+	for name, obj := range pending {
+		pointed[name] = obj.Key
+	}
+	plan := make(map[string][]string, len(pvcs))
+	for _, pvc := range pvcs {
+		// The listing can cover other PVCs, so narrow to this PVC's archives and sidecars
+		allObjects := listed[pvc.PVCName]
+		objects := filterR2Objects(allObjects, buildR2Pattern(opts.keyFormat(), namespace, release, pvc.PVCName, opts.archiveSuffix))
+		objects = append(objects, sidecarsOf(allObjects, objects)...)
+		if obj, ok := pending[pvc.PVCName]; ok {
+			objects = append(objects, obj)
+		}
+		slices.SortStableFunc(objects, func(a, b r2.ObjectInfo) int { return b.LastModified.Compare(a.LastModified) })
+		keep := pointed[pvc.PVCName]
+		plan[pvc.PVCName] = slices.DeleteFunc(store.Plan(objects, opts.retention(), opts.archiveSuffix, time.Now()), func(key string) bool {
+			return keep != "" && (key == keep || key == keep+r2.SidecarSuffix)
+		})
+	}
+	return plan, nil
+}
+
+// printRotationPreview lists what rotation would delete after uploading a new archive for
+// each of pvcs. Listing failures are reported but don't fail the dry run.
+func printRotationPreview(ctx context.Context, opts options, namespace, release string, pvcs []types.PVCInfo) {
+	w := opts.output()
+	dest, err := openStore(opts)
+	if err != nil {
+		fmt.Fprintf(w, "  (cannot preview: %v)\n", err)
+		return
+	}
+	pending := make(map[string]r2.ObjectInfo, len(pvcs))
+	for _, pvc := range pvcs {
+		key := backup.FormatName(opts.keyFormat(), namespace, release, pvc.PVCName, pvc.StorageClass)
+		if !opts.objectPerFile {
+			key += opts.archiveSuffix
+		}
+		pending[pvc.PVCName] = r2.ObjectInfo{Key: key, LastModified: time.Now()}
+	}
+	plan, err := rotationPlan(ctx, dest, opts, namespace, release, pvcs, pending)
+	if err != nil {
+		fmt.Fprintf(w, "  (cannot preview: %v)\n", err)
+		return
+	}
+	for _, pvc := range pvcs {
+		keys, locked := store.SkipLocked(ctx, dest, plan[pvc.PVCName], time.Now())
+		if len(keys) == 0 && len(locked) == 0 {
+			fmt.Fprintf(w, "  - %s: nothing to delete\n", pvc.PVCName)
+		}
+		for _, key := range keys {
+			fmt.Fprintf(w, "  - %s: delete %s\n", pvc.PVCName, dest.ObjectURL(key))
+		}
+		for _, obj := range locked {
+			fmt.Fprintf(w, "  - %s: keep %s (%s)\n", pvc.PVCName, dest.ObjectURL(obj.Key), lockReason(obj))
+		}
+	}
+}
+
+// lockReason says what keeps a backup that rotation would delete.
+func lockReason(obj r2.ObjectInfo) string {
+	if obj.LegalHold {
+		return "legal hold"
+	}
+	return "object lock until " + obj.RetainUntil.Format(time.RFC3339)
+}
+
+// usesZstd reports whether any archive of a backup is compressed with zstd, the only codec
+// --compression-dict applies to.
+func usesZstd(opts options) bool {
+	if _, ext := backup.SplitArchiveExtension(opts.outputFormat); strings.EqualFold(ext, ".tar.zst") || strings.EqualFold(ext, ".tzst") {
+		return true
+	}
+	for _, po := range opts.pvcOpts {
+		if po.Compression == backup.CompressionZstd {
+			return true
+		}
+	}
+	return false
+}
+
+// zstdDict returns the dictionary at path, training it from the host paths of pvcs that
+// are within --allowed-path-roots and saving it there when there is none yet. An earlier
+// release of the same run may have written it since main checked, or a parallel --target
+// may save its own first, which is then the one to use.
+func zstdDict(w io.Writer, path string, pvcs []types.PVCInfo, roots []string) (*backup.ZstdDict, error) {
+	if _, err := os.Stat(path); err == nil {
+		return backup.LoadZstdDict(path)
+	}
+	dirs := make([]string, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		// The backup refuses the others, so training must not read them either
+		if err := backup.CheckPathRoots(roots, pvc.HostPath); err == nil {
+			dirs = append(dirs, pvc.HostPath)
+		}
+	}
+	dict, err := backup.TrainZstdDict(dirs)
+	if err != nil {
+		return nil, err
+	}
+	if err := dict.Save(path); errors.Is(err, fs.ErrExist) {
+		return backup.LoadZstdDict(path)
+	} else if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "Trained zstd dictionary %d from %d PVC(s) and saved it to %s; keep it, restores need it\n", dict.ID, len(dirs), path)
+	return dict, nil
+}
+
+// backupOptions maps flags onto Backuper options, and onto the archive options that
+// backup and restore share.
+func backupOptions(opts options) []backup.Option {
+	var bopts []backup.Option
+	if opts.allowedRoot != "" {
+		bopts = append(bopts, backup.WithAllowedRoot(opts.allowedRoot))
+	}
+	if opts.strictPaths {
+		bopts = append(bopts, backup.WithStrictPaths())
+	}
+	if len(opts.pathRoots) > 0 {
+		bopts = append(bopts, backup.WithAllowedPathRoots(opts.pathRoots...))
+	}
+	if opts.pvcTimeout > 0 {
+		bopts = append(bopts, backup.WithPVCTimeout(opts.pvcTimeout))
+	}
+	if opts.readOnly {
+		bopts = append(bopts, backup.WithReadOnlySnapshot())
+	}
+	if opts.failFast {
+		bopts = append(bopts, backup.WithFailFast())
+	}
+	if opts.parallel > 1 {
+		bopts = append(bopts, backup.WithParallel(opts.parallel))
+	}
+	if opts.outputDir == stdoutDir {
+		bopts = append(bopts, backup.WithOutput(os.Stdout))
+	}
+	// Every checksum mode except none needs the archive's SHA-256
+	if opts.checksumMode != r2.ChecksumNone && opts.checksumMode != "" {
+		bopts = append(bopts, backup.WithChecksum())
+	}
+	// --pvc-opts overrides codec and encryption per PVC
+	if len(opts.pvcOpts) > 0 {
+		bopts = append(bopts, backup.WithPVCOptions(opts.pvcOpts))
+	}
+	if opts.nameTemplate != nil {
+		bopts = append(bopts, backup.WithNameTemplate(opts.nameTemplate))
+	}
+	if opts.dateSource != "" && opts.dateSource != backup.DateNow {
+		bopts = append(bopts, backup.WithDateSource(opts.dateSource))
+	}
+	// --checksum-mode embedded also writes a per-file manifest into the archive. The
+	// encrypter of --kms or --encrypt-recipient decrypts on restore as well.
+	archive := backup.ArchiveOptions{
+		Manifest:         opts.checksumMode == r2.ChecksumEmbedded,
+		Encrypter:        opts.encrypter,
+		TarFormat:        opts.tarFormat,
+		MemoryLimit:      opts.memLimit,
+		Xattrs:           opts.xattrs,
+		Owner:            opts.owner,
+		ModeMask:         opts.modeMask,
+		Reproducible:     opts.reproducible,
+		StreamBuffer:     opts.streamBuffer,
+		Dict:             opts.dict,
+		ExcludeEmptyDirs: opts.excludeEmpty,
+		ParallelGzip:     opts.parallelGzip,
+		OneFileSystem:    opts.oneFileSystem,
+		Level:            opts.compressLevel,
+		Exclude:          opts.exclude,
+		Suffix:           opts.archiveSuffix,
+	}
+	if archive != (backup.ArchiveOptions{}) {
+		bopts = append(bopts, backup.WithArchiveOptions(archive))
+	}
+	return bopts
+}
+
+// splitCSI separates the PVCs on CSI volumes from the rest, keeping their order.
+func splitCSI(pvcs []types.PVCInfo) (csi, rest []types.PVCInfo) {
+	for _, pvc := range pvcs {
+		if pvc.CSIDriver != "" {
+			csi = append(csi, pvc)
+		} else {
+			rest = append(rest, pvc)
+		}
+	}
+	return csi, rest
+}
+
+// takeSnapshots takes a VolumeSnapshot of each of pvcs, recording the ones taken in rel,
+// and returns the names of the PVCs snapshotted. The others are archived the usual way.
+func takeSnapshots(ctx context.Context, opts options, rel *releaseReport, pvcs []types.PVCInfo) map[string]bool {
+	w := opts.output()
+	fmt.Fprintf(w, "\nTaking VolumeSnapshots of %d CSI PVC(s)...\n", len(pvcs))
+	now := time.Now()
+	taken := make(map[string]bool)
+	for _, pvc := range pvcs {
+		name := snapshot.Name(pvc.PVCName, now)
+		if err := opts.snapshotter.Create(ctx, pvc, name); err != nil {
+			log.Printf("WARNING: snapshotting %s failed, archiving it instead: %v", pvc.PVCName, err)
+			continue
+		}
+		fmt.Fprintf(w, "  SNAP  %s -> VolumeSnapshot %s/%s\n", pvc.PVCName, pvc.Namespace, name)
+		rel.Snapshots = append(rel.Snapshots, pvc.Namespace+"/"+name)
+		taken[pvc.PVCName] = true
+	}
+	return taken
+}
+
+// newDiscoverer returns the Discoverer for a run, matching PVCs by every --label-key.
+func newDiscoverer(client kubernetes.Interface, opts options) *discovery.Discoverer {
+	return discovery.New(client, opts.verbose, discovery.WithLabelKeys(opts.labelKeys...))
+}
+
+// newScaler returns the Scaler for a run, pausing HPAs with --handle-hpa and leaving the
+// --scale-to replicas running.
+func newScaler(client kubernetes.Interface, opts options) *scaler.Scaler {
+	var sopts []scaler.Option
+	if opts.handleHPA {
+		sopts = append(sopts, scaler.WithHPAHandling())
+	}
+	if len(opts.scaleTargets) > 0 {
+		sopts = append(sopts, scaler.WithScaleTargets(opts.scaleTargets))
+	}
+	if opts.readyKey != "" {
+		sopts = append(sopts, scaler.WithReadyAnnotation(opts.readyKey, opts.readyValue))
+	}
+	if opts.postDelay > 0 {
+		sopts = append(sopts, scaler.WithPostReadyDelay(opts.postDelay))
+	}
+	return scaler.New(client, opts.verbose, sopts...)
+}
 
-		if keepLast > 0 {
-			fmt.Printf("\n=== R2 Rotation (keep last %d) ===\n", keepLast)
-			for _, pvc := range pvcs {
-				prefix := buildR2Prefix(outputFormat, namespace, release, pvc.PVCName)
-				allObjects, err := r2Client.ListByPrefix(ctx, prefix)
-				if err != nil {
-					fmt.Printf("  FAIL  %s: %v\n", pvc.PVCName, err)
-					continue
-				}
-				objects := filterR2Objects(allObjects, buildR2Pattern(outputFormat, namespace, release, pvc.PVCName))
-				if len(objects) <= keepLast {
-					continue
-				}
-				for _, obj := range objects[keepLast:] {
-					if err := r2Client.Delete(ctx, obj.Key); err != nil {
-						fmt.Printf("  FAIL  %s: %v\n", obj.Key, err)
-					} else {
-						fmt.Printf("  DEL   %s\n", obj.Key)
-					}
-				}
-			}
+// warnHPAs warns about each workload an HPA scales, unless --handle-hpa pauses them.
+func warnHPAs(workloads []*types.WorkloadInfo, opts options) {
+	if opts.handleHPA {
+		return
+	}
+	for _, w := range workloads {
+		if w.HPA != "" {
+			log.Printf("WARNING: %s/%s is scaled by HPA %s, which may scale it back up while it should be at 0; pass --handle-hpa to pause it", w.Kind, w.Name, w.HPA)
 		}
 	}
-
-	return nil
 }
 
 func uniqueWorkloads(pvcs []types.PVCInfo) []*types.WorkloadInfo {
@@ -258,35 +2983,211 @@ func uniqueWorkloads(pvcs []types.PVCInfo) []*types.WorkloadInfo {
 	return result
 }
 
-func printDryRun(pvcs []types.PVCInfo, workloads []*types.WorkloadInfo, outputDir, outputFormat, namespace, release, r2Credentials string, keepLast int) {
-	fmt.Println("\n=== DRY RUN ===")
-	if len(workloads) > 0 {
-		fmt.Println("\nWould scale down:")
-		for _, w := range workloads {
-			fmt.Printf("  - %s/%s (currently %d replicas)\n", w.Kind, w.Name, w.OriginalReplicas)
+// orderPVCs returns items reordered so that PVCs named in order come first, in that order.
+// Everything else keeps its original relative order after them. Names not present are ignored.
+func orderPVCs[T any](items []T, order []string, pvcName func(T) string) []T {
+	if len(order) == 0 {
+		return items
+	}
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		if _, dup := rank[name]; !dup {
+			rank[name] = i
+		}
+	}
+	sorted := slices.Clone(items)
+	slices.SortStableFunc(sorted, func(a, b T) int {
+		ra, okA := rank[pvcName(a)]
+		rb, okB := rank[pvcName(b)]
+		switch {
+		case okA && okB:
+			return ra - rb
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// skippedPVC is a discovered PVC that was left out of the working set, with the reason why.
+type skippedPVC struct {
+	pvc    types.PVCInfo
+	reason string
+}
+
+// filterByWorkload drops orphan PVCs (no mounting workload) when excludeOrphans is set, or
+// everything but orphans when onlyOrphans is set. With neither, all PVCs are kept.
+func filterByWorkload(pvcs []types.PVCInfo, excludeOrphans, onlyOrphans bool) ([]types.PVCInfo, []skippedPVC) {
+	if !excludeOrphans && !onlyOrphans {
+		return pvcs, nil
+	}
+
+	var kept []types.PVCInfo
+	var skipped []skippedPVC
+	for _, pvc := range pvcs {
+		switch {
+		case excludeOrphans && pvc.Workload == nil:
+			skipped = append(skipped, skippedPVC{pvc: pvc, reason: "no workload mounts it (--exclude-pvc-without-workload)"})
+		case onlyOrphans && pvc.Workload != nil:
+			reason := fmt.Sprintf("mounted by %s/%s (--only-orphans)", pvc.Workload.Kind, pvc.Workload.Name)
+			skipped = append(skipped, skippedPVC{pvc: pvc, reason: reason})
+		default:
+			kept = append(kept, pvc)
+		}
+	}
+	return kept, skipped
+}
+
+// requireWorkloads fails for --require-workload when a PVC selected for backup is an
+// orphan, naming every orphan.
+func requireWorkloads(pvcs []types.PVCInfo) error {
+	var orphans []string
+	for _, pvc := range pvcs {
+		if pvc.Workload == nil {
+			orphans = append(orphans, pvc.PVCName)
 		}
 	}
-	fmt.Println("\nWould create archives:")
+	if len(orphans) > 0 {
+		return fmt.Errorf("--require-workload: no workload mounts %d selected PVC(s): %s", len(orphans), strings.Join(orphans, ", "))
+	}
+	return nil
+}
+
+// filterByOrdinal keeps the per-ordinal PVCs of StatefulSets (discovery.Ordinal) whose
+// ordinal is one of ordinals. Every other PVC is kept.
+func filterByOrdinal(pvcs []types.PVCInfo, ordinals []int) ([]types.PVCInfo, []skippedPVC) {
+	var kept []types.PVCInfo
+	var skipped []skippedPVC
 	for _, pvc := range pvcs {
-		name := backup.FormatName(outputFormat, namespace, release, pvc.PVCName)
-		fmt.Printf("  - %s -> %s\n", pvc.HostPath, filepath.Join(outputDir, name))
+		n, ok := discovery.Ordinal(pvc)
+		if ok && !slices.Contains(ordinals, n) {
+			reason := fmt.Sprintf("ordinal %d of StatefulSet %s is not in --ordinals", n, pvc.Workload.Name)
+			skipped = append(skipped, skippedPVC{pvc: pvc, reason: reason})
+			continue
+		}
+		kept = append(kept, pvc)
+	}
+	return kept, skipped
+}
+
+// warnPartialStatefulSets warns about StatefulSets that --ordinals backs up only some
+// ordinals of: a StatefulSet scales down as a whole, so the other ordinals stop too.
+func warnPartialStatefulSets(kept []types.PVCInfo, skipped []skippedPVC) {
+	warned := make(map[string]bool)
+	for _, sk := range skipped {
+		w := sk.pvc.Workload
+		key := w.Namespace + "/" + w.Name
+		partial := slices.ContainsFunc(kept, func(p types.PVCInfo) bool {
+			return p.Workload != nil && p.Workload.Kind == w.Kind && p.Workload.Namespace == w.Namespace && p.Workload.Name == w.Name
+		})
+		if partial && !warned[key] {
+			log.Printf("WARNING: StatefulSet %s is scaled to 0 as a whole, so its ordinals left out by --ordinals stop during the backup too", key)
+			warned[key] = true
+		}
+	}
+}
+
+func printDryRun(ctx context.Context, pvcs, csi []types.PVCInfo, skipped []skippedPVC, workloads []*types.WorkloadInfo, opts options, namespace, release string) {
+	w := opts.output()
+	fmt.Fprintln(w, "\n=== DRY RUN ===")
+	if len(skipped) > 0 {
+		fmt.Fprintln(w, "\nWould skip:")
+		for _, sk := range skipped {
+			fmt.Fprintf(w, "  - %s: %s\n", sk.pvc.PVCName, sk.reason)
+		}
+	}
+	if len(csi) > 0 {
+		fmt.Fprintln(w, "\nWould take VolumeSnapshots of (archiving them instead if that fails):")
+		for _, pvc := range csi {
+			fmt.Fprintf(w, "  - %s (CSI driver %s)\n", pvc.PVCName, pvc.CSIDriver)
+		}
 	}
-	if r2Credentials != "" {
-		fmt.Println("\nWould upload to R2:")
+	printScalePlan(workloads, "backup", opts)
+	if opts.objectPerFile {
+		fmt.Fprintf(w, "\nWould store file by file in %s:\n", destName(opts))
 		for _, pvc := range pvcs {
-			name := backup.FormatName(outputFormat, namespace, release, pvc.PVCName)
-			fmt.Printf("  - %s\n", name)
+			name := backup.FormatName(opts.keyFormat(), namespace, release, pvc.PVCName, pvc.StorageClass)
+			fmt.Fprintf(w, "  - %s -> %s\n", pvc.HostPath, perfile.Prefix(name))
 		}
-		if keepLast > 0 {
-			fmt.Printf("\nWould rotate R2 backups (keep last %d per PVC)\n", keepLast)
+	} else {
+		printArchiveDryRun(pvcs, opts, namespace, release)
+	}
+	if opts.minFreeAfter > 0 {
+		fmt.Fprintln(w)
+		if err := checkMinFreeAfter(pvcs, opts); err != nil {
+			fmt.Fprintf(w, "  Would fail: %v\n", err)
 		}
 	}
-	if len(workloads) > 0 {
-		fmt.Println("\nWould restore replicas:")
-		for _, w := range workloads {
-			fmt.Printf("  - %s/%s -> %d replicas\n", w.Kind, w.Name, w.OriginalReplicas)
+	if (opts.useR2() || opts.dest != "") && opts.retention().Enabled() {
+		fmt.Fprintf(w, "\nWould rotate %s backups (%s per PVC):\n", destName(opts), opts.retention())
+		printRotationPreview(ctx, opts, namespace, release, pvcs)
+	}
+}
+
+// printScalePlan shows the replicas each workload goes through around phase (backup or
+// restore), e.g. "Deployment/web: 3 -> 0 (backup) -> 3 (after)". Workloads already at 0
+// and ones an HPA scales, which may undo the scale-down unless handleHPA, are flagged.
+func printScalePlan(workloads []*types.WorkloadInfo, phase string, opts options) {
+	if len(workloads) == 0 {
+		return
+	}
+	fmt.Fprintln(opts.output(), "\nWould scale:")
+	for _, w := range workloads {
+		target := opts.scaleTargets[scaler.TargetKey(w)]
+		line := fmt.Sprintf("  - %s/%s: %d -> %d (%s) -> %d (after)", w.Kind, w.Name, w.OriginalReplicas, target, phase, w.OriginalReplicas)
+		switch {
+		case w.OriginalReplicas == 0:
+			line = fmt.Sprintf("  - %s/%s: 0, already scaled down (no-op)", w.Kind, w.Name)
+		case w.OriginalReplicas <= target:
+			line = fmt.Sprintf("  - %s/%s: %d, already at most --scale-to %d (no-op)", w.Kind, w.Name, w.OriginalReplicas, target)
 		}
+		switch {
+		case w.HPA != "" && opts.handleHPA:
+			line += fmt.Sprintf("; HPA %s paused meanwhile", w.HPA)
+		case w.HPA != "":
+			line += fmt.Sprintf("; HPA %s may scale it back up", w.HPA)
+		}
+		fmt.Fprintln(opts.output(), line)
+	}
+}
+
+// printArchiveDryRun lists the archives a backup would create and upload.
+func printArchiveDryRun(pvcs []types.PVCInfo, opts options, namespace, release string) {
+	w := opts.output()
+	fmt.Fprintln(w, "\nWould create archives:")
+	for _, pvc := range pvcs {
+		name := archiveName(opts, namespace, release, pvc) + opts.archiveSuffix
+		dst := filepath.Join(opts.outputDir, name)
+		if opts.outputDir == stdoutDir {
+			dst = "stdout (" + name + ")"
+		} else if opts.stream {
+			dst = "streamed, not written to disk (" + name + ")"
+		}
+		fmt.Fprintf(w, "  - %s -> %s\n", pvc.HostPath, dst)
+	}
+	if opts.useR2() || opts.dest != "" {
+		fmt.Fprintf(w, "\nWould upload to %s:\n", destName(opts))
+		for _, pvc := range pvcs {
+			name := archiveName(opts, namespace, release, pvc) + opts.archiveSuffix
+			fmt.Fprintf(w, "  - %s\n", name)
+		}
+	}
+}
+
+// archiveName is the name a backup of pvc taken now would get, before any --pvc-opts
+// codec, encryption or archive suffix. A template that fails for pvc shows its error.
+func archiveName(opts options, namespace, release string, pvc types.PVCInfo) string {
+	if opts.nameTemplate == nil {
+		return backup.FormatName(opts.outputFormat, namespace, release, pvc.PVCName, pvc.StorageClass)
 	}
+	name, err := opts.nameTemplate.Execute(backup.NewNameData(pvc, namespace, release))
+	if err != nil {
+		return fmt.Sprintf("(%v)", err)
+	}
+	return name
 }
 
 func formatSize(bytes int64) string {
@@ -307,83 +3208,102 @@ func formatSize(bytes int64) string {
 	}
 }
 
-func runRestore(ctx context.Context, client kubernetes.Interface, namespace, release, outputFormat, r2Credentials string, archives []string, dryRun, verbose bool) error {
-	disc := discovery.New(client, verbose)
-	sc := scaler.New(client, verbose)
-	bk := backup.New("", "", verbose)
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// combinedRestoreTasks restores every directory of each combined archive into the PVC it
+// is named after. A directory that matches no PVC fails the restore before anything is
+// changed, or is skipped with a warning under --skip-missing.
+func combinedRestoreTasks(opts options, bk *backup.Backuper, pvcs []types.PVCInfo, archives []string) ([]restoreTask, error) {
+	var tasks []restoreTask
+	fmt.Fprintf(out, "Reading %d combined archive(s):\n", len(archives))
+	for _, archive := range archives {
+		subtrees, err := bk.CombinedSubtrees(archive)
+		if err != nil {
+			return nil, fmt.Errorf("reading archive %q: %w", archive, err)
+		}
+		matched, skipped, err := backup.MatchSubtrees(subtrees, pvcs, opts.skipMissing)
+		if err != nil {
+			return nil, fmt.Errorf("archive %q: %w (use --skip-missing to restore the rest)", filepath.Base(archive), err)
+		}
+		for _, name := range skipped {
+			log.Printf("WARNING: skipping %s/ of %s: no PVC %q in release %q", name, filepath.Base(archive), name, opts.release)
+		}
+		var names []string
+		for _, pvc := range matched {
+			names = append(names, pvc.PVCName)
+			tasks = append(tasks, restoreTask{archivePath: archive, pvc: pvc, subtree: pvc.PVCName})
+		}
+		if len(names) == 0 {
+			names = []string{"none"}
+		}
+		fmt.Fprintf(out, "  - %s -> PVC(s) %s\n", filepath.Base(archive), strings.Join(names, ", "))
+	}
+	return tasks, nil
+}
+
+func runRestore(ctx context.Context, client kubernetes.Interface, opts options, archives []string, rep *runReport) error {
+	namespace, release := opts.namespace, opts.release
+	rel := rep.add(namespace, release)
+	disc := newDiscoverer(client, opts)
+	sc := newScaler(client, opts)
+	bk := backup.New("", "", opts.verbose, backupOptions(opts)...)
 
 	// Step 1: Discover PVCs for the release
-	fmt.Printf("Discovering PVCs for release %q in namespace %q...\n", release, namespace)
+	fmt.Fprintf(out, "Discovering PVCs for release %q in namespace %q...\n", release, namespace)
+	rel.start(phaseDiscover)
 	pvcs, err := disc.Discover(ctx, namespace, release)
+	rel.set(phaseDiscover, err)
 	if err != nil {
 		return fmt.Errorf("discovery: %w", err)
 	}
+	if err := checkHostPaths(opts, pvcs); err != nil {
+		return err
+	}
+	if err := checkPlan(opts, rep, pvcs); err != nil {
+		return err
+	}
+	if err := opts.restoreAfter.check(pvcs, release); err != nil {
+		return err
+	}
 
 	pvcMap := make(map[string]types.PVCInfo)
 	for _, pvc := range pvcs {
 		pvcMap[pvc.PVCName] = pvc
 	}
 
+	if opts.verifyChecksum && !opts.useR2() && opts.dest == "" {
+		// Check every archive before the first volume is touched
+		for _, archive := range archives {
+			if err := verifyLocalChecksum(archive); err != nil {
+				return err
+			}
+		}
+	}
+
 	var tasks []restoreTask
-	var tmpDir string // for R2 downloads
 
-	if r2Credentials != "" {
-		creds, err := r2.LoadCredentials(r2Credentials)
+	if opts.useR2() || opts.dest != "" {
+		tmpDir, err := os.MkdirTemp("", "k8s-cf-backup-restore-*")
 		if err != nil {
-			return fmt.Errorf("r2 credentials: %w", err)
+			return fmt.Errorf("creating temp dir: %w", err)
 		}
-		r2Client, err := r2.New(creds, verbose)
+		defer os.RemoveAll(tmpDir)
+
+		rel.start(phaseDownload)
+		tasks, err = downloadRestoreArchives(ctx, opts, pvcs, pvcMap, archives, tmpDir)
+		rel.set(phaseDownload, err)
 		if err != nil {
 			return err
 		}
-
-		tmpDir, err = os.MkdirTemp("", "k8s-cf-backup-restore-*")
+	} else if opts.combined {
+		tasks, err = combinedRestoreTasks(opts, bk, pvcs, archives)
 		if err != nil {
-			return fmt.Errorf("creating temp dir: %w", err)
-		}
-		defer os.RemoveAll(tmpDir)
-
-		if len(archives) > 0 {
-			// R2 credentials + explicit keys: download those specific keys
-			fmt.Printf("Downloading %d archive(s) from R2...\n", len(archives))
-			for _, key := range archives {
-				pvcName, err := parseArchiveName(key, outputFormat, namespace, release)
-				if err != nil {
-					return fmt.Errorf("parsing R2 key %q: %w", key, err)
-				}
-				pvc, ok := pvcMap[pvcName]
-				if !ok {
-					return fmt.Errorf("PVC %q (from R2 key %q) not found in release %q", pvcName, key, release)
-				}
-				destPath := filepath.Join(tmpDir, key)
-				if err := r2Client.Download(ctx, key, destPath); err != nil {
-					return fmt.Errorf("downloading %q: %w", key, err)
-				}
-				fmt.Printf("  Downloaded %s\n", key)
-				tasks = append(tasks, restoreTask{archivePath: destPath, pvc: pvc})
-			}
-		} else {
-			// R2 credentials + no explicit keys: find latest per PVC
-			fmt.Println("Finding latest R2 backups per PVC...")
-			for _, pvc := range pvcs {
-				prefix := buildR2Prefix(outputFormat, namespace, release, pvc.PVCName)
-				allObjects, err := r2Client.ListByPrefix(ctx, prefix)
-				if err != nil {
-					return fmt.Errorf("listing R2 objects for %s: %w", pvc.PVCName, err)
-				}
-				objects := filterR2Objects(allObjects, buildR2Pattern(outputFormat, namespace, release, pvc.PVCName))
-				if len(objects) == 0 {
-					fmt.Printf("  SKIP  %s: no backups found in R2\n", pvc.PVCName)
-					continue
-				}
-				latest := objects[0] // sorted newest first
-				destPath := filepath.Join(tmpDir, latest.Key)
-				if err := r2Client.Download(ctx, latest.Key, destPath); err != nil {
-					return fmt.Errorf("downloading %q: %w", latest.Key, err)
-				}
-				fmt.Printf("  Downloaded %s (latest for %s)\n", latest.Key, pvc.PVCName)
-				tasks = append(tasks, restoreTask{archivePath: destPath, pvc: pvc})
-			}
+			return err
 		}
 	} else {
 		// Local file restore (unchanged path)
@@ -393,16 +3313,16 @@ func runRestore(ctx context.Context, client kubernetes.Interface, namespace, rel
 		}
 		var mappings []archiveMapping
 		for _, archive := range archives {
-			pvcName, err := parseArchiveName(archive, outputFormat, namespace, release)
+			pvcName, err := parseArchiveNameAny(backup.TrimArchiveSuffix(archive, opts.archiveSuffix), opts.archiveFormats(), namespace, release)
 			if err != nil {
 				return fmt.Errorf("parsing archive %q: %w", archive, err)
 			}
 			mappings = append(mappings, archiveMapping{path: archive, pvcName: pvcName})
 		}
 
-		fmt.Printf("Parsed %d archive(s):\n", len(mappings))
+		fmt.Fprintf(out, "Parsed %d archive(s):\n", len(mappings))
 		for _, m := range mappings {
-			fmt.Printf("  - %s -> PVC %s\n", filepath.Base(m.path), m.pvcName)
+			fmt.Fprintf(out, "  - %s -> PVC %s\n", filepath.Base(m.path), m.pvcName)
 		}
 
 		for _, m := range mappings {
@@ -415,13 +3335,15 @@ func runRestore(ctx context.Context, client kubernetes.Interface, namespace, rel
 	}
 
 	if len(tasks) == 0 {
-		fmt.Println("No archives to restore.")
+		fmt.Fprintln(out, "No archives to restore.")
 		return nil
 	}
 
-	fmt.Printf("Matched %d archive(s) to PVC(s):\n", len(tasks))
+	tasks = orderPVCs(tasks, opts.pvcOrder, func(t restoreTask) string { return t.pvc.PVCName })
+
+	fmt.Fprintf(out, "Matched %d archive(s) to PVC(s):\n", len(tasks))
 	for _, t := range tasks {
-		fmt.Printf("  - %s -> %s (host path: %s)\n", filepath.Base(t.archivePath), t.pvc.PVCName, t.pvc.HostPath)
+		fmt.Fprintf(out, "  - %s -> %s (host path: %s)\n", filepath.Base(t.archivePath), t.pvc.PVCName, t.pvc.HostPath)
 	}
 
 	// Collect workloads from matched PVCs
@@ -429,56 +3351,307 @@ func runRestore(ctx context.Context, client kubernetes.Interface, namespace, rel
 	for _, t := range tasks {
 		matchedPVCs = append(matchedPVCs, t.pvc)
 	}
+	if err := checkScaleTargets(opts, matchedPVCs); err != nil {
+		return err
+	}
 	workloads := uniqueWorkloads(matchedPVCs)
+	warnHPAs(workloads, opts)
 
-	if dryRun {
-		printRestoreDryRun(tasks, workloads)
+	if opts.dryRun {
+		printRestoreDryRun(tasks, workloads, opts)
 		return nil
 	}
 
 	// Scale down
 	if len(workloads) > 0 {
-		fmt.Printf("\nScaling down %d workload(s)...\n", len(workloads))
+		fmt.Fprintf(out, "\nScaling down %d workload(s)...\n", len(workloads))
 		defer func() {
-			fmt.Println("\nRestoring workload replicas...")
-			if err := sc.ScaleBack(ctx, workloads); err != nil {
-				log.Printf("WARNING: Failed to restore some workloads: %v", err)
+			fmt.Fprintln(out, "\nRestoring workload replicas...")
+			rel.start(phaseScaleBack)
+			err := sc.ScaleBack(ctx, workloads)
+			if err == nil && opts.waitReady {
+				fmt.Fprintln(out, "Waiting for workloads to become ready...")
+				err = sc.WaitReady(ctx, workloads)
+			}
+			rel.set(phaseScaleBack, err)
+			if err != nil {
+				log.Printf("ERROR: Failed to restore some workloads: %v", err)
 			} else {
-				fmt.Println("All workloads restored.")
+				fmt.Fprintln(out, "All workloads restored.")
 			}
 		}()
 
-		if err := sc.ScaleDown(ctx, workloads); err != nil {
+		rel.start(phaseScaleDown)
+		err := sc.ScaleDown(ctx, workloads)
+		rel.set(phaseScaleDown, err)
+		if err != nil {
 			return fmt.Errorf("scale down: %w", err)
 		}
-		fmt.Println("All workloads scaled to 0.")
+		fmt.Fprintln(out, "All workloads scaled down.")
 	}
 
 	// Restore each archive
-	fmt.Printf("\nRestoring %d PVC(s)...\n", len(tasks))
+	rel.start(phaseRestore)
+	fmt.Fprintf(out, "\nRestoring %d PVC(s)...\n", len(tasks))
+	restore := func(t restoreTask) types.RestoreResult {
+		fmt.Fprintf(out, "  Restoring %s -> %s\n", filepath.Base(t.archivePath), t.pvc.HostPath)
+		// Restore clears the host path: make sure it is still this PVC's volume
+		if err := disc.Verify(ctx, t.pvc); err != nil {
+			return types.RestoreResult{
+				PVCName:     t.pvc.PVCName,
+				ArchivePath: t.archivePath,
+				TargetDir:   t.pvc.HostPath,
+				Err:         fmt.Errorf("not restoring into %s, it may belong to another volume now: %w", t.pvc.HostPath, err),
+			}
+		}
+		if t.perFile {
+			if err := backup.CheckPathRoots(opts.pathRoots, t.pvc.HostPath); err != nil {
+				return types.RestoreResult{PVCName: t.pvc.PVCName, ArchivePath: t.archivePath, TargetDir: t.pvc.HostPath, Err: err}
+			}
+			return restorePerFile(ctx, opts, t)
+		}
+		return bk.RestoreSubtree(t.pvc, t.archivePath, t.subtree)
+	}
+	var results []types.RestoreResult
+	if len(opts.restoreAfter) > 0 {
+		results = runOrdered(tasks, opts.restoreAfter, restore)
+	} else {
+		for _, t := range tasks {
+			results = append(results, restore(t))
+		}
+	}
+
+	// Report
+	fmt.Fprintln(out, "\n=== Restore Summary ===")
 	var hasError bool
-	for _, t := range tasks {
-		fmt.Printf("  Restoring %s -> %s\n", filepath.Base(t.archivePath), t.pvc.HostPath)
-		if err := bk.RestoreOne(t.archivePath, t.pvc.HostPath); err != nil {
-			fmt.Printf("  FAIL  %s: %v\n", t.pvc.PVCName, err)
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(out, "  FAIL  %s: %v\n", r.PVCName, r.Err)
 			hasError = true
 		} else {
-			fmt.Printf("  OK    %s\n", t.pvc.PVCName)
+			fmt.Fprintf(out, "  OK    %s <- %s (%d file(s), %s in %s)\n", r.PVCName, filepath.Base(r.ArchivePath), r.Files, formatSize(r.Bytes), formatDuration(r.Duration))
+			rel.PVCs = append(rel.PVCs, r.PVCName)
+			rel.Bytes += r.Bytes
 		}
 	}
 
-	// Report
-	fmt.Println("\n=== Restore Summary ===")
-	for _, t := range tasks {
-		fmt.Printf("  %s -> %s\n", filepath.Base(t.archivePath), t.pvc.PVCName)
+	if hasError {
+		err := fmt.Errorf("some restores failed (see above)")
+		rel.set(phaseRestore, err)
+		return err
 	}
+	rel.set(phaseRestore, nil)
+	return nil
+}
 
-	if hasError {
-		return fmt.Errorf("some restores failed (see above)")
+// restorePerFile replaces the host path of t.pvc with the --object-per-file snapshot under
+// t.archivePath.
+func restorePerFile(ctx context.Context, opts options, t restoreTask) types.RestoreResult {
+	result := types.RestoreResult{PVCName: t.pvc.PVCName, ArchivePath: t.archivePath, TargetDir: t.pvc.HostPath}
+	dest, err := openStore(opts)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	start := time.Now()
+	result.Files, result.Bytes, result.Err = perfile.Restore(ctx, dest, t.archivePath, t.pvc.HostPath, opts.verbose)
+	result.Duration = time.Since(start)
+	return result
+}
+
+// downloadRestoreArchives fetches the archives to restore from R2 or --dest into tmpDir.
+// Without explicit keys the newest backup of each PVC is downloaded.
+func downloadRestoreArchives(ctx context.Context, opts options, pvcs []types.PVCInfo, pvcMap map[string]types.PVCInfo, archives []string, tmpDir string) ([]restoreTask, error) {
+	namespace, release := opts.namespace, opts.release
+	dest, err := openStore(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []restoreTask
+	if len(archives) > 0 {
+		// R2 credentials + explicit keys: download those specific keys
+		fmt.Fprintf(out, "Downloading %d archive(s) from %s...\n", len(archives), destName(opts))
+		for _, key := range archives {
+			pvcName, err := parseArchiveNameAny(backup.TrimArchiveSuffix(key, opts.archiveSuffix), opts.archiveFormats(), namespace, release)
+			if err != nil {
+				return nil, fmt.Errorf("parsing R2 key %q: %w", key, err)
+			}
+			pvc, ok := pvcMap[pvcName]
+			if !ok {
+				return nil, fmt.Errorf("PVC %q (from R2 key %q) not found in release %q", pvcName, key, release)
+			}
+			destPath := filepath.Join(tmpDir, key)
+			if err := requireChecksum(ctx, dest, opts, key); err != nil {
+				return nil, err
+			}
+			if err := dest.Download(ctx, key, destPath); err != nil {
+				return nil, fmt.Errorf("downloading %q: %w", key, err)
+			}
+			fmt.Fprintf(out, "  Downloaded %s\n", key)
+			tasks = append(tasks, restoreTask{archivePath: destPath, pvc: pvc})
+		}
+	} else {
+		// R2 credentials + no explicit keys: pick --restore-version (latest by default) per PVC
+		selector := versionSelector(opts.restoreVersion)
+		fmt.Fprintf(out, "Finding %s %s backups per PVC...\n", selector, destName(opts))
+		versions, err := pvcVersions(ctx, dest, opts, pvcNames(pvcs))
+		if err != nil {
+			return nil, err
+		}
+		var chosen []restoreChoice
+		for _, pvc := range pvcs {
+			objects := versions[pvc.PVCName]
+			if len(objects) == 0 {
+				fmt.Fprintf(out, "  SKIP  %s: no backups found in %s\n", pvc.PVCName, destName(opts))
+				continue
+			}
+			if opts.restoreVersion >= len(objects) {
+				fmt.Fprintf(out, "  SKIP  %s: no %s backup, only %d found in %s\n", pvc.PVCName, selector, len(objects), destName(opts))
+				continue
+			}
+			obj, ok := usableVersion(ctx, dest, objects[opts.restoreVersion:]) // sorted newest first
+			if !ok {
+				fmt.Fprintf(out, "  SKIP  %s: no usable %s or older backup in %s\n", pvc.PVCName, selector, destName(opts))
+				continue
+			}
+			chosen = append(chosen, restoreChoice{pvc: pvc, obj: obj})
+		}
+		if opts.restoreAll {
+			printRestoreAllPlan(chosen)
+		}
+		for _, c := range chosen {
+			pvc, obj := c.pvc, c.obj
+			if opts.objectPerFile {
+				// Snapshots are fetched file by file straight into the host path
+				fmt.Fprintf(out, "  Found %s (%s for %s)\n", perfile.Prefix(obj.Key), selector, pvc.PVCName)
+				tasks = append(tasks, restoreTask{archivePath: perfile.Prefix(obj.Key), pvc: pvc, perFile: true})
+				continue
+			}
+			destPath := filepath.Join(tmpDir, obj.Key)
+			if err := requireChecksum(ctx, dest, opts, obj.Key); err != nil {
+				return nil, err
+			}
+			if err := dest.Download(ctx, obj.Key, destPath); err != nil {
+				return nil, fmt.Errorf("downloading %q: %w", obj.Key, err)
+			}
+			if from := obj.Labels.Release; from != "" && from != release {
+				fmt.Fprintf(out, "  Downloaded %s (%s for %s, backed up as release %q)\n", obj.Key, selector, pvc.PVCName, from)
+			} else {
+				fmt.Fprintf(out, "  Downloaded %s (%s for %s)\n", obj.Key, selector, pvc.PVCName)
+			}
+			tasks = append(tasks, restoreTask{archivePath: destPath, pvc: pvc})
+		}
+	}
+
+	return tasks, nil
+}
+
+// requireChecksum fails, with --verify-checksum, for an archive that has no SHA-256
+// recorded in its metadata or a sidecar. Download verifies the ones that do.
+func requireChecksum(ctx context.Context, dest store.Store, opts options, key string) error {
+	if !opts.verifyChecksum {
+		return nil
+	}
+	info, err := dest.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("checking %q for a checksum: %w", key, err)
+	}
+	if info.SHA256 != "" {
+		return nil
+	}
+	if _, err := dest.Stat(ctx, key+r2.SidecarSuffix); err == nil {
+		return nil
+	}
+	return fmt.Errorf("%q has no recorded SHA-256 to verify (back up with --checksum-mode sidecar or metadata)", key)
+}
+
+// verifyLocalChecksum checks a local archive against the <archive>.sha256 file next to
+// it, for --verify-checksum.
+func verifyLocalChecksum(archive string) error {
+	data, err := os.ReadFile(archive + r2.SidecarSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s has no %s next to it to verify", filepath.Base(archive), filepath.Base(archive)+r2.SidecarSuffix)
+	}
+	if err != nil {
+		return err
+	}
+	want := r2.SidecarSum(data)
+	sum, err := backup.FileSHA256(archive)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("%s: SHA-256 %s does not match %s in %s", filepath.Base(archive), sum, want, filepath.Base(archive)+r2.SidecarSuffix)
 	}
 	return nil
 }
 
+// restoreChoice is the backup picked to restore a PVC from.
+type restoreChoice struct {
+	pvc types.PVCInfo
+	obj r2.ObjectInfo
+}
+
+// printRestoreAllPlan shows what --restore-all is about to overwrite, before anything is
+// downloaded: each PVC, the key of the backup picked for it and its host path.
+func printRestoreAllPlan(chosen []restoreChoice) {
+	fmt.Fprintf(out, "\nRestore plan (%d PVC(s), latest backup each):\n", len(chosen))
+	for _, c := range chosen {
+		fmt.Fprintf(out, "  - %s: %s -> %s\n", c.pvc.PVCName, c.obj.Key, c.pvc.HostPath)
+	}
+	fmt.Fprintln(out)
+}
+
+// usableVersion returns the first of objects, newest first, that a Stat finds with the size
+// it was listed with. An object that has gone or changed since the listing is being
+// rotated away or still being uploaded; it is skipped for the next older one.
+func usableVersion(ctx context.Context, dest store.Store, objects []r2.ObjectInfo) (r2.ObjectInfo, bool) {
+	for _, obj := range objects {
+		info, err := dest.Stat(ctx, obj.Key)
+		switch {
+		case err != nil:
+			fmt.Fprintf(out, "  SKIP  %s: %v, trying the next older backup\n", obj.Key, err)
+		case info.Size != obj.Size:
+			fmt.Fprintf(out, "  SKIP  %s: listed with %d bytes but now holds %d, trying the next older backup\n", obj.Key, obj.Size, info.Size)
+		default:
+			return obj, true
+		}
+	}
+	return r2.ObjectInfo{}, false
+}
+
+// applyCompression replaces the archive extension of format with the one for compression,
+// appending it when format has none.
+func applyCompression(format, compression string) (string, error) {
+	ext, err := backup.CompressionExtension(compression)
+	if err != nil {
+		return "", err
+	}
+	base, oldExt := backup.SplitArchiveExtension(format)
+	if strings.EqualFold(oldExt, ".zip") {
+		return "", fmt.Errorf("--compression %s cannot be combined with a .zip --output-format", compression)
+	}
+	return base + ext, nil
+}
+
+// formatPattern quotes format as a regex with {namespace} and {release} filled in and
+// {storageClass} matching any class, as the class may have changed since a backup. Its
+// archive extension, if any, matches every recognised extension with or without an
+// encryption suffix and the archive suffix, so archives written with a different
+// --compression, encryption or --archive-suffix setting are still found.
+func formatPattern(format, namespace, release, suffix string) string {
+	base, ext := backup.SplitArchiveExtension(format)
+	pattern := regexp.QuoteMeta(base)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{namespace}"), regexp.QuoteMeta(namespace))
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{release}"), regexp.QuoteMeta(release))
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{storageClass}"), "[^/]+?")
+	if ext != "" {
+		pattern += backup.ArchiveExtensionPattern(suffix)
+	}
+	return pattern
+}
+
 // parseArchiveName extracts the PVC name from an archive filename using the output format pattern.
 // It replaces {namespace} and {release} with their known values, {date} with a wildcard,
 // and captures {pvc} via a regex group.
@@ -486,9 +3659,7 @@ func parseArchiveName(archivePath, format, namespace, release string) (string, e
 	filename := filepath.Base(archivePath)
 
 	// Escape the format as a regex literal, then replace placeholders
-	pattern := regexp.QuoteMeta(format)
-	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{namespace}"), regexp.QuoteMeta(namespace))
-	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{release}"), regexp.QuoteMeta(release))
+	pattern := formatPattern(format, namespace, release, "")
 	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{pvc}"), "(.+?)")
 	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{date}"), ".+")
 	pattern = "^" + pattern + "$"
@@ -506,52 +3677,128 @@ func parseArchiveName(archivePath, format, namespace, release string) (string, e
 	return matches[1], nil
 }
 
-func printRestoreDryRun(tasks []restoreTask, workloads []*types.WorkloadInfo) {
-	fmt.Println("\n=== DRY RUN ===")
-	if len(workloads) > 0 {
-		fmt.Println("\nWould scale down:")
-		for _, w := range workloads {
-			fmt.Printf("  - %s/%s (currently %d replicas)\n", w.Kind, w.Name, w.OriginalReplicas)
+// archiveFormats returns the formats archive names may follow on restore: --output-format,
+// then each --restore-format.
+func (o options) archiveFormats() []string {
+	return append([]string{o.outputFormat}, o.restoreFormats...)
+}
+
+// parseArchiveNameAny extracts the PVC name with the first of formats that the archive name
+// matches, so archives written under an older naming convention still restore.
+func parseArchiveNameAny(archivePath string, formats []string, namespace, release string) (string, error) {
+	var errs []error
+	for _, format := range formats {
+		pvcName, err := parseArchiveName(archivePath, format, namespace, release)
+		if err == nil {
+			return pvcName, nil
 		}
+		errs = append(errs, err)
 	}
-	fmt.Println("\nWould restore:")
+	return "", errors.Join(errs...)
+}
+
+func printRestoreDryRun(tasks []restoreTask, workloads []*types.WorkloadInfo, opts options) {
+	fmt.Fprintln(out, "\n=== DRY RUN ===")
+	printScalePlan(workloads, "restore", opts)
+	fmt.Fprintln(out, "\nWould restore:")
 	for _, t := range tasks {
-		fmt.Printf("  - %s -> %s (host path: %s)\n", filepath.Base(t.archivePath), t.pvc.PVCName, t.pvc.HostPath)
-	}
-	if len(workloads) > 0 {
-		fmt.Println("\nWould restore replicas:")
-		for _, w := range workloads {
-			fmt.Printf("  - %s/%s -> %d replicas\n", w.Kind, w.Name, w.OriginalReplicas)
-		}
+		fmt.Fprintf(out, "  - %s -> %s (host path: %s)\n", filepath.Base(t.archivePath), t.pvc.PVCName, t.pvc.HostPath)
 	}
 }
 
 // buildR2Prefix creates an S3 prefix for efficiently listing R2 objects.
-// It fills in the known placeholders, then truncates at {date} so the prefix matches
-// all date variants. Note: when {date} precedes {pvc} in the format, the prefix may
-// be broader than a single PVC — use buildR2Pattern to filter results precisely.
+// It fills in the known placeholders, then truncates at {date} or {storageClass} so the
+// prefix matches all their variants. Note: when either precedes {pvc} in the format, the
+// prefix may be broader than a single PVC — use buildR2Pattern to filter results precisely.
 func buildR2Prefix(outputFormat, namespace, release, pvcName string) string {
 	prefix := outputFormat
 	prefix = strings.ReplaceAll(prefix, "{namespace}", namespace)
 	prefix = strings.ReplaceAll(prefix, "{release}", release)
 	prefix = strings.ReplaceAll(prefix, "{pvc}", pvcName)
-	if idx := strings.Index(prefix, "{date}"); idx >= 0 {
-		prefix = prefix[:idx]
+	for _, p := range []string{"{date}", "{storageClass}"} {
+		if idx := strings.Index(prefix, p); idx >= 0 {
+			prefix = prefix[:idx]
+		}
 	}
 	return prefix
 }
 
 // buildR2Pattern creates a regex that matches R2 keys for a specific PVC,
-// regardless of placeholder order in the format template.
-func buildR2Pattern(outputFormat, namespace, release, pvcName string) *regexp.Regexp {
-	pattern := regexp.QuoteMeta(outputFormat)
-	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{namespace}"), regexp.QuoteMeta(namespace))
-	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{release}"), regexp.QuoteMeta(release))
+// regardless of placeholder order in the format template, with or without suffix.
+func buildR2Pattern(outputFormat, namespace, release, pvcName, suffix string) *regexp.Regexp {
+	pattern := formatPattern(outputFormat, namespace, release, suffix)
 	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{pvc}"), regexp.QuoteMeta(pvcName))
 	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{date}"), ".+")
 	return regexp.MustCompile("^" + pattern + "$")
 }
 
+// pvcObjects lists the objects of each named PVC of a release, newest first, keyed by PVC
+// name. A listing may include other objects, so callers still filter with buildR2Pattern.
+// When the format gives every PVC its own "directory" ({pvc}/ with no {date} before it, as
+// in {namespace}/{release}/{pvc}/{date}.tar.gz) a single grouped listing covers all PVCs;
+// flat formats like the default need one listing per PVC.
+func pvcObjects(ctx context.Context, dest store.Store, format, namespace, release string, names []string) (map[string][]r2.ObjectInfo, error) {
+	result := make(map[string][]r2.ObjectInfo, len(names))
+	if base, ok := groupPrefix(format, namespace, release); ok {
+		groups, err := store.ListGrouped(ctx, dest, base, "/")
+		if err != nil {
+			return nil, fmt.Errorf("listing objects under %q: %w", base, err)
+		}
+		for _, name := range names {
+			result[name] = groups[name]
+		}
+		return result, nil
+	}
+
+	for _, name := range names {
+		objects, err := dest.ListByPrefix(ctx, buildR2Prefix(format, namespace, release, name))
+		if err != nil {
+			return nil, fmt.Errorf("listing objects for %s: %w", name, err)
+		}
+		result[name] = objects
+	}
+	return result, nil
+}
+
+// groupPrefix returns the key prefix shared by all PVCs of a release when format puts {pvc}
+// in a path segment of its own, so objects can be grouped by that segment.
+func groupPrefix(format, namespace, release string) (string, bool) {
+	i := strings.Index(format, "{pvc}/")
+	if i < 0 || (i > 0 && format[i-1] != '/') {
+		return "", false
+	}
+	base := format[:i]
+	if strings.Contains(base, "{date}") || strings.Contains(base, "{storageClass}") {
+		return "", false
+	}
+	base = strings.ReplaceAll(base, "{namespace}", namespace)
+	base = strings.ReplaceAll(base, "{release}", release)
+	return base, true
+}
+
+func pvcNames(pvcs []types.PVCInfo) []string {
+	names := make([]string, len(pvcs))
+	for i, pvc := range pvcs {
+		names[i] = pvc.PVCName
+	}
+	return names
+}
+
+// sidecarsOf returns the checksum sidecars in all that belong to one of archives.
+func sidecarsOf(all, archives []r2.ObjectInfo) []r2.ObjectInfo {
+	want := make(map[string]bool, len(archives))
+	for _, obj := range archives {
+		want[obj.Key+r2.SidecarSuffix] = true
+	}
+	var sidecars []r2.ObjectInfo
+	for _, obj := range all {
+		if want[obj.Key] {
+			sidecars = append(sidecars, obj)
+		}
+	}
+	return sidecars
+}
+
 // filterR2Objects returns only the objects whose keys match the given pattern.
 func filterR2Objects(objects []r2.ObjectInfo, pattern *regexp.Regexp) []r2.ObjectInfo {
 	var filtered []r2.ObjectInfo
@@ -563,10 +3810,34 @@ func filterR2Objects(objects []r2.ObjectInfo, pattern *regexp.Regexp) []r2.Objec
 	return filtered
 }
 
-func buildClient(kubeconfig string) (kubernetes.Interface, error) {
+func buildClient(opts options) (kubernetes.Interface, error) {
+	config, err := buildConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// buildSnapshotter returns a Snapshotter on a dynamic client, which VolumeSnapshots need.
+func buildSnapshotter(opts options) (*snapshot.Snapshotter, error) {
+	config, err := buildConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.New(client, opts.verbose), nil
+}
+
+// buildConfig loads the REST config from --kubeconfig, in-cluster credentials or the default
+// kubeconfig, in that order, and applies --as/--as-group impersonation.
+func buildConfig(opts options) (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
+	kubeconfig := opts.kubeconfig
 	if kubeconfig != "" {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	} else {
@@ -583,7 +3854,13 @@ func buildClient(kubeconfig string) (kubernetes.Interface, error) {
 		return nil, err
 	}
 
-	return kubernetes.NewForConfig(config)
+	if opts.as != "" {
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: opts.as,
+			Groups:   opts.asGroups,
+		}
+	}
+	return config, nil
 }
 
 func init() {
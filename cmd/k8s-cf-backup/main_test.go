@@ -1,11 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/crypt"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/perfile"
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/snapshot"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestUniqueWorkloads(t *testing.T) {
@@ -68,6 +90,16 @@ func TestParseArchiveName_Default(t *testing.T) {
 	}
 }
 
+func TestParseArchiveName_DataDated(t *testing.T) {
+	// --archive-mtime-source newest-file can date an archive long before it was written
+	format := "{namespace}_{release}_{date}_{pvc}.tar.gz"
+	name := backup.FormatNameAt(format, "ns", "rel", "data", "", time.Date(2019, 2, 3, 4, 5, 6, 0, time.Local))
+	pvc, err := parseArchiveName(name, format, "ns", "rel")
+	if err != nil || pvc != "data" {
+		t.Errorf("parseArchiveName(%s) = %q, %v; want data", name, pvc, err)
+	}
+}
+
 func TestParseArchiveName_WithPath(t *testing.T) {
 	format := "{namespace}_{release}_{date}_{pvc}.tar.gz"
 	pvc, err := parseArchiveName("/tmp/backups/davai_davai-backend_20240315-093000_postgres-data.tar.gz", format, "davai", "davai-backend")
@@ -106,6 +138,45 @@ func TestParseArchiveName_WrongNamespace(t *testing.T) {
 	}
 }
 
+func TestParseArchiveNameAny_SecondaryFormat(t *testing.T) {
+	opts := options{
+		outputFormat:   "{namespace}/{release}/{pvc}/{date}.tar.gz",
+		restoreFormats: []string{"{namespace}-{release}-{pvc}.tar.gz", "{namespace}_{release}_{date}_{pvc}.tar.gz"},
+	}
+	archive := "davai_davai-backend_20240101-120000_redis-data.tar.gz"
+	if _, err := parseArchiveName(archive, opts.outputFormat, "davai", "davai-backend"); err == nil {
+		t.Fatal("archive unexpectedly matches the primary format")
+	}
+
+	pvc, err := parseArchiveNameAny(archive, opts.archiveFormats(), "davai", "davai-backend")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pvc != "redis-data" {
+		t.Errorf("pvc = %q, want %q", pvc, "redis-data")
+	}
+}
+
+func TestParseArchiveNameAny_PrimaryFirst(t *testing.T) {
+	// Both formats match; the primary one decides how the name is split
+	formats := []string{"{namespace}_{release}_{pvc}.tar.gz", "{namespace}_{release}_{date}_{pvc}.tar.gz"}
+	pvc, err := parseArchiveNameAny("ns_rel_20240101-120000_data.tar.gz", formats, "ns", "rel")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pvc != "20240101-120000_data" {
+		t.Errorf("pvc = %q, want %q", pvc, "20240101-120000_data")
+	}
+}
+
+func TestParseArchiveNameAny_NoMatch(t *testing.T) {
+	formats := []string{"{namespace}_{release}_{date}_{pvc}.tar.gz", "{namespace}/{release}/{pvc}/{date}.tar.gz"}
+	_, err := parseArchiveNameAny("random-file.txt", formats, "ns", "rel")
+	if err == nil {
+		t.Fatal("expected error when no format matches")
+	}
+}
+
 func TestBuildR2Prefix_Default(t *testing.T) {
 	prefix := buildR2Prefix("{namespace}_{release}_{date}_{pvc}.tar.gz", "davai", "davai-backend", "redis-data")
 	want := "davai_davai-backend_"
@@ -131,7 +202,7 @@ func TestBuildR2Prefix_NoDate(t *testing.T) {
 }
 
 func TestBuildR2Pattern_Default(t *testing.T) {
-	pattern := buildR2Pattern("{namespace}_{release}_{date}_{pvc}.tar.gz", "davai", "davai-backend", "redis-data")
+	pattern := buildR2Pattern("{namespace}_{release}_{date}_{pvc}.tar.gz", "davai", "davai-backend", "redis-data", "")
 	if !pattern.MatchString("davai_davai-backend_20240101-120000_redis-data.tar.gz") {
 		t.Error("pattern should match correct key")
 	}
@@ -141,7 +212,7 @@ func TestBuildR2Pattern_Default(t *testing.T) {
 }
 
 func TestBuildR2Pattern_Custom(t *testing.T) {
-	pattern := buildR2Pattern("backup-{release}-{date}-{pvc}.tar.gz", "ns", "myapp", "data-vol")
+	pattern := buildR2Pattern("backup-{release}-{date}-{pvc}.tar.gz", "ns", "myapp", "data-vol", "")
 	if !pattern.MatchString("backup-myapp-20240101-120000-data-vol.tar.gz") {
 		t.Error("pattern should match correct key")
 	}
@@ -151,7 +222,7 @@ func TestBuildR2Pattern_Custom(t *testing.T) {
 }
 
 func TestFilterR2Objects(t *testing.T) {
-	pattern := buildR2Pattern("{namespace}_{release}_{date}_{pvc}.tar.gz", "ns", "rel", "pvc-a")
+	pattern := buildR2Pattern("{namespace}_{release}_{date}_{pvc}.tar.gz", "ns", "rel", "pvc-a", "")
 	objects := []r2.ObjectInfo{
 		{Key: "ns_rel_20240101-120000_pvc-a.tar.gz", LastModified: time.Now()},
 		{Key: "ns_rel_20240101-120000_pvc-b.tar.gz", LastModified: time.Now()},
@@ -170,6 +241,22 @@ func TestFilterR2Objects(t *testing.T) {
 	}
 }
 
+func TestArchiveName(t *testing.T) {
+	pvc := types.PVCInfo{PVCName: "data", PVName: "pv-1", Node: "node-1"}
+	opts := options{outputFormat: "{namespace}_{release}_{pvc}.tar.gz"}
+	if got := archiveName(opts, "ns", "rel", pvc); got != "ns_rel_data.tar.gz" {
+		t.Errorf("archiveName(output format) = %q", got)
+	}
+	tmpl, err := backup.ParseNameTemplate(`{{.Node}}_{{.PVName | replace "-" ""}}_{{.StorageClass}}.tar`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.nameTemplate = tmpl
+	if got := archiveName(opts, "ns", "rel", pvc); got != "node-1_pv1_default.tar" {
+		t.Errorf("archiveName(template) = %q, want node-1_pv1_default.tar", got)
+	}
+}
+
 func TestFormatSize(t *testing.T) {
 	tests := []struct {
 		input int64
@@ -191,3 +278,1810 @@ func TestFormatSize(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		input time.Duration
+		want  string
+	}{
+		{0, "0s"},
+		{1234 * time.Millisecond, "1.2s"},
+		{59*time.Second + 960*time.Millisecond, "1m0s"},
+		{3*time.Minute + 25400*time.Millisecond, "3m25s"},
+	}
+
+	for _, tc := range tests {
+		got := formatDuration(tc.input)
+		if got != tc.want {
+			t.Errorf("formatDuration(%v) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestGroupByRelease(t *testing.T) {
+	pvcs := []types.PVCInfo{
+		{Namespace: "alpha", Release: "web", PVCName: "web-data"},
+		{Namespace: "alpha", Release: "web", PVCName: "web-cache"},
+		{Namespace: "beta", Release: "web", PVCName: "web-data"},
+		{Namespace: "alpha", Release: "db", PVCName: "db-data"},
+	}
+
+	groups := groupByRelease(pvcs)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(groups))
+	}
+	if groups[0].namespace != "alpha" || groups[0].release != "web" || len(groups[0].pvcs) != 2 {
+		t.Errorf("groups[0] = %s/%s with %d PVC(s), want alpha/web with 2", groups[0].namespace, groups[0].release, len(groups[0].pvcs))
+	}
+	if groups[1].namespace != "beta" || groups[1].release != "web" || len(groups[1].pvcs) != 1 {
+		t.Errorf("groups[1] = %s/%s with %d PVC(s), want beta/web with 1", groups[1].namespace, groups[1].release, len(groups[1].pvcs))
+	}
+	if groups[2].namespace != "alpha" || groups[2].release != "db" {
+		t.Errorf("groups[2] = %s/%s, want alpha/db", groups[2].namespace, groups[2].release)
+	}
+}
+
+func TestFilterByWorkload(t *testing.T) {
+	w := &types.WorkloadInfo{Kind: "StatefulSet", Name: "db", Namespace: "default"}
+	pvcs := []types.PVCInfo{
+		{PVCName: "data", Workload: w},
+		{PVCName: "leftover", Workload: nil},
+	}
+
+	kept, skipped := filterByWorkload(pvcs, false, false)
+	if len(kept) != 2 || len(skipped) != 0 {
+		t.Errorf("default: kept %d, skipped %d, want 2 and 0", len(kept), len(skipped))
+	}
+
+	kept, skipped = filterByWorkload(pvcs, true, false)
+	if len(kept) != 1 || kept[0].PVCName != "data" {
+		t.Errorf("exclude orphans: kept = %+v, want only data", kept)
+	}
+	if len(skipped) != 1 || skipped[0].pvc.PVCName != "leftover" || skipped[0].reason == "" {
+		t.Errorf("exclude orphans: skipped = %+v, want leftover with a reason", skipped)
+	}
+
+	kept, skipped = filterByWorkload(pvcs, false, true)
+	if len(kept) != 1 || kept[0].PVCName != "leftover" {
+		t.Errorf("only orphans: kept = %+v, want only leftover", kept)
+	}
+	if len(skipped) != 1 || skipped[0].pvc.PVCName != "data" {
+		t.Errorf("only orphans: skipped = %+v, want data", skipped)
+	}
+}
+
+func TestFilterByOrdinal(t *testing.T) {
+	db := &types.WorkloadInfo{Kind: "StatefulSet", Name: "db", Namespace: "default"}
+	web := &types.WorkloadInfo{Kind: "Deployment", Name: "web", Namespace: "default"}
+	pvcs := []types.PVCInfo{
+		{PVCName: "data-db-0", Workload: db},
+		{PVCName: "data-db-1", Workload: db},
+		{PVCName: "wal-db-2", Workload: db},
+		{PVCName: "shared", Workload: db},
+		{PVCName: "uploads-1", Workload: web},
+		{PVCName: "leftover-0"},
+	}
+
+	kept, skipped := filterByOrdinal(pvcs, []int{0, 2})
+	if got := pvcNames(kept); !reflect.DeepEqual(got, []string{"data-db-0", "wal-db-2", "shared", "uploads-1", "leftover-0"}) {
+		t.Errorf("kept = %v, want ordinals 0 and 2 and every PVC without an ordinal", got)
+	}
+	if len(skipped) != 1 || skipped[0].pvc.PVCName != "data-db-1" || !strings.Contains(skipped[0].reason, "ordinal 1") {
+		t.Errorf("skipped = %+v, want data-db-1 as ordinal 1", skipped)
+	}
+}
+
+func TestBackupOptions_ChecksumModes(t *testing.T) {
+	tests := []struct {
+		mode r2.ChecksumMode
+		want int
+	}{
+		{r2.ChecksumNone, 0},
+		{r2.ChecksumSidecar, 1},
+		{r2.ChecksumMetadata, 1},
+		{r2.ChecksumEmbedded, 2},
+	}
+	for _, tc := range tests {
+		if got := len(backupOptions(options{checksumMode: tc.mode})); got != tc.want {
+			t.Errorf("backupOptions(%s) returned %d option(s), want %d", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestBackup_CompressionLevel(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	var text strings.Builder
+	for i := range 20000 {
+		fmt.Fprintf(&text, "%d %d\n", i, i*i%9973)
+	}
+	if err := os.WriteFile(filepath.Join(paths["data"], "numbers.txt"), []byte(text.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	captureOut(t)
+	sizes := make(map[int]int64)
+	for _, level := range []int{1, 9} {
+		opts := options{
+			namespace:     "ns",
+			release:       "rel",
+			outputFormat:  "{pvc}.tar.gz",
+			outputDir:     t.TempDir(),
+			compressLevel: level,
+		}
+		if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+			t.Fatalf("run() at level %d error: %v", level, err)
+		}
+		info, err := os.Stat(filepath.Join(opts.outputDir, "data.tar.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = info.Size()
+	}
+	if sizes[1] <= sizes[9] {
+		t.Errorf("level 1 archive is %d bytes, level 9 %d; want level 1 larger", sizes[1], sizes[9])
+	}
+}
+
+func TestBackup_Exclude(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	os.MkdirAll(filepath.Join(paths["data"], "tmp"), 0755)
+	os.WriteFile(filepath.Join(paths["data"], "tmp", "cache.bin"), []byte("cache"), 0644)
+	os.WriteFile(filepath.Join(paths["data"], "app.sock"), nil, 0644)
+	exclude, err := backup.ParseExcludes([]string{"tmp/", "*.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		exclude:      exclude,
+	}
+	captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	archive := filepath.Join(opts.outputDir, "data.tar.gz")
+	names, err := backup.ArchiverFor(archive).List(archive, backup.ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"./", "data.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("archive entries = %v, want only data.txt", names)
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: admin
+current-context: test
+`
+
+func TestBuildConfig_Impersonation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := buildConfig(options{
+		kubeconfig: path,
+		as:         "system:serviceaccount:apps:backup",
+		asGroups:   []string{"system:serviceaccounts", "backup-operators"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Impersonate.UserName != "system:serviceaccount:apps:backup" {
+		t.Errorf("Impersonate.UserName = %q", config.Impersonate.UserName)
+	}
+	if !reflect.DeepEqual(config.Impersonate.Groups, []string{"system:serviceaccounts", "backup-operators"}) {
+		t.Errorf("Impersonate.Groups = %v", config.Impersonate.Groups)
+	}
+
+	// Without --as the runner's own identity is used
+	config, err = buildConfig(options{kubeconfig: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Impersonate.UserName != "" || len(config.Impersonate.Groups) != 0 {
+		t.Errorf("Impersonate = %+v, want empty", config.Impersonate)
+	}
+}
+
+func TestCheckRotationFormat(t *testing.T) {
+	tests := []struct {
+		opts    options
+		wantErr bool
+	}{
+		{options{outputFormat: "{pvc}.tar.gz"}, false},
+		{options{outputFormat: defaultOutputFormat, keepLast: 3}, false},
+		{options{outputFormat: "{pvc}.tar.gz", keepLast: 3}, true},
+		{options{outputFormat: "{namespace}/{pvc}.tar.gz", keepDays: 7}, true},
+		{options{outputFormat: "{pvc}.tar.gz", gfs: store.GFS{Daily: 7}}, true},
+	}
+	for _, tt := range tests {
+		err := checkRotationFormat(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkRotationFormat(%q, %s) = %v, want error %v", tt.opts.outputFormat, tt.opts.retention(), err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "{date}") {
+			t.Errorf("error %q does not mention {date}", err)
+		}
+	}
+}
+
+func TestCheckNameTemplate(t *testing.T) {
+	const text = "{{.PVC}}.tar.gz"
+	if _, err := checkNameTemplate(options{}, "backup", text); err != nil {
+		t.Fatalf("checkNameTemplate() = %v", err)
+	}
+	for _, opts := range []options{{keepLast: 3}, {keepDays: 7}, {gfs: store.GFS{Weekly: 4}}} {
+		_, err := checkNameTemplate(opts, "backup", text)
+		if err == nil {
+			t.Fatalf("checkNameTemplate(%s) succeeded despite retention", opts.retention())
+		}
+		for _, flag := range []string{"--keep-last", "--keep-days", "--retention-daily", "--retention-weekly", "--retention-monthly"} {
+			if !strings.Contains(err.Error(), flag) {
+				t.Errorf("error %q does not name %s", err, flag)
+			}
+		}
+		if strings.Contains(err.Error(), "--gfs") {
+			t.Errorf("error %q names --gfs, which is not a flag", err)
+		}
+	}
+}
+
+func TestApplyCompression(t *testing.T) {
+	tests := []struct {
+		format, compression, want string
+	}{
+		{defaultOutputFormat, "none", "{namespace}_{release}_{date}_{pvc}.tar"},
+		{defaultOutputFormat, "zstd", "{namespace}_{release}_{date}_{pvc}.tar.zst"},
+		{"{pvc}-{date}.tgz", "gzip", "{pvc}-{date}.tar.gz"},
+		{"{pvc}-{date}", "none", "{pvc}-{date}.tar"},
+	}
+	for _, tc := range tests {
+		got, err := applyCompression(tc.format, tc.compression)
+		if err != nil {
+			t.Errorf("applyCompression(%q, %q) error: %v", tc.format, tc.compression, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("applyCompression(%q, %q) = %q, want %q", tc.format, tc.compression, got, tc.want)
+		}
+	}
+
+	if _, err := applyCompression("{pvc}.zip", "none"); err == nil {
+		t.Error("expected error combining --compression with .zip")
+	}
+	if _, err := applyCompression(defaultOutputFormat, "bzip2"); err == nil {
+		t.Error("expected error for unknown compression")
+	}
+}
+
+func TestBuildR2Pattern_AnyArchiveExtension(t *testing.T) {
+	// After switching to --compression none, rotation must still see the older .tar.gz backups
+	pattern := buildR2Pattern("{namespace}_{release}_{date}_{pvc}.tar", "ns", "rel", "data", "")
+	for _, key := range []string{"ns_rel_20240101-120000_data.tar", "ns_rel_20240101-120000_data.tar.gz", "ns_rel_20240101-120000_data.tar.zst"} {
+		if !pattern.MatchString(key) {
+			t.Errorf("pattern should match %q", key)
+		}
+	}
+	if pattern.MatchString("ns_rel_20240101-120000_data.tar.sha256") {
+		t.Error("pattern should not match sidecars")
+	}
+
+	pvc, err := parseArchiveName("ns_rel_20240101-120000_data.tar.gz", "{namespace}_{release}_{date}_{pvc}.tar", "ns", "rel")
+	if err != nil || pvc != "data" {
+		t.Errorf("parseArchiveName() = %q, %v; want %q", pvc, err, "data")
+	}
+}
+
+func TestBuildR2Pattern_EncryptedArchives(t *testing.T) {
+	pattern := buildR2Pattern(defaultOutputFormat, "ns", "rel", "data", "")
+	for _, name := range []string{"ns_rel_20240101-120000_data.tar.gz.enc", "ns_rel_20240101-120000_data.tar.gz.age"} {
+		if !pattern.MatchString(name) {
+			t.Errorf("pattern should match encrypted archive %s", name)
+		}
+		pvc, err := parseArchiveName(name, defaultOutputFormat, "ns", "rel")
+		if err != nil || pvc != "data" {
+			t.Errorf("parseArchiveName(%s) = %q, %v; want %q", name, pvc, err, "data")
+		}
+	}
+}
+
+func TestBackupAndRestore_Age(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.txt")
+	os.WriteFile(keyFile, []byte(id.String()+"\n"), 0600)
+
+	encrypter, err := crypt.NewAge([]string{id.Recipient().String()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		checksumMode: r2.ChecksumNone,
+		encrypter:    encrypter,
+	}
+	buf := captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	archive := filepath.Join(opts.outputDir, "data.tar.gz.age")
+	if data, err := os.ReadFile(archive); err != nil || !bytes.HasPrefix(data, []byte("age-encryption.org/v1\n")) {
+		t.Fatalf("%s is not an age file: %v", archive, err)
+	}
+
+	// The recipient alone cannot decrypt, and the volume is left alone; the identity file can
+	os.WriteFile(filepath.Join(paths["data"], "data.txt"), []byte("changed"), 0644)
+	if err := runRestore(context.Background(), client, opts, []string{archive}, newRunReport("restore")); err == nil {
+		t.Error("restore without --decrypt-identity succeeded")
+	}
+	if data, _ := os.ReadFile(filepath.Join(paths["data"], "data.txt")); string(data) != "changed" {
+		t.Errorf("data.txt = %q after the refused restore, want it untouched", data)
+	}
+	if opts.encrypter, err = crypt.NewAge(nil, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore(context.Background(), client, opts, []string{archive}, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore() error: %v\n%s", err, buf)
+	}
+	if data, _ := os.ReadFile(filepath.Join(paths["data"], "data.txt")); string(data) != "data" {
+		t.Errorf("data.txt = %q, want data", data)
+	}
+}
+
+func TestArchiveSuffix_ParseAndPrefix(t *testing.T) {
+	key := backup.FormatName(defaultOutputFormat, "ns", "rel", "data", "") + ".bak"
+	if !strings.HasSuffix(key, ".tar.gz.bak") {
+		t.Fatalf("key = %q, want the suffix after the extension", key)
+	}
+	if !strings.HasPrefix(key, buildR2Prefix(defaultOutputFormat, "ns", "rel", "data")) {
+		t.Errorf("prefix %q does not cover %q", buildR2Prefix(defaultOutputFormat, "ns", "rel", "data"), key)
+	}
+	if !buildR2Pattern(defaultOutputFormat, "ns", "rel", "data", ".bak").MatchString(key) {
+		t.Errorf("pattern does not match %q", key)
+	}
+	for _, name := range []string{key, "ns_rel_20240101-120000_data.tar.gz.enc.bak", "ns_rel_20240101-120000_data.tar.gz"} {
+		if pvc, err := parseArchiveName(backup.TrimArchiveSuffix(name, ".bak"), defaultOutputFormat, "ns", "rel"); err != nil || pvc != "data" {
+			t.Errorf("parseArchiveName(%q) = %q, %v; want data", name, pvc, err)
+		}
+	}
+
+	// With {pvc} last and no {date} the prefix runs up to the extension
+	format := "{namespace}/{release}/{pvc}.tar.gz"
+	name := backup.FormatName(format, "ns", "rel", "data", "") + ".bak"
+	if prefix := buildR2Prefix(format, "ns", "rel", "data"); !strings.HasPrefix(name, prefix) {
+		t.Errorf("prefix %q does not cover %q", prefix, name)
+	}
+	if !buildR2Pattern(format, "ns", "rel", "data", ".bak").MatchString(name) {
+		t.Errorf("pattern does not match %q", name)
+	}
+}
+
+func TestOrderPVCs(t *testing.T) {
+	pvcs := []types.PVCInfo{{PVCName: "a"}, {PVCName: "b"}, {PVCName: "c"}, {PVCName: "d"}}
+	name := func(p types.PVCInfo) string { return p.PVCName }
+
+	tests := []struct {
+		order []string
+		want  string
+	}{
+		{nil, "a,b,c,d"},
+		{[]string{"c", "a"}, "c,a,b,d"},
+		{[]string{"d", "missing", "b"}, "d,b,a,c"},
+		{[]string{"b", "b", "a"}, "b,a,c,d"},
+	}
+	for _, tc := range tests {
+		var got []string
+		for _, p := range orderPVCs(pvcs, tc.order, name) {
+			got = append(got, p.PVCName)
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("orderPVCs(%v) = %v, want %s", tc.order, got, tc.want)
+		}
+	}
+}
+
+// newFakeRelease returns a clientset holding bound PVCs (without workloads) for release,
+// each backed by a hostPath PV pointing at a fresh temp dir containing name.txt.
+func newFakeRelease(t *testing.T, namespace, release string, names ...string) (*fake.Clientset, map[string]string) {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	paths := make(map[string]string)
+	for _, name := range names {
+		paths[name] = newFakePVC(t, client, namespace, release, name)
+	}
+	return client, paths
+}
+
+// newFakePVC adds a PVC of the release bound to a hostPath PV in a temp dir holding
+// <name>.txt, and returns that dir.
+func newFakePVC(t *testing.T, client *fake.Clientset, namespace, release, name string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name+".txt"), []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-" + name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: dir}},
+		},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/instance": release},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-" + name},
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Create(context.Background(), pv, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// captureOut redirects the package's progress output into a buffer for the test's duration.
+func captureOut(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := out
+	out = &buf
+	t.Cleanup(func() { out = prev })
+	return &buf
+}
+
+// okOrder returns the names from "  OK    <name>" lines in the order they were printed.
+func okOrder(output string) []string {
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		if rest, ok := strings.CutPrefix(line, "  OK    "); ok {
+			names = append(names, strings.Fields(rest)[0])
+		}
+	}
+	return names
+}
+
+func TestBackup_Parallel(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data", "wal", "cache", "logs")
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		parallel:     3,
+		pvcOrder:     []string{"wal", "logs"},
+	}
+	buf := captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	// The summary keeps the planned order, however the archives finished
+	if got, want := okOrder(buf.String()), []string{"wal", "logs", "cache", "data"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("summary order = %v, want %v", got, want)
+	}
+	for _, pvc := range []string{"data", "wal", "cache", "logs"} {
+		if _, err := os.Stat(filepath.Join(opts.outputDir, pvc+".tar.gz")); err != nil {
+			t.Errorf("archive of %s: %v", pvc, err)
+		}
+	}
+}
+
+func TestPVCOrder_BackupAndRestore(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal", "cache")
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		checksumMode: r2.ChecksumNone,
+		pvcOrder:     []string{"wal", "data"},
+	}
+
+	buf := captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if got := okOrder(buf.String()); !reflect.DeepEqual(got, []string{"wal", "data", "cache"}) {
+		t.Errorf("backup order = %v, want [wal data cache]", got)
+	}
+
+	// Restore the archives given in a different order; --pvc-order still decides
+	buf.Reset()
+	opts.pvcOrder = []string{"cache", "data"}
+	archives := []string{
+		filepath.Join(opts.outputDir, "data.tar.gz"),
+		filepath.Join(opts.outputDir, "wal.tar.gz"),
+		filepath.Join(opts.outputDir, "cache.tar.gz"),
+	}
+	if err := runRestore(context.Background(), client, opts, archives, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore() error: %v", err)
+	}
+	if got := okOrder(buf.String()); !reflect.DeepEqual(got, []string{"cache", "data", "wal"}) {
+		t.Errorf("restore order = %v, want [cache data wal]", got)
+	}
+	if !strings.Contains(buf.String(), "  OK    wal <- wal.tar.gz (1 file(s), 3 B in ") {
+		t.Errorf("restore summary lacks the per-PVC result:\n%s", buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(paths["wal"], "wal.txt")); err != nil || string(data) != "wal" {
+		t.Errorf("wal not restored: %q, %v", data, err)
+	}
+}
+
+func TestUploadAndRotate_FSDest(t *testing.T) {
+	buf := captureOut(t)
+	ctx := context.Background()
+	root := t.TempDir()
+
+	// Two older backups already on the share; only the newest of them survives keep-last 2
+	old := time.Now().Add(-48 * time.Hour)
+	for i, name := range []string{"default-app-data-20240101-000000.tar.gz", "default-app-data-20240102-000000.tar.gz"} {
+		p := filepath.Join(root, name)
+		if err := os.WriteFile(p, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := old.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(p, mtime, mtime)
+	}
+
+	archive := filepath.Join(t.TempDir(), "default-app-data-20240103-000000.tar.gz")
+	if err := os.WriteFile(archive, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		dest:         "fs://" + root,
+		keepLast:     2,
+		outputFormat: "{namespace}-{release}-{pvc}-{date}.tar.gz",
+		checksumMode: r2.ChecksumMetadata,
+	}
+	pvcs := []types.PVCInfo{{PVCName: "data"}}
+	results := []types.BackupResult{{PVCName: "data", ArchivePath: archive, Size: 3, SHA256: "feed"}}
+	if err := uploadAndRotate(ctx, opts, "default", "app", pvcs, results); err != nil {
+		t.Fatalf("uploadAndRotate: %v\n%s", err, buf)
+	}
+
+	entries, _ := os.ReadDir(root)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{
+		"default-app-data-20240102-000000.tar.gz",
+		"default-app-data-20240103-000000.tar.gz",
+		"default-app-data-20240103-000000.tar.gz.sha256",
+		"default-app-latest.json",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("destination = %v, want %v\n%s", names, want, buf)
+	}
+	latest, err := mustOpenStore(t, opts).GetLatest(ctx, "default-app-latest.json")
+	if err != nil || latest == nil || latest.PVCs["data"] != "default-app-data-20240103-000000.tar.gz" {
+		t.Errorf("latest.json = %+v, %v; want data -> the uploaded archive", latest, err)
+	}
+	if !strings.Contains(buf.String(), "=== Destination Rotation (keep last 2) ===") {
+		t.Errorf("missing rotation heading:\n%s", buf)
+	}
+}
+
+func TestRequirePlan(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data")
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		dryRun:       true,
+		planHash:     true,
+	}
+
+	buf := captureOut(t)
+	rep := newRunReport("backup")
+	if err := run(context.Background(), client, opts, rep); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if rep.PlanHash == "" || !strings.Contains(buf.String(), "Plan hash: "+rep.PlanHash) {
+		t.Fatalf("plan hash not reported:\n%s", buf)
+	}
+
+	// The approved hash lets the real run through
+	opts.dryRun, opts.planHash, opts.requirePlan = false, false, rep.PlanHash
+	rep = newRunReport("backup")
+	if err := run(context.Background(), client, opts, rep); err != nil {
+		t.Fatalf("run with matching plan: %v", err)
+	}
+	if rel := rep.Releases[0]; len(rel.PVCs) == 0 || rel.Bytes == 0 {
+		t.Errorf("report recorded PVCs %v and %d bytes, want the ones backed up", rel.PVCs, rel.Bytes)
+	}
+
+	// A PVC added after review changes the plan, and nothing is backed up
+	newFakePVC(t, client, "ns", "rel", "extra")
+	opts.outputDir = t.TempDir()
+	err := run(context.Background(), client, opts, newRunReport("backup"))
+	if err == nil || !strings.Contains(err.Error(), "does not match --require-plan") {
+		t.Fatalf("expected a plan mismatch, got %v", err)
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 0 {
+		t.Errorf("archives written despite plan mismatch: %v", entries)
+	}
+}
+
+func TestDryRun_ChecksWriteAccess(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}-{date}.tar.gz",
+		outputDir:    t.TempDir(),
+		dest:         "fs://" + root,
+		dryRun:       true,
+	}
+	buf := captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("dry run: %v\n%s", err, buf)
+	}
+	if !strings.Contains(buf.String(), "  OK    wrote and deleted "+store.PermCheckPrefix) {
+		t.Errorf("missing write check:\n%s", buf)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("dry run left %v in the destination", entries)
+	}
+}
+
+func TestLoadSecretCredentials(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "r2", Namespace: "backup"},
+		Data: map[string][]byte{
+			"account_id":        []byte("acc"),
+			"access_key_id":     []byte("key"),
+			"secret_access_key": []byte("secret"),
+			"bucket":            []byte("bucket"),
+		},
+	})
+	ctx := context.Background()
+
+	creds, err := loadSecretCredentials(ctx, client, "backup/r2", "apps")
+	if err != nil {
+		t.Fatalf("loadSecretCredentials: %v", err)
+	}
+	if creds.AccountID != "acc" || creds.Bucket != "bucket" {
+		t.Errorf("creds = %+v", creds)
+	}
+
+	// A bare name is looked up in --namespace
+	if _, err := loadSecretCredentials(ctx, client, "r2", "backup"); err != nil {
+		t.Errorf("bare name: %v", err)
+	}
+	if _, err := loadSecretCredentials(ctx, client, "r2", "apps"); err == nil {
+		t.Error("expected an error for a secret in another namespace")
+	}
+	if _, err := loadSecretCredentials(ctx, client, "backup/", "apps"); err == nil {
+		t.Error("expected an error for an empty name")
+	}
+}
+
+// countingStore counts ListByPrefix calls made through it.
+type countingStore struct {
+	store.Store
+	lists int
+}
+
+func (c *countingStore) ListByPrefix(ctx context.Context, prefix string) ([]r2.ObjectInfo, error) {
+	c.lists++
+	return c.Store.ListByPrefix(ctx, prefix)
+}
+
+func TestGroupPrefix(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+		ok     bool
+	}{
+		{"{namespace}/{release}/{pvc}/{date}.tar.gz", "ns/rel/", true},
+		{"backups/{namespace}-{release}/{pvc}/{date}.tar.gz", "backups/ns-rel/", true},
+		{"{pvc}/{date}.tar.gz", "", true},
+		{"{namespace}_{release}_{date}_{pvc}.tar.gz", "", false},
+		{"{namespace}/{release}-{pvc}/{date}.tar.gz", "", false},
+		{"{date}/{pvc}/data.tar.gz", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := groupPrefix(tc.format, "ns", "rel")
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("groupPrefix(%q) = %q, %v; want %q, %v", tc.format, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestPVCObjects_ListCalls(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs, err := store.NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "a.tar.gz")
+	os.WriteFile(src, []byte("x"), 0644)
+	for _, key := range []string{
+		"ns/rel/data/20240101-000000.tar.gz",
+		"ns/rel/wal/20240101-000000.tar.gz",
+		"ns_rel_20240101-000000_data.tar.gz",
+		"ns_rel_20240101-000000_wal.tar.gz",
+	} {
+		if err := fs.Upload(ctx, src, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := []string{"data", "wal", "cache"}
+
+	tests := []struct {
+		format string
+		lists  int
+	}{
+		{"{namespace}/{release}/{pvc}/{date}.tar.gz", 1},
+		{defaultOutputFormat, len(names)},
+	}
+	for _, tc := range tests {
+		cs := &countingStore{Store: fs}
+		got, err := pvcObjects(ctx, cs, tc.format, "ns", "rel", names)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		if cs.lists != tc.lists {
+			t.Errorf("%s: %d list call(s), want %d", tc.format, cs.lists, tc.lists)
+		}
+		for _, name := range []string{"data", "wal"} {
+			objects := filterR2Objects(got[name], buildR2Pattern(tc.format, "ns", "rel", name, ""))
+			if len(objects) != 1 {
+				t.Errorf("%s: %s has %d archive(s), want 1", tc.format, name, len(objects))
+			}
+		}
+		if objects := filterR2Objects(got["cache"], buildR2Pattern(tc.format, "ns", "rel", "cache", "")); len(objects) != 0 {
+			t.Errorf("%s: cache = %v, want none", tc.format, objects)
+		}
+	}
+}
+
+func TestCheckHostPaths(t *testing.T) {
+	pvcs := []types.PVCInfo{
+		{Namespace: "ns", PVCName: "a", HostPath: "/data/x"},
+		{Namespace: "ns", PVCName: "b", HostPath: "/data/x"},
+	}
+	if err := checkHostPaths(options{}, pvcs); err != nil {
+		t.Errorf("checkHostPaths() = %v, want only a warning", err)
+	}
+	err := checkHostPaths(options{strictPaths: true}, pvcs)
+	if err == nil || !strings.Contains(err.Error(), "/data/x is the host path of ns/a, ns/b") {
+		t.Errorf("checkHostPaths() with --strict-paths = %v, want the colliding PVCs named", err)
+	}
+	if err := checkHostPaths(options{strictPaths: true}, pvcs[:1]); err != nil {
+		t.Errorf("checkHostPaths() = %v for a single PVC", err)
+	}
+}
+
+func TestRun_StdoutRequiresOnePVC(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "a", "b")
+	opts := options{namespace: "ns", release: "rel", outputFormat: "{pvc}.tar.gz", outputDir: stdoutDir}
+
+	captureOut(t)
+	err := run(context.Background(), client, opts, newRunReport("backup"))
+	if err == nil || !strings.Contains(err.Error(), "2 PVC(s) are selected") {
+		t.Errorf("run() = %v, want a single-PVC error", err)
+	}
+}
+
+func TestPVStillExists(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data")
+	check := pvStillExists(client)
+	pvc := types.PVCInfo{PVCName: "data", PVName: "pv-data"}
+	if err := check(context.Background(), pvc); err != nil {
+		t.Fatalf("check() = %v for an existing PV", err)
+	}
+	if err := client.CoreV1().PersistentVolumes().Delete(context.Background(), "pv-data", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(context.Background(), pvc); err == nil || !strings.Contains(err.Error(), "PV pv-data was deleted since discovery") {
+		t.Errorf("check() = %v, want the deleted PV reported", err)
+	}
+}
+
+func TestStorageClassRoundTrip(t *testing.T) {
+	const format = "{storageClass}/{namespace}_{release}_{date}_{pvc}.tar.gz"
+	key := backup.FormatName(format, "ns", "rel", "redis-data", "local-ssd")
+	if !strings.HasPrefix(key, "local-ssd/ns_rel_") {
+		t.Fatalf("FormatName() = %q", key)
+	}
+
+	// A local archive is matched by its base name, whatever the class
+	flat := "{namespace}_{release}_{storageClass}_{date}_{pvc}.tar.gz"
+	name := backup.FormatName(flat, "ns", "rel", "redis-data", "")
+	if pvc, err := parseArchiveName(name, flat, "ns", "rel"); err != nil || pvc != "redis-data" {
+		t.Errorf("parseArchiveName(%q) = %q, %v; want redis-data", name, pvc, err)
+	}
+
+	// Listing stops at the class, so keys of every class are found and then filtered
+	if prefix := buildR2Prefix(format, "ns", "rel", "redis-data"); prefix != "" {
+		t.Errorf("buildR2Prefix() = %q, want an empty prefix", prefix)
+	}
+	if prefix := buildR2Prefix("{namespace}/{storageClass}/{pvc}/{date}.tar.gz", "ns", "rel", "redis-data"); prefix != "ns/" {
+		t.Errorf("buildR2Prefix() = %q, want %q", prefix, "ns/")
+	}
+	pattern := buildR2Pattern(format, "ns", "rel", "redis-data", "")
+	for _, k := range []string{key, strings.Replace(key, "local-ssd", "standard", 1)} {
+		if !pattern.MatchString(k) {
+			t.Errorf("pattern does not match %q", k)
+		}
+	}
+	if other := backup.FormatName(format, "ns", "rel", "postgres-data", "local-ssd"); pattern.MatchString(other) {
+		t.Errorf("pattern matches another PVC's key %q", other)
+	}
+
+	if _, ok := groupPrefix("{storageClass}/{pvc}/{date}.tar.gz", "ns", "rel"); ok {
+		t.Error("groupPrefix() grouped a format with {storageClass} before {pvc}")
+	}
+}
+
+func TestPrintScalePlan(t *testing.T) {
+	buf := captureOut(t)
+	printScalePlan([]*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web-deploy", OriginalReplicas: 3},
+		{Kind: "StatefulSet", Name: "db", OriginalReplicas: 0},
+		{Kind: "Deployment", Name: "api", OriginalReplicas: 2, HPA: "api-hpa"},
+		{Kind: "StatefulSet", Name: "pg", OriginalReplicas: 3},
+		{Kind: "Deployment", Name: "pg", OriginalReplicas: 2},
+		{Kind: "Deployment", Name: "cache", OriginalReplicas: 1},
+	}, "backup", options{scaleTargets: map[string]int32{"StatefulSet/pg": 1, "Deployment/cache": 1}})
+	want := `
+Would scale:
+  - Deployment/web-deploy: 3 -> 0 (backup) -> 3 (after)
+  - StatefulSet/db: 0, already scaled down (no-op)
+  - Deployment/api: 2 -> 0 (backup) -> 2 (after); HPA api-hpa may scale it back up
+  - StatefulSet/pg: 3 -> 1 (backup) -> 3 (after)
+  - Deployment/pg: 2 -> 0 (backup) -> 2 (after)
+  - Deployment/cache: 1, already at most --scale-to 1 (no-op)
+`
+	if buf.String() != want {
+		t.Errorf("printScalePlan() printed:\n%s\nwant:\n%s", buf, want)
+	}
+}
+
+func TestCheckScaleTargets(t *testing.T) {
+	pvcs := []types.PVCInfo{
+		{PVCName: "data-db-0", Workload: &types.WorkloadInfo{Kind: "StatefulSet", Name: "db"}},
+		{PVCName: "cache", Workload: &types.WorkloadInfo{Kind: "Deployment", Name: "cache"}},
+	}
+	opts := options{scaleTargets: map[string]int32{"StatefulSet/db": 1}}
+	if err := checkScaleTargets(opts, pvcs); err != nil {
+		t.Errorf("checkScaleTargets() error: %v", err)
+	}
+
+	// A typo would leave the primary it meant to keep scaled to 0
+	opts.scaleTargets = map[string]int32{"StatefulSet/dbb": 1, "Deployment/db": 1, "Deployment/cache": 1}
+	err := checkScaleTargets(opts, pvcs)
+	if err == nil || !strings.Contains(err.Error(), "--scale-to Deployment/db, StatefulSet/dbb matches no workload") {
+		t.Errorf("checkScaleTargets() error = %v, want the unmatched entries named", err)
+	}
+	opts.targets = []target{{Name: "shop"}}
+	if err := checkScaleTargets(opts, pvcs); err != nil {
+		t.Errorf("checkScaleTargets() with --targets error = %v, want only a warning", err)
+	}
+}
+
+func TestPrintRotationPreview(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	for i, ago := range []time.Duration{72 * time.Hour, 47 * time.Hour, 24 * time.Hour} {
+		p := filepath.Join(root, fmt.Sprintf("default-app-data-2024010%d-000000.tar.gz", i+1))
+		if err := os.WriteFile(p, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, now.Add(-ago), now.Add(-ago))
+	}
+	pvcs := []types.PVCInfo{{PVCName: "data"}, {PVCName: "empty"}}
+
+	// The archive the run would upload counts as the newest backup of each PVC
+	tests := map[string]struct {
+		opts    options
+		deleted []string
+	}{
+		"keep-last": {options{keepLast: 2}, []string{"20240102", "20240101"}},
+		"keep-days": {options{keepDays: 2}, []string{"20240101"}},
+		"gfs":       {options{gfs: store.GFS{Monthly: 1}}, []string{"20240103", "20240102", "20240101"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := captureOut(t)
+			opts := tc.opts
+			opts.dest = "fs://" + root
+			opts.outputFormat = "{namespace}-{release}-{pvc}-{date}.tar.gz"
+			printRotationPreview(context.Background(), opts, "default", "app", pvcs)
+
+			var want []string
+			for _, date := range tc.deleted {
+				want = append(want, fmt.Sprintf("  - data: delete fs://%s/default-app-data-%s-000000.tar.gz", root, date))
+			}
+			want = append(want, "  - empty: nothing to delete")
+			if got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); !reflect.DeepEqual(got, want) {
+				t.Errorf("preview =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			if entries, _ := os.ReadDir(root); len(entries) != 3 {
+				t.Errorf("%d archives left after the preview, want all 3", len(entries))
+			}
+		})
+	}
+}
+
+func TestRestore_Combined(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal", "cache")
+	src := t.TempDir()
+	for _, name := range []string{"data", "wal", "orphan"} {
+		if err := os.Mkdir(filepath.Join(src, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, name, "restored.txt"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(t.TempDir(), "combined.tar.gz")
+	if _, err := backup.ArchiverFor(archive).Create(context.Background(), archive, src, backup.ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{namespace: "ns", release: "rel", outputFormat: defaultOutputFormat, combined: true}
+	captureOut(t)
+	// orphan has no PVC, so nothing is restored without --skip-missing
+	if err := runRestore(context.Background(), client, opts, []string{archive}, newRunReport("restore")); err == nil || !strings.Contains(err.Error(), "orphan") {
+		t.Fatalf("runRestore() error = %v, want one naming orphan", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths["data"], "data.txt")); err != nil {
+		t.Errorf("data was changed by the failed restore: %v", err)
+	}
+
+	opts.skipMissing = true
+	buf := captureOut(t)
+	if err := runRestore(context.Background(), client, opts, []string{archive}, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore() error: %v", err)
+	}
+	for _, name := range []string{"data", "wal"} {
+		entries, _ := os.ReadDir(paths[name])
+		if len(entries) != 1 || entries[0].Name() != "restored.txt" {
+			t.Errorf("%s holds %v, want only restored.txt", name, entries)
+		}
+		if data, err := os.ReadFile(filepath.Join(paths[name], "restored.txt")); err != nil || string(data) != name {
+			t.Errorf("%s/restored.txt = %q, %v; want %q", name, data, err, name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(paths["cache"], "cache.txt")); err != nil {
+		t.Errorf("cache, which the archive lacks, was changed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "  - combined.tar.gz -> PVC(s) data, wal\n") {
+		t.Errorf("output lacks the matched PVCs:\n%s", buf)
+	}
+}
+
+func TestUploadAndRotate_Quota(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	// 100 bytes stored: two old archives of the PVC and one unrelated object
+	old := time.Now().Add(-48 * time.Hour)
+	for i, name := range []string{"default-app-data-20240101-000000.tar.gz", "default-app-data-20240102-000000.tar.gz", "other.bin"} {
+		p := filepath.Join(root, name)
+		if err := os.WriteFile(p, bytes.Repeat([]byte("x"), []int{40, 40, 20}[i]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := old.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(p, mtime, mtime)
+	}
+	archive := filepath.Join(t.TempDir(), "default-app-data-20240103-000000.tar.gz")
+	if err := os.WriteFile(archive, bytes.Repeat([]byte("n"), 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pvcs := []types.PVCInfo{{PVCName: "data"}}
+	results := []types.BackupResult{{PVCName: "data", ArchivePath: archive, Size: 30}}
+	uploaded := func() bool {
+		_, err := os.Stat(filepath.Join(root, filepath.Base(archive)))
+		return err == nil
+	}
+
+	opts := options{
+		dest:         "fs://" + root,
+		outputFormat: "{namespace}-{release}-{pvc}-{date}.tar.gz",
+		checksumMode: r2.ChecksumNone,
+		quota:        120,
+	}
+	buf := captureOut(t)
+	// 100 + 30 without rotation
+	err := uploadAndRotate(ctx, opts, "default", "app", pvcs, results)
+	if err == nil || !strings.Contains(err.Error(), "over the --r2-quota") || uploaded() {
+		t.Fatalf("uploadAndRotate() = %v, uploaded %v; want a quota error and no upload\n%s", err, uploaded(), buf)
+	}
+
+	// keep-last 2 frees the oldest 40 bytes: 100 - 40 + 30 fits
+	opts.keepLast = 2
+	buf.Reset()
+	if err := uploadAndRotate(ctx, opts, "default", "app", pvcs, results); err != nil || !uploaded() {
+		t.Fatalf("uploadAndRotate() = %v, uploaded %v; want the upload within quota\n%s", err, uploaded(), buf)
+	}
+	if !strings.Contains(buf.String(), "Quota: 100 B stored, 30 B to upload, 40 B freed by rotation: 90 B of 120 B") {
+		t.Errorf("missing quota summary:\n%s", buf)
+	}
+
+	// Over the quota again, but --force uploads anyway
+	os.Remove(filepath.Join(root, filepath.Base(archive)))
+	opts.keepLast, opts.quota, opts.force = 0, 50, true
+	if err := uploadAndRotate(ctx, opts, "default", "app", pvcs, results); err != nil || !uploaded() {
+		t.Errorf("uploadAndRotate(--force) = %v, uploaded %v; want the upload", err, uploaded())
+	}
+}
+
+func TestBackup_Stream(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newFakeRelease(t, "ns", "rel", "data", "wal")
+	root := t.TempDir()
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{namespace}_{release}_{pvc}_{date}.tar.gz",
+		outputDir:    t.TempDir(),
+		dest:         "fs://" + root,
+		stream:       true,
+		keepLast:     1,
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 0 {
+		t.Errorf("archives written to --output-dir: %v", entries)
+	}
+	if n := strings.Count(buf.String(), ", streamed)"); n != 2 {
+		t.Errorf("%d streamed upload(s) confirmed, want 2:\n%s", n, buf)
+	}
+
+	dest, err := store.NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := dest.GetLatest(ctx, latestKey(opts, "ns", "rel"))
+	if err != nil || latest == nil || len(latest.PVCs) != 2 {
+		t.Fatalf("latest = %+v, %v; want both PVCs", latest, err)
+	}
+	archive := filepath.Join(t.TempDir(), "data.tar.gz")
+	if err := dest.Download(ctx, latest.PVCs["data"], archive); err != nil {
+		t.Fatal(err)
+	}
+	restored := t.TempDir()
+	if err := backup.New("", "", false).RestoreOne(archive, restored); err != nil {
+		t.Fatalf("restoring the streamed archive: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(restored, "data.txt")); string(data) != "data" {
+		t.Errorf("data.txt = %q, want data", data)
+	}
+}
+
+func TestBackup_MinFreeAfter(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	if err := os.WriteFile(filepath.Join(paths["data"], "big.bin"), make([]byte, 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A nearly full disk: the 10 KB estimate (data plus tar headers) leaves 10 KB
+	saved := freeSpace
+	freeSpace = func(string) (int64, error) { return 20 * 1024, nil }
+	t.Cleanup(func() { freeSpace = saved })
+
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{namespace}_{release}_{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		minFreeAfter: 16 * 1024,
+	}
+	buf := captureOut(t)
+	err := run(ctx, client, opts, newRunReport("backup"))
+	if err == nil || !strings.Contains(err.Error(), "could leave 10.0 KB free") {
+		t.Fatalf("run() error = %v, want a --min-free-after error\n%s", err, buf)
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 0 {
+		t.Errorf("archives written despite the check: %v", entries)
+	}
+
+	opts.minFreeAfter = 8 * 1024
+	buf.Reset()
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	if !strings.Contains(buf.String(), "Disk: 20.0 KB free in "+opts.outputDir+", up to 10.0 KB of archives: 10.0 KB left of at least 8.0 KB") {
+		t.Errorf("missing disk summary:\n%s", buf)
+	}
+	if _, err := os.Stat(filepath.Join(opts.outputDir, "ns_rel_data.tar.gz")); err != nil {
+		t.Errorf("archive not written: %v", err)
+	}
+}
+
+func TestObjectPerFile_BackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	dest, err := store.NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An older snapshot that keep-last 1 rotates away
+	if _, err := perfile.Upload(ctx, dest, paths["data"], "ns/rel/data/20240101-000000/", false); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(root, "ns", "rel", "data", "20240101-000000", perfile.ManifestName), old, old)
+
+	opts := options{
+		namespace:     "ns",
+		release:       "rel",
+		outputFormat:  "{namespace}/{release}/{pvc}/{date}.tar.gz",
+		outputDir:     t.TempDir(),
+		dest:          "fs://" + root,
+		keepLast:      1,
+		objectPerFile: true,
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 0 {
+		t.Errorf("archives written locally: %v", entries)
+	}
+	snapshots, _ := os.ReadDir(filepath.Join(root, "ns", "rel", "data"))
+	if len(snapshots) != 1 || snapshots[0].Name() == "20240101-000000" {
+		t.Fatalf("snapshots = %v, want only the new one\n%s", snapshots, buf)
+	}
+	if !strings.Contains(buf.String(), "  DEL   ns/rel/data/20240101-000000/ (2 object(s))") {
+		t.Errorf("rotation did not delete the old snapshot:\n%s", buf)
+	}
+
+	if err := os.WriteFile(filepath.Join(paths["data"], "data.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := runRestore(ctx, client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore() error: %v\n%s", err, buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(paths["data"], "data.txt")); err != nil || string(data) != "data" {
+		t.Errorf("data.txt = %q, %v; want the backed-up content", data, err)
+	}
+	if !strings.Contains(buf.String(), "  OK    data <- "+snapshots[0].Name()+" (1 file(s), 4 B in ") {
+		t.Errorf("restore summary lacks the snapshot:\n%s", buf)
+	}
+}
+
+func TestRestore_VerifyChecksum(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumNone,
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("backup: %v\n%s", err, buf)
+	}
+	changed := filepath.Join(paths["data"], "data.txt")
+	os.WriteFile(changed, []byte("changed"), 0644)
+
+	// Without a sum the archive is refused, before the volume is touched
+	opts.verifyChecksum = true
+	if err := runRestore(ctx, client, opts, nil, newRunReport("restore")); err == nil || !strings.Contains(err.Error(), "no recorded SHA-256") {
+		t.Errorf("restore without a checksum: %v", err)
+	}
+	if data, _ := os.ReadFile(changed); string(data) != "changed" {
+		t.Fatalf("data.txt = %q after the refused restore", data)
+	}
+
+	os.WriteFile(changed, []byte("data"), 0644)
+	opts.checksumMode = r2.ChecksumSidecar
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("backup: %v\n%s", err, buf)
+	}
+	os.WriteFile(changed, []byte("changed"), 0644)
+	if err := runRestore(ctx, client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("restore with a sidecar: %v\n%s", err, buf)
+	}
+	if data, _ := os.ReadFile(changed); string(data) != "data" {
+		t.Errorf("data.txt = %q, want data", data)
+	}
+
+	// Local archives are checked against the .sha256 file next to them
+	opts.dest = ""
+	archive := filepath.Join(root, "data.tar.gz")
+	os.WriteFile(changed, []byte("changed"), 0644)
+	os.WriteFile(archive+r2.SidecarSuffix, []byte(strings.Repeat("0", 64)+"  data.tar.gz\n"), 0644)
+	if err := runRestore(ctx, client, opts, []string{archive}, newRunReport("restore")); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("restore of a local archive with a wrong sum: %v", err)
+	}
+	os.Remove(archive + r2.SidecarSuffix)
+	if err := runRestore(ctx, client, opts, []string{archive}, newRunReport("restore")); err == nil || !strings.Contains(err.Error(), "no data.tar.gz.sha256") {
+		t.Errorf("restore of a local archive without a sum: %v", err)
+	}
+	if data, _ := os.ReadFile(changed); string(data) != "changed" {
+		t.Errorf("data.txt = %q after the refused local restores", data)
+	}
+}
+
+func TestRestore_RestoreAll(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal")
+	root := t.TempDir()
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}-{date}.tar.gz",
+		outputDir:    t.TempDir(),
+		dest:         "fs://" + root,
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("backup: %v\n%s", err, buf)
+	}
+	// wal has no backup left, so it is skipped rather than failing the restore
+	walArchives, _ := filepath.Glob(filepath.Join(root, "wal-*.tar.gz"))
+	for _, f := range walArchives {
+		os.Remove(f)
+	}
+	for name, dir := range paths {
+		if err := os.WriteFile(filepath.Join(dir, name+".txt"), []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf.Reset()
+	opts.restoreAll, opts.yes = true, true
+	if err := runRestore(ctx, client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore() error: %v\n%s", err, buf)
+	}
+	plan := "Restore plan (1 PVC(s), latest backup each):\n  - data: data-"
+	if !strings.Contains(buf.String(), plan) || !strings.Contains(buf.String(), "  SKIP  wal: no backups found") {
+		t.Errorf("output lacks the plan or the skipped PVC:\n%s", buf)
+	}
+	if strings.Index(buf.String(), plan) > strings.Index(buf.String(), "Downloaded") {
+		t.Errorf("plan printed after downloading:\n%s", buf)
+	}
+	if data, _ := os.ReadFile(filepath.Join(paths["data"], "data.txt")); string(data) != "data" {
+		t.Errorf("data.txt = %q, want the backed-up content", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(paths["wal"], "wal.txt")); string(data) != "changed" {
+		t.Errorf("wal.txt = %q, want it left alone", data)
+	}
+}
+
+func TestRun_StateFileResumes(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal")
+	root := t.TempDir()
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		dest:         "fs://" + root,
+		stateFile:    filepath.Join(t.TempDir(), "state.json"),
+		skipExisting: true,
+	}
+
+	// wal's host path is missing, so the first run stops short of uploading anything
+	walDir := paths["wal"]
+	if err := os.RemoveAll(walDir); err != nil {
+		t.Fatal(err)
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err == nil {
+		t.Fatalf("first run succeeded although wal is missing\n%s", buf)
+	}
+	if _, err := os.Stat(opts.stateFile); err != nil {
+		t.Fatalf("no state file after the interrupted run: %v", err)
+	}
+
+	// An earlier attempt already uploaded data
+	archive, err := os.ReadFile(filepath.Join(opts.outputDir, "data.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "data.tar.gz"), archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(walDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("second run: %v\n%s", err, buf)
+	}
+	for _, want := range []string{
+		"Resuming: " + opts.stateFile + " records 1 completed PVC(s).",
+		"  OK    data -> " + filepath.Join(opts.outputDir, "data.tar.gz"),
+		", completed by an earlier run)",
+		"  SKIP  fs://" + filepath.Join(root, "data.tar.gz") + ": already uploaded",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, buf)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "wal.tar.gz")); err != nil {
+		t.Errorf("wal was not uploaded: %v", err)
+	}
+	if _, err := os.Stat(opts.stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file left after a complete run: %v", err)
+	}
+}
+
+func TestRun_ContinueFrom(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data", "wal", "cache")
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		pvcOrder:     []string{"data", "wal", "cache"},
+		continueFrom: "wal",
+	}
+	buf := captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if got := okOrder(buf.String()); !reflect.DeepEqual(got, []string{"wal", "cache"}) {
+		t.Errorf("backed up %v, want [wal cache]", got)
+	}
+	if !strings.Contains(buf.String(), "  - data: before --continue-from wal\n") {
+		t.Errorf("output lacks the skipped PVC:\n%s", buf)
+	}
+
+	opts.continueFrom = "missing"
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err == nil {
+		t.Error("run() accepted an unknown --continue-from PVC")
+	}
+}
+
+// newFakeSnapshotter returns a Snapshotter whose VolumeSnapshots come back with status.
+func newFakeSnapshotter(status map[string]interface{}) *snapshot.Snapshotter {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{snapshot.Resource: "VolumeSnapshotList"})
+	client.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).Object["status"] = status
+		return false, nil, nil
+	})
+	return snapshot.New(client, false)
+}
+
+func TestRun_UseCSISnapshot(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal")
+	pv, err := client.CoreV1().PersistentVolumes().Get(context.Background(), "pv-data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv.Spec.PersistentVolumeSource = corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+		Driver:           "hostpath.csi.k8s.io",
+		VolumeAttributes: map[string]string{"path": paths["data"]},
+	}}
+	if _, err := client.CoreV1().PersistentVolumes().Update(context.Background(), pv, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		namespace:      "ns",
+		release:        "rel",
+		outputFormat:   "{pvc}.tar.gz",
+		outputDir:      t.TempDir(),
+		useCSISnapshot: true,
+		snapshotter:    newFakeSnapshotter(map[string]interface{}{"readyToUse": true}),
+	}
+	buf := captureOut(t)
+	rep := newRunReport("backup")
+	if err := run(context.Background(), client, opts, rep); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if got := okOrder(buf.String()); !reflect.DeepEqual(got, []string{"wal"}) {
+		t.Errorf("archived %v, want only the non-CSI wal", got)
+	}
+	if snaps := rep.Releases[0].Snapshots; len(snaps) != 1 || !strings.HasPrefix(snaps[0], "ns/data-") {
+		t.Errorf("snapshots = %v, want one of data", snaps)
+	}
+
+	// A snapshot that fails falls back to archiving the PVC
+	opts.snapshotter = newFakeSnapshotter(map[string]interface{}{"error": map[string]interface{}{"message": "not supported"}})
+	buf.Reset()
+	rep = newRunReport("backup")
+	if err := run(context.Background(), client, opts, rep); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	if got := okOrder(buf.String()); !reflect.DeepEqual(got, []string{"data", "wal"}) {
+		t.Errorf("archived %v, want both PVCs", got)
+	}
+	if snaps := rep.Releases[0].Snapshots; len(snaps) != 0 {
+		t.Errorf("snapshots = %v after a failed snapshot", snaps)
+	}
+}
+
+// gatedStore holds up the upload of gated until release is closed.
+type gatedStore struct {
+	store.Store
+	gated   string
+	release chan struct{}
+}
+
+func (g *gatedStore) UploadWithChecksum(ctx context.Context, archivePath, key, sum string, mode r2.ChecksumMode) error {
+	if key == g.gated {
+		<-g.release
+	}
+	return g.Store.UploadWithChecksum(ctx, archivePath, key, sum, mode)
+}
+
+func TestUploadPipeline_OverlapsBackup(t *testing.T) {
+	ctx := context.Background()
+	fs, err := store.NewFS(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pvcs []types.PVCInfo
+	for _, name := range []string{"data", "wal", "cache"} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, name+".txt"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pvcs = append(pvcs, types.PVCInfo{PVCName: name, HostPath: dir})
+	}
+
+	// data's upload only finishes once wal is being archived, which deadlocks unless the
+	// two overlap; the timeout turns that into a failure
+	dest := &gatedStore{Store: fs, gated: "data.tar.gz", release: make(chan struct{})}
+	check := func(ctx context.Context, pvc types.PVCInfo) error {
+		if pvc.PVCName == "wal" {
+			close(dest.release)
+		}
+		return nil
+	}
+	opts := options{pipelineDepth: 1, checksumMode: r2.ChecksumNone}
+	pipe := startUploadPipeline(ctx, dest, opts, "ns", "rel")
+	bk := backup.New(t.TempDir(), "{pvc}.tar.gz", false, backup.WithPVCheck(check), backup.WithOnResult(pipe.add))
+
+	done := make(chan []types.BackupResult)
+	go func() {
+		results := bk.BackupAll(ctx, pvcs, "ns", "rel")
+		pipe.wait()
+		done <- results
+	}()
+	var results []types.BackupResult
+	select {
+	case results = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload of data did not overlap the backup of wal")
+	}
+
+	for i, r := range results {
+		if r.Err != nil || r.PVCName != pvcs[i].PVCName {
+			t.Errorf("result %d = %+v, want %s backed up", i, r, pvcs[i].PVCName)
+		}
+	}
+	want := []string{fs.ObjectURL("data.tar.gz"), fs.ObjectURL("wal.tar.gz"), fs.ObjectURL("cache.tar.gz")}
+	if got := okOrder(pipe.output.String()); !reflect.DeepEqual(got, want) || pipe.failed != 0 {
+		t.Errorf("uploaded %v with %d failure(s), want %v in order", got, pipe.failed, want)
+	}
+}
+
+func TestRun_BacksUpPV(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	// The PVC is gone; its Retain PV and data are left
+	if err := client.CoreV1().PersistentVolumeClaims("ns").Delete(ctx, "data", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(ctx, "pv-data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "ns", Name: "data"}
+	pv.Status.Phase = corev1.VolumeReleased
+	if _, err := client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{namespace}_{release}_{pvc}.tar.gz",
+		outputDir:    outputDir,
+		checksumMode: r2.ChecksumNone,
+		pvs:          []string{"pv-data"},
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	if strings.Contains(buf.String(), "Scaling") {
+		t.Errorf("scaled workloads for a PV:\n%s", buf)
+	}
+
+	archive := filepath.Join(outputDir, "ns_rel_pv-data.tar.gz")
+	restored := t.TempDir()
+	if err := backup.ArchiverFor(archive).Extract(archive, restored, backup.ArchiveOptions{}); err != nil {
+		t.Fatalf("extracting %s: %v\n%s", archive, err, buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(restored, "data.txt")); err != nil || string(data) != "data" {
+		t.Errorf("archived data.txt = %q, %v; want the data of %s", data, err, paths["data"])
+	}
+}
+
+func TestRun_PipelineDepth(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data", "wal")
+	root := t.TempDir()
+	opts := options{
+		namespace:     "ns",
+		release:       "rel",
+		outputFormat:  "{pvc}-{date}.tar.gz",
+		outputDir:     t.TempDir(),
+		dest:          "fs://" + root,
+		checksumMode:  r2.ChecksumNone,
+		keepLast:      1,
+		pipelineDepth: 2,
+	}
+	for _, stale := range []string{"data-20200101-000000.tar.gz", "wal-20200101-000000.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(root, stale), bytes.Repeat([]byte("old "), 8), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := captureOut(t)
+	rep := newRunReport("backup")
+	if err := run(context.Background(), client, opts, rep); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	output := buf.String()
+	summary, upload, ok := strings.Cut(output, "Upload ===")
+	if !ok || !strings.Contains(summary, "=== Backup Summary ===") {
+		t.Fatalf("upload section missing or before the summary:\n%s", output)
+	}
+	if got := len(okOrder(upload)); got != 3 {
+		t.Errorf("%d upload(s) reported, want 2 and latest.json:\n%s", got, output)
+	}
+	if strings.Count(output, "  DEL   ") != 2 {
+		t.Errorf("rotation did not delete both stale backups:\n%s", output)
+	}
+	for _, p := range rep.Releases[0].Phases {
+		if (p.Name == phaseBackup || p.Name == phaseUpload) && p.Status != statusOK {
+			t.Errorf("phase %s = %s, want ok", p.Name, p.Status)
+		}
+	}
+}
+
+func TestRestore_RefusesRebindBeforeWipe(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal")
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+		checksumMode: r2.ChecksumNone,
+	}
+	buf := captureOut(t)
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("run() error: %v", err)
+	}
+	for _, name := range []string{"data", "wal"} {
+		if err := os.WriteFile(filepath.Join(paths[name], "keep"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pv-data moves to another directory after discovery has read it
+	elsewhere := t.TempDir()
+	var dataGets int
+	client.PrependReactor("get", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() != "pv-data" {
+			return false, nil, nil
+		}
+		if dataGets++; dataGets == 1 {
+			return false, nil, nil
+		}
+		return true, &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: elsewhere}},
+			},
+		}, nil
+	})
+
+	buf.Reset()
+	archives := []string{filepath.Join(opts.outputDir, "data.tar.gz"), filepath.Join(opts.outputDir, "wal.tar.gz")}
+	err := runRestore(context.Background(), client, opts, archives, newRunReport("restore"))
+	if err == nil {
+		t.Fatalf("runRestore() succeeded although pv-data moved\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), "  FAIL  data: not restoring into "+paths["data"]) {
+		t.Errorf("restore output lacks the refusal:\n%s", buf)
+	}
+	if _, err := os.Stat(filepath.Join(paths["data"], "keep")); err != nil {
+		t.Errorf("data's old host path was wiped: %v", err)
+	}
+	// The other PVC is still restored
+	if _, err := os.Stat(filepath.Join(paths["wal"], "keep")); !os.IsNotExist(err) {
+		t.Errorf("wal was not restored: %v", err)
+	}
+}
+
+func TestBackup_SkipUnchanged(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data", "wal")
+	root := t.TempDir()
+	opts := options{
+		namespace:     "ns",
+		release:       "rel",
+		outputFormat:  "{namespace}_{release}_{pvc}.tar.gz",
+		outputDir:     t.TempDir(),
+		dest:          "fs://" + root,
+		unchangedFile: filepath.Join(t.TempDir(), "fingerprints.json"),
+	}
+	buf := captureOut(t)
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("first run: %v\n%s", err, buf)
+	}
+	if strings.Contains(buf.String(), "SKIP") {
+		t.Fatalf("first run skipped a PVC:\n%s", buf)
+	}
+
+	if err := os.WriteFile(filepath.Join(paths["wal"], "segment"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "ns_rel_data.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+		t.Fatalf("second run: %v\n%s", err, buf)
+	}
+	if !strings.Contains(buf.String(), "SKIP  data: unchanged since the last backup") {
+		t.Errorf("unchanged PVC not skipped:\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), "OK    wal -> ") {
+		t.Errorf("changed PVC not backed up:\n%s", buf)
+	}
+	if _, err := os.Stat(filepath.Join(root, "ns_rel_data.tar.gz")); err == nil {
+		t.Error("unchanged PVC uploaded again")
+	}
+}
+
+func TestBackup_RequireWorkload(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "rel", "data", "wal")
+	opts := options{
+		namespace:       "ns",
+		release:         "rel",
+		outputFormat:    "{namespace}_{release}_{pvc}.tar.gz",
+		outputDir:       t.TempDir(),
+		requireWorkload: true,
+	}
+	buf := captureOut(t)
+	err := run(context.Background(), client, opts, newRunReport("backup"))
+	if err == nil || !strings.Contains(err.Error(), "no workload mounts 2 selected PVC(s): data, wal") {
+		t.Fatalf("run() error = %v, want both orphans named\n%s", err, buf)
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 0 {
+		t.Errorf("archives written despite --require-workload: %v", entries)
+	}
+
+	w := &types.WorkloadInfo{Kind: "StatefulSet", Name: "db", Namespace: "ns"}
+	if err := requireWorkloads([]types.PVCInfo{{PVCName: "data", Workload: w}}); err != nil {
+		t.Errorf("requireWorkloads() with a workload = %v", err)
+	}
+}
+
+func TestBackup_MultipleReleases(t *testing.T) {
+	client, _ := newFakeRelease(t, "ns", "shop", "shop-data")
+	newFakePVC(t, client, "ns", "blog", "blog-data")
+	newFakePVC(t, client, "ns", "wiki", "wiki-data")
+	opts := options{
+		namespace:    "ns",
+		release:      "shop",
+		releases:     []string{"shop", "blog"},
+		outputFormat: "{namespace}_{release}_{pvc}.tar.gz",
+		outputDir:    t.TempDir(),
+	}
+	buf := captureOut(t)
+	rep := newRunReport("backup")
+	if err := run(context.Background(), client, opts, rep); err != nil {
+		t.Fatalf("run() error: %v\n%s", err, buf)
+	}
+	for _, name := range []string{"ns_shop_shop-data.tar.gz", "ns_blog_blog-data.tar.gz"} {
+		if _, err := os.Stat(filepath.Join(opts.outputDir, name)); err != nil {
+			t.Errorf("archive %s missing: %v", name, err)
+		}
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 2 {
+		t.Errorf("archives = %v, want wiki left out", entries)
+	}
+	if !strings.Contains(buf.String(), "##### ns/shop #####") || !strings.Contains(buf.String(), "##### ns/blog #####") {
+		t.Errorf("output not grouped by release:\n%s", buf)
+	}
+	if len(rep.Releases) != 2 || rep.Releases[0].Release != "shop" || rep.Releases[1].Release != "blog" {
+		t.Errorf("report releases = %v, want shop and blog", rep.Releases)
+	}
+
+	// A release without PVCs fails the run before anything is archived
+	opts.releases, opts.outputDir = []string{"shop", "typo"}, t.TempDir()
+	if err := run(context.Background(), client, opts, newRunReport("backup")); err == nil || !strings.Contains(err.Error(), "release typo") {
+		t.Fatalf("run() with an unknown release error = %v", err)
+	}
+	if entries, _ := os.ReadDir(opts.outputDir); len(entries) != 0 {
+		t.Errorf("archives written despite a failed discovery: %v", entries)
+	}
+}
+
+func TestDedupStore_SharesBlobsAcrossReleases(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	buf := captureOut(t)
+	for _, release := range []string{"shop", "blog"} {
+		client, _ := newFakeRelease(t, "ns", release, "data")
+		opts := options{
+			namespace:     "ns",
+			release:       release,
+			outputFormat:  "{namespace}/{release}/{pvc}/{date}.tar.gz",
+			outputDir:     t.TempDir(),
+			dest:          "fs://" + root,
+			objectPerFile: true,
+			dedupStore:    true,
+		}
+		if err := run(ctx, client, opts, newRunReport("backup")); err != nil {
+			t.Fatalf("run(%s) error: %v\n%s", release, err, buf)
+		}
+	}
+	// Both volumes hold data.txt with the same content
+	blobs, _ := os.ReadDir(filepath.Join(root, filepath.FromSlash(perfile.BlobPrefix)))
+	if len(blobs) != 1 {
+		t.Fatalf("blobs = %v, want the shared file stored once\n%s", blobs, buf)
+	}
+
+	client, paths := newFakeRelease(t, "ns", "blog", "data")
+	os.WriteFile(filepath.Join(paths["data"], "data.txt"), []byte("changed"), 0644)
+	opts := options{
+		namespace:     "ns",
+		release:       "blog",
+		outputFormat:  "{namespace}/{release}/{pvc}/{date}.tar.gz",
+		outputDir:     t.TempDir(),
+		dest:          "fs://" + root,
+		objectPerFile: true,
+	}
+	buf.Reset()
+	if err := runRestore(ctx, client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore() error: %v\n%s", err, buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(paths["data"], "data.txt")); err != nil || string(data) != "data" {
+		t.Errorf("data.txt = %q, %v; want the content of the shared blob", data, err)
+	}
+}
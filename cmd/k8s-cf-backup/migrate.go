@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+)
+
+// migration re-keys one archive, together with its checksum sidecar when it has one.
+type migration struct {
+	from    string
+	to      string
+	size    int64
+	sidecar bool
+}
+
+// templatePrefix is the part of format before its first {pvc}, {storageClass} or {date},
+// with {namespace} and {release} filled in: the narrowest prefix that lists every archive
+// of the release.
+func templatePrefix(format, namespace, release string) string {
+	prefix := strings.NewReplacer("{namespace}", namespace, "{release}", release).Replace(format)
+	for _, p := range []string{"{pvc}", "{storageClass}", "{date}"} {
+		if i := strings.Index(prefix, p); i >= 0 {
+			prefix = prefix[:i]
+		}
+	}
+	return prefix
+}
+
+// migrationPattern matches whole keys written with format for namespace/release, capturing
+// the PVC name, storage class, date and archive extension, with suffix if the key has it.
+// Unlike parseArchiveName it matches the full key, so formats that put the PVC in a
+// "directory" can be re-keyed too.
+func migrationPattern(format, namespace, release, suffix string) *regexp.Regexp {
+	base, ext := backup.SplitArchiveExtension(format)
+	pattern := regexp.QuoteMeta(base)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{namespace}"), regexp.QuoteMeta(namespace))
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{release}"), regexp.QuoteMeta(release))
+	pattern = strings.Replace(pattern, regexp.QuoteMeta("{pvc}"), "(?P<pvc>.+?)", 1)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{pvc}"), ".+?")
+	pattern = strings.Replace(pattern, regexp.QuoteMeta("{storageClass}"), "(?P<storageClass>[^/]+?)", 1)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{storageClass}"), "[^/]+?")
+	pattern = strings.Replace(pattern, regexp.QuoteMeta("{date}"), `(?P<date>\d{8}-\d{6})`, 1)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{date}"), `\d{8}-\d{6}`)
+	if ext != "" {
+		pattern += "(?P<ext>" + backup.ArchiveExtensionPattern(suffix) + ")"
+	}
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// migrationKey returns the key obj gets under toFormat, or false when obj's key does not
+// follow the pattern. The PVC name, storage class and archive extension are kept from the
+// old key; {date} is the time the backup was taken, so the new key sorts and rotates like
+// the old one.
+func migrationKey(obj r2.ObjectInfo, from *regexp.Regexp, toFormat, namespace, release string) (string, bool) {
+	m := from.FindStringSubmatch(obj.Key)
+	if m == nil {
+		return "", false
+	}
+	group := func(name string) string {
+		if i := from.SubexpIndex(name); i >= 0 {
+			return m[i]
+		}
+		return ""
+	}
+
+	base, ext := backup.SplitArchiveExtension(toFormat)
+	if group("ext") != "" {
+		ext = group("ext")
+	}
+	key := strings.NewReplacer(
+		"{namespace}", namespace,
+		"{release}", release,
+		"{pvc}", group("pvc"),
+		"{storageClass}", group("storageClass"),
+		"{date}", store.BackupTime(obj).Format("20060102-150405"),
+	).Replace(base)
+	return key + ext, true
+}
+
+// planMigration maps the archives among objects that match fromFormat for
+// namespace/fromRelease to their keys under toFormat for namespace/toRelease. Objects that
+// don't match are left alone. Two archives mapping to the same key is an error, as one
+// would overwrite the other. suffix is the archive suffix keys may end with.
+func planMigration(objects []r2.ObjectInfo, fromFormat, toFormat, namespace, fromRelease, toRelease, suffix string) ([]migration, error) {
+	listed := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		listed[obj.Key] = true
+	}
+
+	// The class is only known from the old key, not the cluster
+	if strings.Contains(toFormat, "{storageClass}") && !strings.Contains(fromFormat, "{storageClass}") {
+		return nil, fmt.Errorf("--output-format uses {storageClass} but --from-format does not, so the storage class of existing archives is unknown")
+	}
+	from := migrationPattern(fromFormat, namespace, fromRelease, suffix)
+	sources := make(map[string]string)
+	var plan []migration
+	for _, obj := range objects {
+		if !backup.IsArchive(backup.TrimArchiveSuffix(obj.Key, suffix)) {
+			continue
+		}
+		to, ok := migrationKey(obj, from, toFormat, namespace, toRelease)
+		if !ok {
+			continue
+		}
+		if other, dup := sources[to]; dup {
+			return nil, fmt.Errorf("%s and %s would both migrate to %s (does the new --output-format include {pvc} and {date}?)", other, obj.Key, to)
+		}
+		sources[to] = obj.Key
+		plan = append(plan, migration{from: obj.Key, to: to, size: obj.Size, sidecar: listed[obj.Key+r2.SidecarSuffix]})
+	}
+	return plan, nil
+}
+
+// openMigrationTarget returns the store migrate copies to: --to-r2-credentials or --to-dest,
+// or the source store itself when neither is given.
+func openMigrationTarget(opts options) (store.Store, error) {
+	switch {
+	case opts.toR2Creds != "":
+		creds, err := r2.LoadCredentials(opts.toR2Creds)
+		if err != nil {
+			return nil, fmt.Errorf("target r2 credentials: %w", err)
+		}
+		return newR2Client(creds, opts)
+	case opts.toDest != "":
+		return store.Open(opts.toDest, opts.verbose)
+	}
+	return openStore(opts)
+}
+
+// runMigrate re-keys the archives of a release from --from-format to --output-format,
+// optionally into another bucket, release name or --dest.
+func runMigrate(ctx context.Context, opts options) error {
+	src, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	dst, err := openMigrationTarget(opts)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, src, dst, opts)
+}
+
+func migrate(ctx context.Context, src, dst store.Store, opts options) error {
+	fromFormat, toRelease := opts.fromFormat, opts.toRelease
+	if fromFormat == "" {
+		fromFormat = opts.outputFormat
+	}
+	if toRelease == "" {
+		toRelease = opts.release
+	}
+
+	prefix := templatePrefix(fromFormat, opts.namespace, opts.release)
+	fmt.Fprintf(out, "Listing %s...\n", src.ObjectURL(prefix))
+	objects, err := src.ListByPrefix(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	plan, err := planMigration(objects, fromFormat, opts.outputFormat, opts.namespace, opts.release, toRelease, opts.archiveSuffix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Found %d archive(s) to migrate.\n", len(plan))
+
+	if opts.dryRun {
+		fmt.Fprintln(out, "\n=== DRY RUN ===")
+		fmt.Fprintln(out, "\nWould copy:")
+		for _, m := range plan {
+			fmt.Fprintf(out, "  - %s -> %s\n", src.ObjectURL(m.from), dst.ObjectURL(m.to))
+		}
+		if opts.deleteSource && len(plan) > 0 {
+			fmt.Fprintln(out, "\nWould delete each source after it is copied.")
+		}
+		return nil
+	}
+
+	var failed int
+	for _, m := range plan {
+		if src.ObjectURL(m.from) == dst.ObjectURL(m.to) {
+			fmt.Fprintf(out, "  SKIP  %s: key unchanged\n", m.from)
+			continue
+		}
+
+		// An earlier, interrupted run may have copied the archive already
+		info, err := dst.Stat(ctx, m.to)
+		copied := err == nil && info.Size == m.size
+		if err := migrateOne(ctx, src, dst, m, !copied); err != nil {
+			fmt.Fprintf(out, "  FAIL  %s: %v\n", m.from, err)
+			failed++
+			continue
+		}
+		if copied {
+			fmt.Fprintf(out, "  SKIP  %s: already at %s\n", m.from, dst.ObjectURL(m.to))
+		} else {
+			fmt.Fprintf(out, "  OK    %s -> %s (%s)\n", m.from, dst.ObjectURL(m.to), formatSize(m.size))
+		}
+
+		if !opts.deleteSource {
+			continue
+		}
+		keys := []string{m.from}
+		if m.sidecar {
+			keys = append(keys, m.from+r2.SidecarSuffix)
+		}
+		for _, key := range keys {
+			if err := src.Delete(ctx, key); err != nil {
+				fmt.Fprintf(out, "  FAIL  %s: %v\n", key, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(out, "  DEL   %s\n", src.ObjectURL(key))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d object(s) failed to migrate (see above)", failed)
+	}
+	return nil
+}
+
+// migrateOne copies the archive of m, unless copyArchive is false, and then its sidecar.
+// The sidecar names the archive file, so it is rewritten for the new key rather than
+// copied as is.
+func migrateOne(ctx context.Context, src, dst store.Store, m migration, copyArchive bool) error {
+	if copyArchive {
+		if err := store.Copy(ctx, src, dst, m.from, m.to); err != nil {
+			return err
+		}
+	}
+	if !m.sidecar {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-sidecar-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := src.Download(ctx, m.from+r2.SidecarSuffix, tmp.Name()); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum sidecar %s", m.from+r2.SidecarSuffix)
+	}
+	line := fmt.Sprintf("%s  %s\n", fields[0], path.Base(m.to))
+	if err := os.WriteFile(tmp.Name(), []byte(line), 0644); err != nil {
+		return err
+	}
+	return dst.Upload(ctx, tmp.Name(), m.to+r2.SidecarSuffix)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+)
+
+func TestTemplatePrefix(t *testing.T) {
+	tests := map[string]string{
+		"{namespace}_{release}_{date}_{pvc}.tar.gz":  "ns_rel_",
+		"backups/{namespace}/{release}/{pvc}/{date}": "backups/ns/rel/",
+		"{release}-{pvc}.tar.gz":                     "rel-",
+		"{pvc}.tar.gz":                               "",
+	}
+	for format, want := range tests {
+		if got := templatePrefix(format, "ns", "rel"); got != want {
+			t.Errorf("templatePrefix(%q) = %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestMigrationKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		from, to string
+		fromRel  string
+		toRel    string
+		want     string
+	}{
+		{
+			name:    "flat to nested",
+			key:     "ns_rel_20240101-120000_redis-data.tar.gz",
+			from:    defaultOutputFormat,
+			to:      "{namespace}/{release}/{pvc}/{date}.tar.gz",
+			fromRel: "rel",
+			toRel:   "rel",
+			want:    "ns/rel/redis-data/20240101-120000.tar.gz",
+		},
+		{
+			name:    "release rename keeps extension",
+			key:     "ns_old_20240101-120000_data.tar.zst.enc",
+			from:    defaultOutputFormat,
+			to:      defaultOutputFormat,
+			fromRel: "old",
+			toRel:   "new",
+			want:    "ns_new_20240101-120000_data.tar.zst.enc",
+		},
+		{
+			name:    "new prefix",
+			key:     "ns/rel/data/20240101-120000.zip",
+			from:    "{namespace}/{release}/{pvc}/{date}.tar.gz",
+			to:      "cluster-a/{namespace}_{release}_{date}_{pvc}.tar.gz",
+			fromRel: "rel",
+			toRel:   "rel",
+			want:    "cluster-a/ns_rel_20240101-120000_data.zip",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pattern := migrationPattern(tc.from, "ns", tc.fromRel, "")
+			got, ok := migrationKey(r2.ObjectInfo{Key: tc.key}, pattern, tc.to, "ns", tc.toRel)
+			if !ok || got != tc.want {
+				t.Errorf("migrationKey(%q) = %q, %v; want %q", tc.key, got, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrationKey_DateFromModTime(t *testing.T) {
+	mtime := time.Date(2024, 3, 4, 5, 6, 7, 0, time.Local)
+	pattern := migrationPattern("{namespace}-{release}-{pvc}.tar.gz", "ns", "rel", "")
+	got, ok := migrationKey(r2.ObjectInfo{Key: "ns-rel-data.tar.gz", LastModified: mtime}, pattern, defaultOutputFormat, "ns", "rel")
+	if want := "ns_rel_20240304-050607_data.tar.gz"; !ok || got != want {
+		t.Errorf("migrationKey() = %q, %v; want %q", got, ok, want)
+	}
+}
+
+func TestMigrationKey_NoMatch(t *testing.T) {
+	pattern := migrationPattern(defaultOutputFormat, "ns", "rel", "")
+	for _, key := range []string{"ns_other_20240101-120000_data.tar.gz", "ns_rel_latest_data.tar.gz", "ns_rel_20240101-120000_data.txt"} {
+		if got, ok := migrationKey(r2.ObjectInfo{Key: key}, pattern, defaultOutputFormat, "ns", "rel"); ok {
+			t.Errorf("migrationKey(%q) = %q, want no match", key, got)
+		}
+	}
+}
+
+func TestPlanMigration(t *testing.T) {
+	objects := []r2.ObjectInfo{
+		{Key: "ns_rel_20240102-000000_data.tar.gz", Size: 2},
+		{Key: "ns_rel_20240102-000000_data.tar.gz.sha256"},
+		{Key: "ns_rel_20240101-000000_data.tar.gz", Size: 1},
+		{Key: "ns_rel_notes.txt"},
+	}
+	plan, err := planMigration(objects, defaultOutputFormat, "{namespace}/{release}/{pvc}/{date}.tar.gz", "ns", "rel", "rel", "")
+	if err != nil {
+		t.Fatalf("planMigration: %v", err)
+	}
+	want := []migration{
+		{from: "ns_rel_20240102-000000_data.tar.gz", to: "ns/rel/data/20240102-000000.tar.gz", size: 2, sidecar: true},
+		{from: "ns_rel_20240101-000000_data.tar.gz", to: "ns/rel/data/20240101-000000.tar.gz", size: 1},
+	}
+	if !slices.Equal(plan, want) {
+		t.Errorf("plan = %+v, want %+v", plan, want)
+	}
+
+	// Without {date} every archive of a PVC lands on the same key
+	if _, err := planMigration(objects, defaultOutputFormat, "{namespace}/{release}/{pvc}.tar.gz", "ns", "rel", "rel", ""); err == nil {
+		t.Error("planMigration succeeded although two archives map to one key")
+	}
+
+	// Archives with the --archive-suffix keep it under their new key
+	suffixed := []r2.ObjectInfo{{Key: "ns_rel_20240102-000000_data.tar.gz.bak", Size: 2}}
+	plan, err = planMigration(suffixed, defaultOutputFormat, "{namespace}/{release}/{pvc}/{date}.tar.gz", "ns", "rel", "rel", ".bak")
+	if err != nil || len(plan) != 1 || plan[0].to != "ns/rel/data/20240102-000000.tar.gz.bak" {
+		t.Errorf("planMigration(suffixed) = %+v, %v", plan, err)
+	}
+}
+
+// seedSum is the SHA-256 of the archives seedMigration uploads.
+const seedSum = "0eb3e36bfb24dcd9bb1d1bece1531216b59539a8fde17ee80224af0653c92aa3"
+
+// seedMigration uploads the given archive keys to a new FS store, each with a sidecar.
+func seedMigration(t *testing.T, keys ...string) (string, store.Store) {
+	t.Helper()
+	root := t.TempDir()
+	s, err := store.NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := os.WriteFile(archive, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := s.UploadWithChecksum(context.Background(), archive, key, seedSum, r2.ChecksumSidecar); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, s
+}
+
+func listKeys(t *testing.T, s store.Store) []string {
+	t.Helper()
+	objects, err := s.ListByPrefix(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestMigrate_FS(t *testing.T) {
+	ctx := context.Background()
+	_, src := seedMigration(t, "ns_old_20240101-000000_data.tar.gz", "ns_old_20240102-000000_data.tar.gz", "ns_other_20240101-000000_data.tar.gz")
+	dstRoot, dst := seedMigration(t)
+
+	opts := options{
+		namespace:    "ns",
+		release:      "old",
+		toRelease:    "new",
+		fromFormat:   defaultOutputFormat,
+		outputFormat: "{namespace}/{release}/{pvc}/{date}.tar.gz",
+		deleteSource: true,
+	}
+
+	captureOut(t)
+	dry := opts
+	dry.dryRun = true
+	if err := migrate(ctx, src, dst, dry); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if keys := listKeys(t, dst); len(keys) != 0 {
+		t.Fatalf("dry run copied %v", keys)
+	}
+
+	if err := migrate(ctx, src, dst, opts); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	wantDst := []string{
+		"ns/new/data/20240101-000000.tar.gz",
+		"ns/new/data/20240101-000000.tar.gz.sha256",
+		"ns/new/data/20240102-000000.tar.gz",
+		"ns/new/data/20240102-000000.tar.gz.sha256",
+	}
+	if got := listKeys(t, dst); !slices.Equal(got, wantDst) {
+		t.Errorf("destination keys = %v, want %v", got, wantDst)
+	}
+	// Only the migrated release is removed from the source
+	wantSrc := []string{"ns_other_20240101-000000_data.tar.gz", "ns_other_20240101-000000_data.tar.gz.sha256"}
+	if got := listKeys(t, src); !slices.Equal(got, wantSrc) {
+		t.Errorf("source keys = %v, want %v", got, wantSrc)
+	}
+
+	sidecar, err := os.ReadFile(filepath.Join(dstRoot, "ns", "new", "data", "20240101-000000.tar.gz.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := seedSum + "  20240101-000000.tar.gz\n"; string(sidecar) != want {
+		t.Errorf("sidecar = %q, want %q", sidecar, want)
+	}
+}
+
+func TestMigrate_RerunSkipsCopiedArchives(t *testing.T) {
+	ctx := context.Background()
+	_, s := seedMigration(t, "ns_rel_20240101-000000_data.tar.gz")
+	opts := options{namespace: "ns", release: "rel", fromFormat: defaultOutputFormat, outputFormat: "{namespace}/{release}/{pvc}/{date}.tar.gz"}
+
+	captureOut(t)
+	if err := migrate(ctx, s, s, opts); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	buf := captureOut(t)
+	if err := migrate(ctx, s, s, opts); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	if !strings.Contains(buf.String(), "SKIP  ns_rel_20240101-000000_data.tar.gz: already at") {
+		t.Errorf("second run did not skip the copied archive:\n%s", buf)
+	}
+	want := []string{
+		"ns/rel/data/20240101-000000.tar.gz",
+		"ns/rel/data/20240101-000000.tar.gz.sha256",
+		"ns_rel_20240101-000000_data.tar.gz",
+		"ns_rel_20240101-000000_data.tar.gz.sha256",
+	}
+	if got := listKeys(t, s); !slices.Equal(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+}
+
+func TestPlanMigration_StorageClass(t *testing.T) {
+	objects := []r2.ObjectInfo{{Key: "local-ssd/ns_rel_20240101-000000_data.tar.gz"}}
+	from := "{storageClass}/{namespace}_{release}_{date}_{pvc}.tar.gz"
+	plan, err := planMigration(objects, from, "{namespace}/{storageClass}/{pvc}/{date}.tar.gz", "ns", "rel", "rel", "")
+	if err != nil {
+		t.Fatalf("planMigration: %v", err)
+	}
+	if want := "ns/local-ssd/data/20240101-000000.tar.gz"; len(plan) != 1 || plan[0].to != want {
+		t.Errorf("plan = %+v, want the key %q", plan, want)
+	}
+
+	if _, err := planMigration(objects, defaultOutputFormat, from, "ns", "rel", "rel", ""); err == nil {
+		t.Error("planMigration succeeded although the source format has no storage class")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes. pflag already exits with 2 on a bad command line.
+const (
+	exitOK     = 0
+	exitFailed = 1
+	// exitScaledDown means scale-back failed, so workloads may still be at 0 replicas.
+	exitScaledDown = 3
+)
+
+// Phase names, in the order they run.
+const (
+	phaseDiscover  = "discover"
+	phaseDownload  = "download"
+	phaseScaleDown = "scale-down"
+	phaseBackup    = "backup"
+	phaseRestore   = "restore"
+	phaseUpload    = "upload"
+	phaseScaleBack = "scale-back"
+)
+
+var (
+	backupPhases  = []string{phaseDiscover, phaseScaleDown, phaseBackup, phaseUpload, phaseScaleBack}
+	restorePhases = []string{phaseDiscover, phaseDownload, phaseScaleDown, phaseRestore, phaseScaleBack}
+)
+
+const (
+	statusOK      = "ok"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// phaseResult is the outcome of one phase of a run, with how long it took when the phase
+// was started with releaseReport.start.
+type phaseResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"duration_seconds,omitempty"`
+}
+
+// releaseReport tracks the phases of a backup or restore for one namespace/release.
+// Phases that never run (dry-run, nothing to do, or an earlier failure) stay "skipped".
+type releaseReport struct {
+	Namespace string        `json:"namespace"`
+	Release   string        `json:"release"`
+	Status    string        `json:"status"`
+	Phases    []phaseResult `json:"phases"`
+	PVCs      []string      `json:"pvcs,omitempty"`      // PVCs backed up or restored successfully
+	Bytes     int64         `json:"bytes,omitempty"`     // their archive size on backup, restored file size on restore
+	Snapshots []string      `json:"snapshots,omitempty"` // namespace/name of VolumeSnapshots taken instead of archives
+
+	started map[string]time.Time
+}
+
+func newReleaseReport(namespace, release string, phases []string) *releaseReport {
+	r := &releaseReport{Namespace: namespace, Release: release, Status: statusOK, started: make(map[string]time.Time)}
+	for _, name := range phases {
+		r.Phases = append(r.Phases, phaseResult{Name: name, Status: statusSkipped})
+	}
+	return r
+}
+
+// start marks the beginning of a phase, so that set records its duration.
+func (r *releaseReport) start(name string) {
+	r.startAt(name, time.Now())
+}
+
+// startAt is start for a phase that began at t, such as a discovery shared by releases.
+func (r *releaseReport) startAt(name string, t time.Time) {
+	r.started[name] = t
+}
+
+// set records the outcome of a phase: ok when err is nil, failed otherwise.
+func (r *releaseReport) set(name string, err error) {
+	for i := range r.Phases {
+		if r.Phases[i].Name != name {
+			continue
+		}
+		if t, ok := r.started[name]; ok {
+			r.Phases[i].Duration = time.Since(t)
+			r.Phases[i].Seconds = r.Phases[i].Duration.Seconds()
+		}
+		if err != nil {
+			r.Phases[i].Status = statusFailed
+			r.Phases[i].Error = err.Error()
+			r.Status = statusFailed
+		} else {
+			r.Phases[i].Status = statusOK
+			r.Phases[i].Error = ""
+		}
+		return
+	}
+}
+
+func (r *releaseReport) failed(name string) bool {
+	for _, p := range r.Phases {
+		if p.Name == name {
+			return p.Status == statusFailed
+		}
+	}
+	return false
+}
+
+// runReport aggregates the release reports of one invocation.
+type runReport struct {
+	Command  string           `json:"command"`
+	Started  time.Time        `json:"started"`
+	Status   string           `json:"status"`
+	ExitCode int              `json:"exit_code"`
+	Error    string           `json:"error,omitempty"`
+	PlanHash string           `json:"plan_hash,omitempty"`
+	Seconds  float64          `json:"duration_seconds"` // wall-clock time of the whole run
+	Releases []*releaseReport `json:"releases"`
+
+	duration time.Duration
+	mu       sync.Mutex // guards Releases while --targets run in parallel
+}
+
+func newRunReport(command string) *runReport {
+	return &runReport{Command: command, Status: statusOK, Started: time.Now()}
+}
+
+func (r *runReport) add(namespace, release string) *releaseReport {
+	phases := backupPhases
+	if r.Command == "restore" {
+		phases = restorePhases
+	}
+	rel := newReleaseReport(namespace, release, phases)
+	r.mu.Lock()
+	r.Releases = append(r.Releases, rel)
+	r.mu.Unlock()
+	return rel
+}
+
+// finish settles the overall status and exit code from the phases and the run's error.
+// A failed scale-back takes precedence because a release left scaled down is an outage.
+func (r *runReport) finish(err error) {
+	r.duration = time.Since(r.Started)
+	r.Seconds = r.duration.Seconds()
+	r.ExitCode = exitOK
+	if err != nil {
+		r.Error = err.Error()
+		r.ExitCode = exitFailed
+	}
+	for _, rel := range r.Releases {
+		if rel.Status == statusFailed && r.ExitCode == exitOK {
+			r.ExitCode = exitFailed
+		}
+		if rel.failed(phaseScaleBack) {
+			r.ExitCode = exitScaledDown
+		}
+	}
+	if r.ExitCode != exitOK {
+		r.Status = statusFailed
+	}
+}
+
+// print writes a human-readable phase summary.
+func (r *runReport) print(w io.Writer) {
+	fmt.Fprintln(w, "\n=== Phase Summary ===")
+	for _, rel := range r.Releases {
+		if len(r.Releases) > 1 {
+			fmt.Fprintf(w, "%s/%s:\n", rel.Namespace, rel.Release)
+		}
+		for _, p := range rel.Phases {
+			switch p.Status {
+			case statusFailed:
+				fmt.Fprintf(w, "  FAIL  %s: %s\n", p.Name, p.Error)
+			case statusSkipped:
+				fmt.Fprintf(w, "  SKIP  %s\n", p.Name)
+			default:
+				fmt.Fprintf(w, "  OK    %s\n", p.Name)
+			}
+		}
+	}
+	if r.ExitCode == exitScaledDown {
+		fmt.Fprintln(w, "\nWARNING: some workloads could not be scaled back and may still be at 0 replicas.")
+	}
+}
+
+// printTiming writes how long each phase that ran took, per release, and the total
+// wall-clock time of the run, e.g. "discover: 1.2s, scale-down: 45s, backup: 12m0s".
+func (r *runReport) printTiming(w io.Writer) {
+	fmt.Fprintln(w, "\n=== Timing ===")
+	for _, rel := range r.Releases {
+		var parts []string
+		for _, p := range rel.Phases {
+			if p.Status != statusSkipped {
+				parts = append(parts, fmt.Sprintf("%s: %s", p.Name, formatDuration(p.Duration)))
+			}
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "no phases ran")
+		}
+		if len(r.Releases) > 1 {
+			fmt.Fprintf(w, "  %s/%s: %s\n", rel.Namespace, rel.Release, strings.Join(parts, ", "))
+		} else {
+			fmt.Fprintf(w, "  %s\n", strings.Join(parts, ", "))
+		}
+	}
+	fmt.Fprintf(w, "  total: %s\n", formatDuration(r.duration))
+}
+
+// appendSummary appends the report to the --summary-file at path as one line of JSON, so
+// the file keeps a record per run after the pod and its logs are gone.
+func (r *runReport) appendSummary(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (r *runReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunReport_Finish(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(r *runReport)
+		err      error
+		wantCode int
+		wantStat string
+	}{
+		{
+			name: "all ok",
+			setup: func(r *runReport) {
+				rel := r.add("ns", "rel")
+				rel.set(phaseDiscover, nil)
+				rel.set(phaseBackup, nil)
+			},
+			wantCode: exitOK,
+			wantStat: statusOK,
+		},
+		{
+			name: "backup failed",
+			setup: func(r *runReport) {
+				r.add("ns", "rel").set(phaseBackup, errors.New("disk full"))
+			},
+			err:      errors.New("some backups failed"),
+			wantCode: exitFailed,
+			wantStat: statusFailed,
+		},
+		{
+			name: "scale-back failed without run error",
+			setup: func(r *runReport) {
+				rel := r.add("ns", "rel")
+				rel.set(phaseBackup, nil)
+				rel.set(phaseScaleBack, errors.New("conflict"))
+			},
+			wantCode: exitScaledDown,
+			wantStat: statusFailed,
+		},
+		{
+			name: "scale-back failure wins over other failures",
+			setup: func(r *runReport) {
+				r.add("ns", "a").set(phaseUpload, errors.New("timeout"))
+				r.add("ns", "b").set(phaseScaleBack, errors.New("conflict"))
+			},
+			err:      errors.New("upload failed"),
+			wantCode: exitScaledDown,
+			wantStat: statusFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRunReport("backup")
+			tc.setup(r)
+			r.finish(tc.err)
+			if r.ExitCode != tc.wantCode {
+				t.Errorf("ExitCode = %d, want %d", r.ExitCode, tc.wantCode)
+			}
+			if r.Status != tc.wantStat {
+				t.Errorf("Status = %q, want %q", r.Status, tc.wantStat)
+			}
+		})
+	}
+}
+
+func TestRunReport_PhasesByCommand(t *testing.T) {
+	backupRel := newRunReport("backup").add("ns", "rel")
+	restoreRel := newRunReport("restore").add("ns", "rel")
+
+	var names []string
+	for _, p := range restoreRel.Phases {
+		names = append(names, p.Name)
+		if p.Status != statusSkipped {
+			t.Errorf("phase %s starts as %q, want %q", p.Name, p.Status, statusSkipped)
+		}
+	}
+	if got := strings.Join(names, ","); got != "discover,download,scale-down,restore,scale-back" {
+		t.Errorf("restore phases = %s", got)
+	}
+	if len(backupRel.Phases) != len(backupPhases) {
+		t.Errorf("backup phases = %d, want %d", len(backupRel.Phases), len(backupPhases))
+	}
+}
+
+func TestRunReport_Output(t *testing.T) {
+	r := newRunReport("backup")
+	rel := r.add("ns", "rel")
+	rel.set(phaseDiscover, nil)
+	rel.set(phaseScaleBack, errors.New("conflict"))
+	r.finish(nil)
+
+	var human bytes.Buffer
+	r.print(&human)
+	for _, want := range []string{"OK    discover", "FAIL  scale-back: conflict", "SKIP  upload", "WARNING"} {
+		if !strings.Contains(human.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, human.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeJSON(&buf); err != nil {
+		t.Fatalf("writeJSON() error: %v", err)
+	}
+	var decoded runReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if decoded.ExitCode != exitScaledDown || decoded.Status != statusFailed {
+		t.Errorf("decoded = %+v", &decoded)
+	}
+	if p := decoded.Releases[0].Phases[len(backupPhases)-1]; p.Name != phaseScaleBack || p.Error != "conflict" {
+		t.Errorf("scale-back phase = %+v", p)
+	}
+}
+
+func TestRunReport_Timing(t *testing.T) {
+	r := newRunReport("backup")
+	rel := r.add("ns", "rel")
+	rel.startAt(phaseDiscover, time.Now().Add(-1500*time.Millisecond))
+	rel.set(phaseDiscover, nil)
+	rel.start(phaseBackup)
+	rel.set(phaseBackup, nil)
+	r.finish(nil)
+
+	if d := rel.Phases[0].Duration; d < 1500*time.Millisecond || d > time.Minute {
+		t.Errorf("discover took %s, want about 1.5s", d)
+	}
+
+	var buf bytes.Buffer
+	r.printTiming(&buf)
+	got := buf.String()
+	if !strings.Contains(got, "  discover: 1.5s, backup: 0s\n") || !strings.Contains(got, "  total: ") {
+		t.Errorf("timing output:\n%s", got)
+	}
+
+	buf.Reset()
+	if err := r.writeJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Seconds  float64 `json:"duration_seconds"`
+		Releases []struct {
+			Phases []struct {
+				Name    string  `json:"name"`
+				Seconds float64 `json:"duration_seconds"`
+			} `json:"phases"`
+		} `json:"releases"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if p := decoded.Releases[0].Phases[0]; p.Name != phaseDiscover || p.Seconds < 1.5 {
+		t.Errorf("JSON discover phase = %+v, want at least 1.5s", p)
+	}
+	if decoded.Seconds < 0 {
+		t.Errorf("JSON duration_seconds = %v", decoded.Seconds)
+	}
+}
+
+func TestRunReport_AppendSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backups.jsonl")
+	for i, runErr := range []error{nil, errors.New("discovery failed")} {
+		r := newRunReport("backup")
+		rel := r.add("ns", "rel")
+		rel.PVCs = []string{"data"}
+		rel.Bytes = 1024
+		r.finish(runErr)
+		if err := r.appendSummary(path); err != nil {
+			t.Fatalf("appendSummary() error: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) != i+1 {
+			t.Fatalf("after run %d the file has %d lines, want %d:\n%s", i+1, len(lines), i+1, data)
+		}
+		var decoded runReport
+		if err := json.Unmarshal([]byte(lines[i]), &decoded); err != nil {
+			t.Fatalf("line %d is not JSON: %v", i+1, err)
+		}
+		if decoded.Started.IsZero() || len(decoded.Releases) != 1 || decoded.Releases[0].Bytes != 1024 || !reflect.DeepEqual(decoded.Releases[0].PVCs, []string{"data"}) {
+			t.Errorf("line %d = %+v", i+1, &decoded)
+		}
+		if runErr != nil && (decoded.Status != statusFailed || decoded.Error != runErr.Error()) {
+			t.Errorf("failed run recorded as %s, %q", decoded.Status, decoded.Error)
+		}
+	}
+}
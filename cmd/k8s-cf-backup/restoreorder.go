@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+// restoreDeps maps a PVC to the PVCs it is restored after (--restore-after).
+type restoreDeps map[string][]string
+
+// parseRestoreAfter parses --restore-after values, each pvc=dep[,dep...]. A PVC given twice
+// waits for the deps of both. Dependencies that form a cycle are an error, since none of
+// their PVCs could ever start.
+func parseRestoreAfter(values []string) (restoreDeps, error) {
+	deps := make(restoreDeps)
+	for _, v := range values {
+		pvc, list, ok := strings.Cut(v, "=")
+		if !ok || pvc == "" || list == "" {
+			return nil, fmt.Errorf("invalid value %q (want pvc=dep[,dep...])", v)
+		}
+		for _, dep := range strings.Split(list, ",") {
+			if dep == "" {
+				return nil, fmt.Errorf("invalid value %q (want pvc=dep[,dep...])", v)
+			}
+			if !slices.Contains(deps[pvc], dep) {
+				deps[pvc] = append(deps[pvc], dep)
+			}
+		}
+	}
+	if cycle := deps.cycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle %s", strings.Join(cycle, " -> "))
+	}
+	return deps, nil
+}
+
+// cycle returns the PVCs of a dependency cycle, starting and ending with the same PVC, or
+// nil when there is none.
+func (d restoreDeps) cycle() []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(pvc string) []string
+	visit = func(pvc string) []string {
+		switch state[pvc] {
+		case visiting:
+			return append(path[slices.Index(path, pvc):], pvc)
+		case visited:
+			return nil
+		}
+		state[pvc] = visiting
+		path = append(path, pvc)
+		for _, dep := range d[pvc] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[pvc] = visited
+		return nil
+	}
+	pvcs := make([]string, 0, len(d))
+	for pvc := range d {
+		pvcs = append(pvcs, pvc)
+	}
+	slices.Sort(pvcs)
+	for _, pvc := range pvcs {
+		if cycle := visit(pvc); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// check fails when deps name a PVC that is not one of pvcs, most likely a typo that would
+// otherwise silently drop the ordering.
+func (d restoreDeps) check(pvcs []types.PVCInfo, release string) error {
+	known := make(map[string]bool, len(pvcs))
+	for _, pvc := range pvcs {
+		known[pvc.PVCName] = true
+	}
+	for pvc, list := range d {
+		for _, name := range append([]string{pvc}, list...) {
+			if !known[name] {
+				return fmt.Errorf("--restore-after: PVC %q not found in release %q", name, release)
+			}
+		}
+	}
+	return nil
+}
+
+// runOrdered restores tasks in parallel, each once every task of the PVCs it is restored
+// after has finished, and returns the results in task order. A task waits only for PVCs
+// among tasks; a PVC that is not being restored is already in place. When a PVC it waits
+// for fails, the task is not run and fails too.
+func runOrdered(tasks []restoreTask, deps restoreDeps, restore func(restoreTask) types.RestoreResult) []types.RestoreResult {
+	results := make([]types.RestoreResult, len(tasks))
+	done := make([]chan struct{}, len(tasks))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+			for _, dep := range deps[t.pvc.PVCName] {
+				for j, u := range tasks {
+					if u.pvc.PVCName != dep {
+						continue
+					}
+					<-done[j]
+					if results[j].Err != nil {
+						results[i] = types.RestoreResult{
+							PVCName:     t.pvc.PVCName,
+							ArchivePath: t.archivePath,
+							TargetDir:   t.pvc.HostPath,
+							Err:         fmt.Errorf("not restored: it is restored after %s, which failed", dep),
+						}
+						return
+					}
+				}
+			}
+			results[i] = restore(t)
+		}()
+	}
+	wg.Wait()
+	return results
+}
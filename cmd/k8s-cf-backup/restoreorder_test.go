@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestParseRestoreAfter(t *testing.T) {
+	deps, err := parseRestoreAfter([]string{"wal=data", "app=data,config", "wal=config"})
+	if err != nil {
+		t.Fatalf("parseRestoreAfter: %v", err)
+	}
+	if got := strings.Join(deps["wal"], ","); got != "data,config" {
+		t.Errorf("wal deps = %s, want data,config", got)
+	}
+	if got := strings.Join(deps["app"], ","); got != "data,config" {
+		t.Errorf("app deps = %s, want data,config", got)
+	}
+
+	for values, want := range map[string]string{
+		"wal":                      "invalid value",
+		"=data":                    "invalid value",
+		"wal=data,":                "invalid value",
+		"data=data":                "cycle data -> data",
+		"a=b;b=c;c=a":              "cycle a -> b -> c -> a",
+		"wal=data;data=config;x=y": "",
+	} {
+		_, err := parseRestoreAfter(strings.Split(values, ";"))
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("parseRestoreAfter(%s) error = %v, want %q", values, err, want)
+		}
+	}
+}
+
+func TestRestoreDeps_Check(t *testing.T) {
+	pvcs := []types.PVCInfo{{PVCName: "data"}, {PVCName: "wal"}}
+	if err := (restoreDeps{"wal": {"data"}}).check(pvcs, "rel"); err != nil {
+		t.Errorf("check() = %v", err)
+	}
+	if err := (restoreDeps{"wal": {"dta"}}).check(pvcs, "rel"); err == nil || !strings.Contains(err.Error(), `"dta"`) {
+		t.Errorf("check() = %v, want PVC dta not found", err)
+	}
+}
+
+func TestRunOrdered_WaitsForDependency(t *testing.T) {
+	tasks := []restoreTask{
+		{pvc: types.PVCInfo{PVCName: "wal"}},
+		{pvc: types.PVCInfo{PVCName: "data"}},
+		{pvc: types.PVCInfo{PVCName: "media"}},
+	}
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	mediaStarted := make(chan struct{})
+	restore := func(task restoreTask) types.RestoreResult {
+		name := task.pvc.PVCName
+		record("start " + name)
+		switch name {
+		case "data":
+			// Finishes only once the unrelated media restore runs, so it must be parallel
+			select {
+			case <-mediaStarted:
+			case <-time.After(5 * time.Second):
+				t.Error("media did not start while data was restoring")
+			}
+		case "media":
+			close(mediaStarted)
+		}
+		record("end " + name)
+		return types.RestoreResult{PVCName: name}
+	}
+
+	results := runOrdered(tasks, restoreDeps{"wal": {"data"}}, restore)
+	for i, r := range results {
+		if r.PVCName != tasks[i].pvc.PVCName || r.Err != nil {
+			t.Errorf("results[%d] = %+v, want %s without error", i, r, tasks[i].pvc.PVCName)
+		}
+	}
+	index := func(e string) int {
+		for i, got := range events {
+			if got == e {
+				return i
+			}
+		}
+		t.Fatalf("no %q in %v", e, events)
+		return -1
+	}
+	if index("start wal") < index("end data") {
+		t.Errorf("wal started before data finished: %v", events)
+	}
+}
+
+func TestRunOrdered_SkipsAfterFailure(t *testing.T) {
+	tasks := []restoreTask{
+		{pvc: types.PVCInfo{PVCName: "data"}},
+		{pvc: types.PVCInfo{PVCName: "wal"}},
+	}
+	var ran []string
+	results := runOrdered(tasks, restoreDeps{"wal": {"data"}}, func(task restoreTask) types.RestoreResult {
+		ran = append(ran, task.pvc.PVCName)
+		return types.RestoreResult{PVCName: task.pvc.PVCName, Err: errors.New("disk full")}
+	})
+	if len(ran) != 1 || ran[0] != "data" {
+		t.Errorf("ran %v, want only data", ran)
+	}
+	if err := results[1].Err; err == nil || !strings.Contains(err.Error(), "restored after data") {
+		t.Errorf("wal error = %v, want it skipped after data failed", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+// selftestPVC names the scratch volume the self-test backs up, in keys and output.
+const selftestPVC = "selftest"
+
+// runSelftest backs up a scratch directory and restores it through the same code paths as
+// backup and restore: archiving with the configured options, uploading to and downloading
+// from R2 or --dest when one is set, and extracting. It fails unless the restored tree
+// matches the original. Everything it creates, locally and in the destination, is removed
+// afterwards; the release's latest.json is never written, so selftest against a real
+// release leaves its backups as they were. The cluster is not touched: the scratch volume
+// stands in for a discovered PVC.
+func runSelftest(ctx context.Context, opts options) error {
+	root, err := os.MkdirTemp("", "k8s-cf-backup-selftest-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	src := filepath.Join(root, "source")
+	if err := writeSelftestData(src); err != nil {
+		return fmt.Errorf("creating scratch data: %w", err)
+	}
+	pvc := types.PVCInfo{
+		Namespace: opts.namespace,
+		Release:   opts.release,
+		PVCName:   selftestPVC,
+		PVName:    selftestPVC,
+		HostPath:  src,
+	}
+
+	// Never rotate: the scratch release may share a bucket with real backups
+	opts.outputDir = filepath.Join(root, "archives")
+	opts.keepLast, opts.keepDays, opts.gfs = 0, 0, store.GFS{}
+	if err := os.Mkdir(opts.outputDir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Self-test of %s/%s in %s\n", opts.namespace, opts.release, root)
+	bk := backup.New(opts.outputDir, opts.outputFormat, opts.verbose, backupOptions(opts)...)
+	result := bk.BackupAll(ctx, []types.PVCInfo{pvc}, opts.namespace, opts.release)[0]
+	if result.Err != nil {
+		return fmt.Errorf("backup: %w", result.Err)
+	}
+	fmt.Fprintf(out, "  OK    backup -> %s (%s)\n", filepath.Base(result.ArchivePath), formatSize(result.Size))
+
+	archivePath := result.ArchivePath
+	if opts.useR2() || opts.dest != "" {
+		dest, err := openStore(opts)
+		if err != nil {
+			return err
+		}
+		// Only the archive is uploaded and fetched back by key: latest.json and rotation
+		// belong to the release's real backups
+		key := filepath.Base(result.ArchivePath)
+		defer cleanupSelftest(ctx, dest, key)
+		if !uploadResult(ctx, out, dest, opts, opts.namespace, opts.release, result) {
+			return errors.New("upload failed (see above)")
+		}
+
+		downloadDir := filepath.Join(root, "download")
+		if err := os.Mkdir(downloadDir, 0755); err != nil {
+			return err
+		}
+		pvcMap := map[string]types.PVCInfo{pvc.PVCName: pvc}
+		tasks, err := downloadRestoreArchives(ctx, opts, []types.PVCInfo{pvc}, pvcMap, []string{key}, downloadDir)
+		if err != nil {
+			return fmt.Errorf("download: %w", err)
+		}
+		archivePath = tasks[0].archivePath
+	}
+
+	restored := pvc
+	restored.HostPath = filepath.Join(root, "restored")
+	if err := os.Mkdir(restored.HostPath, 0755); err != nil {
+		return err
+	}
+	res := bk.RestorePVC(restored, archivePath)
+	if res.Err != nil {
+		return fmt.Errorf("restore: %w", res.Err)
+	}
+	fmt.Fprintf(out, "  OK    restore <- %s (%d file(s))\n", filepath.Base(archivePath), res.Files)
+
+	if err := compareTrees(src, restored.HostPath); err != nil {
+		fmt.Fprintf(out, "  FAIL  compare: %v\n", err)
+		return fmt.Errorf("restored data differs from the original: %w", err)
+	}
+	fmt.Fprintln(out, "  OK    restored data matches the original")
+	fmt.Fprintln(out, "Self-test passed.")
+	return nil
+}
+
+// cleanupSelftest deletes the self-test archive at key from dest, along with its checksum
+// sidecar when one was written. Not only --checksum-mode sidecar writes one: stores
+// without object metadata fall back to a sidecar in metadata mode too.
+func cleanupSelftest(ctx context.Context, dest store.Store, key string) {
+	keys := []string{key}
+	if _, err := dest.Stat(ctx, key+r2.SidecarSuffix); err == nil {
+		keys = append(keys, key+r2.SidecarSuffix)
+	}
+	for _, k := range keys {
+		if err := dest.Delete(ctx, k); err != nil {
+			fmt.Fprintf(out, "  FAIL  cleanup %s: %v\n", k, err)
+			continue
+		}
+		fmt.Fprintf(out, "  DEL   %s\n", dest.ObjectURL(k))
+	}
+}
+
+// writeSelftestData fills dir with a small tree covering what archives must preserve:
+// nested directories, random and empty files, permissions and a symlink.
+func writeSelftestData(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "nested", "deeper"), 0755); err != nil {
+		return err
+	}
+	random := make([]byte, 64<<10)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{"random.bin", random, 0644},
+		{"empty", nil, 0644},
+		{"nested/secret.txt", []byte("selftest\n"), 0600},
+		{"nested/deeper/script.sh", []byte("#!/bin/sh\n"), 0755},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, f.data, f.perm); err != nil {
+			return err
+		}
+		// WriteFile is subject to the umask
+		if err := os.Chmod(path, f.perm); err != nil {
+			return err
+		}
+	}
+	return os.Symlink("nested/secret.txt", filepath.Join(dir, "link"))
+}
+
+// compareTrees reports the first difference between the trees at a and b: a missing or
+// extra entry, or one whose type, permissions, content or link target differ.
+func compareTrees(a, b string) error {
+	ta, err := describeTree(a)
+	if err != nil {
+		return err
+	}
+	tb, err := describeTree(b)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(ta))
+	for name := range ta {
+		names = append(names, name)
+	}
+	for name := range tb {
+		if _, ok := ta[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		want, inA := ta[name]
+		got, inB := tb[name]
+		switch {
+		case !inB:
+			return fmt.Errorf("%s is missing", name)
+		case !inA:
+			return fmt.Errorf("%s was not in the original", name)
+		case got != want:
+			return fmt.Errorf("%s differs: %s, want %s", name, got, want)
+		}
+	}
+	return nil
+}
+
+// describeTree maps each entry below root, by relative path, to its type and permissions
+// plus the SHA-256 of a file or the target of a symlink.
+func describeTree(root string) (map[string]string, error) {
+	tree := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		desc := []string{info.Mode().String()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc = append(desc, "-> "+target)
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			desc = append(desc, "sha256 "+hex.EncodeToString(sum[:]))
+		}
+		tree[rel] = strings.Join(desc, " ")
+		return nil
+	})
+	return tree, err
+}
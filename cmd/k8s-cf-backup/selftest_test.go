@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+func TestSelftest_Local(t *testing.T) {
+	for _, format := range []string{defaultOutputFormat, "{namespace}_{release}_{date}_{pvc}.zip"} {
+		t.Run(format, func(t *testing.T) {
+			buf := captureOut(t)
+			opts := options{namespace: "ci", release: "scratch", outputFormat: format, checksumMode: r2.ChecksumEmbedded}
+			if err := runSelftest(context.Background(), opts); err != nil {
+				t.Fatalf("runSelftest: %v\n%s", err, buf)
+			}
+			if !strings.Contains(buf.String(), "Self-test passed.") {
+				t.Errorf("output does not report success:\n%s", buf)
+			}
+		})
+	}
+}
+
+func TestSelftest_FSDestCleansUp(t *testing.T) {
+	root := t.TempDir()
+	buf := captureOut(t)
+	opts := options{
+		namespace:    "ci",
+		release:      "scratch",
+		outputFormat: defaultOutputFormat,
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumSidecar,
+		keepLast:     1,
+	}
+	if err := runSelftest(context.Background(), opts); err != nil {
+		t.Fatalf("runSelftest: %v\n%s", err, buf)
+	}
+	if !strings.Contains(buf.String(), "Downloaded ") {
+		t.Errorf("archive was not fetched back from --dest:\n%s", buf)
+	}
+
+	var left []string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			left = append(left, path)
+		}
+		return nil
+	})
+	if len(left) != 0 {
+		t.Errorf("self-test left objects behind: %v", left)
+	}
+}
+
+func TestSelftest_KeepsLatest(t *testing.T) {
+	root := t.TempDir()
+	buf := captureOut(t)
+	opts := options{
+		namespace:    "prod",
+		release:      "app",
+		outputFormat: defaultOutputFormat,
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumMetadata,
+	}
+	dest, err := openStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := latestKey(opts, opts.namespace, opts.release)
+	want := r2.Latest{PVCs: map[string]string{"data": "prod_app_2024-01-01-000000_data.tar.gz"}}
+	if err := dest.SetLatest(ctx, key, want); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runSelftest(ctx, opts); err != nil {
+		t.Fatalf("runSelftest: %v\n%s", err, buf)
+	}
+	got, err := dest.GetLatest(ctx, key)
+	if err != nil || got == nil {
+		t.Fatalf("%s after selftest: %v, %v", key, got, err)
+	}
+	if !maps.Equal(got.PVCs, want.PVCs) {
+		t.Errorf("%s points at %v after selftest, want %v", key, got.PVCs, want.PVCs)
+	}
+	// Only latest.json is left: the archive and its metadata-mode sidecar are gone
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("selftest left %v behind", names)
+	}
+}
+
+func TestCompareTrees(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	for _, dir := range []string{a, b} {
+		if err := writeSelftestData(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// writeSelftestData fills random.bin differently each time
+	data, _ := os.ReadFile(filepath.Join(a, "random.bin"))
+	os.WriteFile(filepath.Join(b, "random.bin"), data, 0644)
+	if err := compareTrees(a, b); err != nil {
+		t.Fatalf("compareTrees() = %v for identical trees", err)
+	}
+
+	changes := map[string]func(){
+		"content": func() { os.WriteFile(filepath.Join(b, "empty"), []byte("x"), 0644) },
+		"mode":    func() { os.Chmod(filepath.Join(b, "nested", "secret.txt"), 0644) },
+		"missing": func() { os.Remove(filepath.Join(b, "link")) },
+		"extra":   func() { os.WriteFile(filepath.Join(b, "new"), nil, 0644) },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			b = t.TempDir()
+			writeSelftestData(b)
+			os.WriteFile(filepath.Join(b, "random.bin"), data, 0644)
+			change()
+			if err := compareTrees(a, b); err == nil {
+				t.Error("compareTrees() found no difference")
+			}
+		})
+	}
+}
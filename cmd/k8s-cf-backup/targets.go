@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// targetsFile is the --targets file: the backups one process runs, each with the command
+// line's options as its defaults.
+type targetsFile struct {
+	Targets []target `json:"targets"`
+}
+
+// target is one entry of a --targets file. Fields left out keep the value of the matching
+// flag; keep_last and keep_days can be set to 0 to turn inherited retention off.
+type target struct {
+	Name          string   `json:"name"`
+	Namespace     string   `json:"namespace,omitempty"`
+	Release       string   `json:"release,omitempty"`
+	Releases      []string `json:"releases,omitempty"`
+	OutputDir     string   `json:"output_dir,omitempty"`
+	OutputFormat  string   `json:"output_format,omitempty"`
+	KeepLast      *int     `json:"keep_last,omitempty"`
+	KeepDays      *int     `json:"keep_days,omitempty"`
+	R2Credentials string   `json:"r2_credentials,omitempty"`
+	Dest          string   `json:"dest,omitempty"`
+}
+
+// loadTargets reads a --targets file and checks every target against opts, so a mistake
+// in any of them fails the run before anything is backed up.
+func loadTargets(path string, opts options) ([]target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading --targets: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	var tf targetsFile
+	if err := dec.Decode(&tf); err != nil {
+		return nil, fmt.Errorf("parsing --targets %s: %w", path, err)
+	}
+	if len(tf.Targets) == 0 {
+		return nil, fmt.Errorf("--targets %s lists no targets", path)
+	}
+	seen := make(map[string]bool)
+	for i, t := range tf.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("--targets %s: target %d has no name", path, i+1)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("--targets %s: target %s is listed twice", path, t.Name)
+		}
+		seen[t.Name] = true
+		if _, _, err := t.apply(opts); err != nil {
+			return nil, fmt.Errorf("--targets %s: target %s: %w", path, t.Name, err)
+		}
+	}
+	return tf.Targets, nil
+}
+
+// apply returns opts with the settings of t, and the releases t backs up.
+func (t target) apply(opts options) (options, []string, error) {
+	if t.Namespace != "" {
+		opts.namespace = t.Namespace
+	}
+	if t.OutputDir != "" {
+		opts.outputDir = t.OutputDir
+	}
+	if t.OutputFormat != "" {
+		opts.outputFormat = t.OutputFormat
+	}
+	if t.KeepLast != nil {
+		opts.keepLast = *t.KeepLast
+	}
+	if t.KeepDays != nil {
+		opts.keepDays = *t.KeepDays
+	}
+	// A target's destination replaces the command line's, whichever kind that was
+	if t.R2Credentials != "" || t.Dest != "" {
+		opts.r2Credentials, opts.r2Secret, opts.r2Creds, opts.dest = t.R2Credentials, "", nil, t.Dest
+	}
+
+	releases := t.Releases
+	if t.Release != "" {
+		releases = append([]string{t.Release}, releases...)
+	}
+	if len(releases) == 0 && opts.release != "" {
+		releases = []string{opts.release}
+	}
+	switch {
+	case opts.namespace == "":
+		return opts, nil, errors.New("no namespace, and no --namespace to default to")
+	case len(releases) == 0:
+		return opts, nil, errors.New("no release, and no --release to default to")
+	case opts.r2Credentials != "" && opts.dest != "":
+		return opts, nil, errors.New("r2_credentials and dest are mutually exclusive")
+	case opts.keepLast < 0 || opts.keepDays < 0:
+		return opts, nil, errors.New("keep_last and keep_days must not be negative")
+	}
+	if err := checkRotationFormat(opts); err != nil {
+		return opts, nil, err
+	}
+	return opts, releases, nil
+}
+
+// runTargets backs up every target, --target-parallel at a time, each release of a target
+// as its own run. A failed target or release never stops the others; they are all listed
+// in a combined summary at the end.
+func runTargets(ctx context.Context, client kubernetes.Interface, opts options, targets []target, rep *runReport) error {
+	save, err := loadFingerprints(&opts)
+	if err != nil {
+		return err
+	}
+	defer save()
+
+	errs := make([]error, len(targets))
+	if parallel := max(opts.targetParallel, 1); parallel == 1 {
+		for i, t := range targets {
+			errs[i] = runTarget(ctx, client, opts, t, rep)
+		}
+	} else {
+		runTargetsParallel(ctx, client, opts, targets, rep, parallel, errs)
+	}
+
+	fmt.Fprintln(out, "\n=== Targets Summary ===")
+	var failed int
+	for i, t := range targets {
+		if errs[i] != nil {
+			fmt.Fprintf(out, "  FAIL  %s: %v\n", t.Name, errs[i])
+			failed++
+		} else {
+			fmt.Fprintf(out, "  OK    %s\n", t.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d target(s) failed (see above)", failed, len(targets))
+	}
+	return nil
+}
+
+// runTargetsParallel backs up targets parallel at a time, recording the error of each in
+// errs. Each target writes into a buffer of its own, which is copied to out once the
+// target and all before it are done, so the output reads as if the targets ran in turn.
+func runTargetsParallel(ctx context.Context, client kubernetes.Interface, opts options, targets []target, rep *runReport, parallel int, errs []error) {
+	bufs := make([]bytes.Buffer, len(targets))
+	done := make([]chan struct{}, len(targets))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	go func() {
+		sem := make(chan struct{}, parallel)
+		for i, t := range targets {
+			sem <- struct{}{}
+			go func() {
+				defer close(done[i])
+				defer func() { <-sem }()
+				topts := opts
+				topts.out = &bufs[i]
+				errs[i] = runTarget(ctx, client, topts, t, rep)
+			}()
+		}
+	}()
+	for i := range targets {
+		<-done[i]
+		out.Write(bufs[i].Bytes())
+	}
+}
+
+// runTarget backs up the releases of one target in turn.
+func runTarget(ctx context.Context, client kubernetes.Interface, opts options, t target, rep *runReport) error {
+	opts, releases, err := t.apply(opts)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, release := range releases {
+		fmt.Fprintf(opts.output(), "\n##### %s: %s/%s #####\n", t.Name, opts.namespace, release)
+		opts.release = release
+		if err := run(ctx, client, opts, rep); err != nil {
+			log.Printf("ERROR: %s: %s/%s: %v", t.Name, opts.namespace, release, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", release, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
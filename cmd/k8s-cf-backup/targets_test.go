@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func writeTargets(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "targets.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTargets(t *testing.T) {
+	opts := options{outputFormat: "{namespace}_{release}_{date}_{pvc}.tar.gz", outputDir: "/backups"}
+	targets, err := loadTargets(writeTargets(t, `{"targets": [
+		{"name": "shop", "namespace": "prod", "release": "shop", "releases": ["shop-cache"], "keep_last": 7},
+		{"name": "blog", "namespace": "web", "releases": ["blog"], "output_dir": "/blog", "dest": "fs:///mnt/blog"}
+	]}`), opts)
+	if err != nil {
+		t.Fatalf("loadTargets: %v", err)
+	}
+	shop, releases, err := targets[0].apply(opts)
+	if err != nil || shop.namespace != "prod" || shop.keepLast != 7 || shop.outputDir != "/backups" || strings.Join(releases, ",") != "shop,shop-cache" {
+		t.Errorf("shop = %+v, %v, %v", shop, releases, err)
+	}
+	if blog, _, _ := targets[1].apply(opts); blog.outputDir != "/blog" || blog.dest != "fs:///mnt/blog" || blog.keepLast != 0 {
+		t.Errorf("blog = %+v", blog)
+	}
+
+	for content, want := range map[string]string{
+		`{"targets": []}`: "lists no targets",
+		`{"targets": [{"namespace": "prod", "release": "shop"}]}`:                                                            "has no name",
+		`{"targets": [{"name": "a", "namespace": "x", "release": "r"}, {"name": "a", "namespace": "y", "release": "r"}]}`:    "listed twice",
+		`{"targets": [{"name": "a", "namespace": "prod"}]}`:                                                                  "no release",
+		`{"targets": [{"name": "a", "namespace": "prod", "release": "r", "keep-last": 3}]}`:                                  "unknown field",
+		`{"targets": [{"name": "a", "namespace": "prod", "release": "r", "output_format": "{pvc}.tar.gz", "keep_days": 3}]}`: "need {date}",
+	} {
+		if _, err := loadTargets(writeTargets(t, content), opts); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadTargets(%s) error = %v, want %q", content, err, want)
+		}
+	}
+}
+
+func TestRunTargets_IsolatesFailures(t *testing.T) {
+	for _, parallel := range []int{1, 2} {
+		client := fake.NewSimpleClientset()
+		newFakePVC(t, client, "prod", "shop", "data")
+		newFakePVC(t, client, "web", "blog", "wal")
+		outputDir := t.TempDir()
+		opts := options{
+			outputFormat:   "{namespace}_{release}_{pvc}.tar.gz",
+			outputDir:      outputDir,
+			targetParallel: parallel,
+		}
+		targets := []target{
+			{Name: "broken", Namespace: "prod", Release: "gone"},
+			{Name: "shop", Namespace: "prod", Release: "shop"},
+			{Name: "blog", Namespace: "web", Releases: []string{"blog"}},
+		}
+
+		buf := captureOut(t)
+		rep := newRunReport("backup")
+		err := runTargets(context.Background(), client, opts, targets, rep)
+		if err == nil || !strings.Contains(err.Error(), "1 of 3 target(s) failed") {
+			t.Fatalf("parallel %d: runTargets() error = %v, want one failed target\n%s", parallel, err, buf)
+		}
+		for _, name := range []string{"prod_shop_data.tar.gz", "web_blog_wal.tar.gz"} {
+			if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+				t.Errorf("parallel %d: %s not written despite the failed target: %v", parallel, name, err)
+			}
+		}
+		summary := buf.String()[strings.Index(buf.String(), "=== Targets Summary ==="):]
+		for _, line := range []string{`  FAIL  broken: gone: discovery: no PVCs found for release "gone"`, "  OK    shop\n", "  OK    blog\n"} {
+			if !strings.Contains(summary, line) {
+				t.Errorf("parallel %d: summary lacks %q:\n%s", parallel, line, summary)
+			}
+		}
+		if len(rep.Releases) != 3 {
+			t.Errorf("parallel %d: report has %d release(s), want 3", parallel, len(rep.Releases))
+		}
+		// Concurrent targets are printed whole and in the order listed
+		shop, blog := strings.Index(buf.String(), "##### shop: prod/shop #####"), strings.Index(buf.String(), "##### blog: web/blog #####")
+		if shop < 0 || blog < shop || strings.Contains(buf.String()[shop:blog], "web_blog_wal") {
+			t.Errorf("parallel %d: target output is out of order or interleaved:\n%s", parallel, buf)
+		}
+	}
+}
+
+func TestRunTargets_SharesFingerprints(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	newFakePVC(t, client, "prod", "shop", "data")
+	newFakePVC(t, client, "web", "blog", "wal")
+	path := filepath.Join(t.TempDir(), "fingerprints.json")
+	opts := options{
+		outputFormat:   "{namespace}_{release}_{pvc}.tar.gz",
+		outputDir:      t.TempDir(),
+		targetParallel: 2,
+		unchangedFile:  path,
+	}
+	targets := []target{
+		{Name: "shop", Namespace: "prod", Release: "shop"},
+		{Name: "blog", Namespace: "web", Release: "blog"},
+	}
+
+	buf := captureOut(t)
+	if err := runTargets(context.Background(), client, opts, targets, newRunReport("backup")); err != nil {
+		t.Fatalf("runTargets() error: %v\n%s", err, buf)
+	}
+	f, err := backup.LoadFingerprints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each target saving a copy of its own would leave only the last one's entry
+	for _, key := range []string{"prod/shop/data", "web/blog/wal"} {
+		if f.PVCs[key] == "" {
+			t.Errorf("%s has no fingerprint in %v", key, f.PVCs)
+		}
+	}
+}
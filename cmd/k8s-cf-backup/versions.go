@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+// parseRestoreVersion parses a --restore-version selector into an index into the
+// newest-first list of a PVC's backups: "latest" is 0 and "latest-N" is N.
+func parseRestoreVersion(s string) (int, error) {
+	if s == "latest" {
+		return 0, nil
+	}
+	n, ok := strings.CutPrefix(s, "latest-")
+	if ok {
+		if i, err := strconv.Atoi(n); err == nil && i >= 0 {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid --restore-version %q (want latest or latest-N)", s)
+}
+
+// versionSelector is the --restore-version value that selects index i.
+func versionSelector(i int) string {
+	if i == 0 {
+		return "latest"
+	}
+	return fmt.Sprintf("latest-%d", i)
+}
+
+// pvcVersions lists the backups of each named PVC, newest first. Their indices are the ones
+// --restore-version selects and --list-versions prints. Archives too small to be complete
+// are left out, so a stub left by an interrupted upload never counts as the latest, and
+// the archive the release's latest.json points at comes first whatever its date.
+func pvcVersions(ctx context.Context, dest store.Store, opts options, names []string) (map[string][]r2.ObjectInfo, error) {
+	var versions map[string][]r2.ObjectInfo
+	if opts.matchByMeta {
+		var err error
+		if versions, err = metadataVersions(ctx, dest, opts, names); err != nil {
+			return nil, err
+		}
+	} else {
+		listed, err := pvcObjects(ctx, dest, opts.keyFormat(), opts.namespace, opts.release, names)
+		if err != nil {
+			return nil, err
+		}
+		versions = make(map[string][]r2.ObjectInfo, len(names))
+		for _, name := range names {
+			versions[name] = filterR2Objects(listed[name], buildR2Pattern(opts.keyFormat(), opts.namespace, opts.release, name, opts.archiveSuffix))
+		}
+	}
+	for name, objects := range versions {
+		versions[name] = completeArchives(objects, opts.archiveSuffix)
+	}
+	latest, err := dest.GetLatest(ctx, latestKey(opts, opts.namespace, opts.release))
+	if err != nil {
+		log.Printf("WARNING: %v; picking the newest backups by date", err)
+	} else if latest != nil {
+		for name, objects := range versions {
+			if key, ok := latest.PVCs[name]; ok {
+				versions[name] = preferLatest(objects, name, key)
+			}
+		}
+	}
+	return versions, nil
+}
+
+// latestKey is the key of a release's latest.json. It sits next to the release's archives,
+// under the part of the key format before {pvc}, {date} and {storageClass} when that part
+// names the namespace and release, and at namespace_release_latest.json otherwise.
+func latestKey(opts options, namespace, release string) string {
+	prefix := opts.keyFormat()
+	for _, p := range []string{"{pvc}", "{date}", "{storageClass}"} {
+		if i := strings.Index(prefix, p); i >= 0 {
+			prefix = prefix[:i]
+		}
+	}
+	if !strings.Contains(prefix, "{namespace}") || !strings.Contains(prefix, "{release}") {
+		prefix = "{namespace}_{release}_"
+	}
+	prefix = strings.ReplaceAll(prefix, "{namespace}", namespace)
+	prefix = strings.ReplaceAll(prefix, "{release}", release)
+	return prefix + r2.LatestName
+}
+
+// preferLatest moves the object with key, the one latest.json points at for pvc, to the
+// front of objects. When it is not among them the order by date is kept, with a warning.
+func preferLatest(objects []r2.ObjectInfo, pvc, key string) []r2.ObjectInfo {
+	i := slices.IndexFunc(objects, func(obj r2.ObjectInfo) bool { return obj.Key == key })
+	if i < 0 {
+		log.Printf("WARNING: %s points %s at %s, which is missing; picking the newest backup by date", r2.LatestName, pvc, key)
+		return objects
+	}
+	sorted := append([]r2.ObjectInfo{objects[i]}, objects[:i]...)
+	return append(sorted, objects[i+1:]...)
+}
+
+// completeArchives drops the archives in objects smaller than backup.MinArchiveSize,
+// warning about each. Per-file manifests are kept whatever their size. suffix is the
+// archive suffix keys may end with.
+func completeArchives(objects []r2.ObjectInfo, suffix string) []r2.ObjectInfo {
+	kept := objects[:0:0]
+	for _, obj := range objects {
+		if backup.IsArchive(backup.TrimArchiveSuffix(obj.Key, suffix)) && obj.Size < backup.MinArchiveSize {
+			log.Printf("WARNING: ignoring %s: %d bytes is too small for a complete archive", obj.Key, obj.Size)
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept
+}
+
+// metadataVersions is pvcVersions for --match-by-metadata. It lists every archive under
+// metadataPrefix and assigns each to the PVC its labels name, whatever release its key and
+// labels carry, so backups taken before a release rename are found. Archives without
+// labels or labelled for another namespace are left out. Labels are only returned by
+// Stat, so this costs a request per archive. Archives named by --name-template are listed
+// under the literal text the template starts with, often the whole bucket.
+func metadataVersions(ctx context.Context, dest store.Store, opts options, names []string) (map[string][]r2.ObjectInfo, error) {
+	formats := opts.archiveFormats()
+	if opts.nameTemplate != nil {
+		formats = append(formats, opts.nameTemplate.Prefix())
+	}
+	prefix := metadataPrefix(formats, opts.namespace)
+	objects, err := dest.ListByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under %q: %w", prefix, err)
+	}
+
+	versions := make(map[string][]r2.ObjectInfo, len(names))
+	for _, name := range names {
+		versions[name] = nil
+	}
+	for _, obj := range objects {
+		if !backup.IsArchive(backup.TrimArchiveSuffix(obj.Key, opts.archiveSuffix)) {
+			continue
+		}
+		info, err := dest.Stat(ctx, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		if info.Labels.Namespace != opts.namespace {
+			continue
+		}
+		if _, ok := versions[info.Labels.PVC]; ok {
+			versions[info.Labels.PVC] = append(versions[info.Labels.PVC], info)
+		}
+	}
+	return versions, nil
+}
+
+// metadataPrefix is the key prefix all archives of namespace share whatever their release:
+// the part of each format before its first placeholder other than {namespace}, cut down to
+// what the formats have in common.
+func metadataPrefix(formats []string, namespace string) string {
+	var prefix string
+	for i, format := range formats {
+		p := strings.ReplaceAll(format, "{namespace}", namespace)
+		for _, placeholder := range []string{"{release}", "{pvc}", "{storageClass}", "{date}"} {
+			if j := strings.Index(p, placeholder); j >= 0 {
+				p = p[:j]
+			}
+		}
+		if i == 0 {
+			prefix = p
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(p) && prefix[n] == p[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+// versionEntry is one restorable backup in the --list-versions output.
+type versionEntry struct {
+	Index        int       `json:"index"`
+	Selector     string    `json:"selector"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// pvcVersionList is the --list-versions output for one PVC.
+type pvcVersionList struct {
+	PVC      string         `json:"pvc"`
+	Versions []versionEntry `json:"versions"`
+}
+
+// versionsReport is the --list-versions --json document.
+type versionsReport struct {
+	Namespace string           `json:"namespace"`
+	Release   string           `json:"release"`
+	PVCs      []pvcVersionList `json:"pvcs"`
+}
+
+// runListVersions prints the backups available for each PVC of the release, indexed the
+// way --restore-version selects them. With --json the list is written to stdout as JSON.
+func runListVersions(ctx context.Context, client kubernetes.Interface, opts options, stdout io.Writer) error {
+	disc := newDiscoverer(client, opts)
+	fmt.Fprintf(out, "Discovering PVCs for release %q in namespace %q...\n", opts.release, opts.namespace)
+	pvcs, err := disc.Discover(ctx, opts.namespace, opts.release)
+	if err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	pvcs = orderPVCs(pvcs, opts.pvcOrder, func(p types.PVCInfo) string { return p.PVCName })
+
+	dest, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+
+	versions, err := pvcVersions(ctx, dest, opts, pvcNames(pvcs))
+	if err != nil {
+		return err
+	}
+
+	rep := versionsReport{Namespace: opts.namespace, Release: opts.release, PVCs: []pvcVersionList{}}
+	for _, pvc := range pvcs {
+		objects := versions[pvc.PVCName]
+		list := pvcVersionList{PVC: pvc.PVCName, Versions: []versionEntry{}}
+		for i, obj := range objects {
+			list.Versions = append(list.Versions, versionEntry{
+				Index:        i,
+				Selector:     versionSelector(i),
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			})
+		}
+		rep.PVCs = append(rep.PVCs, list)
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+
+	for _, list := range rep.PVCs {
+		fmt.Fprintf(out, "\n%s: %d version(s) in %s\n", list.PVC, len(list.Versions), destName(opts))
+		for _, v := range list.Versions {
+			fmt.Fprintf(out, "  %-9s %s  %9s  %s\n", v.Selector, v.LastModified.Local().Format("2006-01-02 15:04:05"), formatSize(v.Size), v.Key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/store"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestParseRestoreVersion(t *testing.T) {
+	tests := map[string]int{"latest": 0, "latest-0": 0, "latest-2": 2}
+	for in, want := range tests {
+		got, err := parseRestoreVersion(in)
+		if err != nil || got != want {
+			t.Errorf("parseRestoreVersion(%q) = %d, %v; want %d", in, got, err, want)
+		}
+		if sel := versionSelector(got); got > 0 && sel != in {
+			t.Errorf("versionSelector(%d) = %q, want %q", got, sel, in)
+		}
+	}
+	for _, in := range []string{"", "2", "latest-", "latest--1", "latest-x", "oldest"} {
+		if _, err := parseRestoreVersion(in); err == nil {
+			t.Errorf("parseRestoreVersion(%q) succeeded", in)
+		}
+	}
+}
+
+// seedVersions writes one archive per content string to root, oldest first, each holding
+// data.txt with that content, and returns the keys newest first.
+func seedVersions(t *testing.T, root string, contents ...string) []string {
+	t.Helper()
+	var keys []string
+	start := time.Now().Add(-time.Duration(len(contents)) * time.Hour)
+	for i, content := range contents {
+		src := t.TempDir()
+		if err := os.WriteFile(filepath.Join(src, "data.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("data_2024010%d-000000.tar.gz", i+1)
+		results := backup.New(root, key, false).BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: src}}, "ns", "rel")
+		if results[0].Err != nil {
+			t.Fatal(results[0].Err)
+		}
+		mtime := start.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(results[0].ArchivePath, mtime, mtime)
+		keys = append([]string{key}, keys...)
+	}
+	return keys
+}
+
+func TestListVersionsAndRestoreVersion(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	keys := seedVersions(t, root, "v1", "v2", "v3")
+
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}_{date}.tar.gz",
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumNone,
+		json:         true,
+	}
+
+	captureOut(t)
+	var stdout bytes.Buffer
+	if err := runListVersions(context.Background(), client, opts, &stdout); err != nil {
+		t.Fatalf("runListVersions: %v", err)
+	}
+	var rep versionsReport
+	if err := json.Unmarshal(stdout.Bytes(), &rep); err != nil {
+		t.Fatalf("decoding %s: %v", stdout.String(), err)
+	}
+	if len(rep.PVCs) != 1 || len(rep.PVCs[0].Versions) != 3 {
+		t.Fatalf("versions = %+v", rep.PVCs)
+	}
+	for i, v := range rep.PVCs[0].Versions {
+		if v.Index != i || v.Key != keys[i] || v.Selector != versionSelector(i) {
+			t.Errorf("version %d = %+v, want key %s", i, v, keys[i])
+		}
+	}
+
+	// The selector shown for index 2 restores that same archive
+	opts.json = false
+	opts.restoreVersion = 2
+	buf := captureOut(t)
+	if err := runRestore(context.Background(), client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore: %v\n%s", err, buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(paths["data"], "data.txt")); err != nil || string(data) != "v1" {
+		t.Errorf("restored %q, %v; want v1", data, err)
+	}
+
+	// Asking past the oldest version skips the PVC rather than restoring something else
+	opts.restoreVersion = 3
+	buf.Reset()
+	if err := runRestore(context.Background(), client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore: %v", err)
+	}
+	if !strings.Contains(buf.String(), "SKIP  data: no latest-3 backup, only 3 found") {
+		t.Errorf("missing skip line:\n%s", buf)
+	}
+}
+
+func TestRestoreLatest_SkipsStubArchives(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	seedVersions(t, root, "v1", "v2")
+
+	// Newer than both: an empty object and one cut short, as interrupted uploads leave them
+	for i, size := range []int{0, 10} {
+		stub := filepath.Join(root, fmt.Sprintf("data_2024020%d-000000.tar.gz", i+1))
+		if err := os.WriteFile(stub, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i) * time.Minute)
+		os.Chtimes(stub, mtime, mtime)
+	}
+
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}_{date}.tar.gz",
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumNone,
+	}
+	versions, err := pvcVersions(context.Background(), mustOpenStore(t, opts), opts, []string{"data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions["data"]; len(got) != 2 || got[0].Key != "data_20240102-000000.tar.gz" {
+		t.Errorf("versions = %+v, want the two complete archives", got)
+	}
+
+	buf := captureOut(t)
+	if err := runRestore(context.Background(), client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore: %v\n%s", err, buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(paths["data"], "data.txt")); err != nil || string(data) != "v2" {
+		t.Errorf("restored %q, %v; want v2", data, err)
+	}
+}
+
+func TestRestore_CorruptDownloadKeepsData(t *testing.T) {
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	keys := seedVersions(t, root, "v1")
+	// The sidecar records another archive's checksum, as it would after bit rot
+	if err := os.WriteFile(filepath.Join(root, keys[0]+r2.SidecarSuffix), []byte(strings.Repeat("0", 64)+"  "+keys[0]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}_{date}.tar.gz",
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumNone,
+	}
+	buf := captureOut(t)
+	err := runRestore(context.Background(), client, opts, nil, newRunReport("restore"))
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("runRestore() error = %v, want a checksum mismatch\n%s", err, buf)
+	}
+	// The live data is neither wiped nor overwritten with v1
+	if data, err := os.ReadFile(filepath.Join(paths["data"], "data.txt")); err != nil || string(data) != "data" {
+		t.Errorf("host path was touched: data.txt = %q, %v", data, err)
+	}
+}
+
+func TestRestoreLatest_FollowsPointer(t *testing.T) {
+	ctx := context.Background()
+	client, paths := newFakeRelease(t, "ns", "rel", "data")
+	root := t.TempDir()
+	keys := seedVersions(t, root, "v1", "v2", "v3")
+
+	opts := options{
+		namespace:    "ns",
+		release:      "rel",
+		outputFormat: "{pvc}_{date}.tar.gz",
+		dest:         "fs://" + root,
+		checksumMode: r2.ChecksumNone,
+		keepLast:     1,
+	}
+	dest := mustOpenStore(t, opts)
+	// v3 is newer by date, but the pointer says v2 is the last good backup
+	if err := dest.SetLatest(ctx, latestKey(opts, "ns", "rel"), r2.Latest{PVCs: map[string]string{"data": keys[1]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := pvcVersions(ctx, dest, opts, []string{"data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions["data"]; len(got) != 3 || got[0].Key != keys[1] || got[1].Key != keys[0] || got[2].Key != keys[2] {
+		t.Errorf("versions = %+v, want %s first, then the rest by date", got, keys[1])
+	}
+
+	// Rotation keeps the pointed-at archive even though keep-last 1 would delete it
+	plan, err := rotationPlan(ctx, dest, opts, "ns", "rel", []types.PVCInfo{{PVCName: "data"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plan["data"]; len(got) != 1 || got[0] != keys[2] {
+		t.Errorf("rotation plan = %v, want only %s", got, keys[2])
+	}
+
+	buf := captureOut(t)
+	if err := runRestore(ctx, client, opts, nil, newRunReport("restore")); err != nil {
+		t.Fatalf("runRestore: %v\n%s", err, buf)
+	}
+	if data, err := os.ReadFile(filepath.Join(paths["data"], "data.txt")); err != nil || string(data) != "v2" {
+		t.Errorf("restored %q, %v; want v2", data, err)
+	}
+
+	// A pointer at an archive that has gone falls back to the newest by date
+	if err := dest.SetLatest(ctx, latestKey(opts, "ns", "rel"), r2.Latest{PVCs: map[string]string{"data": "data_gone.tar.gz"}}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = pvcVersions(ctx, dest, opts, []string{"data"})
+	if err != nil || versions["data"][0].Key != keys[0] {
+		t.Errorf("versions = %+v, %v; want %s first", versions["data"], err, keys[0])
+	}
+}
+
+func TestLatestKey(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{defaultOutputFormat, "ns_rel_latest.json"},
+		{"{namespace}/{release}/{pvc}/{date}.tar.gz", "ns/rel/latest.json"},
+		{"backups/{release}-{namespace}-{date}-{pvc}.tar.gz", "backups/rel-ns-latest.json"},
+		{"{pvc}_{date}.tar.gz", "ns_rel_latest.json"},
+	}
+	for _, tt := range tests {
+		if got := latestKey(options{outputFormat: tt.format}, "ns", "rel"); got != tt.want {
+			t.Errorf("latestKey(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func mustOpenStore(t *testing.T, opts options) store.Store {
+	t.Helper()
+	dest, err := openStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+// labeledStore is a store whose Stat returns the labels R2 would keep as object metadata.
+type labeledStore struct {
+	store.Store
+	labels map[string]r2.Labels
+}
+
+func (s labeledStore) Stat(ctx context.Context, key string) (r2.ObjectInfo, error) {
+	info, err := s.Store.Stat(ctx, key)
+	info.Labels = s.labels[key]
+	return info, err
+}
+
+func TestPVCVersions_MatchByMetadata(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs, err := store.NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	// Large enough not to be taken for the stub of an interrupted upload
+	if err := os.WriteFile(archive, bytes.Repeat([]byte("archive "), 4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]r2.Labels{
+		"ns_old_20240101-000000_data.tar.gz":   {Namespace: "ns", Release: "old", PVC: "data"},
+		"ns_new_20240102-000000_data.tar.gz":   {Namespace: "ns", Release: "new", PVC: "data"},
+		"ns_old_20240101-000000_wal.tar.gz":    {Namespace: "ns", Release: "old", PVC: "wal"},
+		"ns_old_20240101-000000_cache.tar.gz":  {Namespace: "ns", Release: "old", PVC: "cache"},
+		"ns_other_20240101-000000_data.tar.gz": {Namespace: "other", Release: "old", PVC: "data"},
+		"ns_old_20240103-000000_data.tar.gz":   {},
+	}
+	for i, key := range []string{
+		"ns_old_20240101-000000_data.tar.gz",
+		"ns_old_20240101-000000_wal.tar.gz",
+		"ns_old_20240101-000000_cache.tar.gz",
+		"ns_other_20240101-000000_data.tar.gz",
+		"ns_new_20240102-000000_data.tar.gz",
+		"ns_old_20240103-000000_data.tar.gz",
+	} {
+		if err := fs.Upload(ctx, archive, key); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(filepath.Join(root, key), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := options{namespace: "ns", release: "new", outputFormat: defaultOutputFormat, matchByMeta: true}
+	versions, err := pvcVersions(ctx, labeledStore{Store: fs, labels: labels}, opts, []string{"data", "wal"})
+	if err != nil {
+		t.Fatalf("pvcVersions() error: %v", err)
+	}
+	var data []string
+	for _, obj := range versions["data"] {
+		data = append(data, obj.Key)
+	}
+	// Newest first, across the rename; unlabelled archives and other namespaces are left out
+	want := []string{"ns_new_20240102-000000_data.tar.gz", "ns_old_20240101-000000_data.tar.gz"}
+	if strings.Join(data, " ") != strings.Join(want, " ") {
+		t.Errorf("data versions = %v, want %v", data, want)
+	}
+	if wal := versions["wal"]; len(wal) != 1 || wal[0].Labels.Release != "old" {
+		t.Errorf("wal versions = %+v, want the archive labelled with release old", wal)
+	}
+	if _, ok := versions["cache"]; ok {
+		t.Error("versions include cache, which was not asked for")
+	}
+
+	// Without the flag only the current release's keys are found
+	opts.matchByMeta = false
+	versions, err = pvcVersions(ctx, labeledStore{Store: fs, labels: labels}, opts, []string{"data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions["data"]) != 1 {
+		t.Errorf("key-based versions = %+v, want only the new release's archive", versions["data"])
+	}
+}
+
+func TestMetadataPrefix(t *testing.T) {
+	tests := []struct {
+		formats []string
+		want    string
+	}{
+		{[]string{defaultOutputFormat}, "ns_"},
+		{[]string{"backups/{namespace}/{release}/{pvc}/{date}.tar.gz"}, "backups/ns/"},
+		{[]string{"backups/{namespace}/{release}/{pvc}.tar.gz", "{namespace}_{release}_{pvc}.tar.gz"}, ""},
+		{[]string{"b/{namespace}/{release}-{pvc}.tar.gz", "b/{namespace}/{pvc}/{date}.tar.gz"}, "b/ns/"},
+	}
+	for _, tc := range tests {
+		if got := metadataPrefix(tc.formats, "ns"); got != tc.want {
+			t.Errorf("metadataPrefix(%v) = %q, want %q", tc.formats, got, tc.want)
+		}
+	}
+}
+
+func TestPVCVersions_NameTemplate(t *testing.T) {
+	ctx := context.Background()
+	fs, err := store.NewFS(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := os.WriteFile(archive, bytes.Repeat([]byte("archive "), 4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := "node-1-DATA-2024-01.tar.gz"
+	if err := fs.Upload(ctx, archive, key); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]r2.Labels{key: {Namespace: "ns", Release: "rel", PVC: "data"}}
+
+	tmpl, err := backup.ParseNameTemplate(`{{.Node}}-{{.PVC | upper}}-{{.Date.Format "2006-01"}}.tar.gz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{namespace: "ns", release: "rel", outputFormat: defaultOutputFormat, nameTemplate: tmpl, matchByMeta: true}
+	versions, err := pvcVersions(ctx, labeledStore{Store: fs, labels: labels}, opts, []string{"data"})
+	if err != nil {
+		t.Fatalf("pvcVersions() error: %v", err)
+	}
+	if data := versions["data"]; len(data) != 1 || data[0].Key != key {
+		t.Errorf("data versions = %+v, want %s found by its labels", data, key)
+	}
+}
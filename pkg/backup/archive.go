@@ -0,0 +1,1445 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// ArchiveOptions tunes how an Archiver writes and reads archives.
+type ArchiveOptions struct {
+	// Level is the codec-specific compression level; 0 selects the codec default.
+	Level int
+	// Manifest appends a ManifestName entry listing the SHA-256 of every regular file.
+	Manifest bool
+	// Encrypter, when set, encrypts the archive as it is written and decrypts it on extract.
+	Encrypter Encrypter
+	// TarFormat is the header format of tar entries. tar.FormatUnknown lets archive/tar pick
+	// USTAR, PAX or GNU per entry, whichever is the first to fit. Zip ignores it.
+	TarFormat tar.Format
+	// MemoryLimit bounds zstd memory in bytes; 0 uses the codec defaults. Backups use a window
+	// of at most this size and restores refuse frames that need a larger one, so a limit
+	// below the window an archive was written with fails its restore.
+	MemoryLimit uint64
+	// Xattrs stores the extended attributes of every entry (SELinux labels, ACLs) as PAX
+	// records on create and sets them again on extract. Only tar archives carry them, and
+	// only on Linux.
+	Xattrs bool
+	// Owner, when set, chowns every extracted entry as it decides instead of leaving it owned
+	// by the restoring user. Create ignores it.
+	Owner *OwnerMap
+	// StreamBuffer is the size in bytes of the buffer Stream collects output in before
+	// writing it on; 0 selects DefaultStreamBuffer. Create ignores it.
+	StreamBuffer int
+	// ModeMask, when non-zero, is ANDed with the permission bits of every extracted file and
+	// directory, which are then set exactly, regardless of the umask. 0700 makes a restore
+	// private to its owner. Create ignores it.
+	ModeMask os.FileMode
+	// Reproducible pins the gzip header to fixed values (no name, comment or timestamp, OS
+	// "unknown"), so archives of unchanged data are byte-identical across runs and
+	// platforms. Restore ignores it.
+	Reproducible bool
+	// Subtree, when set, makes Extract unpack only the entries below this top-level
+	// directory of the archive, with the directory stripped from their paths. It selects
+	// one PVC from a combined archive. Create ignores it.
+	Subtree string
+	// ExcludeEmptyDirs leaves out directories that hold no file, symlink or other
+	// non-directory entry anywhere below them. The root is always kept. Restore ignores it.
+	ExcludeEmptyDirs bool
+	// Dict, when set, primes zstd with a dictionary on create and supplies it on extract.
+	// Archives written with a dictionary need the same one to be read. Other codecs
+	// ignore it.
+	Dict *ZstdDict
+	// ParallelGzip compresses gzip with pgzip, in blocks on every core, and decompresses
+	// it with pgzip's read-ahead reader, which inflates in its own goroutine while the
+	// tar is being extracted. Either side reads the other's archives. Other codecs
+	// ignore it.
+	ParallelGzip bool
+	// OneFileSystem keeps archives on the filesystem of the source directory, like tar
+	// --one-file-system: a directory on another device, typically a mount point below the
+	// volume, is archived empty, and other entries on another device are left out. Only
+	// supported on Linux. Restore ignores it.
+	OneFileSystem bool
+	// Exclude, when set, leaves the entries it matches out of tar and zip archives, and
+	// the contents of matched directories with them. Restore ignores it.
+	Exclude *Excludes
+	// Suffix is appended to archive names after the extension and any encryption suffix,
+	// e.g. ".bak"; see ValidateArchiveSuffix. Names are read with or without it.
+	Suffix string
+}
+
+// DefaultStreamBuffer is the Stream buffer size when ArchiveOptions.StreamBuffer is 0.
+const DefaultStreamBuffer = 1 << 20
+
+// OwnerMap decides the owner of extracted entries. A UID or GID of 0 or more is given to
+// every entry; -1 maps the archived id through UIDs or GIDs and keeps it when it has no
+// mapping. Zip archives carry no ids, so only the fixed UID and GID apply to them.
+type OwnerMap struct {
+	UID, GID   int
+	UIDs, GIDs map[int]int
+}
+
+// owner returns the uid and gid for an entry archived with uid and gid, -1 meaning unknown.
+// A -1 result leaves that id unchanged when passed to os.Lchown.
+func (m *OwnerMap) owner(uid, gid int) (int, int) {
+	return mapID(m.UID, m.UIDs, uid), mapID(m.GID, m.GIDs, gid)
+}
+
+func mapID(fixed int, ids map[int]int, id int) int {
+	if fixed >= 0 {
+		return fixed
+	}
+	if mapped, ok := ids[id]; ok && id >= 0 {
+		return mapped
+	}
+	return id
+}
+
+// chown applies m to target, which was archived with uid and gid. A nil m does nothing.
+func (m *OwnerMap) chown(target string, uid, gid int) error {
+	if m == nil {
+		return nil
+	}
+	u, g := m.owner(uid, gid)
+	if u < 0 && g < 0 {
+		return nil
+	}
+	if err := os.Lchown(target, u, g); err != nil {
+		return fmt.Errorf("changing owner of %s: %w", target, err)
+	}
+	return nil
+}
+
+// maskMode applies opts.ModeMask to the permission bits of mode.
+func (opts ArchiveOptions) maskMode(mode os.FileMode) os.FileMode {
+	if opts.ModeMask == 0 {
+		return mode
+	}
+	return mode&^os.ModePerm | mode&opts.ModeMask&os.ModePerm
+}
+
+// specialBits are the mode bits besides the permissions that extraction restores.
+const specialBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// applyMode sets the masked permissions and the setuid, setgid and sticky bits of an
+// extracted file or directory archived with mode. Creating it is not enough: the umask
+// applies there, and the kernel drops setuid and setgid when the owner changes.
+func (opts ArchiveOptions) applyMode(target string, mode os.FileMode) error {
+	if err := os.Chmod(target, opts.maskMode(mode).Perm()|mode&specialBits); err != nil {
+		return fmt.Errorf("setting mode of %s: %w", target, err)
+	}
+	return nil
+}
+
+// ParseModeMask parses a --restore-mode-mask value, an octal permission mask such as 0750.
+func ParseModeMask(s string) (os.FileMode, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask == 0 || mask > 0777 {
+		return 0, fmt.Errorf("invalid mode mask %q (want octal permissions from 1 to 0777, e.g. 0700)", s)
+	}
+	return os.FileMode(mask), nil
+}
+
+// ParseOwner parses a --chown value, uid:gid, into an OwnerMap.
+func ParseOwner(s string) (*OwnerMap, error) {
+	u, g, ok := strings.Cut(s, ":")
+	uid, uerr := strconv.Atoi(u)
+	gid, gerr := strconv.Atoi(g)
+	if !ok || uerr != nil || gerr != nil || uid < 0 || gid < 0 {
+		return nil, fmt.Errorf("invalid owner %q (want uid:gid, e.g. 1000:1000)", s)
+	}
+	return &OwnerMap{UID: uid, GID: gid}, nil
+}
+
+// ParseIDMap parses old:new pairs, as given to --uid-map and --gid-map, into a map.
+func ParseIDMap(pairs []string) (map[int]int, error) {
+	ids := make(map[int]int, len(pairs))
+	for _, pair := range pairs {
+		o, n, ok := strings.Cut(pair, ":")
+		old, oerr := strconv.Atoi(o)
+		id, nerr := strconv.Atoi(n)
+		if !ok || oerr != nil || nerr != nil || old < 0 || id < 0 {
+			return nil, fmt.Errorf("invalid id mapping %q (want old:new, e.g. 999:1000)", pair)
+		}
+		if prev, dup := ids[old]; dup && prev != id {
+			return nil, fmt.Errorf("id %d is mapped twice (to %d and %d)", old, prev, id)
+		}
+		ids[old] = id
+	}
+	return ids, nil
+}
+
+// paxXattrPrefix prefixes PAX records holding extended attributes, as GNU tar writes them.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// ParseTarFormat maps a --tar-format value to its tar.Format.
+func ParseTarFormat(s string) (tar.Format, error) {
+	switch s {
+	case "pax":
+		return tar.FormatPAX, nil
+	case "gnu":
+		return tar.FormatGNU, nil
+	case "ustar":
+		return tar.FormatUSTAR, nil
+	}
+	return tar.FormatUnknown, fmt.Errorf("invalid tar format %q (want pax, gnu or ustar)", s)
+}
+
+// Encrypter encrypts archive bytes on their way to disk and decrypts them on the way back.
+type Encrypter interface {
+	// Suffix is appended to encrypted archive names, e.g. ".enc" or ".age".
+	Suffix() string
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+	Decrypt(r io.Reader) (io.Reader, error)
+}
+
+// encryptionSuffixes are the name suffixes that Encrypter implementations append.
+var encryptionSuffixes = []string{".enc", ".age"}
+
+// encryptionSuffix returns the encryption suffix name ends with, or "".
+func encryptionSuffix(name string) string {
+	lower := strings.ToLower(name)
+	for _, s := range encryptionSuffixes {
+		if strings.HasSuffix(lower, s) {
+			return name[len(name)-len(s):]
+		}
+	}
+	return ""
+}
+
+// IsEncrypted reports whether name carries an encryption suffix.
+func IsEncrypted(name string) bool {
+	return encryptionSuffix(name) != ""
+}
+
+// ManifestName is the archive entry holding per-file SHA-256 sums in sha256sum format.
+// Extract never writes it into the target directory.
+const ManifestName = ".k8s-cf-backup.sha256"
+
+// manifest accumulates sha256sum lines while an archive is written.
+type manifest struct {
+	buf bytes.Buffer
+}
+
+func newManifest(enabled bool) *manifest {
+	if !enabled {
+		return nil
+	}
+	return &manifest{}
+}
+
+func (m *manifest) add(name string, sum []byte) {
+	fmt.Fprintf(&m.buf, "%x  %s\n", sum, filepath.ToSlash(name))
+}
+
+// openSource opens a file being archived. Tests replace it to simulate slow disks.
+var openSource = func(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+// copyFile copies the file at path to w, recording its checksum in m when m is non-nil.
+// The copy stops at the first read after ctx is done.
+func (m *manifest) copyFile(ctx context.Context, w io.Writer, path, name string) error {
+	f, err := openSource(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src := ctxReader{ctx: ctx, r: f}
+
+	if m == nil {
+		_, err = io.Copy(w, src)
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), src); err != nil {
+		return err
+	}
+	m.add(name, h.Sum(nil))
+	return nil
+}
+
+// ctxReader fails reads once ctx is done, so copying from a slow disk can be abandoned
+// between reads. A read already blocked in the kernel still has to return first.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func isManifest(name string) bool {
+	return filepath.Clean(name) == ManifestName
+}
+
+// Archiver creates and extracts archives of a directory tree in one on-disk format.
+type Archiver interface {
+	// Create archives the contents of srcDir into dst and returns the archive size in bytes.
+	// When ctx is done the partial archive is removed and ctx.Err() is returned.
+	Create(ctx context.Context, dst, srcDir string, opts ArchiveOptions) (int64, error)
+	// Extract unpacks src into dstDir, which must already exist.
+	Extract(src, dstDir string, opts ArchiveOptions) error
+	// List returns the names of the entries in src in archive order, without the manifest.
+	// Directory names end in a slash.
+	List(src string, opts ArchiveOptions) ([]string, error)
+}
+
+var (
+	tarGzArchiver    Archiver = tarArchiver{codec: gzipCodec{}}
+	tarZstArchiver   Archiver = tarArchiver{codec: zstdCodec{}}
+	plainTarArchiver Archiver = tarArchiver{codec: noCodec{}}
+	zipFileArchiver  Archiver = zipArchiver{}
+)
+
+// archiveExtensions maps recognised filename suffixes to their Archiver. Longer suffixes
+// are listed first so ".tar.gz" wins over ".tar".
+var archiveExtensions = []struct {
+	suffix   string
+	archiver Archiver
+}{
+	{".tar.gz", tarGzArchiver},
+	{".tgz", tarGzArchiver},
+	{".tar.zst", tarZstArchiver},
+	{".tzst", tarZstArchiver},
+	{".tar", plainTarArchiver},
+	{".zip", zipFileArchiver},
+}
+
+// ArchiverFor returns the Archiver for the extension of name. Names without a recognised
+// extension get the tar.gz archiver, which is what every archive used to be.
+func ArchiverFor(name string) Archiver {
+	_, ext := SplitArchiveExtension(name)
+	lower := strings.ToLower(ext[:len(ext)-len(encryptionSuffix(ext))])
+	for _, e := range archiveExtensions {
+		if lower == e.suffix {
+			return e.archiver
+		}
+	}
+	return tarGzArchiver
+}
+
+// MinArchiveSize is the size of the smallest archive any format writes, that of an empty
+// zip. An object below it was cut short by an interrupted upload and holds no backup.
+const MinArchiveSize = 22
+
+// IsArchive reports whether name ends in one of the recognised archive extensions.
+func IsArchive(name string) bool {
+	_, ext := SplitArchiveExtension(name)
+	return ext != ""
+}
+
+// ArchiveExtensionPattern returns a case-insensitive regular expression matching any
+// recognised archive extension, optionally followed by an encryption suffix and suffix,
+// the archive suffix, when it is set.
+func ArchiveExtensionPattern(suffix string) string {
+	var exts, encs []string
+	for _, e := range archiveExtensions {
+		exts = append(exts, regexp.QuoteMeta(e.suffix))
+	}
+	for _, s := range encryptionSuffixes {
+		encs = append(encs, regexp.QuoteMeta(s))
+	}
+	pattern := "(?:" + strings.Join(exts, "|") + ")(?:" + strings.Join(encs, "|") + ")?"
+	if suffix != "" {
+		pattern += "(?:" + regexp.QuoteMeta(suffix) + ")?"
+	}
+	return "(?i:" + pattern + ")"
+}
+
+// ValidateArchiveSuffix checks suffix for ArchiveOptions.Suffix. It must start with "."
+// and cannot be an archive extension or encryption suffix, which would make names
+// ambiguous.
+func ValidateArchiveSuffix(suffix string) error {
+	if suffix != "" {
+		lower := strings.ToLower(suffix)
+		switch {
+		case !strings.HasPrefix(suffix, ".") || len(suffix) < 2:
+			return fmt.Errorf("archive suffix %q must start with \".\"", suffix)
+		case strings.ContainsAny(suffix, "/{}"):
+			return fmt.Errorf("archive suffix %q cannot contain \"/\" or placeholders", suffix)
+		case slices.Contains(encryptionSuffixes, lower):
+			return fmt.Errorf("archive suffix %q is the encryption suffix", suffix)
+		}
+		for _, e := range archiveExtensions {
+			if strings.HasSuffix(lower, e.suffix) {
+				return fmt.Errorf("archive suffix %q ends in the archive extension %s", suffix, e.suffix)
+			}
+		}
+	}
+	return nil
+}
+
+// TrimArchiveSuffix returns name without suffix, compared case-insensitively like
+// extensions are. Name parsing (SplitArchiveExtension, IsArchive, ArchiverFor) expects
+// names trimmed this way.
+func TrimArchiveSuffix(name, suffix string) string {
+	if suffix != "" && strings.HasSuffix(strings.ToLower(name), strings.ToLower(suffix)) {
+		return name[:len(name)-len(suffix)]
+	}
+	return name
+}
+
+// SplitArchiveExtension splits name into its base and recognised archive extension,
+// including any encryption suffix, keeping the original case. ext is empty when name has
+// no recognised extension. An archive suffix must be trimmed first, with TrimArchiveSuffix.
+func SplitArchiveExtension(name string) (base, ext string) {
+	enc := encryptionSuffix(name)
+	trimmed := name[:len(name)-len(enc)]
+	lower := strings.ToLower(trimmed)
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(lower, e.suffix) {
+			i := len(trimmed) - len(e.suffix)
+			return name[:i], name[i:]
+		}
+	}
+	return name, ""
+}
+
+// Compression values for --compression, selecting the codec wrapped around the tar stream.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// CompressionExtension returns the archive extension written for a compression value.
+func CompressionExtension(compression string) (string, error) {
+	switch compression {
+	case CompressionGzip:
+		return ".tar.gz", nil
+	case CompressionZstd:
+		return ".tar.zst", nil
+	case CompressionNone:
+		return ".tar", nil
+	}
+	return "", fmt.Errorf("invalid compression %q (want gzip, zstd or none)", compression)
+}
+
+// DetectArchiver picks the Archiver for an existing archive from its magic bytes, so a
+// renamed or extension-less file still restores. Unrecognised content falls back to
+// ArchiverFor(path), with the archive suffix trimmed from path first.
+func DetectArchiver(path, suffix string) (Archiver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening archive: %w", err)
+	}
+	defer f.Close()
+
+	// The tar magic sits at offset 257 of the first header block
+	head := make([]byte, 262)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("reading archive header: %w", err)
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return tarGzArchiver, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return tarZstArchiver, nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return zipFileArchiver, nil
+	case len(head) == 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return plainTarArchiver, nil
+	}
+	return ArchiverFor(TrimArchiveSuffix(path, suffix)), nil
+}
+
+// codec is the compression layer wrapped around a tar stream.
+type codec interface {
+	compress(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error)
+	decompress(r io.Reader, opts ArchiveOptions) (io.ReadCloser, error)
+}
+
+// tarArchiver writes a tar stream through a compression codec.
+type tarArchiver struct {
+	codec codec
+}
+
+func (a tarArchiver) Create(ctx context.Context, dst, srcDir string, opts ArchiveOptions) (int64, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	err = a.write(ctx, file, srcDir, opts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Clean up partial archive on error
+		os.Remove(dst)
+		return 0, err
+	}
+
+	stat, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (a tarArchiver) write(ctx context.Context, w io.Writer, srcDir string, opts ArchiveOptions) error {
+	ew, err := encryptWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	cw, err := a.codec.compress(ew, opts)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(cw)
+	m := newManifest(opts.Manifest)
+	if err := writeTar(ctx, tw, srcDir, m, opts); err != nil {
+		return err
+	}
+	if m != nil {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     ManifestName,
+			Mode:     0644,
+			Size:     int64(m.buf.Len()),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+			Format:   opts.TarFormat,
+		}); err != nil {
+			return fmt.Errorf("writing manifest header: %w", err)
+		}
+		if _, err := tw.Write(m.buf.Bytes()); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+	}
+
+	// Flush everything before the caller takes the size
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return fmt.Errorf("finishing encryption: %w", err)
+	}
+	return nil
+}
+
+// Stream writes an archive of srcDir to w rather than to a file, in the format ArchiverFor
+// picks for name, and returns the number of bytes written. w need not be seekable, so it
+// can be stdout or a pipe; a failure leaves a truncated archive behind in w. Output goes
+// through a buffer of opts.StreamBuffer bytes, so a slow reader on the other end holds up
+// archiving rather than letting compressed data pile up in memory.
+func Stream(ctx context.Context, w io.Writer, name, srcDir string, opts ArchiveOptions) (int64, error) {
+	size := opts.StreamBuffer
+	if size <= 0 {
+		size = DefaultStreamBuffer
+	}
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriterSize(cw, size)
+
+	var err error
+	switch a := ArchiverFor(TrimArchiveSuffix(name, opts.Suffix)).(type) {
+	case tarArchiver:
+		err = a.write(ctx, bw, srcDir, opts)
+	case zipArchiver:
+		err = writeEncryptedZip(ctx, bw, srcDir, opts)
+	default:
+		err = fmt.Errorf("streaming %T archives is not supported", a)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (a tarArchiver) Extract(src, dstDir string, opts ArchiveOptions) error {
+	tr, closeArchive, err := a.open(src, opts)
+	if err != nil {
+		return err
+	}
+	defer closeArchive()
+	return a.zstdError(extractTar(tr, dstDir, opts), opts)
+}
+
+func (a tarArchiver) List(src string, opts ArchiveOptions) ([]string, error) {
+	tr, closeArchive, err := a.open(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+	return a.list(tr, opts)
+}
+
+// ErrNotStreamable is returned by ListStream for formats that cannot be read front to back.
+var ErrNotStreamable = errors.New("archive format needs random access and cannot be read as a stream")
+
+// ListStream lists the entries of an archive read sequentially from r, like Archiver.List,
+// without writing it to disk. name picks the format as in ArchiverFor. Tar formats are
+// read to the end, as their headers are spread through the stream. Zip keeps its directory
+// at the end of the file, so it returns ErrNotStreamable and must be listed from a file.
+func ListStream(r io.Reader, name string, opts ArchiveOptions) ([]string, error) {
+	a, ok := ArchiverFor(TrimArchiveSuffix(name, opts.Suffix)).(tarArchiver)
+	if !ok {
+		return nil, ErrNotStreamable
+	}
+	tr, closeArchive, err := a.reader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+	return a.list(tr, opts)
+}
+
+// list returns the entry names of tr in archive order, without the manifest.
+func (a tarArchiver) list(tr *tar.Reader, opts ArchiveOptions) ([]string, error) {
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, a.zstdError(fmt.Errorf("reading tar: %w", err), opts)
+		}
+		if isManifest(hdr.Name) {
+			continue
+		}
+		name := hdr.Name
+		if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+}
+
+// open returns a reader over the tar stream in src, decrypted and decompressed, and a
+// function that closes it.
+func (a tarArchiver) open(src string, opts ArchiveOptions) (*tar.Reader, func(), error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening archive: %w", err)
+	}
+	tr, closeReader, err := a.reader(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return tr, func() {
+		closeReader()
+		f.Close()
+	}, nil
+}
+
+// reader returns a tar reader over r, decrypted and decompressed, and a function that
+// closes the decompressor. Closing r is left to the caller.
+func (a tarArchiver) reader(r io.Reader, opts ArchiveOptions) (*tar.Reader, func(), error) {
+	dr, err := decryptReader(r, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, err := a.codec.decompress(dr, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tar.NewReader(rc), func() { rc.Close() }, nil
+}
+
+// zstdError explains a zstd window that exceeds the memory limit and a frame compressed
+// with a dictionary that was not supplied.
+func (a tarArchiver) zstdError(err error, opts ArchiveOptions) error {
+	switch {
+	case errors.Is(err, zstd.ErrWindowSizeExceeded):
+		return fmt.Errorf("%w: the archive was written with a larger zstd window than the memory limit of %d bytes allows", err, opts.MemoryLimit)
+	case errors.Is(err, zstd.ErrUnknownDictionary) && opts.Dict != nil:
+		return fmt.Errorf("%w: the archive was written with a different zstd dictionary than %d", err, opts.Dict.ID)
+	case errors.Is(err, zstd.ErrUnknownDictionary):
+		return fmt.Errorf("%w: the archive was written with a zstd dictionary, which must be supplied to read it", err)
+	}
+	return err
+}
+
+// writeTar walks sourceDir and writes every entry to tw with paths relative to sourceDir,
+// adding regular files to m when it is non-nil. Headers are written in opts.TarFormat, with
+// extended attributes when opts.Xattrs is set. The walk stops with ctx.Err() once ctx is done.
+func writeTar(ctx context.Context, tw *tar.Writer, sourceDir string, m *manifest, opts ArchiveOptions) error {
+	format := opts.TarFormat
+	var dirs pendingDirs
+	var fsys fsBoundary
+	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		crossed, err := fsys.crossed(opts, info)
+		if err != nil {
+			return err
+		}
+		if crossed && !info.IsDir() {
+			return nil
+		}
+
+		// Use relative path inside the archive
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		if opts.Exclude.Match(relPath, info.IsDir()) {
+			return opts.Exclude.skip(info)
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("creating tar header for %s: %w", path, err)
+		}
+		header.Name = relPath
+		header.Format = format
+		// Access and change times are not restored, and only PAX could store them
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+
+		// Handle symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			header.Linkname = link
+		}
+
+		if opts.Xattrs {
+			attrs, err := readXattrs(path)
+			if err != nil {
+				return err
+			}
+			for name, value := range attrs {
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords[paxXattrPrefix+name] = value
+			}
+		}
+
+		writeHeader := func() error {
+			if err := tw.WriteHeader(header); err != nil {
+				if format == tar.FormatUSTAR {
+					return fmt.Errorf("%s cannot be stored as USTAR, which limits names to 100 bytes plus a 155-byte directory prefix, sizes to 8 GiB and uid/gid to 2097151; use --tar-format pax or gnu: %w", relPath, err)
+				}
+				return fmt.Errorf("writing tar header: %w", err)
+			}
+			return nil
+		}
+		if opts.ExcludeEmptyDirs && relPath != "." {
+			if info.IsDir() {
+				dirs.hold(relPath, writeHeader)
+				return skipCrossed(crossed)
+			}
+			if err := dirs.flush(relPath); err != nil {
+				return err
+			}
+		}
+		if err := writeHeader(); err != nil {
+			return err
+		}
+		if crossed {
+			return filepath.SkipDir
+		}
+
+		// Only write content for regular files
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return m.copyFile(ctx, tw, path, relPath)
+	})
+}
+
+// fsBoundary finds, for ArchiveOptions.OneFileSystem, the entries of a walk that are on
+// another filesystem than its root, the first entry it is shown.
+type fsBoundary struct {
+	root  uint64
+	known bool
+}
+
+// deviceOf is statDevice, replaced in tests.
+var deviceOf = statDevice
+
+// crossed reports whether info is on another filesystem than the walk's root. It is always
+// false unless opts.OneFileSystem is set.
+func (b *fsBoundary) crossed(opts ArchiveOptions, info os.FileInfo) (bool, error) {
+	if !opts.OneFileSystem {
+		return false, nil
+	}
+	dev, err := deviceOf(info)
+	if err != nil {
+		return false, err
+	}
+	if !b.known {
+		b.root, b.known = dev, true
+		return false, nil
+	}
+	return dev != b.root, nil
+}
+
+// skipCrossed is the walk result for a directory once its entry is written or held: its
+// contents are skipped when it is on another filesystem.
+func skipCrossed(crossed bool) error {
+	if crossed {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// pendingDirs defers the entries of the directories a walk is in until something other
+// than a directory turns up below them, for ArchiveOptions.ExcludeEmptyDirs. It holds a
+// chain of ancestors, outermost first; a directory left without writing was empty.
+type pendingDirs struct {
+	names  []string
+	writes []func() error
+}
+
+// trim drops the held directories that relPath is not below: the walk has left them.
+func (p *pendingDirs) trim(relPath string) {
+	for n := len(p.names); n > 0 && !strings.HasPrefix(relPath, p.names[n-1]+string(filepath.Separator)); n-- {
+		p.names, p.writes = p.names[:n-1], p.writes[:n-1]
+	}
+}
+
+// hold defers write, the entry of the directory relPath, until flush.
+func (p *pendingDirs) hold(relPath string, write func() error) {
+	p.trim(relPath)
+	p.names = append(p.names, relPath)
+	p.writes = append(p.writes, write)
+}
+
+// flush writes the held directories that relPath, a non-directory entry, is below.
+func (p *pendingDirs) flush(relPath string) error {
+	p.trim(relPath)
+	for _, write := range p.writes {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+	p.names, p.writes = p.names[:0], p.writes[:0]
+	return nil
+}
+
+// extractTar unpacks every entry of tr below targetDir, rejecting paths that escape it.
+// With opts.Subtree, only that directory's entries are unpacked. With opts.Xattrs, extended
+// attributes recorded in the archive are set on the entries; with opts.Owner, their owner
+// is changed, and with opts.ModeMask, their permissions are masked. The setuid, setgid and
+// sticky bits and the modification times of files and directories are restored as archived.
+func extractTar(tr *tar.Reader, targetDir string, opts ArchiveOptions) error {
+	var dirs dirTimes
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return dirs.apply()
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+
+		name, ok := subtreeEntry(hdr.Name, opts.Subtree)
+		if !ok || isManifest(hdr.Name) {
+			continue
+		}
+		target, err := safeJoin(targetDir, name)
+		if err != nil {
+			return err
+		}
+
+		// Not os.FileMode(hdr.Mode): tar keeps the special bits where Go does not
+		mode := opts.maskMode(hdr.FileInfo().Mode())
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFile(target, tr, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		// Before the mode and xattrs: changing the owner clears setuid, setgid and
+		// security.capability, where file capabilities are kept
+		if err := opts.Owner.chown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			if err := opts.applyMode(target, mode); err != nil {
+				return err
+			}
+		}
+		if opts.Xattrs {
+			if err := writeXattrs(target, headerXattrs(hdr)); err != nil {
+				return err
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs.add(target, hdr.ModTime)
+		case tar.TypeReg:
+			if err := os.Chtimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dirTimes holds the modification times of extracted directories. They are set once the
+// whole archive is unpacked, as creating the entries inside a directory changes its time.
+type dirTimes []dirTime
+
+type dirTime struct {
+	path  string
+	mtime time.Time
+}
+
+func (d *dirTimes) add(path string, mtime time.Time) {
+	*d = append(*d, dirTime{path, mtime})
+}
+
+// apply sets the recorded times. A zero access time leaves the access time unchanged.
+func (d dirTimes) apply() error {
+	for _, dir := range d {
+		if err := os.Chtimes(dir.path, time.Time{}, dir.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerXattrs returns the extended attributes recorded in hdr's PAX records.
+func headerXattrs(hdr *tar.Header) map[string]string {
+	attrs := make(map[string]string)
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// subtreeEntry maps an archive entry name to its path below subtree, or reports false
+// when the entry is outside it. The subtree directory itself maps to ".". An empty subtree
+// keeps every name as it is.
+func subtreeEntry(name, subtree string) (string, bool) {
+	if subtree == "" {
+		return name, true
+	}
+	clean := path.Clean(name)
+	if clean == subtree {
+		return ".", true
+	}
+	return strings.CutPrefix(clean, subtree+"/")
+}
+
+// TopLevelDirs returns the sorted names of the directories at the top of an archive, as
+// listed by List. Files at the top level are left out.
+func TopLevelDirs(names []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, name := range names {
+		first, _, nested := strings.Cut(path.Clean(name), "/")
+		isDir := nested || strings.HasSuffix(name, "/")
+		if first == "." || first == ".." || !isDir || seen[first] {
+			continue
+		}
+		seen[first] = true
+		dirs = append(dirs, first)
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// safeJoin joins name onto baseDir and fails if the result would land outside baseDir.
+func safeJoin(baseDir, name string) (string, error) {
+	cleanBase := filepath.Clean(baseDir)
+	target := filepath.Join(baseDir, name)
+	cleanTarget := filepath.Clean(target)
+
+	// Prevent path traversal
+	if cleanTarget != cleanBase && !strings.HasPrefix(cleanTarget, cleanBase+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	return target, nil
+}
+
+func writeFile(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type gzipCodec struct{}
+
+// gzipOSUnknown is the gzip header OS byte for "unknown", which --reproducible writes
+// whatever platform the backup runs on.
+const gzipOSUnknown = 255
+
+func (gzipCodec) compress(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error) {
+	level := opts.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if opts.ParallelGzip {
+		zw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Reproducible {
+			zw.Header = pgzip.Header{Name: "", Comment: "", ModTime: time.Time{}, OS: gzipOSUnknown}
+		}
+		return zw, nil
+	}
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Reproducible {
+		// These match the stdlib defaults today; pin them so no default can leak in. The
+		// XFL byte follows the level and the deflate stream the Go version, neither of
+		// which a header can fix.
+		zw.Header = gzip.Header{Name: "", Comment: "", ModTime: time.Time{}, OS: gzipOSUnknown}
+	}
+	return zw, nil
+}
+
+// decompress reads every gzip member of r in turn, so archives of concatenated members,
+// as parallel compressors such as pigz can write, restore like any other.
+func (gzipCodec) decompress(r io.Reader, opts ArchiveOptions) (io.ReadCloser, error) {
+	if opts.ParallelGzip {
+		gr, err := pgzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip reader: %w", err)
+		}
+		return gr, nil
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("gzip reader: %w", err)
+	}
+	return gr, nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) compress(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error) {
+	var eopts []zstd.EOption
+	if opts.Level != 0 {
+		eopts = append(eopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	if opts.MemoryLimit > 0 {
+		eopts = append(eopts,
+			zstd.WithWindowSize(zstdWindow(opts.MemoryLimit)),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithLowerEncoderMem(true),
+		)
+	}
+	if opts.Dict != nil {
+		eopts = append(eopts, zstd.WithEncoderDict(opts.Dict.Data))
+	}
+	return zstd.NewWriter(w, eopts...)
+}
+
+func (zstdCodec) decompress(r io.Reader, opts ArchiveOptions) (io.ReadCloser, error) {
+	var dopts []zstd.DOption
+	if opts.MemoryLimit > 0 {
+		dopts = append(dopts,
+			zstd.WithDecoderMaxWindow(max(opts.MemoryLimit, zstd.MinWindowSize)),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+		)
+	}
+	if opts.Dict != nil {
+		dopts = append(dopts, zstd.WithDecoderDicts(opts.Dict.Data))
+	}
+	zr, err := zstd.NewReader(r, dopts...)
+	if err != nil {
+		return nil, fmt.Errorf("zstd reader: %w", err)
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// zstdWindow is the largest valid zstd window size that fits in limit bytes.
+func zstdWindow(limit uint64) int {
+	window := zstd.MinWindowSize
+	for window < zstd.MaxWindowSize && uint64(window)*2 <= limit {
+		window *= 2
+	}
+	return window
+}
+
+// encryptWriter wraps w with opts.Encrypter, or returns it unchanged when there is none.
+func encryptWriter(w io.Writer, opts ArchiveOptions) (io.WriteCloser, error) {
+	if opts.Encrypter == nil {
+		return nopWriteCloser{w}, nil
+	}
+	ew, err := opts.Encrypter.Encrypt(w)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting archive: %w", err)
+	}
+	return ew, nil
+}
+
+func decryptReader(r io.Reader, opts ArchiveOptions) (io.Reader, error) {
+	if opts.Encrypter == nil {
+		return r, nil
+	}
+	dr, err := opts.Encrypter.Decrypt(r)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting archive: %w", err)
+	}
+	return dr, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type noCodec struct{}
+
+func (noCodec) compress(w io.Writer, _ ArchiveOptions) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noCodec) decompress(r io.Reader, _ ArchiveOptions) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// zipArchiver writes deflate-compressed zip files, which Windows can open natively.
+type zipArchiver struct{}
+
+func (zipArchiver) Create(ctx context.Context, dst, srcDir string, opts ArchiveOptions) (int64, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeEncryptedZip(ctx, file, srcDir, opts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Clean up partial archive on error
+		os.Remove(dst)
+		return 0, err
+	}
+
+	stat, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func writeEncryptedZip(ctx context.Context, w io.Writer, sourceDir string, opts ArchiveOptions) error {
+	ew, err := encryptWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeZip(ctx, ew, sourceDir, opts); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return fmt.Errorf("finishing encryption: %w", err)
+	}
+	return nil
+}
+
+func writeZip(ctx context.Context, w io.Writer, sourceDir string, opts ArchiveOptions) error {
+	zw := zip.NewWriter(w)
+	if opts.Level != 0 {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, opts.Level)
+		})
+	}
+	m := newManifest(opts.Manifest)
+
+	var dirs pendingDirs
+	var fsys fsBoundary
+	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		crossed, err := fsys.crossed(opts, info)
+		if err != nil {
+			return err
+		}
+		if crossed && !info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		// The root itself has no entry; zip trees start at their children
+		if relPath == "." {
+			return nil
+		}
+		if opts.Exclude.Match(relPath, info.IsDir()) {
+			return opts.Exclude.skip(info)
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return fmt.Errorf("creating zip header for %s: %w", path, err)
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+
+		if opts.ExcludeEmptyDirs {
+			if info.IsDir() {
+				dirs.hold(relPath, func() error {
+					if _, err := zw.CreateHeader(header); err != nil {
+						return fmt.Errorf("writing zip header: %w", err)
+					}
+					return nil
+				})
+				return skipCrossed(crossed)
+			}
+			if err := dirs.flush(relPath); err != nil {
+				return err
+			}
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("writing zip header: %w", err)
+		}
+		if crossed {
+			return filepath.SkipDir
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			// Zip stores a symlink's target as its content
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, link)
+			return err
+		case info.Mode().IsRegular():
+			return m.copyFile(ctx, fw, path, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: ManifestName, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return fmt.Errorf("writing manifest header: %w", err)
+		}
+		if _, err := fw.Write(m.buf.Bytes()); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+	}
+	return zw.Close()
+}
+
+func (zipArchiver) Extract(src, dstDir string, opts ArchiveOptions) error {
+	zr, closeArchive, err := openZip(src, opts)
+	if err != nil {
+		return err
+	}
+	defer closeArchive()
+
+	var dirs dirTimes
+	for _, f := range zr.File {
+		name, ok := subtreeEntry(f.Name, opts.Subtree)
+		if !ok || isManifest(f.Name) {
+			continue
+		}
+		target, err := safeJoin(dstDir, name)
+		if err != nil {
+			return err
+		}
+
+		mode := opts.maskMode(f.Mode())
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(string(link), target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", f.Name, err)
+			}
+			err = writeFile(target, rc, mode.Perm())
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := opts.Owner.chown(target, -1, -1); err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink == 0 {
+			if err := opts.applyMode(target, mode); err != nil {
+				return err
+			}
+		}
+		switch {
+		case mode.IsDir():
+			dirs.add(target, f.Modified)
+		case mode.IsRegular():
+			if err := os.Chtimes(target, time.Time{}, f.Modified); err != nil {
+				return err
+			}
+		}
+	}
+	return dirs.apply()
+}
+
+func (zipArchiver) List(src string, opts ArchiveOptions) ([]string, error) {
+	zr, closeArchive, err := openZip(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+
+	var names []string
+	for _, f := range zr.File {
+		if !isManifest(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// openZip opens the zip archive src and returns it with a function that closes it.
+// Encrypted archives are decrypted to a temporary file first, as zip needs random access.
+func openZip(src string, opts ArchiveOptions) (*zip.ReadCloser, func(), error) {
+	plain := ""
+	if opts.Encrypter != nil {
+		var err error
+		if plain, err = decryptToTemp(src, opts); err != nil {
+			return nil, nil, err
+		}
+		src = plain
+	}
+
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		if plain != "" {
+			os.Remove(plain)
+		}
+		return nil, nil, fmt.Errorf("opening archive: %w", err)
+	}
+	return zr, func() {
+		zr.Close()
+		if plain != "" {
+			os.Remove(plain)
+		}
+	}, nil
+}
+
+func decryptToTemp(src string, opts ArchiveOptions) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("opening archive: %w", err)
+	}
+	defer f.Close()
+
+	dr, err := decryptReader(f, opts)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-*.zip")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, dr); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("decrypting archive: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,1181 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestArchiverFor(t *testing.T) {
+	tests := []struct {
+		name string
+		want Archiver
+	}{
+		{"ns_rel_20240101-120000_data.tar.gz", tarGzArchiver},
+		{"data.tgz", tarGzArchiver},
+		{"DATA.TAR.GZ", tarGzArchiver},
+		{"data.tar.zst", tarZstArchiver},
+		{"data.tzst", tarZstArchiver},
+		{"data.tar", plainTarArchiver},
+		{"data.zip", zipFileArchiver},
+		{"/backups/data.zip", zipFileArchiver},
+		{"backup-rel-vol", tarGzArchiver}, // no extension keeps the historical default
+		{"data.tar.bz2", tarGzArchiver},
+	}
+
+	for _, tc := range tests {
+		if got := ArchiverFor(tc.name); got != tc.want {
+			t.Errorf("ArchiverFor(%q) = %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestArchivers_RoundTrip(t *testing.T) {
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tar", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			srcDir := t.TempDir()
+			os.WriteFile(filepath.Join(srcDir, "file1.txt"), []byte("hello"), 0644)
+			os.Mkdir(filepath.Join(srcDir, "subdir"), 0755)
+			os.WriteFile(filepath.Join(srcDir, "subdir", "file2.txt"), []byte("world"), 0600)
+			if err := os.Symlink("file1.txt", filepath.Join(srcDir, "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			archivePath := filepath.Join(t.TempDir(), "test"+ext)
+			a := ArchiverFor(archivePath)
+			size, err := a.Create(context.Background(), archivePath, srcDir, ArchiveOptions{})
+			if err != nil {
+				t.Fatalf("Create() error: %v", err)
+			}
+			if size <= 0 {
+				t.Errorf("size = %d, want > 0", size)
+			}
+
+			restoreDir := t.TempDir()
+			if err := a.Extract(archivePath, restoreDir, ArchiveOptions{}); err != nil {
+				t.Fatalf("Extract() error: %v", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(restoreDir, "subdir", "file2.txt"))
+			if err != nil {
+				t.Fatalf("reading subdir/file2.txt: %v", err)
+			}
+			if string(data) != "world" {
+				t.Errorf("subdir/file2.txt = %q, want %q", string(data), "world")
+			}
+			info, err := os.Stat(filepath.Join(restoreDir, "subdir", "file2.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("subdir/file2.txt mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+			}
+			link, err := os.Readlink(filepath.Join(restoreDir, "link"))
+			if err != nil {
+				t.Fatalf("reading link: %v", err)
+			}
+			if link != "file1.txt" {
+				t.Errorf("link target = %q, want %q", link, "file1.txt")
+			}
+		})
+	}
+}
+
+func TestArchivers_CompressionLevel(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), 0644)
+
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".zip"} {
+		archivePath := filepath.Join(t.TempDir(), "test"+ext)
+		if _, err := ArchiverFor(archivePath).Create(context.Background(), archivePath, srcDir, ArchiveOptions{Level: 1}); err != nil {
+			t.Errorf("%s: Create() with level 1 error: %v", ext, err)
+		}
+	}
+}
+
+func TestBackupAll_ArchiveFormatFromExtension(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("zstd me"), 0644)
+
+	outDir := t.TempDir()
+	b := New(outDir, "{pvc}.tar.zst", false)
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "my-pvc", HostPath: srcDir}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("unexpected error: %v", results[0].Err)
+	}
+
+	// A zstd archive must not be readable as gzip, but must restore through the factory
+	if _, err := (gzipCodec{}).decompress(mustOpen(t, results[0].ArchivePath), ArchiveOptions{}); err == nil {
+		t.Error("expected .tar.zst archive not to be gzip")
+	}
+	restoreDir := t.TempDir()
+	if err := b.RestoreOne(results[0].ArchivePath, restoreDir); err != nil {
+		t.Fatalf("RestoreOne() error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(restoreDir, "data.txt"))
+	if err != nil || string(data) != "zstd me" {
+		t.Errorf("data.txt = %q (err %v), want %q", string(data), err, "zstd me")
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestArchivers_EmbeddedManifest(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "hello.txt"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(srcDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "sub", "world.txt"), []byte("world"), 0644)
+
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "test"+ext)
+			a := ArchiverFor(archivePath)
+			if _, err := a.Create(context.Background(), archivePath, srcDir, ArchiveOptions{Manifest: true}); err != nil {
+				t.Fatalf("Create() error: %v", err)
+			}
+
+			// The manifest is readable when extracting the archive with generic tools
+			got := readManifest(t, archivePath)
+			want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  hello.txt\n" +
+				"486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7  sub/world.txt\n"
+			if got != want {
+				t.Errorf("manifest = %q, want %q", got, want)
+			}
+
+			// Extract must not leave the manifest in the restored data
+			restoreDir := t.TempDir()
+			if err := a.Extract(archivePath, restoreDir, ArchiveOptions{}); err != nil {
+				t.Fatalf("Extract() error: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(restoreDir, ManifestName)); !os.IsNotExist(err) {
+				t.Errorf("manifest extracted into target dir (err %v)", err)
+			}
+			if _, err := os.Stat(filepath.Join(restoreDir, "sub", "world.txt")); err != nil {
+				t.Errorf("sub/world.txt missing: %v", err)
+			}
+		})
+	}
+}
+
+func readManifest(t *testing.T, archivePath string) string {
+	t.Helper()
+	if strings.HasSuffix(archivePath, ".zip") {
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.Name == ManifestName {
+				data, err := readZipFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(data)
+			}
+		}
+		t.Fatal("no manifest in zip")
+	}
+
+	gr, err := gzip.NewReader(mustOpen(t, archivePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("no manifest in tar: %v", err)
+		}
+		if hdr.Name == ManifestName {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+	}
+}
+
+func TestBackupAll_WithChecksum(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("sum me"), 0644)
+
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithChecksum())
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "my-pvc", HostPath: srcDir}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("unexpected error: %v", results[0].Err)
+	}
+
+	want, err := FileSHA256(results[0].ArchivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results[0].SHA256) != 64 || results[0].SHA256 != want {
+		t.Errorf("SHA256 = %q, want %q", results[0].SHA256, want)
+	}
+
+	// Without the option no checksum is computed
+	results = New(t.TempDir(), "{pvc}.tar.gz", false).BackupAll(context.Background(), []types.PVCInfo{{PVCName: "my-pvc", HostPath: srcDir}}, "ns", "rel")
+	if results[0].SHA256 != "" {
+		t.Errorf("SHA256 = %q, want empty", results[0].SHA256)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for _, name := range []string{"a.tar.gz", "a.TGZ", "a.tar.zst", "a.tzst", "a.tar", "a.zip"} {
+		if !IsArchive(name) {
+			t.Errorf("IsArchive(%q) = false, want true", name)
+		}
+	}
+	for _, name := range []string{"a.tar.gz.sha256", "manifest.json", "a"} {
+		if IsArchive(name) {
+			t.Errorf("IsArchive(%q) = true, want false", name)
+		}
+	}
+}
+
+func TestDetectArchiver(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("detect me"), 0644)
+
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tar", ".zip"} {
+		// Strip the extension so only the content can identify the format
+		archivePath := filepath.Join(t.TempDir(), "test"+ext)
+		want := ArchiverFor(archivePath)
+		if _, err := want.Create(context.Background(), archivePath, srcDir, ArchiveOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		renamed := filepath.Join(filepath.Dir(archivePath), "renamed.bin")
+		if err := os.Rename(archivePath, renamed); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := DetectArchiver(renamed, "")
+		if err != nil {
+			t.Fatalf("%s: DetectArchiver() error: %v", ext, err)
+		}
+		if got != want {
+			t.Errorf("%s: DetectArchiver() = %#v, want %#v", ext, got, want)
+		}
+	}
+
+	if _, err := DetectArchiver(filepath.Join(t.TempDir(), "missing.tar"), ""); err == nil {
+		t.Error("expected error for missing archive")
+	}
+
+	// Unrecognised content falls back to the extension, behind the archive suffix
+	unknown := filepath.Join(t.TempDir(), "x.zip.bak")
+	os.WriteFile(unknown, []byte("not an archive"), 0644)
+	if got, err := DetectArchiver(unknown, ".bak"); err != nil || got != zipFileArchiver {
+		t.Errorf("DetectArchiver(x.zip.bak) = %#v, %v; want the zip archiver", got, err)
+	}
+}
+
+func TestBackupAll_NoCompressionRoundTrip(t *testing.T) {
+	srcDir := t.TempDir()
+	content := strings.Repeat("incompressible? no, but stored as-is\n", 100)
+	os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte(content), 0644)
+
+	b := New(t.TempDir(), "{pvc}.tar", false)
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "my-pvc", HostPath: srcDir}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("unexpected error: %v", results[0].Err)
+	}
+
+	// With no compression layer the reported size must still match the flushed file
+	info, err := os.Stat(results[0].ArchivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Size != info.Size() {
+		t.Errorf("Size = %d, file is %d bytes", results[0].Size, info.Size())
+	}
+	if info.Size() < int64(len(content)) || info.Size()%512 != 0 {
+		t.Errorf("archive size %d is not a complete uncompressed tar of %d bytes", info.Size(), len(content))
+	}
+
+	// Restore must detect raw tar even when the file was renamed to .tar.gz
+	renamed := results[0].ArchivePath + ".gz"
+	if err := os.Rename(results[0].ArchivePath, renamed); err != nil {
+		t.Fatal(err)
+	}
+	restoreDir := t.TempDir()
+	if err := b.RestoreOne(renamed, restoreDir); err != nil {
+		t.Fatalf("RestoreOne() error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(restoreDir, "data.txt"))
+	if err != nil || string(data) != content {
+		t.Errorf("data.txt not restored intact (err %v)", err)
+	}
+}
+
+func TestRestoreOne_ModTimes(t *testing.T) {
+	srcDir := t.TempDir()
+	fileTime := time.Date(2021, 6, 1, 10, 20, 30, 0, time.UTC)
+	dirTime := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "sub", "data.txt"), []byte("data"), 0644)
+	os.Chtimes(filepath.Join(srcDir, "sub", "data.txt"), fileTime, fileTime)
+	os.Chtimes(filepath.Join(srcDir, "sub"), dirTime, dirTime)
+
+	for _, format := range []string{"{pvc}.tar.gz", "{pvc}.zip"} {
+		b := New(t.TempDir(), format, false)
+		r := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: srcDir}}, "ns", "rel")[0]
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		restoreDir := t.TempDir()
+		if err := b.RestoreOne(r.ArchivePath, restoreDir); err != nil {
+			t.Fatalf("%s: RestoreOne() error: %v", format, err)
+		}
+		// The directory keeps its time even though its file was written after it
+		for path, want := range map[string]time.Time{"sub/data.txt": fileTime, "sub": dirTime} {
+			info, err := os.Stat(filepath.Join(restoreDir, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(want) {
+				t.Errorf("%s: %s mtime = %v, want %v", format, path, info.ModTime(), want)
+			}
+		}
+	}
+}
+
+// xorEncrypter is a trivial Encrypter that marks its output with a header.
+type xorEncrypter struct{}
+
+func (xorEncrypter) Suffix() string { return ".enc" }
+
+func (xorEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if _, err := w.Write([]byte("XOR1")); err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{xorWriter{w}}, nil
+}
+
+func (xorEncrypter) Decrypt(r io.Reader) (io.Reader, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil || string(head) != "XOR1" {
+		return nil, fmt.Errorf("not encrypted")
+	}
+	return xorReader{r}, nil
+}
+
+type xorWriter struct{ w io.Writer }
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i, b := range p {
+		buf[i] = b ^ 0xa5
+	}
+	return x.w.Write(buf)
+}
+
+type xorReader struct{ r io.Reader }
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0xa5
+	}
+	return n, err
+}
+
+func TestBackupAll_EncryptedRoundTrip(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "secret.txt"), []byte("top secret"), 0600)
+
+	for _, format := range []string{"{pvc}.tar.gz", "{pvc}.tar.zst", "{pvc}.zip"} {
+		t.Run(format, func(t *testing.T) {
+			b := New(t.TempDir(), format, false, WithArchiveOptions(ArchiveOptions{Encrypter: xorEncrypter{}}))
+			results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "my-pvc", HostPath: srcDir}}, "ns", "rel")
+			if results[0].Err != nil {
+				t.Fatalf("unexpected error: %v", results[0].Err)
+			}
+			if !strings.HasSuffix(results[0].ArchivePath, ".enc") {
+				t.Errorf("ArchivePath = %q, want .enc suffix", results[0].ArchivePath)
+			}
+			data, _ := os.ReadFile(results[0].ArchivePath)
+			if !bytes.HasPrefix(data, []byte("XOR1")) {
+				t.Error("archive was not passed through the encrypter")
+			}
+
+			restoreDir := t.TempDir()
+			if err := b.RestoreOne(results[0].ArchivePath, restoreDir); err != nil {
+				t.Fatalf("RestoreOne() error: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(restoreDir, "secret.txt"))
+			if err != nil || string(got) != "top secret" {
+				t.Errorf("secret.txt = %q (err %v)", got, err)
+			}
+
+			// Without a key provider an encrypted archive is refused before the wipe
+			os.WriteFile(filepath.Join(restoreDir, "keep.txt"), []byte("keep"), 0644)
+			if err := New("", "", false).RestoreOne(results[0].ArchivePath, restoreDir); err == nil {
+				t.Error("expected error restoring an encrypted archive without an encrypter")
+			}
+			// Nor with an encrypter of another kind
+			aged := strings.TrimSuffix(results[0].ArchivePath, ".enc") + ".age"
+			os.Rename(results[0].ArchivePath, aged)
+			if err := b.RestoreOne(aged, restoreDir); err == nil || !strings.Contains(err.Error(), ".age-encrypted") {
+				t.Errorf("restoring a .age archive with a .enc encrypter: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(restoreDir, "keep.txt")); err != nil {
+				t.Error("target was wiped despite the refused restore")
+			}
+		})
+	}
+}
+
+func TestSplitArchiveExtension(t *testing.T) {
+	tests := []struct{ name, base, ext string }{
+		{"a.tar.gz", "a", ".tar.gz"},
+		{"a.TAR.ZST", "a", ".TAR.ZST"},
+		{"a.tar.gz.enc", "a", ".tar.gz.enc"},
+		{"a.zip.enc", "a", ".zip.enc"},
+		{"a.tar.gz.age", "a", ".tar.gz.age"},
+		{"a.enc", "a.enc", ""},
+		{"a", "a", ""},
+	}
+	for _, tc := range tests {
+		base, ext := SplitArchiveExtension(tc.name)
+		if base != tc.base || ext != tc.ext {
+			t.Errorf("SplitArchiveExtension(%q) = %q, %q; want %q, %q", tc.name, base, ext, tc.base, tc.ext)
+		}
+	}
+	if ArchiverFor("a.tar.zst.enc") != tarZstArchiver {
+		t.Error("ArchiverFor should look through the encryption suffix")
+	}
+}
+
+func TestArchiveSuffix(t *testing.T) {
+	for _, bad := range []string{"bak", ".", ".a/b", ".{date}", ".enc", ".ENC", ".age", ".tar.gz", ".zip"} {
+		if err := ValidateArchiveSuffix(bad); err == nil {
+			t.Errorf("ValidateArchiveSuffix(%q) succeeded", bad)
+		}
+	}
+	if err := ValidateArchiveSuffix(".bak"); err != nil {
+		t.Errorf("ValidateArchiveSuffix(.bak) error: %v", err)
+	}
+
+	tests := []struct{ name, base, ext string }{
+		{"a.tar.gz.bak", "a", ".tar.gz"},
+		{"a.tar.zst.enc.BAK", "a", ".tar.zst.enc"},
+		{"a.tar.gz", "a", ".tar.gz"},
+		{"a.bak", "a", ""},
+	}
+	for _, tc := range tests {
+		base, ext := SplitArchiveExtension(TrimArchiveSuffix(tc.name, ".bak"))
+		if base != tc.base || ext != tc.ext {
+			t.Errorf("SplitArchiveExtension(%q) = %q, %q; want %q, %q", tc.name, base, ext, tc.base, tc.ext)
+		}
+	}
+	if IsArchive("a.zip.bak") || !IsArchive(TrimArchiveSuffix("a.zip.bak", ".bak")) {
+		t.Error("IsArchive should only see through a trimmed suffix")
+	}
+	if re := regexp.MustCompile("^a" + ArchiveExtensionPattern(".bak") + "$"); !re.MatchString("a.tar.gz.bak") || !re.MatchString("a.tar.gz") {
+		t.Errorf("ArchiveExtensionPattern(.bak) = %s should match with and without the suffix", ArchiveExtensionPattern(".bak"))
+	}
+	if re := regexp.MustCompile("^a" + ArchiveExtensionPattern("") + "$"); re.MatchString("a.tar.gz.bak") {
+		t.Errorf("ArchiveExtensionPattern() = %s should not match a suffix", ArchiveExtensionPattern(""))
+	}
+}
+
+func TestBackupAll_ArchiveSuffix(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("hello"), 0644)
+
+	b := New(t.TempDir(), "{pvc}.tar.zst", false, WithArchiveOptions(ArchiveOptions{Encrypter: xorEncrypter{}, Suffix: ".bak"}))
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: srcDir}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	if got := filepath.Base(results[0].ArchivePath); got != "data.tar.zst.enc.bak" {
+		t.Errorf("archive = %s, want data.tar.zst.enc.bak", got)
+	}
+	restoreDir := t.TempDir()
+	if err := b.RestoreOne(results[0].ArchivePath, restoreDir); err != nil {
+		t.Fatalf("RestoreOne() error: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(restoreDir, "a.txt")); err != nil || string(got) != "hello" {
+		t.Errorf("a.txt = %q (err %v)", got, err)
+	}
+}
+
+func TestParseTarFormat(t *testing.T) {
+	tests := map[string]tar.Format{"pax": tar.FormatPAX, "gnu": tar.FormatGNU, "ustar": tar.FormatUSTAR}
+	for in, want := range tests {
+		if got, err := ParseTarFormat(in); err != nil || got != want {
+			t.Errorf("ParseTarFormat(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseTarFormat("v7"); err == nil {
+		t.Error("ParseTarFormat(v7) succeeded")
+	}
+}
+
+// tarFormats returns the header format of every entry of a plain tar archive.
+func tarFormats(t *testing.T, archivePath string) map[string]tar.Format {
+	t.Helper()
+	tr := tar.NewReader(mustOpen(t, archivePath))
+	formats := make(map[string]tar.Format)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return formats
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		formats[hdr.Name] = hdr.Format
+	}
+}
+
+func TestTarArchiver_TarFormat(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "file.txt"), []byte("data"), 0644)
+
+	// Reading back, archive/tar reports the format each header was written in. A PAX header
+	// without extended records is indistinguishable from USTAR, so give the file a sub-second
+	// mtime, which only PAX records.
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 500_000_000, time.UTC)
+	os.Chtimes(filepath.Join(src, "file.txt"), mtime, mtime)
+
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU, tar.FormatUSTAR} {
+		t.Run(format.String(), func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "a.tar")
+			if _, err := plainTarArchiver.Create(context.Background(), dst, src, ArchiveOptions{TarFormat: format, Manifest: true}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			formats := tarFormats(t, dst)
+			for _, name := range []string{"file.txt", ManifestName} {
+				if formats[name] != format {
+					t.Errorf("%s written as %v, want %v", name, formats[name], format)
+				}
+			}
+		})
+	}
+}
+
+func TestTarArchiver_USTARRejectsLongNames(t *testing.T) {
+	src := t.TempDir()
+	long := strings.Repeat("x", 120)
+	os.WriteFile(filepath.Join(src, long), []byte("data"), 0644)
+
+	dst := filepath.Join(t.TempDir(), "a.tar")
+	_, err := plainTarArchiver.Create(context.Background(), dst, src, ArchiveOptions{TarFormat: tar.FormatUSTAR})
+	if err == nil || !strings.Contains(err.Error(), "--tar-format pax or gnu") {
+		t.Fatalf("expected a USTAR limit error, got %v", err)
+	}
+	if _, statErr := os.Stat(dst); !os.IsNotExist(statErr) {
+		t.Error("partial archive was left behind")
+	}
+
+	// The same tree is fine in PAX
+	if _, err := plainTarArchiver.Create(context.Background(), dst, src, ArchiveOptions{TarFormat: tar.FormatPAX}); err != nil {
+		t.Errorf("PAX: %v", err)
+	}
+}
+
+func TestZstdMemoryLimit(t *testing.T) {
+	// Large enough, and incompressible enough, that the encoder uses its full window
+	src := t.TempDir()
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data[:10<<20])
+	if err := os.WriteFile(filepath.Join(src, "data.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	normal := filepath.Join(t.TempDir(), "normal.tar.zst")
+	if _, err := tarZstArchiver.Create(context.Background(), normal, src, ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	limited := filepath.Join(t.TempDir(), "limited.tar.zst")
+	if _, err := tarZstArchiver.Create(context.Background(), limited, src, ArchiveOptions{MemoryLimit: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	extract := func(archive string, limit uint64) error {
+		dst := t.TempDir()
+		if err := tarZstArchiver.Extract(archive, dst, ArchiveOptions{MemoryLimit: limit}); err != nil {
+			return err
+		}
+		got, err := os.ReadFile(filepath.Join(dst, "data.bin"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s with limit %d: restored content differs (%v)", filepath.Base(archive), limit, err)
+		}
+		return nil
+	}
+
+	// A limit at the default window still restores an archive written without one
+	if err := extract(normal, 8<<20); err != nil {
+		t.Errorf("normal archive, 8 MiB limit: %v", err)
+	}
+	// An archive written under a limit restores under the same limit and without one
+	for _, limit := range []uint64{1 << 20, 0} {
+		if err := extract(limited, limit); err != nil {
+			t.Errorf("limited archive, limit %d: %v", limit, err)
+		}
+	}
+	// Below the window an archive needs, restore fails with an explanation instead of
+	// allocating past the limit
+	err := extract(normal, 1<<20)
+	if err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Errorf("normal archive, 1 MiB limit: got %v, want a memory limit error", err)
+	}
+}
+
+func TestZstdWindow(t *testing.T) {
+	tests := map[uint64]int{0: 1 << 10, 1000: 1 << 10, 1 << 20: 1 << 20, 3 << 20: 2 << 20, 1 << 40: 1 << 29}
+	for limit, want := range tests {
+		if got := zstdWindow(limit); got != want {
+			t.Errorf("zstdWindow(%d) = %d, want %d", limit, got, want)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	m, err := ParseOwner("1000:2000")
+	if err != nil || m.UID != 1000 || m.GID != 2000 {
+		t.Errorf("ParseOwner(1000:2000) = %+v, %v", m, err)
+	}
+	for _, bad := range []string{"", "1000", "a:b", "1000:", "-1:0"} {
+		if _, err := ParseOwner(bad); err == nil {
+			t.Errorf("ParseOwner(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseIDMap(t *testing.T) {
+	ids, err := ParseIDMap([]string{"999:1000", "0:0", "999:1000"})
+	if err != nil || len(ids) != 2 || ids[999] != 1000 || ids[0] != 0 {
+		t.Errorf("ParseIDMap() = %v, %v", ids, err)
+	}
+	for _, bad := range [][]string{{"999"}, {"x:1"}, {"1:-2"}, {"999:1000", "999:1001"}} {
+		if _, err := ParseIDMap(bad); err == nil {
+			t.Errorf("ParseIDMap(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestOwnerMap_Owner(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        OwnerMap
+		uid, gid int
+		wantUID  int
+		wantGID  int
+	}{
+		{"flat", OwnerMap{UID: 1, GID: 2}, 999, 999, 1, 2},
+		{"flat without archived ids", OwnerMap{UID: 1, GID: 2}, -1, -1, 1, 2},
+		{"mapped", OwnerMap{UID: -1, GID: -1, UIDs: map[int]int{999: 1000}, GIDs: map[int]int{999: 1001}}, 999, 999, 1000, 1001},
+		{"unmapped kept", OwnerMap{UID: -1, GID: -1, UIDs: map[int]int{999: 1000}}, 5, 6, 5, 6},
+		{"unknown left alone", OwnerMap{UID: -1, GID: -1, UIDs: map[int]int{999: 1000}}, -1, -1, -1, -1},
+	}
+	for _, tc := range tests {
+		if uid, gid := tc.m.owner(tc.uid, tc.gid); uid != tc.wantUID || gid != tc.wantGID {
+			t.Errorf("%s: owner(%d, %d) = %d, %d; want %d, %d", tc.name, tc.uid, tc.gid, uid, gid, tc.wantUID, tc.wantGID)
+		}
+	}
+}
+
+func TestStream_Zip(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "file.txt"), []byte("zipped"), 0644)
+
+	var buf bytes.Buffer
+	n, err := Stream(context.Background(), &buf, "a.zip", src, ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("Stream() = %d, wrote %d bytes", n, buf.Len())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading streamed zip: %v", err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "file.txt" {
+		t.Errorf("zip entries = %v, want file.txt", zr.File)
+	}
+}
+
+// heapWatcher discards what is written to it while recording the peak heap in use.
+type heapWatcher struct {
+	writes int
+	peak   uint64
+}
+
+func (h *heapWatcher) Write(p []byte) (int, error) {
+	// ReadMemStats stops the world, so only sample every few writes
+	if h.writes++; h.writes%16 == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		h.peak = max(h.peak, m.HeapInuse)
+	}
+	return len(p), nil
+}
+
+func TestStream_BoundedMemory(t *testing.T) {
+	src := t.TempDir()
+	// A sparse file: 256 MiB to archive without as much disk or time to create it
+	f, err := os.Create(filepath.Join(src, "large.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(256 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	w := &heapWatcher{}
+	n, err := Stream(context.Background(), w, "large.tar.gz", src, ArchiveOptions{StreamBuffer: 64 << 10, Level: 1})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if n == 0 || w.writes == 0 {
+		t.Fatalf("Stream wrote %d bytes in %d writes", n, w.writes)
+	}
+	if grown := int64(w.peak) - int64(before.HeapInuse); grown > 32<<20 {
+		t.Errorf("heap grew by %d MiB while streaming 256 MiB, want it bounded", grown>>20)
+	}
+}
+
+func TestArchivers_ListAndSubtree(t *testing.T) {
+	srcDir := t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "data", "empty"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "data", "file.txt"), []byte("data"), 0644)
+	os.Mkdir(filepath.Join(srcDir, "wal"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "top.txt"), []byte("top"), 0644)
+
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tar", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "test"+ext)
+			a := ArchiverFor(archivePath)
+			if _, err := a.Create(context.Background(), archivePath, srcDir, ArchiveOptions{Manifest: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			names, err := a.List(archivePath, ArchiveOptions{})
+			if err != nil {
+				t.Fatalf("List() error: %v", err)
+			}
+			for _, name := range names {
+				if isManifest(name) {
+					t.Errorf("List() includes the manifest")
+				}
+			}
+			// The empty wal directory counts; the file at the top does not
+			if got := TopLevelDirs(names); !slices.Equal(got, []string{"data", "wal"}) {
+				t.Errorf("TopLevelDirs(%v) = %v, want [data wal]", names, got)
+			}
+
+			restoreDir := t.TempDir()
+			if err := a.Extract(archivePath, restoreDir, ArchiveOptions{Subtree: "data"}); err != nil {
+				t.Fatalf("Extract(Subtree) error: %v", err)
+			}
+			entries, err := os.ReadDir(restoreDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if !slices.Equal(got, []string{"empty", "file.txt"}) {
+				t.Errorf("extracted %v, want [empty file.txt]", got)
+			}
+		})
+	}
+}
+
+func TestListStream(t *testing.T) {
+	srcDir := t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "data"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "data", "file.txt"), []byte("data"), 0644)
+
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tar", ".tar.gz.enc"} {
+		t.Run(ext, func(t *testing.T) {
+			opts := ArchiveOptions{Manifest: true}
+			if IsEncrypted(ext) {
+				opts.Encrypter = xorEncrypter{}
+			}
+			archivePath := filepath.Join(t.TempDir(), "test"+ext)
+			a := ArchiverFor(archivePath)
+			if _, err := a.Create(context.Background(), archivePath, srcDir, opts); err != nil {
+				t.Fatal(err)
+			}
+			want, err := a.List(archivePath, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ListStream(mustOpen(t, archivePath), archivePath, opts)
+			if err != nil {
+				t.Fatalf("ListStream() error: %v", err)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("ListStream() = %v, want %v", got, want)
+			}
+		})
+	}
+
+	if _, err := ListStream(strings.NewReader(""), "test.zip", ArchiveOptions{}); !errors.Is(err, ErrNotStreamable) {
+		t.Errorf("ListStream(zip) error = %v, want ErrNotStreamable", err)
+	}
+}
+
+func TestSubtreeEntry(t *testing.T) {
+	tests := []struct {
+		name, subtree string
+		want          string
+		ok            bool
+	}{
+		{"data/file.txt", "", "data/file.txt", true},
+		{"data/file.txt", "data", "file.txt", true},
+		{"./data/sub/", "data", "sub", true},
+		{"data/", "data", ".", true},
+		{"database/file.txt", "data", "", false},
+		{"wal/file.txt", "data", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := subtreeEntry(tc.name, tc.subtree)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("subtreeEntry(%q, %q) = %q, %v; want %q, %v", tc.name, tc.subtree, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseModeMask(t *testing.T) {
+	for s, want := range map[string]os.FileMode{"0700": 0700, "750": 0750, "0777": 0777} {
+		if got, err := ParseModeMask(s); err != nil || got != want {
+			t.Errorf("ParseModeMask(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "0", "0800", "1777", "rwx"} {
+		if _, err := ParseModeMask(bad); err == nil {
+			t.Errorf("ParseModeMask(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestExtract_ModeMask(t *testing.T) {
+	srcDir := t.TempDir()
+	os.Mkdir(filepath.Join(srcDir, "shared"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "shared", "data"), []byte("data"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "private"), []byte("secret"), 0600)
+	// Archived modes must not depend on the umask
+	os.Chmod(filepath.Join(srcDir, "shared"), 0755)
+	os.Chmod(filepath.Join(srcDir, "shared", "data"), 0644)
+	os.Chmod(filepath.Join(srcDir, "run.sh"), 0755)
+
+	want := map[string]os.FileMode{"shared": 0750, "shared/data": 0640, "run.sh": 0750, "private": 0600}
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "test"+ext)
+			a := ArchiverFor(archivePath)
+			if _, err := a.Create(context.Background(), archivePath, srcDir, ArchiveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			restoreDir := t.TempDir()
+			if err := a.Extract(archivePath, restoreDir, ArchiveOptions{ModeMask: 0750}); err != nil {
+				t.Fatalf("Extract() error: %v", err)
+			}
+			for name, mode := range want {
+				info, err := os.Stat(filepath.Join(restoreDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != mode {
+					t.Errorf("%s mode = %v, want %v", name, info.Mode().Perm(), mode)
+				}
+			}
+		})
+	}
+}
+
+func TestTarGz_ParallelGzip(t *testing.T) {
+	srcDir := t.TempDir()
+	data := bytes.Repeat([]byte("parallel gzip "), 200_000) // several pgzip blocks
+	if err := os.WriteFile(filepath.Join(srcDir, "data.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each side reads what the other writes
+	for _, create := range []bool{false, true} {
+		archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+		if _, err := tarGzArchiver.Create(context.Background(), archivePath, srcDir, ArchiveOptions{ParallelGzip: create}); err != nil {
+			t.Fatal(err)
+		}
+		for _, extract := range []bool{false, true} {
+			restoreDir := t.TempDir()
+			if err := tarGzArchiver.Extract(archivePath, restoreDir, ArchiveOptions{ParallelGzip: extract}); err != nil {
+				t.Fatalf("parallel create %v, extract %v: %v", create, extract, err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(restoreDir, "data.txt")); !bytes.Equal(got, data) {
+				t.Errorf("parallel create %v, extract %v: restored %d bytes, want %d", create, extract, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestTarGz_Multistream(t *testing.T) {
+	var tarData bytes.Buffer
+	tw := tar.NewWriter(&tarData)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		body := strings.Repeat(name, 1000)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+
+	// Two gzip members split mid-entry, as pigz --independent or cat a.gz b.gz give
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+	var archive bytes.Buffer
+	half := tarData.Len() / 2
+	for _, part := range [][]byte{tarData.Bytes()[:half], tarData.Bytes()[half:]} {
+		zw := gzip.NewWriter(&archive)
+		zw.Write(part)
+		zw.Close()
+	}
+	if err := os.WriteFile(archivePath, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, parallel := range []bool{false, true} {
+		restoreDir := t.TempDir()
+		if err := tarGzArchiver.Extract(archivePath, restoreDir, ArchiveOptions{ParallelGzip: parallel}); err != nil {
+			t.Fatalf("Extract(parallel %v) error: %v", parallel, err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(restoreDir, "b.txt")); string(got) != strings.Repeat("b.txt", 1000) {
+			t.Errorf("parallel %v: b.txt from the second member = %d bytes", parallel, len(got))
+		}
+	}
+}
+
+// BenchmarkGzipDecompress compares the stdlib reader with pgzip's read-ahead one on an
+// archive of 64 MiB of moderately compressible data.
+func BenchmarkGzipDecompress(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 64<<20)
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(8))
+	}
+	var archive bytes.Buffer
+	zw, err := gzipCodec{}.compress(&archive, ArchiveOptions{ParallelGzip: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	zw.Write(data)
+	zw.Close()
+
+	for _, parallel := range []bool{false, true} {
+		name := "single"
+		if parallel {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				zr, err := gzipCodec{}.decompress(bytes.NewReader(archive.Bytes()), ArchiveOptions{ParallelGzip: parallel})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, zr); err != nil {
+					b.Fatal(err)
+				}
+				zr.Close()
+			}
+		})
+	}
+}
+
+func TestExtract_SpecialBits(t *testing.T) {
+	srcDir := t.TempDir()
+	os.Mkdir(filepath.Join(srcDir, "shared"), 0755)
+	os.Mkdir(filepath.Join(srcDir, "tmp"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "shared", "helper"), []byte("#!/bin/sh\n"), 0755)
+	want := map[string]os.FileMode{
+		"shared":        os.ModeSetgid | 0775,
+		"tmp":           os.ModeSticky | 0777,
+		"shared/helper": os.ModeSetuid | 0755,
+	}
+	for name, mode := range want {
+		if err := os.Chmod(filepath.Join(srcDir, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "test"+ext)
+			a := ArchiverFor(archivePath)
+			if _, err := a.Create(context.Background(), archivePath, srcDir, ArchiveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			restoreDir := t.TempDir()
+			if err := a.Extract(archivePath, restoreDir, ArchiveOptions{}); err != nil {
+				t.Fatalf("Extract() error: %v", err)
+			}
+			for name, mode := range want {
+				info, err := os.Stat(filepath.Join(restoreDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := info.Mode() &^ os.ModeDir; got != mode {
+					t.Errorf("%s mode = %v, want %v", name, got, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestArchivers_Reproducible(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("same data"), 0644)
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(srcDir, "file.txt"), mtime, mtime)
+	os.Chtimes(srcDir, mtime, mtime)
+
+	// Different names and times, as two scheduled runs would have
+	var sums []string
+	for _, name := range []string{"ns_rel_20240101-000000_data.tar.gz", "ns_rel_20240102-000000_data.tar.gz"} {
+		archivePath := filepath.Join(t.TempDir(), name)
+		if _, err := tarGzArchiver.Create(context.Background(), archivePath, srcDir, ArchiveOptions{Reproducible: true}); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := FileSHA256(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, sum)
+
+		head := make([]byte, 10)
+		if _, err := io.ReadFull(mustOpen(t, archivePath), head); err != nil {
+			t.Fatal(err)
+		}
+		// FLG (no name or comment), MTIME and OS of the gzip header
+		if head[3] != 0 || !bytes.Equal(head[4:8], []byte{0, 0, 0, 0}) || head[9] != gzipOSUnknown {
+			t.Errorf("%s: gzip header = % x, want no flags, zero mtime and OS 255", name, head)
+		}
+	}
+	if sums[0] != sums[1] {
+		t.Errorf("archives of the same data differ: %s != %s", sums[0], sums[1])
+	}
+}
+
+func TestArchivers_ExcludeEmptyDirs(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, dir := range []string{"cache/a/b/c", "cache/d/e", "cache/g", "links", "empty"} {
+		if err := os.MkdirAll(filepath.Join(srcDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(srcDir, "cache", "d", "e", "f.txt"), []byte("f"), 0644)
+	os.Symlink("../cache", filepath.Join(srcDir, "links", "cache"))
+
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			list := func(opts ArchiveOptions) []string {
+				archivePath := filepath.Join(t.TempDir(), "test"+ext)
+				a := ArchiverFor(archivePath)
+				if _, err := a.Create(context.Background(), archivePath, srcDir, opts); err != nil {
+					t.Fatal(err)
+				}
+				names, err := a.List(archivePath, ArchiveOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return slices.DeleteFunc(names, func(name string) bool { return name == "./" })
+			}
+
+			// Only the directories on the way to f.txt and to the symlink are left
+			want := []string{"cache/", "cache/d/", "cache/d/e/", "cache/d/e/f.txt", "links/", "links/cache"}
+			if got := list(ArchiveOptions{ExcludeEmptyDirs: true}); !slices.Equal(got, want) {
+				t.Errorf("with ExcludeEmptyDirs: %v, want %v", got, want)
+			}
+			// By default the tree is archived exactly
+			if got := list(ArchiveOptions{}); len(got) != 11 {
+				t.Errorf("without ExcludeEmptyDirs: %v, want all 11 entries", got)
+			}
+		})
+	}
+}
+
+func TestArchivers_OneFileSystem(t *testing.T) {
+	srcDir := t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "run", "sockets"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "data.txt"), []byte("data"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "run", "sockets", "app.sock"), []byte("tmpfs"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "bound.txt"), []byte("bind-mounted file"), 0644)
+
+	// Pretend run/sockets is a tmpfs and bound.txt a bind mount from another filesystem
+	saved := deviceOf
+	deviceOf = func(info os.FileInfo) (uint64, error) {
+		switch info.Name() {
+		case "sockets", "app.sock", "bound.txt":
+			return 2, nil
+		}
+		return 1, nil
+	}
+	t.Cleanup(func() { deviceOf = saved })
+
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			list := func(opts ArchiveOptions) []string {
+				archivePath := filepath.Join(t.TempDir(), "test"+ext)
+				a := ArchiverFor(archivePath)
+				if _, err := a.Create(context.Background(), archivePath, srcDir, opts); err != nil {
+					t.Fatal(err)
+				}
+				names, err := a.List(archivePath, ArchiveOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return slices.DeleteFunc(names, func(name string) bool { return name == "./" })
+			}
+
+			// The mount point is kept, empty, as tar --one-file-system does
+			want := []string{"data.txt", "run/", "run/sockets/"}
+			if got := list(ArchiveOptions{OneFileSystem: true}); !slices.Equal(got, want) {
+				t.Errorf("with OneFileSystem: %v, want %v", got, want)
+			}
+			if got := list(ArchiveOptions{OneFileSystem: true, ExcludeEmptyDirs: true}); !slices.Equal(got, []string{"data.txt"}) {
+				t.Errorf("with ExcludeEmptyDirs too: %v, want [data.txt]", got)
+			}
+			if got := list(ArchiveOptions{}); len(got) != 5 {
+				t.Errorf("without OneFileSystem: %v, want all 5 entries", got)
+			}
+		})
+	}
+}
@@ -1,49 +1,361 @@
 package backup
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
 )
 
-// Backuper creates tar.gz archives of PV host paths.
+// Backuper creates archives of PV host paths. The archive format follows the extension of
+// the output format (tar.gz when it has none).
 type Backuper struct {
 	outputDir    string
 	outputFormat string
+	archive      ArchiveOptions
+	checksum     bool
+	allowedRoot  string
+	strictPaths  bool
+	pathRoots    []string // WithAllowedPathRoots; empty allows every path
+	pvcTimeout   time.Duration
+	readOnly     bool
+	failFast     bool
+	parallel     int
+	output       io.Writer
+	pvCheck      func(context.Context, types.PVCInfo) error
+	perFile      func(ctx context.Context, sourceDir, prefix string) (int64, error)
+	upload       func(ctx context.Context, pvc types.PVCInfo, r io.Reader, name string) error
+	state        *State
+	fingerprints *Fingerprints
+	pvcOpts      map[string]PVCOptions
+	onResult     func(types.BackupResult)
+	nameTmpl     *NameTemplate
+	dateSource   DateSource
+	startedAt    time.Time // when the current BackupAll began, for DateSnapshot
 	verbose      bool
 }
 
-func New(outputDir, outputFormat string, verbose bool) *Backuper {
-	return &Backuper{
+// Option configures optional Backuper behaviour.
+type Option func(*Backuper)
+
+// WithArchiveOptions sets the options passed to the Archiver on create and extract.
+func WithArchiveOptions(opts ArchiveOptions) Option {
+	return func(b *Backuper) { b.archive = opts }
+}
+
+// WithChecksum records the SHA-256 of every archive in BackupResult.SHA256.
+func WithChecksum() Option {
+	return func(b *Backuper) { b.checksum = true }
+}
+
+// WithAllowedRoot requires every host path to resolve, after following symlinks, to a
+// directory below root. Paths that escape it are reported as warnings, or fail the backup
+// with WithStrictPaths.
+func WithAllowedRoot(root string) Option {
+	return func(b *Backuper) { b.allowedRoot = root }
+}
+
+// WithStrictPaths fails the backup of a PVC whose host path is a symlink (or, with
+// WithAllowedRoot, resolves outside the allowed root) instead of only warning about it.
+func WithStrictPaths() Option {
+	return func(b *Backuper) { b.strictPaths = true }
+}
+
+// WithAllowedPathRoots refuses to back up or restore a host path that is not below one of
+// roots, both as given and with symlinks resolved. Unlike WithAllowedRoot it never only
+// warns, and it guards restores too.
+func WithAllowedPathRoots(roots ...string) Option {
+	return func(b *Backuper) { b.pathRoots = roots }
+}
+
+// WithPVCTimeout bounds the time spent archiving each PVC. A PVC that takes longer fails
+// with a timeout error and BackupAll moves on to the next one.
+func WithPVCTimeout(d time.Duration) Option {
+	return func(b *Backuper) { b.pvcTimeout = d }
+}
+
+// WithReadOnlySnapshot archives each host path through a read-only bind mount, so the
+// backup reads a view of the volume that nothing can write through. Where the mount is
+// not possible (not Linux, no CAP_SYS_ADMIN) the host path is archived directly and the
+// result carries a warning.
+func WithReadOnlySnapshot() Option {
+	return func(b *Backuper) { b.readOnly = true }
+}
+
+// WithFailFast makes BackupAll stop at the first PVC that fails, leaving the rest
+// unattempted, instead of backing up every PVC it can.
+func WithFailFast() Option {
+	return func(b *Backuper) { b.failFast = true }
+}
+
+// WithOutput writes archives to w instead of to files in the output directory, for
+// streaming a single archive to stdout. BackupResult.ArchivePath is then "-".
+func WithOutput(w io.Writer) Option {
+	return func(b *Backuper) { b.output = w }
+}
+
+// WithPVCheck runs check right before each PVC is archived, failing that PVC when it
+// returns an error. Callers use it to confirm the PV still exists, since it may have been
+// deleted after discovery resolved it.
+func WithPVCheck(check func(ctx context.Context, pvc types.PVCInfo) error) Option {
+	return func(b *Backuper) { b.pvCheck = check }
+}
+
+// WithObjectPerFile hands each source directory to store instead of archiving it, for
+// layouts that keep one object per file. prefix is the archive name without its extension
+// plus "/"; it becomes BackupResult.ArchivePath and store returns the bytes it stored.
+func WithObjectPerFile(store func(ctx context.Context, sourceDir, prefix string) (int64, error)) Option {
+	return func(b *Backuper) { b.perFile = store }
+}
+
+// WithStreamUpload pipes each archive into upload as it is created instead of writing it to
+// the output directory, for nodes without the disk space to hold it. upload must read r to
+// the end; name, the archive name, becomes BackupResult.ArchivePath.
+func WithStreamUpload(upload func(ctx context.Context, pvc types.PVCInfo, r io.Reader, name string) error) Option {
+	return func(b *Backuper) { b.upload = upload }
+}
+
+// WithState records every PVC BackupAll completes in state, and skips PVCs that state
+// already holds as long as their archive is still there, returning the recorded result
+// with Resumed set.
+func WithState(state *State) Option {
+	return func(b *Backuper) { b.state = state }
+}
+
+// WithFingerprints skips PVCs whose host path has the DirFingerprint fingerprints records
+// for them, returning a result with Unchanged set. The fingerprint of every other PVC is
+// returned in its result for the caller to record once the archive is safely stored.
+func WithFingerprints(fingerprints *Fingerprints) Option {
+	return func(b *Backuper) { b.fingerprints = fingerprints }
+}
+
+// WithOnResult calls fn with each result as soon as BackupAll has it, before the next PVC
+// is archived, so a caller can upload one archive while the next is being written. fn may
+// block, holding archiving back until it returns. With WithParallel, fn is called from
+// several goroutines and results arrive in the order they complete.
+func WithOnResult(fn func(types.BackupResult)) Option {
+	return func(b *Backuper) { b.onResult = fn }
+}
+
+// WithParallel archives up to n PVCs at once, each in its own goroutine. n below 2 keeps
+// the default of one PVC after the other.
+func WithParallel(n int) Option {
+	return func(b *Backuper) { b.parallel = n }
+}
+
+// WithDateSource dates archive names, the {date} placeholder and the .Date of a name
+// template, from src instead of the time each archive is named.
+func WithDateSource(src DateSource) Option {
+	return func(b *Backuper) { b.dateSource = src }
+}
+
+// PVCOptions overrides the archive settings of a single PVC.
+type PVCOptions struct {
+	Compression string // one of the Compression values; empty keeps the output format's
+	Encrypt     *bool  // false leaves the PVC's archive unencrypted; nil keeps the default
+}
+
+// WithNameTemplate names archives with t instead of the output format. A PVC's codec
+// override still replaces the extension the template gives.
+func WithNameTemplate(t *NameTemplate) Option {
+	return func(b *Backuper) { b.nameTmpl = t }
+}
+
+// WithPVCOptions applies per-PVC overrides, keyed by PVC name, on top of the output format
+// and archive options every other PVC gets.
+func WithPVCOptions(opts map[string]PVCOptions) Option {
+	return func(b *Backuper) { b.pvcOpts = opts }
+}
+
+// ParsePVCOptions parses a --pvc-opts value, pvc=key:value,..., into the PVC name and its
+// overrides. The keys are codec (gzip, zstd or none) and encrypt (true or false).
+func ParsePVCOptions(s string) (string, PVCOptions, error) {
+	var o PVCOptions
+	pvc, list, ok := strings.Cut(s, "=")
+	if !ok || pvc == "" || list == "" {
+		return "", o, fmt.Errorf("invalid PVC options %q (want pvc=key:value,..., e.g. media=codec:none)", s)
+	}
+	for _, kv := range strings.Split(list, ",") {
+		key, value, _ := strings.Cut(kv, ":")
+		switch key {
+		case "codec":
+			if _, err := CompressionExtension(value); err != nil {
+				return "", o, fmt.Errorf("PVC %s: %w", pvc, err)
+			}
+			o.Compression = value
+		case "encrypt":
+			encrypt, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", o, fmt.Errorf("PVC %s: invalid encrypt value %q (want true or false)", pvc, value)
+			}
+			o.Encrypt = &encrypt
+		default:
+			return "", o, fmt.Errorf("PVC %s: unknown option %q (want codec or encrypt)", pvc, key)
+		}
+	}
+	return pvc, o, nil
+}
+
+// readOnlyView is mountReadOnly, replaced in tests.
+var readOnlyView = mountReadOnly
+
+func New(outputDir, outputFormat string, verbose bool, opts ...Option) *Backuper {
+	b := &Backuper{
 		outputDir:    outputDir,
 		outputFormat: outputFormat,
 		verbose:      verbose,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
-// BackupAll creates archives for all given PVCs and returns results.
-func (b *Backuper) BackupAll(pvcs []types.PVCInfo, namespace, release string) []types.BackupResult {
-	var results []types.BackupResult
-	for _, pvc := range pvcs {
-		result := b.backupOne(pvc, namespace, release)
-		results = append(results, result)
+// BackupAll creates archives for all given PVCs and returns results, in the order of pvcs
+// even when WithParallel archives several at once. Once ctx is done the remaining PVCs
+// fail with its error. With WithFailFast no PVC is started after the first failure, so
+// the results may cover only a prefix of pvcs: result i is always that of pvcs[i], and
+// pvcs[len(results):] were not attempted. With WithState, PVCs an earlier run completed are not
+// backed up again. With WithOnResult each result is also handed over as it completes.
+func (b *Backuper) BackupAll(ctx context.Context, pvcs []types.PVCInfo, namespace, release string) []types.BackupResult {
+	b.startedAt = time.Now()
+	results := make([]types.BackupResult, len(pvcs))
+	started := make([]bool, len(pvcs))
+	var stop atomic.Bool // set by a failure under WithFailFast
+	sem := make(chan struct{}, max(b.parallel, 1))
+	var wg sync.WaitGroup
+	for i, pvc := range pvcs {
+		sem <- struct{}{}
+		if stop.Load() {
+			<-sem
+			break
+		}
+		started[i] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = b.backupPVC(ctx, pvc, namespace, release)
+			if results[i].Err != nil && b.failFast {
+				b.logf("Stopping after %s failed (fail-fast)", pvc.PVCName)
+				stop.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var done []types.BackupResult
+	for i, result := range results {
+		if started[i] {
+			done = append(done, result)
+		}
+	}
+	return done
+}
+
+// backupPVC backs up one PVC for BackupAll, or returns the result an earlier run recorded
+// for it, and hands the result over.
+func (b *Backuper) backupPVC(ctx context.Context, pvc types.PVCInfo, namespace, release string) types.BackupResult {
+	if result, ok := b.resumed(pvc, namespace, release); ok {
+		b.logf("Skipping %s: completed by an earlier run as %s", pvc.PVCName, result.ArchivePath)
+		b.handOver(result)
+		return result
 	}
-	return results
+	result := b.backupWithTimeout(ctx, pvc, namespace, release)
+	if b.state != nil && result.Err == nil && !result.Unchanged {
+		if err := b.state.Record(namespace, release, b.key(result), result); err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("recording progress: %v", err))
+		}
+	}
+	b.handOver(result)
+	return result
 }
 
-func (b *Backuper) backupOne(pvc types.PVCInfo, namespace, release string) types.BackupResult {
-	result := types.BackupResult{PVCName: pvc.PVCName}
+// handOver passes result to the WithOnResult callback, if there is one.
+func (b *Backuper) handOver(result types.BackupResult) {
+	if b.onResult != nil {
+		b.onResult(result)
+	}
+}
+
+// resumed returns the result an earlier run recorded for pvc in the WithState state. An
+// archive file that has since gone or changed size is backed up again.
+func (b *Backuper) resumed(pvc types.PVCInfo, namespace, release string) (types.BackupResult, bool) {
+	if b.state == nil {
+		return types.BackupResult{}, false
+	}
+	e, ok := b.state.Lookup(namespace, release, pvc.PVCName)
+	if !ok {
+		return types.BackupResult{}, false
+	}
+	// Per-file snapshots are stored as they are taken and leave no local file
+	if b.perFile == nil {
+		if info, err := os.Stat(e.Archive); err != nil || info.Size() != e.Size {
+			return types.BackupResult{}, false
+		}
+	}
+	return types.BackupResult{PVCName: pvc.PVCName, ArchivePath: e.Archive, Size: e.Size, SHA256: e.SHA256, Resumed: true}, true
+}
+
+// key is the key the archive of r is uploaded under.
+func (b *Backuper) key(r types.BackupResult) string {
+	if b.perFile != nil {
+		return r.ArchivePath
+	}
+	return filepath.Base(r.ArchivePath)
+}
 
-	// Validate source path exists
+// backupWithTimeout runs backupOne under the per-PVC timeout, if one is set.
+func (b *Backuper) backupWithTimeout(ctx context.Context, pvc types.PVCInfo, namespace, release string) types.BackupResult {
+	if b.pvcTimeout <= 0 {
+		return b.backupOne(ctx, pvc, namespace, release)
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, b.pvcTimeout)
+	defer cancel()
+	result := b.backupOne(pctx, pvc, namespace, release)
+	// Only blame the timeout when it was this PVC's deadline, not the caller's, that expired
+	if errors.Is(result.Err, context.DeadlineExceeded) && ctx.Err() == nil {
+		result.Err = fmt.Errorf("timed out after %s: %w", b.pvcTimeout, result.Err)
+	}
+	return result
+}
+
+func (b *Backuper) backupOne(ctx context.Context, pvc types.PVCInfo, namespace, release string) (result types.BackupResult) {
+	result = types.BackupResult{PVCName: pvc.PVCName}
+
+	if err := CheckPathRoots(b.pathRoots, pvc.HostPath); err != nil {
+		result.Err = err
+		return result
+	}
+	if b.pvCheck != nil {
+		if err := b.pvCheck(ctx, pvc); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	// Validate source path exists. Discovery resolved it, so a missing path means it went
+	// away since, typically because the PV was deleted while earlier PVCs were archived.
 	info, err := os.Stat(pvc.HostPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		result.Err = fmt.Errorf("host path %q of PV %s disappeared since discovery: %w", pvc.HostPath, pvc.PVName, err)
+		return result
+	}
 	if err != nil {
 		result.Err = fmt.Errorf("host path %q: %w", pvc.HostPath, err)
 		return result
@@ -53,13 +365,74 @@ func (b *Backuper) backupOne(pvc types.PVCInfo, namespace, release string) types
 		return result
 	}
 
-	archiveName := b.formatName(namespace, release, pvc.PVCName)
+	sourceDir, warning, err := b.resolveHostPath(pvc.HostPath)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if warning != "" {
+		b.logf("Warning: %s", warning)
+		result.Warnings = append(result.Warnings, warning)
+	}
+
+	if b.fingerprints != nil {
+		fingerprint, err := DirFingerprint(sourceDir)
+		if err != nil {
+			result.Err = fmt.Errorf("fingerprinting %s: %w", sourceDir, err)
+			return result
+		}
+		if last, ok := b.fingerprints.Lookup(namespace, release, pvc.PVCName); ok && last == fingerprint {
+			b.logf("Skipping %s: unchanged since the last backup", pvc.PVCName)
+			result.Unchanged = true
+			return result
+		}
+		result.Fingerprint = fingerprint
+	}
+
+	if b.readOnly {
+		view, unmount, err := readOnlyView(sourceDir)
+		if err != nil {
+			warning := fmt.Sprintf("read-only snapshot unavailable, archiving %s directly: %v", sourceDir, err)
+			b.logf("Warning: %s", warning)
+			result.Warnings = append(result.Warnings, warning)
+		} else {
+			b.logf("Archiving %s through read-only mount %s", sourceDir, view)
+			defer func() {
+				if err := unmount(); err != nil {
+					warning := fmt.Sprintf("cleaning up read-only snapshot: %v", err)
+					b.logf("Warning: %s", warning)
+					result.Warnings = append(result.Warnings, warning)
+				}
+			}()
+			sourceDir = view
+		}
+	}
+
+	date, err := b.archiveDate(sourceDir)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	archiveName, archive, err := b.archiveFor(pvc, namespace, release, date)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if b.output != nil {
+		return b.streamOne(ctx, result, sourceDir, archiveName, archive)
+	}
+	if b.perFile != nil {
+		return b.storeOne(ctx, result, sourceDir, archiveName)
+	}
+	if b.upload != nil {
+		return b.uploadOne(ctx, pvc, result, sourceDir, archiveName, archive)
+	}
 	archivePath := filepath.Join(b.outputDir, archiveName)
 	result.ArchivePath = archivePath
 
-	b.logf("Backing up %s -> %s", pvc.HostPath, archivePath)
+	b.logf("Backing up %s -> %s", sourceDir, archivePath)
 
-	size, err := createTarGz(archivePath, pvc.HostPath)
+	size, err := ArchiverFor(TrimArchiveSuffix(archiveName, archive.Suffix)).Create(ctx, archivePath, sourceDir, archive)
 	if err != nil {
 		result.Err = fmt.Errorf("creating archive: %w", err)
 		return result
@@ -67,101 +440,503 @@ func (b *Backuper) backupOne(pvc types.PVCInfo, namespace, release string) types
 
 	result.Size = size
 	b.logf("Created %s (%d bytes)", archivePath, size)
+
+	if b.checksum {
+		sum, err := FileSHA256(archivePath)
+		if err != nil {
+			result.Err = fmt.Errorf("checksumming archive: %w", err)
+			return result
+		}
+		result.SHA256 = sum
+		b.logf("SHA-256 %s  %s", sum, archiveName)
+	}
 	return result
 }
 
-func FormatName(outputFormat, namespace, release, pvcName string) string {
-	date := time.Now().Format("20060102-150405")
+// archiveFor returns the archive name of pvc and the options to create it with, applying
+// its WithPVCOptions overrides: a codec replaces the extension of the output format, and
+// encryption adds the Encrypter's suffix. The archive suffix goes last.
+func (b *Backuper) archiveFor(pvc types.PVCInfo, namespace, release string, date time.Time) (string, ArchiveOptions, error) {
+	name := FormatNameAt(b.outputFormat, namespace, release, pvc.PVCName, pvc.StorageClass, date)
+	if b.nameTmpl != nil {
+		data := NewNameData(pvc, namespace, release)
+		data.Date = date
+		var err error
+		if name, err = b.nameTmpl.Execute(data); err != nil {
+			return "", b.archive, err
+		}
+	}
+	archive := b.archive
+	o := b.pvcOpts[pvc.PVCName]
+	if o.Compression != "" {
+		base, ext := SplitArchiveExtension(name)
+		if strings.EqualFold(ext, ".zip") {
+			return "", archive, fmt.Errorf("codec %s cannot apply to zip archive %s", o.Compression, name)
+		}
+		ext, err := CompressionExtension(o.Compression)
+		if err != nil {
+			return "", archive, err
+		}
+		name = base + ext
+	}
+	if o.Encrypt != nil {
+		if *o.Encrypt && archive.Encrypter == nil {
+			return "", archive, fmt.Errorf("encryption requested for PVC %s, but no key provider is configured", pvc.PVCName)
+		}
+		if !*o.Encrypt {
+			archive.Encrypter = nil
+		}
+	}
+	if archive.Encrypter != nil {
+		name += archive.Encrypter.Suffix()
+	}
+	return name + archive.Suffix, archive, nil
+}
+
+// streamOne writes the archive of sourceDir to b.output, hashing it on the way when
+// checksums are requested.
+func (b *Backuper) streamOne(ctx context.Context, result types.BackupResult, sourceDir, archiveName string, archive ArchiveOptions) types.BackupResult {
+	result.ArchivePath = "-"
+	b.logf("Streaming %s as %s", sourceDir, archiveName)
+
+	w, h := b.output, sha256.New()
+	if b.checksum {
+		w = io.MultiWriter(w, h)
+	}
+	size, err := Stream(ctx, w, archiveName, sourceDir, archive)
+	if err != nil {
+		result.Err = fmt.Errorf("streaming archive: %w", err)
+		return result
+	}
+
+	result.Size = size
+	b.logf("Streamed %s (%d bytes)", archiveName, size)
+	if b.checksum {
+		result.SHA256 = hex.EncodeToString(h.Sum(nil))
+		b.logf("SHA-256 %s  %s", result.SHA256, archiveName)
+	}
+	return result
+}
+
+// uploadOne streams the archive of sourceDir into the WithStreamUpload upload through a
+// pipe, hashing it on the way when checksums are requested.
+func (b *Backuper) uploadOne(ctx context.Context, pvc types.PVCInfo, result types.BackupResult, sourceDir, archiveName string, archive ArchiveOptions) types.BackupResult {
+	result.ArchivePath = archiveName
+	b.logf("Streaming %s to the upload of %s", sourceDir, archiveName)
+
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := b.upload(ctx, pvc, pr, archiveName)
+		// An upload that gave up must not leave the archiver blocked on the pipe
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	var w io.Writer = pw
+	h := sha256.New()
+	if b.checksum {
+		w = io.MultiWriter(pw, h)
+	}
+	size, err := Stream(ctx, w, archiveName, sourceDir, archive)
+	// A failed archive fails the upload too, rather than completing a truncated object
+	pw.CloseWithError(err)
+	uerr := <-uploaded
+	switch {
+	case uerr != nil && (err == nil || errors.Is(err, uerr)):
+		// The upload failed on its own, not because the archive did
+		result.Err = fmt.Errorf("uploading archive: %w", uerr)
+		return result
+	case err != nil:
+		result.Err = fmt.Errorf("streaming archive: %w", err)
+		return result
+	}
+
+	result.Size = size
+	b.logf("Uploaded %s (%d bytes)", archiveName, size)
+	if b.checksum {
+		result.SHA256 = hex.EncodeToString(h.Sum(nil))
+		b.logf("SHA-256 %s  %s", result.SHA256, archiveName)
+	}
+	return result
+}
+
+// storeOne passes sourceDir to the WithObjectPerFile store under the prefix derived from
+// archiveName.
+func (b *Backuper) storeOne(ctx context.Context, result types.BackupResult, sourceDir, archiveName string) types.BackupResult {
+	base, _ := SplitArchiveExtension(TrimArchiveSuffix(archiveName, b.archive.Suffix))
+	result.ArchivePath = base + "/"
+	b.logf("Storing %s file by file under %s", sourceDir, result.ArchivePath)
+
+	size, err := b.perFile(ctx, sourceDir, result.ArchivePath)
+	if err != nil {
+		result.Err = fmt.Errorf("storing files: %w", err)
+		return result
+	}
+	result.Size = size
+	b.logf("Stored %s (%d bytes)", result.ArchivePath, size)
+	return result
+}
+
+// resolveHostPath follows symlinks in hostPath and returns the real directory to archive.
+// A symlinked host path could point a backup at unrelated parts of the node, so it produces
+// a warning, or an error with strictPaths. With allowedRoot only a real path outside the
+// root is reported.
+func (b *Backuper) resolveHostPath(hostPath string) (string, string, error) {
+	real, err := filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return "", "", fmt.Errorf("resolving host path %q: %w", hostPath, err)
+	}
+
+	var problem string
+	if b.allowedRoot != "" {
+		root, err := filepath.EvalSymlinks(b.allowedRoot)
+		if err != nil {
+			return "", "", fmt.Errorf("resolving allowed root %q: %w", b.allowedRoot, err)
+		}
+		if !isWithin(root, real) {
+			problem = fmt.Sprintf("host path %q resolves to %q, outside the allowed root %q", hostPath, real, b.allowedRoot)
+		}
+	} else if real != filepath.Clean(hostPath) {
+		problem = fmt.Sprintf("host path %q is a symlink to %q", hostPath, real)
+	}
+
+	if problem == "" {
+		return real, "", nil
+	}
+	if b.strictPaths {
+		return "", "", fmt.Errorf("%s (refusing under strict paths)", problem)
+	}
+	return real, problem, nil
+}
+
+// CheckPathRoots fails unless hostPath is below one of roots, both as given and with
+// symlinks resolved, so that neither a misconfigured PV nor a symlink can point the tool
+// at, say, /etc. A path that does not exist is checked as given. Without roots every path
+// passes.
+func CheckPathRoots(roots []string, hostPath string) error {
+	if len(roots) == 0 {
+		return nil
+	}
+	if !filepath.IsAbs(hostPath) {
+		return fmt.Errorf("host path %q is not absolute", hostPath)
+	}
+	paths := []string{filepath.Clean(hostPath)}
+	if real, err := filepath.EvalSymlinks(hostPath); err == nil && real != paths[0] {
+		paths = append(paths, real)
+	}
+	for _, path := range paths {
+		if !slices.ContainsFunc(roots, func(root string) bool { return underRoot(root, path) }) {
+			return fmt.Errorf("host path %q is outside the allowed path roots (%s)", path, strings.Join(roots, ", "))
+		}
+	}
+	return nil
+}
+
+// underRoot reports whether path is within root as given or with its symlinks resolved.
+func underRoot(root, path string) bool {
+	if isWithin(filepath.Clean(root), path) {
+		return true
+	}
+	real, err := filepath.EvalSymlinks(root)
+	return err == nil && isWithin(real, path)
+}
+
+// isWithin reports whether path is root or below it. Both must be clean absolute paths.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DefaultStorageClass stands in for {storageClass} when a PVC has no storage class.
+const DefaultStorageClass = "default"
+
+// FormatName fills in the placeholders of outputFormat for one PVC, with {date} set to now.
+func FormatName(outputFormat, namespace, release, pvcName, storageClass string) string {
+	return FormatNameAt(outputFormat, namespace, release, pvcName, storageClass, time.Now())
+}
+
+// FormatNameAt is FormatName with {date} set to t.
+func FormatNameAt(outputFormat, namespace, release, pvcName, storageClass string, t time.Time) string {
+	date := t.Format("20060102-150405")
+	if storageClass == "" {
+		storageClass = DefaultStorageClass
+	}
 	name := outputFormat
 	name = strings.ReplaceAll(name, "{namespace}", namespace)
 	name = strings.ReplaceAll(name, "{release}", release)
 	name = strings.ReplaceAll(name, "{pvc}", pvcName)
+	name = strings.ReplaceAll(name, "{storageClass}", storageClass)
 	name = strings.ReplaceAll(name, "{date}", date)
 	return name
 }
 
-func (b *Backuper) formatName(namespace, release, pvcName string) string {
-	return FormatName(b.outputFormat, namespace, release, pvcName)
+// NewNameData returns the name template data of pvc, dated now.
+func NewNameData(pvc types.PVCInfo, namespace, release string) NameData {
+	storageClass := pvc.StorageClass
+	if storageClass == "" {
+		storageClass = DefaultStorageClass
+	}
+	return NameData{
+		Namespace:    namespace,
+		Release:      release,
+		PVC:          pvc.PVCName,
+		PVName:       pvc.PVName,
+		Node:         pvc.Node,
+		Date:         time.Now(),
+		StorageClass: storageClass,
+	}
 }
 
-func createTarGz(archivePath, sourceDir string) (int64, error) {
-	file, err := os.Create(archivePath)
-	if err != nil {
-		return 0, err
-	}
-	defer file.Close()
+func (b *Backuper) formatName(namespace, release, pvcName, storageClass string) string {
+	return FormatName(b.outputFormat, namespace, release, pvcName, storageClass)
+}
+
+// DateSource selects the time an archive is dated with.
+type DateSource string
 
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
+const (
+	DateNow        DateSource = "now"         // when the archive is named (the default)
+	DateNewestFile DateSource = "newest-file" // modification time of the newest file in the volume
+	DateSnapshot   DateSource = "snapshot"    // when BackupAll began, once workloads were stopped
+)
 
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
+// ParseDateSource validates an --archive-mtime-source value.
+func ParseDateSource(s string) (DateSource, error) {
+	switch src := DateSource(s); src {
+	case DateNow, DateNewestFile, DateSnapshot:
+		return src, nil
+	}
+	return "", fmt.Errorf("invalid date source %q (want now, newest-file or snapshot)", s)
+}
 
-	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+// archiveDate is the time the archive of sourceDir is dated with, as WithDateSource picks.
+// A volume without regular files has no newest file and is dated now.
+func (b *Backuper) archiveDate(sourceDir string) (time.Time, error) {
+	switch b.dateSource {
+	case DateNewestFile:
+		newest, err := newestMtime(sourceDir)
 		if err != nil {
-			return err
+			return time.Time{}, fmt.Errorf("finding the newest file in %s: %w", sourceDir, err)
+		}
+		if !newest.IsZero() {
+			return newest, nil
 		}
+		b.logf("No files in %s, dating its archive now", sourceDir)
+	case DateSnapshot:
+		if !b.startedAt.IsZero() {
+			return b.startedAt, nil
+		}
+	}
+	return time.Now(), nil
+}
 
-		header, err := tar.FileInfoHeader(info, "")
+// newestMtime returns the latest modification time of the regular files below dir, or the
+// zero time when there are none.
+func newestMtime(dir string) (time.Time, error) {
+	var newest time.Time
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("creating tar header for %s: %w", path, err)
+			return err
 		}
-
-		// Use relative path inside the archive
-		relPath, err := filepath.Rel(sourceDir, path)
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		header.Name = relPath
-
-		// Handle symlinks
-		if info.Mode()&os.ModeSymlink != 0 {
-			link, err := os.Readlink(path)
-			if err != nil {
-				return err
-			}
-			header.Linkname = link
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
 		}
+		return nil
+	})
+	return newest, err
+}
 
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("writing tar header: %w", err)
-		}
+// createTarGz writes a gzip-compressed tar of sourceDir to archivePath.
+func createTarGz(archivePath, sourceDir string) (int64, error) {
+	return tarGzArchiver.Create(context.Background(), archivePath, sourceDir, ArchiveOptions{})
+}
+
+// RestorePVC restores archivePath into the host path of pvc with RestoreOne and reports
+// how long it took and how many files and bytes ended up in the target.
+func (b *Backuper) RestorePVC(pvc types.PVCInfo, archivePath string) types.RestoreResult {
+	return b.RestoreSubtree(pvc, archivePath, "")
+}
+
+// RestoreSubtree is RestorePVC for a combined archive: only the top-level directory subtree
+// of archivePath is restored into the host path of pvc. An empty subtree restores the
+// whole archive.
+func (b *Backuper) RestoreSubtree(pvc types.PVCInfo, archivePath, subtree string) types.RestoreResult {
+	result := types.RestoreResult{PVCName: pvc.PVCName, ArchivePath: archivePath, TargetDir: pvc.HostPath}
+
+	start := time.Now()
+	err := b.restore(archivePath, pvc.HostPath, subtree)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// The target was cleared first, so everything in it came from the archive
+	files, size, err := countFiles(pvc.HostPath)
+	if err != nil {
+		b.logf("Warning: counting restored files in %s: %v", pvc.HostPath, err)
+	}
+	result.Files, result.Bytes = files, size
+	return result
+}
 
-		// Only write content for regular files
-		if !info.Mode().IsRegular() {
+// countFiles returns the number and total size of the regular files below dir.
+func countFiles(dir string) (int, int64, error) {
+	var files int
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
 			return nil
 		}
-
-		f, err := os.Open(path)
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		files++
+		size += info.Size()
+		return nil
+	})
+	return files, size, err
+}
 
-		_, err = io.Copy(tarWriter, f)
-		return err
+// tarBlock is the unit tar pads headers and file data to.
+const tarBlock = 512
+
+// EstimateSize returns how large an archive of dir can get: the size of its regular files
+// plus a tar header and padding for every entry, as if nothing compressed. Long names
+// need extra headers, so it is an estimate rather than a bound.
+func EstimateSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		size += tarBlock
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += (info.Size() + tarBlock - 1) / tarBlock * tarBlock
+		return nil
 	})
+	return size, err
+}
 
+// RestoreOne extracts an archive into targetDir, clearing its contents first.
+func (b *Backuper) RestoreOne(archivePath, targetDir string) error {
+	return b.restore(archivePath, targetDir, "")
+}
+
+// CombinedSubtrees returns the top-level directories of a combined archive, which holds
+// one PVC per directory named after it.
+func (b *Backuper) CombinedSubtrees(archivePath string) ([]string, error) {
+	archiver, opts, err := b.archiverFor(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	names, err := archiver.List(archivePath, opts)
 	if err != nil {
-		// Clean up partial archive on error
-		os.Remove(archivePath)
-		return 0, err
+		return nil, err
 	}
+	return TopLevelDirs(names), nil
+}
 
-	// Flush everything before getting file size
-	tarWriter.Close()
-	gzWriter.Close()
+// MatchSubtrees pairs each subtree of a combined archive with the PVC of the same name.
+// A subtree without one is an error, as its data would be lost, unless skipMissing is set;
+// then it is returned in skipped. PVCs without a subtree are left out.
+func MatchSubtrees(subtrees []string, pvcs []types.PVCInfo, skipMissing bool) (matched []types.PVCInfo, skipped []string, err error) {
+	byName := make(map[string]types.PVCInfo, len(pvcs))
+	for _, pvc := range pvcs {
+		byName[pvc.PVCName] = pvc
+	}
+	for _, subtree := range subtrees {
+		pvc, ok := byName[subtree]
+		if !ok {
+			skipped = append(skipped, subtree)
+			continue
+		}
+		matched = append(matched, pvc)
+	}
+	if len(skipped) > 0 && !skipMissing {
+		return nil, nil, fmt.Errorf("no PVC of the release matches the archive directories %s", strings.Join(skipped, ", "))
+	}
+	return matched, skipped, nil
+}
 
-	stat, err := file.Stat()
+// archiverFor picks the Archiver of archivePath and the options to read it with. Encrypted
+// content can't be sniffed, so those go by extension.
+func (b *Backuper) archiverFor(archivePath string) (Archiver, ArchiveOptions, error) {
+	opts := b.archive
+	name := TrimArchiveSuffix(archivePath, opts.Suffix)
+	if IsEncrypted(name) {
+		if opts.Encrypter == nil {
+			return nil, opts, fmt.Errorf("archive %s is encrypted: a key provider is required to restore it", filepath.Base(archivePath))
+		}
+		if s := encryptionSuffix(name); !strings.EqualFold(s, opts.Encrypter.Suffix()) {
+			return nil, opts, fmt.Errorf("archive %s is %s-encrypted, but restore decrypts %s archives", filepath.Base(archivePath), s, opts.Encrypter.Suffix())
+		}
+		// Unwrap the key up front, so a missing or wrong key leaves the target intact
+		if err := probeDecrypt(archivePath, opts.Encrypter); err != nil {
+			return nil, opts, fmt.Errorf("archive %s: %w", filepath.Base(archivePath), err)
+		}
+		return ArchiverFor(name), opts, nil
+	}
+	opts.Encrypter = nil
+	archiver, err := DetectArchiver(archivePath, opts.Suffix)
+	return archiver, opts, err
+}
+
+// probeDecrypt checks that enc can read the header of the encrypted archive at path.
+func probeDecrypt(path string, enc Encrypter) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return stat.Size(), nil
+	defer f.Close()
+	_, err = enc.Decrypt(f)
+	return err
 }
 
-// RestoreOne extracts a tar.gz archive into targetDir, clearing its contents first.
-func (b *Backuper) RestoreOne(archivePath, targetDir string) error {
-	b.logf("Restoring %s -> %s", archivePath, targetDir)
+// restore clears targetDir and extracts archivePath, or only its subtree directory when
+// subtree is set, into it.
+func (b *Backuper) restore(archivePath, targetDir, subtree string) error {
+	if subtree != "" {
+		b.logf("Restoring %s of %s -> %s", subtree, archivePath, targetDir)
+	} else {
+		b.logf("Restoring %s -> %s", archivePath, targetDir)
+	}
+	if err := CheckPathRoots(b.pathRoots, targetDir); err != nil {
+		return err
+	}
 
 	// Validate target dir exists
 	info, err := os.Stat(targetDir)
@@ -172,6 +947,13 @@ func (b *Backuper) RestoreOne(archivePath, targetDir string) error {
 		return fmt.Errorf("target %q is not a directory", targetDir)
 	}
 
+	// Detect the format before clearing anything, so an unreadable archive leaves data intact
+	archiver, opts, err := b.archiverFor(archivePath)
+	if err != nil {
+		return err
+	}
+	opts.Subtree = subtree
+
 	// Clear target dir contents
 	entries, err := os.ReadDir(targetDir)
 	if err != nil {
@@ -185,61 +967,8 @@ func (b *Backuper) RestoreOne(archivePath, targetDir string) error {
 		}
 	}
 
-	// Open archive
-	f, err := os.Open(archivePath)
-	if err != nil {
-		return fmt.Errorf("opening archive: %w", err)
-	}
-	defer f.Close()
-
-	gr, err := gzip.NewReader(f)
-	if err != nil {
-		return fmt.Errorf("gzip reader: %w", err)
-	}
-	defer gr.Close()
-
-	cleanBase := filepath.Clean(targetDir)
-	tr := tar.NewReader(gr)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("reading tar: %w", err)
-		}
-
-		target := filepath.Join(targetDir, hdr.Name)
-		cleanTarget := filepath.Clean(target)
-
-		// Prevent path traversal
-		if cleanTarget != cleanBase && !strings.HasPrefix(cleanTarget, cleanBase+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal path in archive: %s", hdr.Name)
-		}
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
-			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(out, tr); err != nil {
-				out.Close()
-				return err
-			}
-			out.Close()
-		case tar.TypeSymlink:
-			if err := os.Symlink(hdr.Linkname, target); err != nil {
-				return err
-			}
-		}
+	if err := archiver.Extract(archivePath, targetDir, opts); err != nil {
+		return err
 	}
 
 	b.logf("Restored %s", targetDir)
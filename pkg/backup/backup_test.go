@@ -2,19 +2,25 @@ package backup
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
 )
 
 func TestFormatName(t *testing.T) {
 	b := &Backuper{outputFormat: "{namespace}_{release}_{date}_{pvc}.tar.gz"}
-	name := b.formatName("prod", "myapp", "data-pvc")
+	name := b.formatName("prod", "myapp", "data-pvc", "")
 
 	if !strings.HasPrefix(name, "prod_myapp_") {
 		t.Errorf("formatName() = %q, want prefix %q", name, "prod_myapp_")
@@ -26,7 +32,7 @@ func TestFormatName(t *testing.T) {
 
 func TestFormatName_Custom(t *testing.T) {
 	b := &Backuper{outputFormat: "backup-{release}-{pvc}.tar.gz"}
-	name := b.formatName("ns", "rel", "vol")
+	name := b.formatName("ns", "rel", "vol", "")
 	if name != "backup-rel-vol.tar.gz" {
 		t.Errorf("formatName() = %q, want %q", name, "backup-rel-vol.tar.gz")
 	}
@@ -107,7 +113,7 @@ func TestBackupAll_NonexistentPath(t *testing.T) {
 		{PVCName: "test-pvc", HostPath: "/nonexistent/path/12345"},
 	}
 
-	results := b.BackupAll(pvcs, "ns", "rel")
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
 	if len(results) != 1 {
 		t.Fatalf("expected 1 result, got %d", len(results))
 	}
@@ -129,7 +135,7 @@ func TestBackupAll_Success(t *testing.T) {
 		{PVCName: "my-pvc", HostPath: srcDir},
 	}
 
-	results := b.BackupAll(pvcs, "ns", "rel")
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
 	if len(results) != 1 {
 		t.Fatalf("expected 1 result, got %d", len(results))
 	}
@@ -168,7 +174,7 @@ func TestBackupAll_MultipleePVCs(t *testing.T) {
 		{PVCName: "pvc-2", HostPath: srcDir2},
 	}
 
-	results := b.BackupAll(pvcs, "ns", "rel")
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
 	if len(results) != 2 {
 		t.Fatalf("expected 2 results, got %d", len(results))
 	}
@@ -194,7 +200,7 @@ func TestBackupOne_NotADirectory(t *testing.T) {
 		{PVCName: "test", HostPath: tmpFile},
 	}
 
-	results := b.BackupAll(pvcs, "ns", "rel")
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
 	if results[0].Err == nil {
 		t.Error("expected error when host path is not a directory")
 	}
@@ -263,6 +269,125 @@ func TestRestoreOne_NonexistentTargetDir(t *testing.T) {
 	}
 }
 
+func TestRestorePVC_Result(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "file1.txt"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(srcDir, "subdir"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "subdir", "file2.txt"), []byte("world!"), 0644)
+	os.Symlink("file1.txt", filepath.Join(srcDir, "link"))
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+	if _, err := createTarGz(archivePath, srcDir); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir := t.TempDir()
+	os.WriteFile(filepath.Join(restoreDir, "stale.txt"), []byte("should not be counted"), 0644)
+
+	result := New("", "", false).RestorePVC(types.PVCInfo{PVCName: "data", HostPath: restoreDir}, archivePath)
+	if result.Err != nil {
+		t.Fatalf("RestorePVC() error: %v", result.Err)
+	}
+	if result.PVCName != "data" || result.ArchivePath != archivePath || result.TargetDir != restoreDir {
+		t.Errorf("result = %+v, want PVC data, archive %s, target %s", result, archivePath, restoreDir)
+	}
+	// Symlinks and directories are not files; the cleared stale file is gone
+	if result.Files != 2 || result.Bytes != int64(len("hello")+len("world!")) {
+		t.Errorf("Files, Bytes = %d, %d; want 2, 11", result.Files, result.Bytes)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("Duration = %s, want > 0", result.Duration)
+	}
+}
+
+func TestRestorePVC_Error(t *testing.T) {
+	result := New("", "", false).RestorePVC(types.PVCInfo{PVCName: "data", HostPath: t.TempDir()}, "/nonexistent/archive.tar.gz")
+	if result.Err == nil {
+		t.Fatal("expected error for nonexistent archive")
+	}
+	if result.PVCName != "data" || result.Files != 0 {
+		t.Errorf("result = %+v, want PVC data with nothing restored", result)
+	}
+}
+
+// combinedTree creates a directory holding one subdirectory per name, each with a file
+// named after it.
+func combinedTree(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Join(dir, name, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "sub", name+".txt"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRestoreSubtree_Combined(t *testing.T) {
+	src := combinedTree(t, "data", "wal")
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "combined"+ext)
+			if _, err := ArchiverFor(ext).Create(context.Background(), archivePath, src, ArchiveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			b := New("", "", false)
+			subtrees, err := b.CombinedSubtrees(archivePath)
+			if err != nil {
+				t.Fatalf("CombinedSubtrees() error: %v", err)
+			}
+			if !slices.Equal(subtrees, []string{"data", "wal"}) {
+				t.Fatalf("CombinedSubtrees() = %v, want [data wal]", subtrees)
+			}
+
+			for _, name := range subtrees {
+				target := t.TempDir()
+				os.WriteFile(filepath.Join(target, "stale.txt"), []byte("stale"), 0644)
+				result := b.RestoreSubtree(types.PVCInfo{PVCName: name, HostPath: target}, archivePath, name)
+				if result.Err != nil {
+					t.Fatalf("RestoreSubtree(%s) error: %v", name, result.Err)
+				}
+				// Only this PVC's file, without its directory prefix
+				if result.Files != 1 {
+					t.Errorf("%s: restored %d file(s), want 1", name, result.Files)
+				}
+				data, err := os.ReadFile(filepath.Join(target, "sub", name+".txt"))
+				if err != nil || string(data) != name {
+					t.Errorf("%s: sub/%s.txt = %q, %v", name, name, data, err)
+				}
+				if _, err := os.Stat(filepath.Join(target, "stale.txt")); !os.IsNotExist(err) {
+					t.Errorf("%s: stale.txt was not cleared", name)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchSubtrees(t *testing.T) {
+	pvcs := []types.PVCInfo{{PVCName: "data"}, {PVCName: "wal"}, {PVCName: "cache"}}
+	subtrees := []string{"data", "orphan", "wal"}
+
+	if _, _, err := MatchSubtrees(subtrees, pvcs, false); err == nil || !strings.Contains(err.Error(), "orphan") {
+		t.Errorf("MatchSubtrees() error = %v, want one naming orphan", err)
+	}
+
+	matched, skipped, err := MatchSubtrees(subtrees, pvcs, true)
+	if err != nil {
+		t.Fatalf("MatchSubtrees(skipMissing) error: %v", err)
+	}
+	var names []string
+	for _, pvc := range matched {
+		names = append(names, pvc.PVCName)
+	}
+	if !slices.Equal(names, []string{"data", "wal"}) || !slices.Equal(skipped, []string{"orphan"}) {
+		t.Errorf("matched %v, skipped %v; want [data wal], [orphan]", names, skipped)
+	}
+}
+
 // --- helpers ---
 
 func readTarGzEntries(t *testing.T, path string) []string {
@@ -328,3 +453,649 @@ func readTarGzFileContent(t *testing.T, archivePath, fileName string) string {
 	t.Fatalf("file %q not found in archive", fileName)
 	return ""
 }
+
+func symlinkedHostPath(t *testing.T) (link, real string) {
+	t.Helper()
+	real = t.TempDir()
+	if err := os.WriteFile(filepath.Join(real, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link = filepath.Join(t.TempDir(), "pv")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+	return link, real
+}
+
+func tarNames(t *testing.T, archivePath string) []string {
+	t.Helper()
+	f, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestBackupOne_SymlinkedHostPathWarns(t *testing.T) {
+	link, real := symlinkedHostPath(t)
+	b := New(t.TempDir(), "{pvc}.tar.gz", false)
+
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: link}}, "ns", "rel")
+	r := results[0]
+	if r.Err != nil {
+		t.Fatalf("unexpected error: %v", r.Err)
+	}
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "is a symlink") {
+		t.Errorf("Warnings = %q, want a symlink warning", r.Warnings)
+	}
+
+	// The symlink target's contents are archived, not the link itself
+	names := tarNames(t, r.ArchivePath)
+	found := false
+	for _, n := range names {
+		if n == "data.txt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("archive entries %q do not include data.txt from %s", names, real)
+	}
+}
+
+func TestBackupOne_SymlinkedHostPathStrict(t *testing.T) {
+	link, _ := symlinkedHostPath(t)
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithStrictPaths())
+
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: link}}, "ns", "rel")
+	if results[0].Err == nil || !strings.Contains(results[0].Err.Error(), "strict paths") {
+		t.Errorf("expected a strict paths error, got %v", results[0].Err)
+	}
+	if results[0].ArchivePath != "" {
+		t.Errorf("archive %s was created despite strict paths", results[0].ArchivePath)
+	}
+}
+
+func TestBackupOne_AllowedRoot(t *testing.T) {
+	link, real := symlinkedHostPath(t)
+
+	// A symlink that stays below the allowed root is fine
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithAllowedRoot(filepath.Dir(real)), WithStrictPaths())
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: link}}, "ns", "rel")
+	if results[0].Err != nil || len(results[0].Warnings) != 0 {
+		t.Errorf("inside allowed root: err=%v warnings=%q", results[0].Err, results[0].Warnings)
+	}
+
+	// One that escapes it is reported, and refused under strict paths
+	elsewhere := t.TempDir()
+	b = New(t.TempDir(), "{pvc}.tar.gz", false, WithAllowedRoot(elsewhere))
+	results = b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: link}}, "ns", "rel")
+	if results[0].Err != nil || len(results[0].Warnings) != 1 || !strings.Contains(results[0].Warnings[0], "outside the allowed root") {
+		t.Errorf("outside allowed root: err=%v warnings=%q", results[0].Err, results[0].Warnings)
+	}
+
+	b = New(t.TempDir(), "{pvc}.tar.gz", false, WithAllowedRoot(elsewhere), WithStrictPaths())
+	results = b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: link}}, "ns", "rel")
+	if results[0].Err == nil {
+		t.Error("expected an error for a host path outside the allowed root under strict paths")
+	}
+}
+
+func TestCheckPathRoots(t *testing.T) {
+	link, real := symlinkedHostPath(t)
+	linkRoot, realRoot := filepath.Dir(link), filepath.Dir(real)
+	tests := []struct {
+		roots []string
+		path  string
+		ok    bool
+	}{
+		{nil, "/etc", true},
+		{[]string{"/data", realRoot}, real, true},
+		{[]string{"/data"}, "/data/pv-1/../../etc", false},
+		{[]string{"/data"}, "/database", false},
+		{[]string{"/data"}, "data/pv-1", false},
+		{[]string{"/data/"}, "/data/pv-1", true}, // missing paths are checked as given
+		// A link below one root to a directory below another is fine, one out of them is not
+		{[]string{linkRoot, realRoot}, link, true},
+		{[]string{linkRoot}, link, false},
+	}
+	for _, tt := range tests {
+		if err := CheckPathRoots(tt.roots, tt.path); (err == nil) != tt.ok {
+			t.Errorf("CheckPathRoots(%q, %q) = %v, want ok=%v", tt.roots, tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestBackupAndRestore_AllowedPathRoots(t *testing.T) {
+	allowed, outside := t.TempDir(), t.TempDir()
+	for _, dir := range []string{allowed, outside} {
+		if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithAllowedPathRoots(filepath.Dir(allowed)+"/nope", allowed))
+	results := b.BackupAll(context.Background(), []types.PVCInfo{
+		{PVCName: "ok", HostPath: allowed},
+		{PVCName: "etc", HostPath: outside},
+	}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("backup inside an allowed root: %v", results[0].Err)
+	}
+	if err := results[1].Err; err == nil || !strings.Contains(err.Error(), "outside the allowed path roots") {
+		t.Errorf("backup outside the allowed roots error = %v", err)
+	}
+
+	// Restoring into the outside path would clear it first: it must stay untouched
+	if err := b.RestoreOne(results[0].ArchivePath, outside); err == nil {
+		t.Error("RestoreOne() outside the allowed roots succeeded")
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "data.txt")); err != nil || string(data) != "payload" {
+		t.Errorf("outside path changed: %q, %v", data, err)
+	}
+	if err := b.RestoreOne(results[0].ArchivePath, allowed); err != nil {
+		t.Errorf("RestoreOne() inside an allowed root: %v", err)
+	}
+}
+
+// slowReader hands out one byte per delay, like a failing disk that still answers.
+type slowReader struct {
+	io.ReadCloser
+	delay time.Duration
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.ReadCloser.Read(p[:min(len(p), 1)])
+}
+
+func TestBackupAll_PVCTimeout(t *testing.T) {
+	slowDir, fastDir := t.TempDir(), t.TempDir()
+	// 1000 bytes at 10ms each would take 10s without the timeout
+	if err := os.WriteFile(filepath.Join(slowDir, "data.bin"), bytes.Repeat([]byte("x"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fastDir, "data.bin"), []byte("fast"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	orig := openSource
+	openSource = func(path string) (io.ReadCloser, error) {
+		f, err := orig(path)
+		if err != nil || !strings.HasPrefix(path, slowDir) {
+			return f, err
+		}
+		return slowReader{ReadCloser: f, delay: 10 * time.Millisecond}, nil
+	}
+	t.Cleanup(func() { openSource = orig })
+
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithPVCTimeout(200*time.Millisecond))
+	start := time.Now()
+	results := b.BackupAll(context.Background(), []types.PVCInfo{
+		{PVCName: "slow", HostPath: slowDir},
+		{PVCName: "fast", HostPath: fastDir},
+	}, "ns", "rel")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("BackupAll took %s, want the slow PVC aborted after its timeout", elapsed)
+	}
+
+	slow, fast := results[0], results[1]
+	if !errors.Is(slow.Err, context.DeadlineExceeded) || !strings.Contains(slow.Err.Error(), "timed out after 200ms") {
+		t.Errorf("slow PVC error = %v, want a timeout", slow.Err)
+	}
+	if _, err := os.Stat(slow.ArchivePath); !os.IsNotExist(err) {
+		t.Errorf("partial archive %s was left behind (stat err %v)", slow.ArchivePath, err)
+	}
+	if fast.Err != nil {
+		t.Errorf("fast PVC failed after the slow one timed out: %v", fast.Err)
+	}
+}
+
+func TestBackupAll_ReadOnlySnapshot(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "live.txt"), []byte("live"), 0644)
+	viewDir := t.TempDir()
+	os.WriteFile(filepath.Join(viewDir, "view.txt"), []byte("view"), 0644)
+
+	var mounted, unmounted string
+	orig := readOnlyView
+	readOnlyView = func(dir string) (string, func() error, error) {
+		mounted = dir
+		return viewDir, func() error { unmounted = viewDir; return nil }, nil
+	}
+	t.Cleanup(func() { readOnlyView = orig })
+
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithReadOnlySnapshot())
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: srcDir}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("backup failed: %v", results[0].Err)
+	}
+	if mounted != srcDir || unmounted != viewDir {
+		t.Errorf("mounted %q, unmounted %q; want %q and %q", mounted, unmounted, srcDir, viewDir)
+	}
+	if names := tarNames(t, results[0].ArchivePath); !slices.Contains(names, "view.txt") || slices.Contains(names, "live.txt") {
+		t.Errorf("archive entries = %v, want the read-only view", names)
+	}
+	if len(results[0].Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", results[0].Warnings)
+	}
+}
+
+func TestBackupAll_ReadOnlySnapshotFallsBack(t *testing.T) {
+	srcDir := t.TempDir()
+	os.WriteFile(filepath.Join(srcDir, "live.txt"), []byte("live"), 0644)
+
+	orig := readOnlyView
+	readOnlyView = func(dir string) (string, func() error, error) {
+		return "", nil, errors.New("operation not permitted")
+	}
+	t.Cleanup(func() { readOnlyView = orig })
+
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithReadOnlySnapshot())
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "test", HostPath: srcDir}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("backup failed instead of falling back: %v", results[0].Err)
+	}
+	if names := tarNames(t, results[0].ArchivePath); !slices.Contains(names, "live.txt") {
+		t.Errorf("archive entries = %v, want the host path itself", names)
+	}
+	if len(results[0].Warnings) != 1 || !strings.Contains(results[0].Warnings[0], "read-only snapshot unavailable") {
+		t.Errorf("warnings = %v, want one about the missing snapshot", results[0].Warnings)
+	}
+}
+
+func TestBackupAll_FailFast(t *testing.T) {
+	good := t.TempDir()
+	os.WriteFile(filepath.Join(good, "data.txt"), []byte("data"), 0644)
+	pvcs := []types.PVCInfo{
+		{PVCName: "missing", HostPath: filepath.Join(t.TempDir(), "missing")},
+		{PVCName: "good", HostPath: good},
+	}
+
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithFailFast())
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
+	if len(results) != 1 || results[0].PVCName != "missing" || results[0].Err == nil {
+		t.Fatalf("results = %+v, want only the failed first PVC", results)
+	}
+
+	// Without fail-fast the second PVC is still backed up
+	results = New(t.TempDir(), "{pvc}.tar.gz", false).BackupAll(context.Background(), pvcs, "ns", "rel")
+	if len(results) != 2 || results[1].Err != nil {
+		t.Errorf("results = %+v, want both PVCs attempted", results)
+	}
+}
+
+func TestBackupAll_Parallel(t *testing.T) {
+	good := t.TempDir()
+	os.WriteFile(filepath.Join(good, "data.txt"), []byte("data"), 0644)
+	pvcs := []types.PVCInfo{
+		{PVCName: "a", HostPath: good},
+		{PVCName: "missing", HostPath: filepath.Join(t.TempDir(), "missing")},
+		{PVCName: "b", HostPath: good},
+		{PVCName: "c", HostPath: good},
+		{PVCName: "d", HostPath: good},
+	}
+
+	var mu sync.Mutex
+	var running, most int
+	check := func(ctx context.Context, pvc types.PVCInfo) error {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithParallel(2), WithPVCheck(check))
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
+	if most != 2 {
+		t.Errorf("%d PVCs archived at once, want 2", most)
+	}
+	if len(results) != len(pvcs) {
+		t.Fatalf("%d results, want %d", len(results), len(pvcs))
+	}
+	// Results keep the order of the PVCs, each with its own error
+	for i, r := range results {
+		if r.PVCName != pvcs[i].PVCName || (r.Err != nil) != (r.PVCName == "missing") {
+			t.Errorf("result %d = %s, %v; want %s", i, r.PVCName, r.Err, pvcs[i].PVCName)
+		}
+	}
+}
+
+func TestBackupAll_OnResult(t *testing.T) {
+	good := t.TempDir()
+	os.WriteFile(filepath.Join(good, "data.txt"), []byte("data"), 0644)
+	pvcs := []types.PVCInfo{
+		{PVCName: "first", HostPath: good},
+		{PVCName: "missing", HostPath: filepath.Join(t.TempDir(), "missing")},
+		{PVCName: "last", HostPath: good},
+	}
+
+	// Each result is handed over before the next PVC is archived
+	var handed []string
+	check := func(ctx context.Context, pvc types.PVCInfo) error {
+		if len(handed) != slices.IndexFunc(pvcs, func(p types.PVCInfo) bool { return p.PVCName == pvc.PVCName }) {
+			t.Errorf("%s archived with %v handed over", pvc.PVCName, handed)
+		}
+		return nil
+	}
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithPVCheck(check), WithOnResult(func(r types.BackupResult) {
+		handed = append(handed, r.PVCName)
+	}))
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
+	if !slices.Equal(handed, []string{"first", "missing", "last"}) || len(results) != 3 {
+		t.Errorf("handed over %v, want every result in order", handed)
+	}
+}
+
+func TestBackupAll_ObjectPerFile(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "data.txt"), []byte("x"), 0644)
+
+	var gotDir, gotPrefix string
+	store := func(ctx context.Context, dir, prefix string) (int64, error) {
+		gotDir, gotPrefix = dir, prefix
+		return 42, nil
+	}
+	outputDir := t.TempDir()
+	b := New(outputDir, "{namespace}/{pvc}.tar.zst", false, WithObjectPerFile(store))
+	r := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: src}}, "ns", "rel")[0]
+	if r.Err != nil {
+		t.Fatalf("BackupAll: %v", r.Err)
+	}
+	if gotDir != src || gotPrefix != "ns/data/" {
+		t.Errorf("store called with %q, %q; want %q, ns/data/", gotDir, gotPrefix, src)
+	}
+	if r.ArchivePath != "ns/data/" || r.Size != 42 {
+		t.Errorf("result = %q, %d bytes; want ns/data/, 42 bytes", r.ArchivePath, r.Size)
+	}
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 0 {
+		t.Errorf("files written to the output dir: %v", entries)
+	}
+}
+
+func TestBackupAll_WithStateSkipsCompleted(t *testing.T) {
+	outputDir := t.TempDir()
+	var pvcs []types.PVCInfo
+	for _, name := range []string{"data", "wal"} {
+		src := t.TempDir()
+		os.WriteFile(filepath.Join(src, name+".txt"), []byte(name), 0644)
+		pvcs = append(pvcs, types.PVCInfo{PVCName: name, HostPath: src})
+	}
+	state, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(outputDir, "{pvc}.tar.gz", false, WithState(state))
+
+	// The first run got as far as data
+	first := b.BackupAll(context.Background(), pvcs[:1], "ns", "rel")
+	if first[0].Err != nil || first[0].Resumed {
+		t.Fatalf("first run = %+v", first[0])
+	}
+
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
+	if !results[0].Resumed || results[0].ArchivePath != first[0].ArchivePath || results[0].Size != first[0].Size {
+		t.Errorf("data = %+v, want the recorded result", results[0])
+	}
+	if results[1].Err != nil || results[1].Resumed {
+		t.Errorf("wal = %+v, want a fresh backup", results[1])
+	}
+
+	// A recorded archive that is gone is backed up again
+	os.Remove(first[0].ArchivePath)
+	if r := b.BackupAll(context.Background(), pvcs[:1], "ns", "rel")[0]; r.Err != nil || r.Resumed {
+		t.Errorf("data after its archive was removed = %+v, want a fresh backup", r)
+	}
+}
+
+func TestParsePVCOptions(t *testing.T) {
+	pvc, o, err := ParsePVCOptions("media=codec:none,encrypt:false")
+	if err != nil || pvc != "media" || o.Compression != CompressionNone || o.Encrypt == nil || *o.Encrypt {
+		t.Errorf("ParsePVCOptions() = %q, %+v, %v; want media without compression or encryption", pvc, o, err)
+	}
+	if _, o, err := ParsePVCOptions("cfg=codec:zstd"); err != nil || o.Encrypt != nil {
+		t.Errorf("ParsePVCOptions(cfg) = %+v, %v; want encryption left to the default", o, err)
+	}
+	for _, bad := range []string{"media", "=codec:none", "media=", "media=codec:lz4", "media=encrypt:maybe", "media=level:9"} {
+		if _, _, err := ParsePVCOptions(bad); err == nil {
+			t.Errorf("ParsePVCOptions(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestBackupAll_MixedPVCOptions(t *testing.T) {
+	no := false
+	outputDir := t.TempDir()
+	var pvcs []types.PVCInfo
+	for _, name := range []string{"data", "media", "cfg"} {
+		src := t.TempDir()
+		os.WriteFile(filepath.Join(src, name+".txt"), []byte(name), 0644)
+		pvcs = append(pvcs, types.PVCInfo{PVCName: name, HostPath: src})
+	}
+	b := New(outputDir, "{pvc}.tar.gz", false,
+		WithArchiveOptions(ArchiveOptions{Encrypter: xorEncrypter{}}),
+		WithPVCOptions(map[string]PVCOptions{
+			"media": {Compression: CompressionNone, Encrypt: &no},
+			"cfg":   {Compression: CompressionZstd},
+		}))
+
+	results := b.BackupAll(context.Background(), pvcs, "ns", "rel")
+	want := []string{"data.tar.gz.enc", "media.tar", "cfg.tar.zst.enc"}
+	for i, r := range results {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", r.PVCName, r.Err)
+		}
+		if got := filepath.Base(r.ArchivePath); got != want[i] {
+			t.Errorf("%s archive = %s, want %s", r.PVCName, got, want[i])
+		}
+	}
+
+	// One Backuper restores them all, detecting each archive's settings
+	for i, r := range results {
+		dst := t.TempDir()
+		if err := b.RestoreOne(r.ArchivePath, dst); err != nil {
+			t.Fatalf("RestoreOne(%s): %v", want[i], err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dst, r.PVCName+".txt")); string(data) != r.PVCName {
+			t.Errorf("%s restored %q, want %q", want[i], data, r.PVCName)
+		}
+	}
+
+	yes := true
+	b = New(outputDir, "{pvc}.tar.gz", false, WithPVCOptions(map[string]PVCOptions{"data": {Encrypt: &yes}}))
+	if r := b.BackupAll(context.Background(), pvcs[:1], "ns", "rel")[0]; r.Err == nil {
+		t.Error("encrypt:true without a key provider succeeded")
+	}
+}
+
+func TestBackupAll_StreamOutput(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "data.txt"), []byte("streamed"), 0644)
+
+	var buf bytes.Buffer
+	outputDir := t.TempDir()
+	b := New(outputDir, "{pvc}.tar.gz", false, WithOutput(&buf), WithChecksum())
+	results := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: src}}, "ns", "rel")
+	r := results[0]
+	if r.Err != nil {
+		t.Fatalf("BackupAll: %v", r.Err)
+	}
+	if r.ArchivePath != "-" || r.Size != int64(buf.Len()) {
+		t.Errorf("result = %q, %d bytes; want -, %d bytes", r.ArchivePath, r.Size, buf.Len())
+	}
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 0 {
+		t.Errorf("files written to the output dir: %v", entries)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "data.tar.gz")
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum, _ := FileSHA256(archivePath); r.SHA256 != sum {
+		t.Errorf("SHA256 = %s, want %s", r.SHA256, sum)
+	}
+	dst := t.TempDir()
+	if err := b.RestoreOne(archivePath, dst); err != nil {
+		t.Fatalf("RestoreOne: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "data.txt")); string(data) != "streamed" {
+		t.Errorf("data.txt = %q, want %q", data, "streamed")
+	}
+}
+
+func TestBackupAll_StreamUpload(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "data.txt"), bytes.Repeat([]byte("streamed "), 100000), 0644)
+	pvcs := []types.PVCInfo{{PVCName: "data", HostPath: src}}
+
+	var uploaded bytes.Buffer
+	var gotPVC, gotName string
+	upload := func(ctx context.Context, pvc types.PVCInfo, r io.Reader, name string) error {
+		gotPVC, gotName = pvc.PVCName, name
+		_, err := io.Copy(&uploaded, r)
+		return err
+	}
+	outputDir := t.TempDir()
+	b := New(outputDir, "{pvc}.tar.gz", false, WithStreamUpload(upload), WithChecksum())
+	r := b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]
+	if r.Err != nil {
+		t.Fatalf("BackupAll: %v", r.Err)
+	}
+	if gotPVC != "data" || gotName != "data.tar.gz" || r.ArchivePath != "data.tar.gz" {
+		t.Errorf("uploaded %s as %s, result %s; want data as data.tar.gz", gotPVC, gotName, r.ArchivePath)
+	}
+	if r.Size != int64(uploaded.Len()) {
+		t.Errorf("Size = %d, uploaded %d bytes", r.Size, uploaded.Len())
+	}
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 0 {
+		t.Errorf("files written to the output dir: %v", entries)
+	}
+	archivePath := filepath.Join(t.TempDir(), "data.tar.gz")
+	os.WriteFile(archivePath, uploaded.Bytes(), 0644)
+	if sum, _ := FileSHA256(archivePath); r.SHA256 != sum {
+		t.Errorf("SHA256 = %s, want %s", r.SHA256, sum)
+	}
+
+	// An upload that gives up without reading fails the PVC instead of blocking the archiver
+	refused := errors.New("bucket unavailable")
+	b = New(outputDir, "{pvc}.tar.gz", false, WithStreamUpload(func(context.Context, types.PVCInfo, io.Reader, string) error {
+		return refused
+	}))
+	r = b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]
+	if !errors.Is(r.Err, refused) || !strings.Contains(r.Err.Error(), "uploading archive") {
+		t.Errorf("Err = %v, want the upload's error", r.Err)
+	}
+
+	// An archive that breaks off fails the upload rather than leaving a truncated object
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var uploadErr error
+	b = New(outputDir, "{pvc}.tar", false,
+		WithArchiveOptions(ArchiveOptions{StreamBuffer: 4096}),
+		WithStreamUpload(func(_ context.Context, _ types.PVCInfo, r io.Reader, _ string) error {
+			if _, err := r.Read(make([]byte, 1)); err != nil {
+				return err
+			}
+			cancel()
+			_, uploadErr = io.Copy(io.Discard, r)
+			return uploadErr
+		}))
+	r = b.BackupAll(ctx, pvcs, "ns", "rel")[0]
+	if r.Err == nil || !errors.Is(uploadErr, context.Canceled) {
+		t.Errorf("cancelled archive: Err = %v, upload error = %v; want both to fail", r.Err, uploadErr)
+	}
+}
+
+func TestBackupAll_HostPathVanished(t *testing.T) {
+	gone, kept := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(kept, "data.txt"), []byte("data"), 0644)
+	pvcs := []types.PVCInfo{
+		{PVCName: "gone", PVName: "pv-gone", HostPath: gone},
+		{PVCName: "kept", PVName: "pv-kept", HostPath: kept},
+	}
+	// The directory existed at discovery and is removed before it is archived
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	results := New(t.TempDir(), "{pvc}.tar.gz", false).BackupAll(context.Background(), pvcs, "ns", "rel")
+	if err := results[0].Err; !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "of PV pv-gone disappeared since discovery") {
+		t.Errorf("vanished PVC error = %v, want it to name the PV and discovery", err)
+	}
+	if results[1].Err != nil {
+		t.Errorf("remaining PVC failed: %v", results[1].Err)
+	}
+}
+
+func TestBackupAll_PVCheck(t *testing.T) {
+	src := t.TempDir()
+	check := func(_ context.Context, pvc types.PVCInfo) error {
+		if pvc.PVName == "pv-deleted" {
+			return errors.New("PV pv-deleted was deleted since discovery")
+		}
+		return nil
+	}
+	results := New(t.TempDir(), "{pvc}.tar.gz", false, WithPVCheck(check)).BackupAll(context.Background(), []types.PVCInfo{
+		{PVCName: "a", PVName: "pv-deleted", HostPath: src},
+		{PVCName: "b", PVName: "pv-ok", HostPath: src},
+	}, "ns", "rel")
+	if results[0].Err == nil || results[0].ArchivePath != "" {
+		t.Errorf("PVC with a deleted PV = %+v, want it failed before archiving", results[0])
+	}
+	if results[1].Err != nil {
+		t.Errorf("PVC with a live PV failed: %v", results[1].Err)
+	}
+}
+
+func TestFormatName_StorageClass(t *testing.T) {
+	format := "{storageClass}/{namespace}/{pvc}.tar.gz"
+	if got := FormatName(format, "ns", "rel", "data", "local-ssd"); got != "local-ssd/ns/data.tar.gz" {
+		t.Errorf("FormatName() = %q, want %q", got, "local-ssd/ns/data.tar.gz")
+	}
+	if got := FormatName(format, "ns", "rel", "data", ""); got != "default/ns/data.tar.gz" {
+		t.Errorf("FormatName() without a class = %q, want %q", got, "default/ns/data.tar.gz")
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "a.txt"), bytes.Repeat([]byte("a"), 1000), 0644)
+	os.WriteFile(filepath.Join(src, "empty"), nil, 0644)
+
+	// Headers for ./, sub/, sub/a.txt and empty, plus a.txt padded to two blocks
+	if got, err := EstimateSize(src); err != nil || got != 6*tarBlock {
+		t.Errorf("EstimateSize() = %d, %v; want %d", got, err, 6*tarBlock)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "data.tar")
+	if _, err := ArchiverFor(archivePath).Create(context.Background(), archivePath, src, ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only tar's end-of-archive blocks and record padding are left out
+	if est, _ := EstimateSize(src); info.Size() > est+10*1024 {
+		t.Errorf("archive is %d bytes, far over the estimate of %d", info.Size(), est)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package backup
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// statDevice returns the st_dev of the entry info describes: the filesystem it is on.
+func statDevice(info os.FileInfo) (uint64, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no device number for %s", info.Name())
+	}
+	return uint64(st.Dev), nil
+}
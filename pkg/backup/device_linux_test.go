@@ -0,0 +1,24 @@
+package backup
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStatDevice(t *testing.T) {
+	dir, err := os.Stat(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.Stat("/proc")
+	if err != nil {
+		t.Skip("no /proc:", err)
+	}
+	tmp, err := statDevice(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev, err := statDevice(proc); err != nil || dev == tmp {
+		t.Errorf("statDevice(/proc) = %d, %v; want a device other than %d", dev, err, tmp)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package backup
+
+import (
+	"errors"
+	"os"
+)
+
+func statDevice(info os.FileInfo) (uint64, error) {
+	return 0, errors.New("excluding mount boundaries is only supported on Linux")
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Excludes is a set of glob patterns for entries to leave out of archives, for
+// ArchiveOptions.Exclude. A pattern is matched against the in-archive path of an entry,
+// relative to the volume and with "/" separators, in path.Match syntax. A pattern
+// without "/" also matches the base name at any depth, so *.sock drops every socket, and
+// a trailing "/" matches directories only, like tmp/. An excluded directory is not
+// descended into.
+type Excludes struct {
+	patterns []excludePattern
+}
+
+type excludePattern struct {
+	glob    string
+	dirOnly bool
+	anyBase bool
+}
+
+// ParseExcludes validates patterns. No patterns give a nil Excludes, which matches nothing.
+func ParseExcludes(patterns []string) (*Excludes, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	e := &Excludes{}
+	for _, p := range patterns {
+		glob := strings.TrimPrefix(p, "./")
+		dirOnly := strings.HasSuffix(glob, "/")
+		glob = strings.TrimRight(glob, "/")
+		if glob == "" || glob == "." || strings.HasPrefix(glob, "/") {
+			return nil, fmt.Errorf("exclude pattern %q must name a path below the volume", p)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("exclude pattern %q: %w", p, err)
+		}
+		e.patterns = append(e.patterns, excludePattern{glob: glob, dirOnly: dirOnly, anyBase: !strings.Contains(glob, "/")})
+	}
+	return e, nil
+}
+
+// Match reports whether the entry at relPath, relative to the volume, is excluded. The
+// volume root never is.
+func (e *Excludes) Match(relPath string, isDir bool) bool {
+	if e == nil || relPath == "." {
+		return false
+	}
+	rel := filepath.ToSlash(relPath)
+	for _, p := range e.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		name := rel
+		if p.anyBase {
+			name = path.Base(rel)
+		}
+		// Patterns were validated by ParseExcludes
+		if ok, _ := path.Match(p.glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// skip is the walk result for an entry Match excluded: a directory is pruned whole.
+func (e *Excludes) skip(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestExcludes_Match(t *testing.T) {
+	e, err := ParseExcludes([]string{"tmp/", "*.sock", "lost+found", "data/cache/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{".", true, false},
+		{"tmp", true, true},
+		{"tmp", false, false},
+		{"a/b/tmp", true, true},
+		{"run/app.sock", false, true},
+		{"app.sock.bak", false, false},
+		{"lost+found", true, true},
+		{"data/cache/x", false, true},
+		{"data/cache", true, false},
+		{"other/data/cache/x", false, false},
+	}
+	for _, tt := range tests {
+		if got := e.Match(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, dir=%v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+	if (*Excludes)(nil).Match("anything", false) {
+		t.Error("a nil Excludes matched")
+	}
+}
+
+func TestParseExcludes_Rejects(t *testing.T) {
+	for _, bad := range []string{"[", "/abs", ".", "/"} {
+		if _, err := ParseExcludes([]string{bad}); err == nil {
+			t.Errorf("ParseExcludes(%q) succeeded", bad)
+		}
+	}
+	if e, err := ParseExcludes(nil); e != nil || err != nil {
+		t.Errorf("ParseExcludes(nil) = %v, %v; want nil, nil", e, err)
+	}
+}
+
+func TestBackupAll_Exclude(t *testing.T) {
+	src := t.TempDir()
+	for _, p := range []string{"keep.txt", "tmp/big.bin", "sub/tmp/big.bin", "sub/app.sock", "sub/keep.txt"} {
+		os.MkdirAll(filepath.Join(src, filepath.Dir(p)), 0755)
+		os.WriteFile(filepath.Join(src, p), []byte(p), 0644)
+	}
+	exclude, err := ParseExcludes([]string{"tmp/", "*.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"keep.txt", "sub", "sub/keep.txt"}
+	for _, format := range []string{"{pvc}.tar.gz", "{pvc}.zip"} {
+		opts := ArchiveOptions{Exclude: exclude}
+		b := New(t.TempDir(), format, false, WithArchiveOptions(opts))
+		r := b.BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: src}}, "ns", "rel")[0]
+		if r.Err != nil {
+			t.Fatalf("%s: %v", format, r.Err)
+		}
+		names, err := ArchiverFor(r.ArchivePath).List(r.ArchivePath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, n := range names {
+			if n = filepath.Clean(n); n != "." {
+				got = append(got, n)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s entries = %v, want %v", format, got, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestDirFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := func() string {
+		t.Helper()
+		fp, err := DirFingerprint(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	first := fingerprint()
+	if again := fingerprint(); again != first {
+		t.Fatalf("fingerprint changed without changes: %s != %s", again, first)
+	}
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, change := range map[string]func() error{
+		"mtime": func() error { return os.Chtimes(file, mtime, mtime) },
+		"mode":  func() error { return os.Chmod(file, 0600) },
+		"size":  func() error { return os.WriteFile(file, []byte("hello, world"), 0600) },
+		"new":   func() error { return os.WriteFile(filepath.Join(dir, "other"), nil, 0644) },
+		"link":  func() error { return os.Symlink("file.txt", filepath.Join(dir, "link")) },
+	} {
+		before := fingerprint()
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		if fingerprint() == before {
+			t.Errorf("%s change kept the fingerprint", name)
+		}
+	}
+}
+
+func TestFingerprints_SaveAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints.json")
+	f, err := LoadFingerprints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Lookup("ns", "rel", "data"); ok {
+		t.Fatal("empty file has a fingerprint")
+	}
+	f.Set("ns", "rel", "data", "abc")
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = LoadFingerprints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp, ok := f.Lookup("ns", "rel", "data"); !ok || fp != "abc" {
+		t.Errorf("Lookup() = %q, %v; want abc", fp, ok)
+	}
+	if _, ok := f.Lookup("ns", "other", "data"); ok {
+		t.Error("fingerprint found for another release")
+	}
+}
+
+func TestBackupAll_WithFingerprintsSkipsUnchanged(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "file.txt"), []byte("hello"), 0644)
+	f, err := LoadFingerprints(filepath.Join(t.TempDir(), "fingerprints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvcs := []types.PVCInfo{{PVCName: "data", HostPath: src}}
+	b := New(t.TempDir(), "{pvc}.tar.gz", false, WithFingerprints(f))
+
+	r := b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]
+	if r.Err != nil || r.Unchanged || r.Fingerprint == "" || r.ArchivePath == "" {
+		t.Fatalf("first backup = %+v, want an archive with a fingerprint", r)
+	}
+	// Nothing is skipped until the caller records the fingerprint
+	if r := b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]; r.Unchanged {
+		t.Fatal("skipped before the fingerprint was recorded")
+	}
+	f.Set("ns", "rel", "data", r.Fingerprint)
+	if r := b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]; r.Err != nil || !r.Unchanged || r.ArchivePath != "" {
+		t.Errorf("second backup = %+v, want it skipped as unchanged", r)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package backup
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// FreeSpace returns the bytes available to an unprivileged writer on the filesystem
+// holding dir.
+func FreeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("checking free space in %s: %w", dir, err)
+	}
+	return int64(st.Bavail) * st.Bsize, nil
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(t.TempDir())
+	if err != nil || free <= 0 {
+		t.Errorf("FreeSpace() = %d, %v; want some space", free, err)
+	}
+	if _, err := FreeSpace("/nonexistent/dir"); err == nil || !strings.Contains(err.Error(), "/nonexistent/dir") {
+		t.Errorf("FreeSpace(missing dir) error = %v", err)
+	}
+}
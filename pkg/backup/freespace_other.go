@@ -0,0 +1,9 @@
+//go:build !linux
+
+package backup
+
+import "errors"
+
+func FreeSpace(dir string) (int64, error) {
+	return 0, errors.New("checking free space is only supported on Linux")
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NameData is what a name template is executed with, one PVC at a time.
+type NameData struct {
+	Namespace    string
+	Release      string
+	PVC          string
+	PVName       string
+	Node         string // node the PV is pinned to; empty when it is not
+	Date         time.Time
+	StorageClass string // DefaultStorageClass when the PVC has none
+}
+
+// NameTemplate names archives with a text/template instead of the {placeholder} output
+// format, for names the placeholders cannot express.
+type NameTemplate struct {
+	tmpl   *template.Template
+	prefix string
+}
+
+// nameFuncs are the helpers available to name templates. Their last argument is the value
+// piped in, so {{.PVC | trunc 8 | upper}} works.
+var nameFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trunc": func(n int, s string) string {
+		if n < 0 || n >= len(s) {
+			return s
+		}
+		return s[:n]
+	},
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+}
+
+// ParseNameTemplate parses text as a name template and checks that it names an archive by
+// executing it for a sample PVC.
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	tmpl, err := template.New("name").Funcs(nameFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing name template: %w", err)
+	}
+	t := &NameTemplate{tmpl: tmpl, prefix: text}
+	if i := strings.Index(text, "{{"); i >= 0 {
+		t.prefix = text[:i]
+	}
+	if _, err := t.Execute(NameData{
+		Namespace:    "namespace",
+		Release:      "release",
+		PVC:          "pvc",
+		PVName:       "pv",
+		Node:         "node",
+		Date:         time.Now(),
+		StorageClass: DefaultStorageClass,
+	}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Execute returns the archive name the template gives data. The name must be a plain file
+// name with an archive extension.
+func (t *NameTemplate) Execute(data NameData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("executing name template: %w", err)
+	}
+	name := buf.String()
+	switch {
+	case strings.ContainsAny(name, "/\\") || name == "." || name == "..":
+		return "", fmt.Errorf("name template gave %q, which is not a plain file name", name)
+	case !IsArchive(name):
+		return "", fmt.Errorf("name template gave %q, which has no archive extension", name)
+	}
+	return name, nil
+}
+
+// Prefix is the literal text the template's names start with, before its first action.
+func (t *NameTemplate) Prefix() string {
+	return t.prefix
+}
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestNameTemplate_Execute(t *testing.T) {
+	data := NameData{
+		Namespace:    "Prod",
+		Release:      "shop",
+		PVC:          "data-postgresql-0",
+		PVName:       "pvc-1234",
+		Node:         "node-1",
+		Date:         time.Date(2024, 3, 5, 6, 7, 8, 0, time.UTC),
+		StorageClass: "local-path",
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{{.Namespace | lower}}_{{.Date.Format "2006-01"}}_{{.PVC}}.tar.gz`, "prod_2024-03_data-postgresql-0.tar.gz"},
+		{`{{.Node}}-{{.PVC | replace "-" "_" | trunc 15}}-{{.PVName}}.tar.zst`, "node-1-data_postgresql-pvc-1234.tar.zst"},
+		{`{{if .Node}}{{.Node}}{{else}}any{{end}}.{{.StorageClass | upper}}.zip`, "node-1.LOCAL-PATH.zip"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseNameTemplate(tt.text)
+		if err != nil {
+			t.Fatalf("ParseNameTemplate(%q): %v", tt.text, err)
+		}
+		if got, err := tmpl.Execute(data); err != nil || got != tt.want {
+			t.Errorf("Execute(%q) = %q, %v; want %q", tt.text, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseNameTemplate_Rejects(t *testing.T) {
+	for text, want := range map[string]string{
+		`{{.PVC}`:                     "parsing",
+		`{{.Host}}.tar.gz`:            "executing",
+		`{{.PVC}}`:                    "no archive extension",
+		`{{.Namespace}}/{{.PVC}}.tar`: "not a plain file name",
+	} {
+		if _, err := ParseNameTemplate(text); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseNameTemplate(%q) error = %v, want %q", text, err, want)
+		}
+	}
+}
+
+func TestNameTemplate_Prefix(t *testing.T) {
+	tmpl, err := ParseNameTemplate(`backups-{{.Namespace}}-{{.PVC}}.tar.gz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tmpl.Prefix(); got != "backups-" {
+		t.Errorf("Prefix() = %q, want backups-", got)
+	}
+}
+
+func TestBackupAll_NameTemplate(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "file.txt"), []byte("hello"), 0644)
+	tmpl, err := ParseNameTemplate(`{{.Node}}_{{.PVC | upper}}.tar.gz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(t.TempDir(), "{pvc}.tar.gz", false,
+		WithNameTemplate(tmpl),
+		WithPVCOptions(map[string]PVCOptions{"cfg": {Compression: CompressionZstd}}))
+
+	pvcs := []types.PVCInfo{
+		{PVCName: "data", HostPath: src, Node: "node-1"},
+		{PVCName: "cfg", HostPath: src, Node: "node-2"},
+	}
+	want := []string{"node-1_DATA.tar.gz", "node-2_CFG.tar.zst"}
+	for i, r := range b.BackupAll(context.Background(), pvcs, "ns", "rel") {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", r.PVCName, r.Err)
+		}
+		if got := filepath.Base(r.ArchivePath); got != want[i] {
+			t.Errorf("%s archive = %s, want %s", r.PVCName, got, want[i])
+		}
+	}
+}
+
+func TestBackupAll_DateSourceNewestFile(t *testing.T) {
+	src := t.TempDir()
+	old := time.Date(2021, 6, 1, 10, 0, 0, 0, time.Local)
+	newest := time.Date(2022, 3, 4, 5, 6, 7, 0, time.Local)
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	// Only files count: the directories keep the mtime of these writes
+	for path, mtime := range map[string]time.Time{"a.txt": old, "sub/b.txt": newest} {
+		p := filepath.Join(src, path)
+		if err := os.WriteFile(p, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+	tmpl, err := ParseNameTemplate(`{{.PVC}}-{{.Date.Format "2006"}}.tar.gz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvcs := []types.PVCInfo{{PVCName: "data", HostPath: src}}
+
+	b := New(t.TempDir(), "{namespace}_{release}_{date}_{pvc}.tar.gz", false, WithDateSource(DateNewestFile))
+	r := b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if got, want := filepath.Base(r.ArchivePath), "ns_rel_20220304-050607_data.tar.gz"; got != want {
+		t.Errorf("archive = %s, want %s", got, want)
+	}
+
+	b = New(t.TempDir(), "{pvc}.tar.gz", false, WithDateSource(DateNewestFile), WithNameTemplate(tmpl))
+	if r := b.BackupAll(context.Background(), pvcs, "ns", "rel")[0]; r.Err != nil || filepath.Base(r.ArchivePath) != "data-2022.tar.gz" {
+		t.Errorf("templated archive = %s, %v; want data-2022.tar.gz", filepath.Base(r.ArchivePath), r.Err)
+	}
+
+	// An empty volume has no newest file and is dated now
+	empty := []types.PVCInfo{{PVCName: "data", HostPath: t.TempDir()}}
+	b = New(t.TempDir(), "{pvc}-{date}.tar.gz", false, WithDateSource(DateNewestFile))
+	if r := b.BackupAll(context.Background(), empty, "ns", "rel")[0]; r.Err != nil || strings.Contains(r.ArchivePath, "00010101") {
+		t.Errorf("empty volume archive = %s, %v; want it dated now", r.ArchivePath, r.Err)
+	}
+}
+
+func TestParseDateSource(t *testing.T) {
+	for _, s := range []string{"now", "newest-file", "snapshot"} {
+		if got, err := ParseDateSource(s); err != nil || string(got) != s {
+			t.Errorf("ParseDateSource(%s) = %q, %v", s, got, err)
+		}
+	}
+	if _, err := ParseDateSource("mtime"); err == nil {
+		t.Error("ParseDateSource(mtime) succeeded")
+	}
+}
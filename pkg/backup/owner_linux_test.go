@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// ownerOf returns the uid and gid of path, not following symlinks.
+func ownerOf(t *testing.T, path string) (int, int) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
+
+// ownedTree creates a directory with a file, a subdirectory and a symlink, all owned by
+// uid:gid.
+func ownedTree(t *testing.T, uid, gid int) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "file.txt"), []byte("data"), 0644)
+	os.Symlink("sub/file.txt", filepath.Join(src, "link"))
+	for _, name := range []string{"sub", "sub/file.txt", "link"} {
+		if err := os.Lchown(filepath.Join(src, name), uid, gid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src
+}
+
+func TestExtract_Chown(t *testing.T) {
+	src := ownedTree(t, 999, 999)
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "a"+ext)
+			a := ArchiverFor(archivePath)
+			if _, err := a.Create(context.Background(), archivePath, src, ArchiveOptions{}); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			dst := t.TempDir()
+			if err := a.Extract(archivePath, dst, ArchiveOptions{Owner: &OwnerMap{UID: 1234, GID: 5678}}); err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			for _, name := range []string{"sub", "sub/file.txt", "link"} {
+				if uid, gid := ownerOf(t, filepath.Join(dst, name)); uid != 1234 || gid != 5678 {
+					t.Errorf("%s owned by %d:%d, want 1234:5678", name, uid, gid)
+				}
+			}
+		})
+	}
+}
+
+func TestExtract_IDMap(t *testing.T) {
+	src := ownedTree(t, 999, 998)
+	os.WriteFile(filepath.Join(src, "other.txt"), []byte("x"), 0644)
+	os.Lchown(filepath.Join(src, "other.txt"), 500, 501)
+
+	archivePath := filepath.Join(t.TempDir(), "a.tar.gz")
+	if _, err := tarGzArchiver.Create(context.Background(), archivePath, src, ArchiveOptions{}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	dst := t.TempDir()
+	owner := &OwnerMap{UID: -1, GID: -1, UIDs: map[int]int{999: 1000}, GIDs: map[int]int{998: 1001}}
+	if err := tarGzArchiver.Extract(archivePath, dst, ArchiveOptions{Owner: owner}); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	for _, name := range []string{"sub", "sub/file.txt", "link"} {
+		if uid, gid := ownerOf(t, filepath.Join(dst, name)); uid != 1000 || gid != 1001 {
+			t.Errorf("%s owned by %d:%d, want 1000:1001", name, uid, gid)
+		}
+	}
+	// Ids without a mapping keep their archived value
+	if uid, gid := ownerOf(t, filepath.Join(dst, "other.txt")); uid != 500 || gid != 501 {
+		t.Errorf("other.txt owned by %d:%d, want 500:501", uid, gid)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package backup
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountReadOnly bind-mounts dir read-only on a new temporary directory and returns it with
+// a function that unmounts and removes it. It needs CAP_SYS_ADMIN.
+func mountReadOnly(dir string) (string, func() error, error) {
+	mnt, err := os.MkdirTemp("", "k8s-cf-backup-ro-*")
+	if err != nil {
+		return "", nil, err
+	}
+	// A bind mount inherits the flags of its source; read-only needs a second remount
+	if err := unix.Mount(dir, mnt, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		os.Remove(mnt)
+		return "", nil, fmt.Errorf("bind-mounting %s: %w", dir, err)
+	}
+	release := func() error {
+		if err := unix.Unmount(mnt, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("unmounting %s: %w", mnt, err)
+		}
+		return os.Remove(mnt)
+	}
+	if err := unix.Mount("", mnt, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+		release()
+		return "", nil, fmt.Errorf("remounting %s read-only: %w", mnt, err)
+	}
+	return mnt, release, nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountReadOnly(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "data.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	view, unmount, err := mountReadOnly(src)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("bind mounts need CAP_SYS_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("mountReadOnly() error: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(view, "data.txt")); err != nil || string(data) != "data" {
+		t.Errorf("reading through the view = %q, %v", data, err)
+	}
+	if err := os.WriteFile(filepath.Join(view, "new.txt"), nil, 0644); !errors.Is(err, unix.EROFS) {
+		t.Errorf("writing through the view: err = %v, want EROFS", err)
+	}
+
+	if err := unmount(); err != nil {
+		t.Fatalf("unmount() error: %v", err)
+	}
+	if _, err := os.Stat(view); !os.IsNotExist(err) {
+		t.Errorf("mountpoint %s still exists after unmount (stat err %v)", view, err)
+	}
+	// The volume itself stays writable
+	if err := os.WriteFile(filepath.Join(src, "new.txt"), nil, 0644); err != nil {
+		t.Errorf("host path not writable after unmount: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package backup
+
+import "errors"
+
+func mountReadOnly(dir string) (string, func() error, error) {
+	return "", nil, errors.New("read-only bind mounts are only supported on Linux")
+}
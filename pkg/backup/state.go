@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+// State records the PVCs a backup run has completed, so that a rerun after an interruption
+// skips them. It is saved to its file after every PVC, atomically, so an interrupted run
+// leaves either the previous or the new record behind, never a torn one.
+type State struct {
+	mu        sync.Mutex
+	path      string
+	Completed []StateEntry `json:"completed"`
+}
+
+// StateEntry is a PVC backed up by an earlier run.
+type StateEntry struct {
+	Namespace string    `json:"namespace"`
+	Release   string    `json:"release"`
+	PVC       string    `json:"pvc"`
+	Archive   string    `json:"archive"` // BackupResult.ArchivePath
+	Key       string    `json:"key"`     // key the archive is uploaded under
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// LoadState reads the state file at path. A missing file is an empty state, as on the
+// first run.
+func LoadState(path string) (*State, error) {
+	s := &State{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Lookup returns the entry of a completed PVC.
+func (s *State) Lookup(namespace, release, pvc string) (StateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.Completed {
+		if e.Namespace == namespace && e.Release == release && e.PVC == pvc {
+			return e, true
+		}
+	}
+	return StateEntry{}, false
+}
+
+// Record marks the PVC of r as completed, replacing an earlier entry for it, and saves the
+// state.
+func (s *State) Record(namespace, release, key string, r types.BackupResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := StateEntry{
+		Namespace: namespace,
+		Release:   release,
+		PVC:       r.PVCName,
+		Archive:   r.ArchivePath,
+		Key:       key,
+		Size:      r.Size,
+		SHA256:    r.SHA256,
+		Time:      time.Now(),
+	}
+	kept := s.Completed[:0]
+	for _, e := range s.Completed {
+		if e.Namespace != namespace || e.Release != release || e.PVC != r.PVCName {
+			kept = append(kept, e)
+		}
+	}
+	s.Completed = append(kept, entry)
+	return s.save()
+}
+
+// save writes the state to its file atomically.
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(s.path, data); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	return nil
+}
+
+// writeAtomic writes data to a temporary file next to path and renames it into place, so
+// path holds either its old or its new content, never a torn one.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Remove deletes the state file, once the run it tracks has completed.
+func (s *State) Remove() error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+)
+
+func TestState_RecordAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState on a missing file: %v", err)
+	}
+	if len(s.Completed) != 0 {
+		t.Fatalf("new state holds %v", s.Completed)
+	}
+
+	for _, size := range []int64{1, 2} {
+		r := types.BackupResult{PVCName: "data", ArchivePath: "/out/data.tar.gz", Size: size}
+		if err := s.Record("ns", "rel", "data.tar.gz", r); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	if err := s.Record("ns", "other", "data.tar.gz", types.BackupResult{PVCName: "data"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("state dir holds %v, want only the state file", entries)
+	}
+
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(loaded.Completed) != 2 {
+		t.Errorf("Completed = %+v, want one entry per release", loaded.Completed)
+	}
+	e, ok := loaded.Lookup("ns", "rel", "data")
+	if !ok || e.Size != 2 || e.Key != "data.tar.gz" || e.Archive != "/out/data.tar.gz" {
+		t.Errorf("Lookup() = %+v, %v; want the second record", e, ok)
+	}
+	if _, ok := loaded.Lookup("ns", "rel", "wal"); ok {
+		t.Error("Lookup found a PVC that was never recorded")
+	}
+
+	if err := loaded.Remove(); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file still exists: %v", err)
+	}
+}
+
+func TestLoadState_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{"), 0644)
+	if _, err := LoadState(path); err == nil {
+		t.Error("LoadState accepted a corrupt file")
+	}
+}
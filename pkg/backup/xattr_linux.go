@@ -0,0 +1,73 @@
+//go:build linux
+
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of path without following a final symlink.
+// A filesystem without xattr support has none.
+func readXattrs(path string) (map[string]string, error) {
+	names, err := xattrCall(func(buf []byte) (int, error) { return unix.Llistxattr(path, buf) })
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing xattrs of %s: %w", path, err)
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrCall(func(buf []byte) (int, error) { return unix.Lgetxattr(path, string(name), buf) })
+		if errors.Is(err, unix.ENODATA) {
+			// Removed between list and get
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading xattr %s of %s: %w", name, path, err)
+		}
+		attrs[string(name)] = string(value)
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets attrs on path without following a final symlink.
+func writeXattrs(path string, attrs map[string]string) error {
+	for name, value := range attrs {
+		if err := unix.Lsetxattr(path, name, []byte(value), 0); err != nil {
+			return fmt.Errorf("setting xattr %s on %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// xattrCall runs a list or get call that fills buf, sizing buf with a first call and
+// retrying if the value grew in between.
+func xattrCall(call func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := call(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrDir returns a temporary directory that supports user.* xattrs, preferring the tmpfs
+// at /dev/shm, or skips the test when none does.
+func xattrDir(t *testing.T) string {
+	t.Helper()
+	for _, parent := range []string{"/dev/shm", ""} {
+		if parent != "" {
+			if _, err := os.Stat(parent); err != nil {
+				continue
+			}
+		}
+		dir, err := os.MkdirTemp(parent, "xattr-test-")
+		if err != nil {
+			continue
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		err = unix.Lsetxattr(dir, "user.probe", []byte("1"), 0)
+		if err == nil {
+			unix.Lremovexattr(dir, "user.probe")
+			return dir
+		}
+	}
+	t.Skip("no temporary filesystem with user xattr support")
+	return ""
+}
+
+func TestReadWriteXattrs(t *testing.T) {
+	dir := xattrDir(t)
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"user.label": "system_u:object_r:container_file_t:s0\x00", "user.empty": ""}
+	if err := writeXattrs(path, want); err != nil {
+		t.Fatalf("writeXattrs() error: %v", err)
+	}
+	got, err := readXattrs(path)
+	if err != nil {
+		t.Fatalf("readXattrs() error: %v", err)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("xattr %s = %q, want %q", name, got[name], value)
+		}
+	}
+}
+
+func TestTarArchiver_Xattrs(t *testing.T) {
+	src := xattrDir(t)
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "sub", "data.txt")
+	if err := os.WriteFile(file, []byte("labelled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXattrs(file, map[string]string{"user.selinux": "container_file_t"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXattrs(filepath.Join(src, "sub"), map[string]string{"user.acl": "dir"}); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "x.tar.gz")
+	if _, err := tarGzArchiver.Create(context.Background(), archive, src, ArchiveOptions{Xattrs: true}); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	dst := xattrDir(t)
+	if err := tarGzArchiver.Extract(archive, dst, ArchiveOptions{Xattrs: true}); err != nil {
+		t.Fatalf("Extract() error: %v", err)
+	}
+	if got, _ := readXattrs(filepath.Join(dst, "sub", "data.txt")); got["user.selinux"] != "container_file_t" {
+		t.Errorf("file xattrs after restore = %q, want user.selinux=container_file_t", got)
+	}
+	if got, _ := readXattrs(filepath.Join(dst, "sub")); got["user.acl"] != "dir" {
+		t.Errorf("dir xattrs after restore = %q, want user.acl=dir", got)
+	}
+
+	// Without the option the attributes are neither written nor applied
+	plain := xattrDir(t)
+	if err := tarGzArchiver.Extract(archive, plain, ArchiveOptions{}); err != nil {
+		t.Fatalf("Extract() error: %v", err)
+	}
+	if got, err := readXattrs(filepath.Join(plain, "sub", "data.txt")); err != nil || len(got) != 0 {
+		t.Errorf("xattrs restored without Xattrs = %q (err %v), want none", got, err)
+	}
+}
+
+func TestRestoreOne_Xattrs(t *testing.T) {
+	src := xattrDir(t)
+	file := filepath.Join(src, "data.txt")
+	if err := os.WriteFile(file, []byte("labelled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXattrs(file, map[string]string{"user.label": "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := WithArchiveOptions(ArchiveOptions{Xattrs: true})
+	results := New(t.TempDir(), "{pvc}.tar.gz", false, opts).BackupAll(context.Background(), []types.PVCInfo{{PVCName: "data", HostPath: src}}, "ns", "rel")
+	if results[0].Err != nil {
+		t.Fatalf("BackupAll() error: %v", results[0].Err)
+	}
+
+	dst := xattrDir(t)
+	if err := New("", "", false, opts).RestoreOne(results[0].ArchivePath, dst); err != nil {
+		t.Fatalf("RestoreOne() error: %v", err)
+	}
+	got, err := readXattrs(filepath.Join(dst, "data.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["user.label"] != "v1" {
+		t.Errorf("xattrs after RestoreOne = %q, want user.label=v1", got)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package backup
+
+import "errors"
+
+var errXattrsUnsupported = errors.New("preserving xattrs is only supported on Linux")
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, errXattrsUnsupported
+}
+
+func writeXattrs(path string, attrs map[string]string) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return errXattrsUnsupported
+}
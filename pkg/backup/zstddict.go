@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// zstdDictSize is the size of the history a trained dictionary carries.
+	zstdDictSize = 110 << 10
+	// zstdSampleMax is the largest file sampled for training; larger files gain little
+	// from a dictionary, as their own data soon fills the window.
+	zstdSampleMax = 128 << 10
+	// zstdSampleBudget bounds the bytes read for training across all directories.
+	zstdSampleBudget = 16 << 20
+	// zstdSamplePrefix is how much of each sample goes into the history, so it holds many
+	// files rather than the first few.
+	zstdSamplePrefix = 4 << 10
+	// zstdMinSamples is the fewest samples a dictionary is trained from.
+	zstdMinSamples = 8
+)
+
+// ZstdDict is a zstd dictionary. Archives compressed with one record its ID in every frame
+// and cannot be decompressed without the same dictionary.
+type ZstdDict struct {
+	ID   uint32
+	Data []byte
+}
+
+// LoadZstdDict reads a zstd dictionary from path, as written by Save or zstd --train.
+func LoadZstdDict(path string) (*ZstdDict, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading zstd dictionary: %w", err)
+	}
+	d, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading zstd dictionary %s: %w", path, err)
+	}
+	return &ZstdDict{ID: d.ID(), Data: data}, nil
+}
+
+// Save writes the dictionary to path, which must not exist yet. The file appears whole or
+// not at all, and an existing one is never replaced, as archives compressed with it could
+// no longer be read: Save then fails with an error matching fs.ErrExist, and the caller
+// should use the dictionary already there.
+func (d *ZstdDict) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing zstd dictionary: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(d.Data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing zstd dictionary: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing zstd dictionary: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("writing zstd dictionary: %w", err)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing zstd dictionary: %w", err)
+	}
+	return nil
+}
+
+// TrainZstdDict builds a dictionary from a sample of the small regular files below dirs,
+// for archives of similar trees (one PVC per tenant, say) that are each too small for zstd
+// to learn their common content on its own. Every other sample goes into the history; the
+// rest tune the entropy tables against it.
+func TrainZstdDict(dirs []string) (dict *ZstdDict, err error) {
+	var samples [][]byte
+	var total int
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if total >= zstdSampleBudget {
+				return filepath.SkipAll
+			}
+			if !e.Type().IsRegular() {
+				return nil
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() == 0 || info.Size() > zstdSampleMax {
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, data)
+			total += len(data)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sampling %s for a zstd dictionary: %w", dir, err)
+		}
+	}
+	if len(samples) < zstdMinSamples {
+		return nil, fmt.Errorf("training a zstd dictionary needs at least %d files of at most %d bytes, found %d", zstdMinSamples, zstdSampleMax, len(samples))
+	}
+
+	var history bytes.Buffer
+	var contents [][]byte
+	for i, s := range samples {
+		if i%2 == 1 || history.Len() >= zstdDictSize {
+			contents = append(contents, s)
+			continue
+		}
+		history.Write(s[:min(len(s), zstdSamplePrefix, zstdDictSize-history.Len())])
+	}
+	if history.Len() < 8 {
+		return nil, fmt.Errorf("training a zstd dictionary: samples hold only %d bytes", history.Len())
+	}
+	// IDs below 32768 are reserved for registered dictionaries.
+	id := 1<<15 + crc32.ChecksumIEEE(history.Bytes())%(1<<31-1<<15)
+	// BuildDict divides by zero when the history matches the samples so well that they
+	// leave no literals.
+	defer func() {
+		if recover() != nil {
+			dict, err = nil, errors.New("training a zstd dictionary: the samples are too alike to train on")
+		}
+	}()
+	data, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: contents,
+		History:  history.Bytes(),
+		Offsets:  [3]int{1, 4, 8},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("training a zstd dictionary: %w", err)
+	}
+	return &ZstdDict{ID: id, Data: data}, nil
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTenantTrees writes n similar trees of small config files, as PVCs of the same app
+// for different tenants would hold.
+func writeTenantTrees(t *testing.T, n int) []string {
+	t.Helper()
+	var dirs []string
+	for i := range n {
+		dir := t.TempDir()
+		for j := range 4 {
+			conf := fmt.Sprintf("# tenant settings\nlisten_address = 0.0.0.0:%d\nlog_level = info\nstorage_path = /var/lib/app/tenant-%d/%d\nreplication = enabled\n", 8000+j, i, j)
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("app-%d.conf", j)), []byte(conf), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func TestZstdDict_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dirs := writeTenantTrees(t, 4)
+	trained, err := TrainZstdDict(dirs)
+	if err != nil {
+		t.Fatalf("TrainZstdDict: %v", err)
+	}
+	if trained.ID < 1<<15 {
+		t.Errorf("trained ID = %d, want one outside the reserved range", trained.ID)
+	}
+
+	// A saved dictionary loads back with the same ID, as a restore would provide it
+	path := filepath.Join(t.TempDir(), "app.dict")
+	if err := trained.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	dict, err := LoadZstdDict(path)
+	if err != nil {
+		t.Fatalf("LoadZstdDict: %v", err)
+	}
+	if dict.ID != trained.ID {
+		t.Errorf("loaded ID = %d, want %d", dict.ID, trained.ID)
+	}
+	// A second save must not replace the dictionary archives were compressed with
+	other := &ZstdDict{ID: trained.ID + 1, Data: []byte("other")}
+	if err := other.Save(path); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Save() over an existing dictionary error = %v, want fs.ErrExist", err)
+	}
+	if dict, err := LoadZstdDict(path); err != nil || dict.ID != trained.ID {
+		t.Errorf("after a second Save the dictionary is %v (err %v), want ID %d", dict, err, trained.ID)
+	}
+
+	archive := filepath.Join(t.TempDir(), "data.tar.zst")
+	if _, err := tarZstArchiver.Create(ctx, archive, dirs[0], ArchiveOptions{Dict: dict}); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := tarZstArchiver.Extract(archive, dst, ArchiveOptions{Dict: dict}); err != nil {
+		t.Fatalf("Extract with dictionary: %v", err)
+	}
+	want, _ := os.ReadFile(filepath.Join(dirs[0], "app-1.conf"))
+	if got, err := os.ReadFile(filepath.Join(dst, "app-1.conf")); err != nil || string(got) != string(want) {
+		t.Errorf("restored app-1.conf = %q, %v; want %q", got, err, want)
+	}
+
+	// Without the dictionary the archive cannot be read, and the error says why
+	err = tarZstArchiver.Extract(archive, t.TempDir(), ArchiveOptions{})
+	if err == nil || !strings.Contains(err.Error(), "zstd dictionary") {
+		t.Errorf("Extract without dictionary error = %v, want a zstd dictionary error", err)
+	}
+}
+
+func TestTrainZstdDict_TooFewSamples(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "only.conf"), []byte("log_level = info\n"), 0644)
+	if _, err := TrainZstdDict([]string{dir}); err == nil || !strings.Contains(err.Error(), "needs at least") {
+		t.Errorf("TrainZstdDict error = %v, want a too few files error", err)
+	}
+}
+
+func TestLoadZstdDict_RejectsOther(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not.dict")
+	os.WriteFile(path, []byte("not a dictionary"), 0644)
+	if _, err := LoadZstdDict(path); err == nil {
+		t.Error("LoadZstdDict accepted a file that is not a dictionary")
+	}
+}
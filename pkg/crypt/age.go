@@ -0,0 +1,66 @@
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// AgeSuffix is appended to the names of age-encrypted archives.
+const AgeSuffix = ".age"
+
+// Age encrypts archives to age X25519 recipients. Unlike Envelope it needs no KMS at
+// backup time, and the archives can also be decrypted with the age tool itself.
+type Age struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// NewAge returns an Age that encrypts to recipients, age1... public keys, and decrypts
+// with the identities in identityFile, an age key file as written by age-keygen. Either
+// may be left empty when only the other direction is needed.
+func NewAge(recipients []string, identityFile string) (*Age, error) {
+	a := &Age{}
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %w", s, err)
+		}
+		a.recipients = append(a.recipients, r)
+	}
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading age identity file: %w", err)
+		}
+		defer f.Close()
+		if a.identities, err = age.ParseIdentities(f); err != nil {
+			return nil, fmt.Errorf("parsing age identity file %s: %w", identityFile, err)
+		}
+	}
+	return a, nil
+}
+
+// Suffix returns the file name suffix for age-encrypted archives.
+func (a *Age) Suffix() string { return AgeSuffix }
+
+// Encrypt returns a writer that encrypts everything written to it into w, for every
+// recipient. Close must be called to write the final chunk.
+func (a *Age) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if len(a.recipients) == 0 {
+		return nil, errors.New("no age recipient to encrypt to")
+	}
+	return age.Encrypt(w, a.recipients...)
+}
+
+// Decrypt returns a reader of the plaintext of r. Reads fail if the archive was modified
+// or cut short.
+func (a *Age) Decrypt(r io.Reader) (io.Reader, error) {
+	if len(a.identities) == 0 {
+		return nil, errors.New("no age identity to decrypt with; pass --decrypt-identity")
+	}
+	return age.Decrypt(r, a.identities...)
+}
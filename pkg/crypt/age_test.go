@@ -0,0 +1,91 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// newAgeKey writes a fresh identity to a key file, as age-keygen does, and returns the
+// file and its recipient.
+func newAgeKey(t *testing.T) (identityFile, recipient string) {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile = filepath.Join(t.TempDir(), "key.txt")
+	key := "# public key: " + id.Recipient().String() + "\n" + id.String() + "\n"
+	if err := os.WriteFile(identityFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identityFile, id.Recipient().String()
+}
+
+func TestAge_RoundTrip(t *testing.T) {
+	keyA, recipientA := newAgeKey(t)
+	keyB, recipientB := newAgeKey(t)
+	enc, err := NewAge([]string{recipientA, recipientB}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 3*chunkSize+17)
+	rand.Read(plain)
+	sealed := encrypt(t, enc, plain)
+	if !bytes.HasPrefix(sealed, []byte("age-encryption.org/v1\n")) {
+		t.Error("output is not in the age format")
+	}
+
+	// Either recipient can decrypt
+	for _, key := range []string{keyA, keyB} {
+		dec, err := NewAge(nil, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decrypt(dec, sealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("decrypt with %s: %d bytes, %v; want the plaintext", filepath.Base(key), len(got), err)
+		}
+	}
+}
+
+func TestAge_Rejects(t *testing.T) {
+	key, recipient := newAgeKey(t)
+	otherKey, _ := newAgeKey(t)
+	enc, _ := NewAge([]string{recipient}, "")
+	sealed := encrypt(t, enc, bytes.Repeat([]byte("backup"), chunkSize/2))
+
+	other, _ := NewAge(nil, otherKey)
+	if _, err := decrypt(other, sealed); err == nil {
+		t.Error("decrypt with the wrong identity succeeded")
+	}
+	dec, _ := NewAge(nil, key)
+	if _, err := decrypt(dec, sealed[:len(sealed)-10]); err == nil {
+		t.Error("decrypt of a truncated archive succeeded")
+	}
+	if _, err := dec.Encrypt(&bytes.Buffer{}); err == nil {
+		t.Error("Encrypt without recipients succeeded")
+	}
+	if _, err := enc.Decrypt(bytes.NewReader(sealed)); err == nil || !strings.Contains(err.Error(), "--decrypt-identity") {
+		t.Errorf("Decrypt without identities error = %v, want a hint at --decrypt-identity", err)
+	}
+}
+
+func TestNewAge_Invalid(t *testing.T) {
+	if _, err := NewAge([]string{"age1notakey"}, ""); err == nil || !strings.Contains(err.Error(), "age1notakey") {
+		t.Errorf("NewAge(bad recipient) error = %v", err)
+	}
+	if _, err := NewAge(nil, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("NewAge(missing identity file) succeeded")
+	}
+	bad := filepath.Join(t.TempDir(), "key.txt")
+	os.WriteFile(bad, []byte("AGE-SECRET-KEY-1NOPE\n"), 0600)
+	if _, err := NewAge(nil, bad); err == nil {
+		t.Error("NewAge(bad identity file) succeeded")
+	}
+}
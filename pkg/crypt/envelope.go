@@ -0,0 +1,293 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// KeyProvider wraps and unwraps per-archive data keys with a key held by an external KMS.
+type KeyProvider interface {
+	// Name identifies the provider in the archive header, e.g. "vault-transit".
+	Name() string
+	WrapKey(ctx context.Context, dek []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// Suffix is appended to the names of envelope-encrypted archives.
+const Suffix = ".enc"
+
+const (
+	magic     = "k8scfenc"
+	version   = 1
+	chunkSize = 64 * 1024
+	dekSize   = 32
+	// nonce = 7-byte random prefix | 4-byte chunk counter | 1-byte last-chunk flag
+	noncePrefixSize = 7
+	kmsTimeout      = 30 * time.Second
+)
+
+// Envelope encrypts archives with a fresh AES-256-GCM data key per archive and stores that
+// key, wrapped by the KeyProvider, in the archive header.
+//
+// Layout: magic | version | provider name | wrapped key | nonce prefix, then the payload in
+// 64 KiB chunks, each sealed separately. The header is authenticated with every chunk and
+// the last chunk is flagged, so tampering and truncation are both detected.
+type Envelope struct {
+	provider KeyProvider
+}
+
+// NewEnvelope returns an Envelope that wraps data keys with provider.
+func NewEnvelope(provider KeyProvider) *Envelope {
+	return &Envelope{provider: provider}
+}
+
+// Suffix returns the file name suffix for encrypted archives.
+func (e *Envelope) Suffix() string { return Suffix }
+
+// Encrypt returns a writer that encrypts everything written to it into w. Close must be
+// called to write the final chunk.
+func (e *Envelope) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	dek := make([]byte, dekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("generating data key: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapped, err := e.provider.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping data key with %s: %w", e.provider.Name(), err)
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	header := encodeHeader(e.provider.Name(), wrapped, prefix)
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("writing encryption header: %w", err)
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, aad: header}, nil
+}
+
+// Decrypt reads the header from r, unwraps the data key and returns a reader of the
+// plaintext. Reads fail if any chunk was modified or the stream was cut short.
+func (e *Envelope) Decrypt(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	name, wrapped, prefix, header, err := decodeHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if name != e.provider.Name() {
+		return nil, fmt.Errorf("archive key was wrapped by %q, not %q", name, e.provider.Name())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	dek, err := e.provider.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key with %s: %w", name, err)
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, prefix: prefix, aad: header}, nil
+}
+
+// IsEncrypted reports whether head, the first bytes of a file, starts an Envelope stream.
+func IsEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(magic))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != dekSize {
+		return nil, fmt.Errorf("data key is %d bytes, want %d", len(key), dekSize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, 0, noncePrefixSize+5)
+	n = append(n, prefix...)
+	n = binary.BigEndian.AppendUint32(n, counter)
+	if last {
+		return append(n, 1)
+	}
+	return append(n, 0)
+}
+
+func encodeHeader(name string, wrapped, prefix []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+	binary.Write(&buf, binary.BigEndian, uint16(len(name)))
+	buf.WriteString(name)
+	binary.Write(&buf, binary.BigEndian, uint32(len(wrapped)))
+	buf.Write(wrapped)
+	buf.Write(prefix)
+	return buf.Bytes()
+}
+
+// maxWrappedKey bounds the wrapped-key length read from a header before allocating it.
+const maxWrappedKey = 64 * 1024
+
+func decodeHeader(r io.Reader) (name string, wrapped, prefix, header []byte, err error) {
+	var raw bytes.Buffer
+	tr := io.TeeReader(r, &raw)
+	fail := func(err error) (string, []byte, []byte, []byte, error) {
+		return "", nil, nil, nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+
+	head := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(tr, head); err != nil {
+		return fail(err)
+	}
+	if !IsEncrypted(head) {
+		return fail(errors.New("not an encrypted archive"))
+	}
+	if head[len(magic)] != version {
+		return fail(fmt.Errorf("unsupported version %d", head[len(magic)]))
+	}
+
+	var nameLen uint16
+	if err := binary.Read(tr, binary.BigEndian, &nameLen); err != nil {
+		return fail(err)
+	}
+	nameBuf := make([]byte, nameLen)
+	if _, err := io.ReadFull(tr, nameBuf); err != nil {
+		return fail(err)
+	}
+
+	var wrappedLen uint32
+	if err := binary.Read(tr, binary.BigEndian, &wrappedLen); err != nil {
+		return fail(err)
+	}
+	if wrappedLen > maxWrappedKey {
+		return fail(fmt.Errorf("wrapped key of %d bytes is too large", wrappedLen))
+	}
+	wrapped = make([]byte, wrappedLen)
+	if _, err := io.ReadFull(tr, wrapped); err != nil {
+		return fail(err)
+	}
+
+	prefix = make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(tr, prefix); err != nil {
+		return fail(err)
+	}
+	return string(nameBuf), wrapped, prefix, raw.Bytes(), nil
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+	e.buf = append(e.buf, p...)
+	// Keep the final (possibly full) chunk buffered: only Close knows it is the last one
+	for len(e.buf) > chunkSize {
+		if err := e.seal(e.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[chunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(chunk []byte, last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("archive too large to encrypt")
+	}
+	sealed := e.aead.Seal(nil, nonce(e.prefix, e.counter, last), chunk, e.aad)
+	e.counter++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	sealed := make([]byte, chunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return fmt.Errorf("encrypted archive is truncated")
+		}
+		return err
+	}
+	// A short read, or a full chunk with nothing after it, is the final chunk
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.aead.Open(nil, nonce(d.prefix, d.counter, last), sealed[:n], d.aad)
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: archive is corrupt, truncated or was encrypted with a different key", d.counter)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
@@ -0,0 +1,166 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// xorProvider is a stand-in KMS that "wraps" keys by XOR with a fixed byte.
+type xorProvider struct {
+	name   string
+	unwrap int
+}
+
+func (p *xorProvider) Name() string {
+	if p.name != "" {
+		return p.name
+	}
+	return "xor"
+}
+
+func (p *xorProvider) WrapKey(_ context.Context, dek []byte) ([]byte, error) {
+	out := make([]byte, len(dek))
+	for i, b := range dek {
+		out[i] = b ^ 0x5a
+	}
+	return out, nil
+}
+
+func (p *xorProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	p.unwrap++
+	return p.WrapKey(ctx, wrapped)
+}
+
+// cipherPair is what the helpers need of Envelope and Age.
+type cipherPair interface {
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+	Decrypt(r io.Reader) (io.Reader, error)
+}
+
+func encrypt(t *testing.T, e cipherPair, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := e.Encrypt(&buf)
+	if err != nil {
+		t.Fatalf("Encrypt() error: %v", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(e cipherPair, sealed []byte) ([]byte, error) {
+	r, err := e.Decrypt(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEnvelope_RoundTrip(t *testing.T) {
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		provider := &xorProvider{}
+		e := NewEnvelope(provider)
+		sealed := encrypt(t, e, plain)
+		if !IsEncrypted(sealed) {
+			t.Errorf("size %d: output does not start with the envelope magic", size)
+		}
+		if size > 64 && bytes.Contains(sealed, plain[:64]) {
+			t.Errorf("size %d: plaintext visible in output", size)
+		}
+
+		got, err := decrypt(e, sealed)
+		if err != nil {
+			t.Fatalf("size %d: decrypt error: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: round trip mismatch", size)
+		}
+		if provider.unwrap != 1 {
+			t.Errorf("size %d: UnwrapKey called %d times, want 1", size, provider.unwrap)
+		}
+	}
+}
+
+func TestEnvelope_FreshKeyPerArchive(t *testing.T) {
+	e := NewEnvelope(&xorProvider{})
+	a := encrypt(t, e, []byte("same data"))
+	b := encrypt(t, e, []byte("same data"))
+	if bytes.Equal(a, b) {
+		t.Error("two encryptions of the same data are identical; data key or nonce reused")
+	}
+}
+
+func TestEnvelope_DetectsTampering(t *testing.T) {
+	e := NewEnvelope(&xorProvider{})
+	plain := bytes.Repeat([]byte("backup"), chunkSize/2)
+	sealed := encrypt(t, e, plain)
+
+	tests := map[string][]byte{
+		"flipped payload bit": func() []byte {
+			c := bytes.Clone(sealed)
+			c[len(c)-100] ^= 1
+			return c
+		}(),
+		"truncated mid-chunk":      sealed[:len(sealed)-10],
+		"truncated at chunk bound": sealed[:headerLen(t, sealed)+chunkSize+16],
+		"payload removed":          sealed[:headerLen(t, sealed)],
+	}
+	for name, data := range tests {
+		if _, err := decrypt(e, data); err == nil {
+			t.Errorf("%s: expected decrypt error", name)
+		}
+	}
+}
+
+func headerLen(t *testing.T, sealed []byte) int {
+	t.Helper()
+	_, _, _, header, err := decodeHeader(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(header)
+}
+
+func TestEnvelope_WrongProvider(t *testing.T) {
+	sealed := encrypt(t, NewEnvelope(&xorProvider{}), []byte("data"))
+	_, err := decrypt(NewEnvelope(&xorProvider{name: "other"}), sealed)
+	if err == nil || !strings.Contains(err.Error(), `"xor"`) {
+		t.Errorf("expected provider mismatch error, got %v", err)
+	}
+}
+
+type failingProvider struct{ xorProvider }
+
+func (failingProvider) WrapKey(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("permission denied")
+}
+
+func TestEnvelope_WrapFailure(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewEnvelope(&failingProvider{}).Encrypt(&buf); err == nil {
+		t.Fatal("expected error when the KMS refuses to wrap")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes despite the wrap failure", buf.Len())
+	}
+}
+
+func TestDecrypt_NotEncrypted(t *testing.T) {
+	if _, err := decrypt(NewEnvelope(&xorProvider{}), []byte("\x1f\x8bplain gzip")); err == nil {
+		t.Error("expected error for non-envelope input")
+	}
+}
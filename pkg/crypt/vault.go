@@ -0,0 +1,135 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// VaultTransit wraps data keys with a HashiCorp Vault transit secrets engine key. The key
+// never leaves Vault; only the per-archive data key is sent to it.
+type VaultTransit struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	http      *http.Client
+}
+
+// NewVaultTransit returns a provider for the transit key at <mount>/keys/<key> on the Vault
+// server at addr. namespace is only needed for Vault Enterprise namespaces.
+func NewVaultTransit(addr, token, namespace, mount, key string) *VaultTransit {
+	return &VaultTransit{
+		addr:      strings.TrimRight(addr, "/"),
+		token:     token,
+		namespace: namespace,
+		mount:     strings.Trim(mount, "/"),
+		key:       key,
+		http:      &http.Client{Timeout: kmsTimeout},
+	}
+}
+
+func (v *VaultTransit) Name() string { return "vault-transit" }
+
+// WrapKey encrypts dek with the transit key and returns Vault's "vault:vN:..." ciphertext.
+func (v *VaultTransit) WrapKey(ctx context.Context, dek []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}
+	if err := v.call(ctx, "encrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("vault returned no ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// UnwrapKey asks Vault to decrypt a ciphertext produced by WrapKey.
+func (v *VaultTransit) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"ciphertext": string(wrapped)}
+	if err := v.call(ctx, "decrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	dek, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decoding vault plaintext: %w", err)
+	}
+	return dek, nil
+}
+
+func (v *VaultTransit) call(ctx context.Context, op string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", v.addr, v.mount, op, url.PathEscape(v.key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault transit %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&verr)
+		return fmt.Errorf("vault transit %s: %s: %s", op, resp.Status, strings.Join(verr.Errors, "; "))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("vault transit %s: decoding response: %w", op, err)
+	}
+	return nil
+}
+
+// ProviderFromURI builds a KeyProvider from a --kms value. Supported:
+//
+//	vault://<mount>/<key>   Vault transit; address and token come from VAULT_ADDR and
+//	                        VAULT_TOKEN (and VAULT_NAMESPACE), as for the vault CLI.
+func ProviderFromURI(uri string) (KeyProvider, error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid KMS URI %q (want e.g. vault://transit/<key>)", uri)
+	}
+
+	switch scheme {
+	case "vault":
+		i := strings.LastIndex(rest, "/")
+		if i <= 0 || i == len(rest)-1 {
+			return nil, fmt.Errorf("invalid vault KMS URI %q (want vault://<mount>/<key>)", uri)
+		}
+		addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+		if addr == "" || token == "" {
+			return nil, fmt.Errorf("vault KMS requires VAULT_ADDR and VAULT_TOKEN")
+		}
+		return NewVaultTransit(addr, token, os.Getenv("VAULT_NAMESPACE"), rest[:i], rest[i+1:]), nil
+	}
+	return nil, fmt.Errorf("unsupported KMS %q (supported: vault)", scheme)
+}
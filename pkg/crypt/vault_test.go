@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeTransit emulates the two Vault transit endpoints used by VaultTransit.
+func fakeTransit(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		if r.Header.Get("X-Vault-Namespace") != "team-a" {
+			t.Errorf("X-Vault-Namespace = %q", r.Header.Get("X-Vault-Namespace"))
+		}
+
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/backups":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"ciphertext": "vault:v1:" + req["plaintext"]}})
+		case "/v1/transit/decrypt/backups":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultTransit_WrapUnwrap(t *testing.T) {
+	srv := fakeTransit(t)
+	defer srv.Close()
+
+	v := NewVaultTransit(srv.URL+"/", "s.token", "team-a", "/transit/", "backups")
+	dek := bytes.Repeat([]byte{7}, dekSize)
+
+	wrapped, err := v.WrapKey(context.Background(), dek)
+	if err != nil {
+		t.Fatalf("WrapKey() error: %v", err)
+	}
+	if want := "vault:v1:" + base64.StdEncoding.EncodeToString(dek); string(wrapped) != want {
+		t.Errorf("wrapped = %q, want %q", wrapped, want)
+	}
+
+	got, err := v.UnwrapKey(context.Background(), wrapped)
+	if err != nil {
+		t.Fatalf("UnwrapKey() error: %v", err)
+	}
+	if !bytes.Equal(got, dek) {
+		t.Error("unwrapped key differs from the original")
+	}
+}
+
+func TestVaultTransit_EnvelopeRoundTrip(t *testing.T) {
+	srv := fakeTransit(t)
+	defer srv.Close()
+
+	e := NewEnvelope(NewVaultTransit(srv.URL, "s.token", "team-a", "transit", "backups"))
+	sealed := encrypt(t, e, []byte("archive bytes"))
+	if !bytes.Contains(sealed, []byte("vault-transit")) || !bytes.Contains(sealed, []byte("vault:v1:")) {
+		t.Error("header should carry the provider name and the Vault-wrapped key")
+	}
+	got, err := decrypt(e, sealed)
+	if err != nil || string(got) != "archive bytes" {
+		t.Errorf("decrypt = %q, %v", got, err)
+	}
+}
+
+func TestVaultTransit_Error(t *testing.T) {
+	srv := fakeTransit(t)
+	defer srv.Close()
+
+	v := NewVaultTransit(srv.URL, "wrong", "team-a", "transit", "backups")
+	_, err := v.WrapKey(context.Background(), make([]byte, dekSize))
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("expected Vault error to be surfaced, got %v", err)
+	}
+}
+
+func TestProviderFromURI(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "https://vault.example:8200")
+	t.Setenv("VAULT_TOKEN", "s.token")
+	t.Setenv("VAULT_NAMESPACE", "")
+
+	p, err := ProviderFromURI("vault://ops/transit/backups")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v := p.(*VaultTransit)
+	if v.mount != "ops/transit" || v.key != "backups" || v.addr != "https://vault.example:8200" {
+		t.Errorf("provider = %+v", v)
+	}
+
+	for _, uri := range []string{"vault://backups", "vault://transit/", "aws-kms://alias/x", "transit/backups"} {
+		if _, err := ProviderFromURI(uri); err == nil {
+			t.Errorf("ProviderFromURI(%q): expected error", uri)
+		}
+	}
+
+	t.Setenv("VAULT_TOKEN", "")
+	if _, err := ProviderFromURI("vault://transit/backups"); err == nil {
+		t.Error("expected error without VAULT_TOKEN")
+	}
+}
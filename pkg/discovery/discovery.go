@@ -2,34 +2,66 @@ package discovery
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
 
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// instanceLabel is the label Helm charts conventionally set to the release name.
+const instanceLabel = "app.kubernetes.io/instance"
+
 // Discoverer finds PVCs, resolves PVs, and identifies owning workloads for a Helm release.
 type Discoverer struct {
-	client  kubernetes.Interface
-	verbose bool
+	client    kubernetes.Interface
+	labelKeys []string
+	verbose   bool
+}
+
+// Option configures optional Discoverer behaviour.
+type Option func(*Discoverer)
+
+// WithLabelKeys finds the PVCs of a release by any of keys, each with the release name as
+// its value, instead of app.kubernetes.io/instance alone. A release whose objects were
+// labelled differently over chart upgrades is found whole.
+func WithLabelKeys(keys ...string) Option {
+	return func(d *Discoverer) {
+		if len(keys) > 0 {
+			d.labelKeys = keys
+		}
+	}
 }
 
-func New(client kubernetes.Interface, verbose bool) *Discoverer {
-	return &Discoverer{client: client, verbose: verbose}
+func New(client kubernetes.Interface, verbose bool, opts ...Option) *Discoverer {
+	d := &Discoverer{client: client, labelKeys: []string{instanceLabel}, verbose: verbose}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
 // Discover finds all PVCs for the given Helm release and resolves their PV host paths
-// and owning workloads.
+// and owning workloads. PVCs created from the volumeClaimTemplates of the release's
+// StatefulSets are found even when they lack the release label.
 func (d *Discoverer) Discover(ctx context.Context, namespace, release string) ([]types.PVCInfo, error) {
 	pvcs, err := d.findPVCs(ctx, namespace, release)
 	if err != nil {
 		return nil, fmt.Errorf("finding PVCs: %w", err)
 	}
+	extra, owners := d.findTemplatePVCs(ctx, namespace, release, pvcs)
+	pvcs = append(pvcs, extra...)
 
 	if len(pvcs) == 0 {
 		return nil, fmt.Errorf("no PVCs found for release %q in namespace %q", release, namespace)
@@ -41,25 +73,229 @@ func (d *Discoverer) Discover(ctx context.Context, namespace, release string) ([
 		if err != nil {
 			return nil, fmt.Errorf("resolving PVC %q: %w", pvc.Name, err)
 		}
+		d.templateOwner(ctx, info, owners)
+		info.Release = release
 		results = append(results, *info)
 	}
 
 	return results, nil
 }
 
-func (d *Discoverer) findPVCs(ctx context.Context, namespace, release string) ([]corev1.PersistentVolumeClaim, error) {
-	labelSelector := fmt.Sprintf("app.kubernetes.io/instance=%s", release)
-	d.logf("Listing PVCs in %s with selector %q", namespace, labelSelector)
+// DiscoverAll finds PVCs carrying the release label across all namespaces. An empty release
+// matches any release. Each result's Release is taken from the PVC's label, and results are
+// sorted by namespace and release so callers can process them group by group.
+func (d *Discoverer) DiscoverAll(ctx context.Context, release string) ([]types.PVCInfo, error) {
+	pvcs, err := d.findPVCs(ctx, metav1.NamespaceAll, release)
+	if err != nil {
+		return nil, fmt.Errorf("finding PVCs: %w", err)
+	}
+	extra, owners := d.findTemplatePVCs(ctx, metav1.NamespaceAll, release, pvcs)
+	pvcs = append(pvcs, extra...)
+
+	if len(pvcs) == 0 {
+		if release != "" {
+			return nil, fmt.Errorf("no PVCs found for release %q in any namespace", release)
+		}
+		return nil, fmt.Errorf("no PVCs labelled %s found in any namespace", strings.Join(d.labelKeys, " or "))
+	}
+
+	var results []types.PVCInfo
+	for _, pvc := range pvcs {
+		info, err := d.resolvePVC(ctx, &pvc)
+		if err != nil {
+			return nil, fmt.Errorf("resolving PVC %s/%s: %w", pvc.Namespace, pvc.Name, err)
+		}
+		d.templateOwner(ctx, info, owners)
+		info.Release = d.releaseOf(pvc.Labels)
+		if ss := owners[pvc.Namespace+"/"+pvc.Name]; info.Release == "" && ss != nil {
+			info.Release = d.releaseOf(ss.Labels)
+		}
+		results = append(results, *info)
+	}
 
-	pvcList, err := d.client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: labelSelector,
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Namespace != results[j].Namespace {
+			return results[i].Namespace < results[j].Namespace
+		}
+		return results[i].Release < results[j].Release
 	})
+
+	return results, nil
+}
+
+// PlanHash returns a hex SHA-256 over what a run would act on: every PVC with its PV, host
+// path, owning workload and that workload's replicas. It does not depend on the order of
+// pvcs, so the same cluster state always yields the same hash, and any new PVC, moved
+// volume or replica change yields a different one.
+func PlanHash(pvcs []types.PVCInfo) string {
+	lines := make([]string, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		workload := "-"
+		if w := pvc.Workload; w != nil {
+			workload = fmt.Sprintf("%s/%s/%s replicas=%d", w.Kind, w.Namespace, w.Name, w.OriginalReplicas)
+		}
+		lines = append(lines, fmt.Sprintf("%q %q %q %q %q %s\n", pvc.Namespace, pvc.Release, pvc.PVCName, pvc.PVName, pvc.HostPath, workload))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SharedHostPaths reports the host paths that more than one PVC resolves to, mapped to
+// those PVCs as namespace/name in the order of pvcs. Paths are compared after cleaning,
+// so /data/a and /data/a/ collide; symlinks are not followed.
+func SharedHostPaths(pvcs []types.PVCInfo) map[string][]string {
+	byPath := make(map[string][]string)
+	for _, pvc := range pvcs {
+		if pvc.HostPath == "" {
+			continue
+		}
+		path := filepath.Clean(pvc.HostPath)
+		byPath[path] = append(byPath[path], pvc.Namespace+"/"+pvc.PVCName)
+	}
+	for path, names := range byPath {
+		if len(names) < 2 {
+			delete(byPath, path)
+		}
+	}
+	return byPath
+}
+
+// FormatSharedHostPaths renders the result of SharedHostPaths as one line per path, sorted.
+func FormatSharedHostPaths(shared map[string][]string) []string {
+	lines := make([]string, 0, len(shared))
+	for path, names := range shared {
+		lines = append(lines, fmt.Sprintf("%s is the host path of %s", path, strings.Join(names, ", ")))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// findPVCs lists PVCs labelled with the given release under any of the label keys, each
+// PVC once, in the order of the keys. An empty namespace lists cluster-wide, and an empty
+// release matches any value of the label.
+func (d *Discoverer) findPVCs(ctx context.Context, namespace, release string) ([]corev1.PersistentVolumeClaim, error) {
+	var pvcs []corev1.PersistentVolumeClaim
+	seen := make(map[string]bool)
+	for _, key := range d.labelKeys {
+		labelSelector := key
+		if release != "" {
+			labelSelector = fmt.Sprintf("%s=%s", key, release)
+		}
+		if namespace == metav1.NamespaceAll {
+			d.logf("Listing PVCs in all namespaces with selector %q", labelSelector)
+		} else {
+			d.logf("Listing PVCs in %s with selector %q", namespace, labelSelector)
+		}
+
+		pvcList, err := d.client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: labelSelector,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, pvc := range pvcList.Items {
+			if id := pvc.Namespace + "/" + pvc.Name; !seen[id] {
+				seen[id] = true
+				pvcs = append(pvcs, pvc)
+			}
+		}
+	}
+
+	d.logf("Found %d PVCs", len(pvcs))
+	return pvcs, nil
+}
+
+// releaseOf is the release an object with labels belongs to: the value of the first label
+// key it has.
+func (d *Discoverer) releaseOf(labels map[string]string) string {
+	for _, key := range d.labelKeys {
+		if release, ok := labels[key]; ok {
+			return release
+		}
+	}
+	return ""
+}
+
+// findTemplatePVCs finds the PVCs of the release's StatefulSets that the label selector
+// missed. Helm labels a StatefulSet, but the PVCs its controller creates from the
+// volumeClaimTemplates only carry the labels the templates give them, often none. They
+// are matched by their generated name, <template>-<statefulset>-<ordinal>, for any
+// ordinal, so the PVCs of scaled-down ordinals are found too. It returns them with the
+// StatefulSet of each, keyed by namespace/name. This is a fallback: errors, e.g. for lack
+// of RBAC to list StatefulSets, are logged and leave the labelled PVCs as they are.
+func (d *Discoverer) findTemplatePVCs(ctx context.Context, namespace, release string, found []corev1.PersistentVolumeClaim) ([]corev1.PersistentVolumeClaim, map[string]*appsv1.StatefulSet) {
+	var sets []appsv1.StatefulSet
+	seenSets := make(map[string]bool)
+	for _, key := range d.labelKeys {
+		labelSelector := key
+		if release != "" {
+			labelSelector = fmt.Sprintf("%s=%s", key, release)
+		}
+		list, err := d.client.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			d.logf("Warning: could not list StatefulSets for volumeClaimTemplate PVCs: %v", err)
+			return nil, nil
+		}
+		for _, ss := range list.Items {
+			if id := ss.Namespace + "/" + ss.Name; !seenSets[id] && len(ss.Spec.VolumeClaimTemplates) > 0 {
+				seenSets[id] = true
+				sets = append(sets, ss)
+			}
+		}
+	}
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	all, err := d.client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return nil, err
+		d.logf("Warning: could not list PVCs for volumeClaimTemplate PVCs: %v", err)
+		return nil, nil
 	}
+	seen := make(map[string]bool, len(found))
+	for _, pvc := range found {
+		seen[pvc.Namespace+"/"+pvc.Name] = true
+	}
+	var extra []corev1.PersistentVolumeClaim
+	owners := make(map[string]*appsv1.StatefulSet)
+	for _, pvc := range all.Items {
+		id := pvc.Namespace + "/" + pvc.Name
+		for i := range sets {
+			ss := &sets[i]
+			if seen[id] || ss.Namespace != pvc.Namespace {
+				continue
+			}
+			for _, tmpl := range ss.Spec.VolumeClaimTemplates {
+				suffix, ok := strings.CutPrefix(pvc.Name, tmpl.Name+"-"+ss.Name+"-")
+				if _, isOrdinal := parseOrdinal(suffix); !ok || !isOrdinal {
+					continue
+				}
+				d.logf("PVC %s has no release label; found through volumeClaimTemplate %s of StatefulSet %s", id, tmpl.Name, ss.Name)
+				seen[id] = true
+				extra = append(extra, pvc)
+				owners[id] = ss
+				break
+			}
+		}
+	}
+	return extra, owners
+}
 
-	d.logf("Found %d PVCs", len(pvcList.Items))
-	return pvcList.Items, nil
+// templateOwner makes the StatefulSet findTemplatePVCs found a PVC through its workload
+// when no running pod mounts the PVC, as with an ordinal scaled away.
+func (d *Discoverer) templateOwner(ctx context.Context, info *types.PVCInfo, owners map[string]*appsv1.StatefulSet) {
+	ss := owners[info.Namespace+"/"+info.PVCName]
+	if ss == nil || info.Workload != nil {
+		return
+	}
+	info.Workload = statefulSetInfo(ss)
+	info.Workload.HPA = d.findHPA(ctx, info.Workload)
+	d.logf("PVC %s owned by StatefulSet/%s through its volumeClaimTemplates", info.PVCName, ss.Name)
 }
 
 func (d *Discoverer) resolvePVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (*types.PVCInfo, error) {
@@ -67,6 +303,9 @@ func (d *Discoverer) resolvePVC(ctx context.Context, pvc *corev1.PersistentVolum
 		Namespace: pvc.Namespace,
 		PVCName:   pvc.Name,
 	}
+	if pvc.Spec.StorageClassName != nil {
+		info.StorageClass = *pvc.Spec.StorageClassName
+	}
 
 	// Resolve PV
 	if pvc.Spec.VolumeName == "" {
@@ -79,24 +318,145 @@ func (d *Discoverer) resolvePVC(ctx context.Context, pvc *corev1.PersistentVolum
 		return nil, fmt.Errorf("getting PV %q: %w", info.PVName, err)
 	}
 
+	if pv.Spec.CSI != nil {
+		info.CSIDriver = pv.Spec.CSI.Driver
+	}
 	info.HostPath = resolveHostPath(pv)
 	if info.HostPath == "" {
 		return nil, fmt.Errorf("could not resolve host path for PV %q", info.PVName)
 	}
 	d.logf("PVC %s -> PV %s -> path %s", info.PVCName, info.PVName, info.HostPath)
+	info.Node = pinnedNode(pv)
 
 	// Find owning workload
 	workload, err := d.findWorkload(ctx, pvc)
 	if err != nil {
 		d.logf("Warning: could not find workload for PVC %q: %v", pvc.Name, err)
 	}
+	if workload != nil {
+		workload.HPA = d.findHPA(ctx, workload)
+	}
 	info.Workload = workload
 
 	return info, nil
 }
 
+// ResolvePV describes a PV on its own, for backing up a volume whose PVC was deleted while
+// a Retain reclaim policy kept its data. The PV's name stands in for the PVC name and there
+// is no workload to scale. A PV still bound to a claim is refused: nothing would stop the
+// pods using it, so its release should be backed up instead.
+func (d *Discoverer) ResolvePV(ctx context.Context, namespace, name string) (*types.PVCInfo, error) {
+	pv, err := d.client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting PV %q: %w", name, err)
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		if pv.Status.Phase == corev1.VolumeBound {
+			return nil, fmt.Errorf("PV %q is bound to PVC %s/%s; back up its release instead", name, ref.Namespace, ref.Name)
+		}
+		d.logf("PV %s was claimed by PVC %s/%s", name, ref.Namespace, ref.Name)
+	}
+
+	info := &types.PVCInfo{
+		Namespace:    namespace,
+		PVCName:      pv.Name,
+		PVName:       pv.Name,
+		StorageClass: pv.Spec.StorageClassName,
+		HostPath:     resolveHostPath(pv),
+		Node:         pinnedNode(pv),
+	}
+	if pv.Spec.CSI != nil {
+		info.CSIDriver = pv.Spec.CSI.Driver
+	}
+	if info.HostPath == "" {
+		return nil, fmt.Errorf("could not resolve host path for PV %q", name)
+	}
+	d.logf("PV %s -> path %s", name, info.HostPath)
+	return info, nil
+}
+
+// Verify re-reads pvc and its PV and fails unless the claim is still bound to the same PV
+// and that PV still resolves to the same host path as at discovery. Restore runs it right
+// before wiping a host path, so that a PV rebound in the meantime never gets another
+// volume's directory cleared.
+func (d *Discoverer) Verify(ctx context.Context, pvc types.PVCInfo) error {
+	claim, err := d.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.PVCName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("re-reading PVC %q: %w", pvc.PVCName, err)
+	}
+	if claim.Spec.VolumeName != pvc.PVName {
+		return fmt.Errorf("PVC %q is now bound to PV %q instead of %q", pvc.PVCName, claim.Spec.VolumeName, pvc.PVName)
+	}
+	pv, err := d.client.CoreV1().PersistentVolumes().Get(ctx, pvc.PVName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("re-reading PV %q: %w", pvc.PVName, err)
+	}
+	if path := resolveHostPath(pv); filepath.Clean(path) != filepath.Clean(pvc.HostPath) {
+		return fmt.Errorf("PV %q now resolves to host path %q instead of %q", pvc.PVName, path, pvc.HostPath)
+	}
+	d.logf("PVC %s still resolves to PV %s at %s", pvc.PVCName, pvc.PVName, pvc.HostPath)
+	return nil
+}
+
+// Ordinal returns the StatefulSet ordinal of a PVC created from a volumeClaimTemplate of
+// the StatefulSet that mounts it. Such PVCs are named <template>-<statefulset>-<ordinal>,
+// e.g. data-db-0. Other PVCs have no ordinal.
+func Ordinal(pvc types.PVCInfo) (int, bool) {
+	w := pvc.Workload
+	if w == nil || w.Kind != "StatefulSet" {
+		return 0, false
+	}
+	rest, suffix, ok := cutLast(pvc.PVCName, "-")
+	if !ok || !strings.HasSuffix(rest, "-"+w.Name) {
+		return 0, false
+	}
+	return parseOrdinal(suffix)
+}
+
+// parseOrdinal parses a StatefulSet ordinal: a non-negative decimal without leading zeros.
+func parseOrdinal(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil || strconv.Itoa(n) != s || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// cutLast is strings.Cut around the last sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// pinnedNode returns the node a PV's required node affinity pins it to by hostname, as
+// local and most hostPath provisioners set it. It is empty unless exactly one node matches.
+func pinnedNode(pv *corev1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	var node string
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key != corev1.LabelHostname || expr.Operator != corev1.NodeSelectorOpIn {
+				continue
+			}
+			for _, v := range expr.Values {
+				if node != "" && node != v {
+					return ""
+				}
+				node = v
+			}
+		}
+	}
+	return node
+}
+
 // resolveHostPath extracts the host path from a PV spec.
-// Supports CSI volumeAttributes, local volumes, and hostPath volumes.
+// Supports CSI volumeAttributes, local volumes, hostPath volumes, and NFS exports, whose
+// path is taken as mounted at the same path where the backup runs.
 func resolveHostPath(pv *corev1.PersistentVolume) string {
 	// CSI with volumeAttributes.path (e.g. hostpath provisioner)
 	if pv.Spec.CSI != nil {
@@ -115,6 +475,11 @@ func resolveHostPath(pv *corev1.PersistentVolume) string {
 		return pv.Spec.HostPath.Path
 	}
 
+	// NFS export, e.g. served from the node the backup runs on
+	if pv.Spec.NFS != nil {
+		return pv.Spec.NFS.Path
+	}
+
 	return ""
 }
 
@@ -127,11 +492,19 @@ func (d *Discoverer) findWorkload(ctx context.Context, pvc *corev1.PersistentVol
 	}
 
 	// Find pods that mount this PVC
+	checked := false
 	for _, pod := range pods.Items {
 		if !podMountsPVC(&pod, pvc.Name) {
 			continue
 		}
 		d.logf("Pod %s mounts PVC %s", pod.Name, pvc.Name)
+		if !checked {
+			// Pods of one workload share a spec, so the first one tells
+			for _, problem := range mountProblems(&pod, pvc.Name) {
+				log.Printf("WARNING: PVC %s/%s may not hold the data: %s", pvc.Namespace, pvc.Name, problem)
+			}
+			checked = true
+		}
 
 		// Walk owner references to find Deployment or StatefulSet
 		workload, err := d.resolveOwner(ctx, &pod)
@@ -148,6 +521,29 @@ func (d *Discoverer) findWorkload(ctx context.Context, pvc *corev1.PersistentVol
 	return nil, fmt.Errorf("no workload found mounting PVC %q", pvc.Name)
 }
 
+// findHPA returns the name of the HorizontalPodAutoscaler that scales w, or "" if there is
+// none. HPAs are only looked up to warn about them, so a failure to list them (e.g. for
+// lack of RBAC) is logged rather than returned.
+func (d *Discoverer) findHPA(ctx context.Context, w *types.WorkloadInfo) string {
+	hpas, err := d.client.AutoscalingV2().HorizontalPodAutoscalers(w.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		d.logf("Warning: could not list HPAs in %s: %v", w.Namespace, err)
+		return ""
+	}
+	for _, hpa := range hpas.Items {
+		if hpaTargets(&hpa, w) {
+			d.logf("%s/%s is scaled by HPA %s", w.Kind, w.Name, hpa.Name)
+			return hpa.Name
+		}
+	}
+	return ""
+}
+
+func hpaTargets(hpa *autoscalingv2.HorizontalPodAutoscaler, w *types.WorkloadInfo) bool {
+	ref := hpa.Spec.ScaleTargetRef
+	return ref.Kind == w.Kind && ref.Name == w.Name
+}
+
 func podMountsPVC(pod *corev1.Pod, pvcName string) bool {
 	for _, vol := range pod.Spec.Volumes {
 		if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pvcName {
@@ -157,6 +553,51 @@ func podMountsPVC(pod *corev1.Pod, pvcName string) bool {
 	return false
 }
 
+// mountProblems looks for pod specs where the data meant for pvcName lands elsewhere, so a
+// backup of the PVC would miss it: the PVC volume is declared but no container mounts it,
+// or an emptyDir is mounted at or below a container's mount of the PVC and shadows it.
+func mountProblems(pod *corev1.Pod, pvcName string) []string {
+	var pvcVolume string
+	emptyDirs := make(map[string]bool)
+	for _, vol := range pod.Spec.Volumes {
+		switch {
+		case vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pvcName:
+			pvcVolume = vol.Name
+		case vol.EmptyDir != nil:
+			emptyDirs[vol.Name] = true
+		}
+	}
+
+	var problems []string
+	mounted := false
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, c := range containers {
+		for _, m := range c.VolumeMounts {
+			if m.Name != pvcVolume {
+				continue
+			}
+			mounted = true
+			for _, e := range c.VolumeMounts {
+				if !emptyDirs[e.Name] || !pathWithin(e.MountPath, m.MountPath) {
+					continue
+				}
+				problems = append(problems, fmt.Sprintf("container %s of pod %s mounts emptyDir %s at %s, over the PVC at %s; what it writes there is not on the PVC",
+					c.Name, pod.Name, e.Name, e.MountPath, m.MountPath))
+			}
+		}
+	}
+	if !mounted {
+		problems = append(problems, fmt.Sprintf("pod %s declares volume %s for it, but no container mounts it", pod.Name, pvcVolume))
+	}
+	return problems
+}
+
+// pathWithin reports whether path is dir or below it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
 // resolveOwner walks the owner reference chain from a pod to find a Deployment or StatefulSet.
 func (d *Discoverer) resolveOwner(ctx context.Context, pod *corev1.Pod) (*types.WorkloadInfo, error) {
 	ns := pod.Namespace
@@ -1,10 +1,21 @@
 package discovery
 
 import (
+	"bytes"
 	"context"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -45,6 +56,23 @@ func TestResolveHostPath_Local(t *testing.T) {
 	}
 }
 
+func TestResolveHostPath_NFS(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				NFS: &corev1.NFSVolumeSource{
+					Server: "10.0.0.5",
+					Path:   "/exports/shop-data",
+				},
+			},
+		},
+	}
+	got := resolveHostPath(pv)
+	if got != "/exports/shop-data" {
+		t.Errorf("resolveHostPath(NFS) = %q, want %q", got, "/exports/shop-data")
+	}
+}
+
 func TestResolveHostPath_HostPath(t *testing.T) {
 	pv := &corev1.PersistentVolume{
 		Spec: corev1.PersistentVolumeSpec{
@@ -318,7 +346,21 @@ func TestDiscover_FullChain_Deployment(t *testing.T) {
 		},
 	}
 
-	client := fake.NewSimpleClientset(pvc, pv, dep, rs, pod)
+	// Targets a StatefulSet of the same name, so it does not scale the Deployment
+	otherHPA := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: ns},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "StatefulSet", Name: "web-deploy"},
+		},
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-hpa", Namespace: ns},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "web-deploy"},
+		},
+	}
+
+	client := fake.NewSimpleClientset(pvc, pv, dep, rs, pod, otherHPA, hpa)
 	disc := New(client, false)
 
 	results, err := disc.Discover(context.Background(), ns, release)
@@ -342,4 +384,577 @@ func TestDiscover_FullChain_Deployment(t *testing.T) {
 	if info.Workload.OriginalReplicas != 3 {
 		t.Errorf("Workload.OriginalReplicas = %d, want %d", info.Workload.OriginalReplicas, 3)
 	}
+	if info.Workload.HPA != "web-hpa" {
+		t.Errorf("Workload.HPA = %q, want %q", info.Workload.HPA, "web-hpa")
+	}
+}
+
+func TestDiscoverAll_GroupsAcrossNamespaces(t *testing.T) {
+	newPVC := func(ns, name, release, pv string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+				Labels:    map[string]string{"app.kubernetes.io/instance": release},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{VolumeName: pv},
+		}
+	}
+	newPV := func(name string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: "/data/" + name},
+				},
+			},
+		}
+	}
+	unlabelled := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "scratch", Namespace: "alpha"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-scratch"},
+	}
+
+	client := fake.NewSimpleClientset(
+		newPVC("beta", "db-data", "db", "pv-1"),
+		newPVC("alpha", "web-data", "web", "pv-2"),
+		newPVC("alpha", "cache-data", "cache", "pv-3"),
+		unlabelled,
+		newPV("pv-1"), newPV("pv-2"), newPV("pv-3"), newPV("pv-scratch"),
+	)
+	disc := New(client, false)
+
+	results, err := disc.DiscoverAll(context.Background(), "")
+	if err != nil {
+		t.Fatalf("DiscoverAll() error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 PVCs, got %d", len(results))
+	}
+
+	want := []struct{ ns, release, pvc string }{
+		{"alpha", "cache", "cache-data"},
+		{"alpha", "web", "web-data"},
+		{"beta", "db", "db-data"},
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Namespace != w.ns || got.Release != w.release || got.PVCName != w.pvc {
+			t.Errorf("results[%d] = %s/%s/%s, want %s/%s/%s", i, got.Namespace, got.Release, got.PVCName, w.ns, w.release, w.pvc)
+		}
+	}
+
+	results, err = disc.DiscoverAll(context.Background(), "db")
+	if err != nil {
+		t.Fatalf("DiscoverAll(db) error: %v", err)
+	}
+	if len(results) != 1 || results[0].Namespace != "beta" {
+		t.Errorf("DiscoverAll(db) = %+v, want only beta/db-data", results)
+	}
+}
+
+func TestPlanHash(t *testing.T) {
+	workload := func(replicas int32) *types.WorkloadInfo {
+		return &types.WorkloadInfo{Kind: "StatefulSet", Name: "db", Namespace: "ns", OriginalReplicas: replicas}
+	}
+	plan := []types.PVCInfo{
+		{Namespace: "ns", Release: "rel", PVCName: "data", PVName: "pv-1", HostPath: "/data/1", Workload: workload(3)},
+		{Namespace: "ns", Release: "rel", PVCName: "orphan", PVName: "pv-2", HostPath: "/data/2"},
+	}
+	base := PlanHash(plan)
+	if len(base) != 64 {
+		t.Fatalf("PlanHash = %q, want 64 hex characters", base)
+	}
+
+	reordered := []types.PVCInfo{plan[1], plan[0]}
+	if got := PlanHash(reordered); got != base {
+		t.Errorf("hash depends on order: %s != %s", got, base)
+	}
+
+	changes := map[string]func(p []types.PVCInfo) []types.PVCInfo{
+		"replicas": func(p []types.PVCInfo) []types.PVCInfo { p[0].Workload = workload(1); return p },
+		"hostPath": func(p []types.PVCInfo) []types.PVCInfo { p[1].HostPath = "/elsewhere"; return p },
+		"workload": func(p []types.PVCInfo) []types.PVCInfo { p[1].Workload = workload(1); return p },
+		"new PVC": func(p []types.PVCInfo) []types.PVCInfo {
+			return append(p, types.PVCInfo{Namespace: "ns", Release: "rel", PVCName: "new", PVName: "pv-3", HostPath: "/data/3"})
+		},
+	}
+	for name, change := range changes {
+		changed := change(append([]types.PVCInfo(nil), plan...))
+		if PlanHash(changed) == base {
+			t.Errorf("%s: hash did not change", name)
+		}
+	}
+}
+
+func TestSharedHostPaths(t *testing.T) {
+	pvcs := []types.PVCInfo{
+		{Namespace: "ns", PVCName: "a", HostPath: "/data/shared"},
+		{Namespace: "ns", PVCName: "b", HostPath: "/data/own"},
+		{Namespace: "other", PVCName: "c", HostPath: "/data/shared/"},
+		{Namespace: "ns", PVCName: "unbound"},
+		{Namespace: "ns", PVCName: "unbound2"},
+	}
+	shared := SharedHostPaths(pvcs)
+	if len(shared) != 1 || !slices.Equal(shared["/data/shared"], []string{"ns/a", "other/c"}) {
+		t.Fatalf("SharedHostPaths() = %v, want /data/shared -> [ns/a other/c]", shared)
+	}
+	lines := FormatSharedHostPaths(shared)
+	if want := "/data/shared is the host path of ns/a, other/c"; len(lines) != 1 || lines[0] != want {
+		t.Errorf("FormatSharedHostPaths() = %q, want [%q]", lines, want)
+	}
+
+	if shared := SharedHostPaths(pvcs[:2]); len(shared) != 0 {
+		t.Errorf("SharedHostPaths() = %v for distinct paths, want none", shared)
+	}
+}
+
+func TestDiscover_CSIDriver(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "data",
+			Namespace: "ns",
+			Labels:    map[string]string{"app.kubernetes.io/instance": "rel"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-data"},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           "hostpath.csi.k8s.io",
+					VolumeAttributes: map[string]string{"path": "/data/pv-data"},
+				},
+			},
+		},
+	}
+
+	pvcs, err := New(fake.NewSimpleClientset(pvc, pv), false).Discover(context.Background(), "ns", "rel")
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if pvcs[0].CSIDriver != "hostpath.csi.k8s.io" {
+		t.Errorf("CSIDriver = %q, want hostpath.csi.k8s.io", pvcs[0].CSIDriver)
+	}
+}
+
+func TestDiscover_StorageClass(t *testing.T) {
+	pvc := func(name string, class *string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ns",
+				Labels:    map[string]string{"app.kubernetes.io/instance": "rel"},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-" + name, StorageClassName: class},
+		}
+	}
+	pv := func(name string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-" + name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/data/" + name}},
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(pvc("fast", ptr.To("local-ssd")), pv("fast"), pvc("plain", nil), pv("plain"))
+
+	pvcs, err := New(client, false).Discover(context.Background(), "ns", "rel")
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	classes := make(map[string]string)
+	for _, p := range pvcs {
+		classes[p.PVCName] = p.StorageClass
+	}
+	if classes["fast"] != "local-ssd" || classes["plain"] != "" {
+		t.Errorf("storage classes = %v, want fast=local-ssd and plain empty", classes)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "data",
+			Namespace: "ns",
+			Labels:    map[string]string{"app.kubernetes.io/instance": "rel"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-data"},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/data/pv-data"}},
+		},
+	}
+	client := fake.NewSimpleClientset(pvc, pv)
+	d := New(client, false)
+	pvcs, err := d.Discover(ctx, "ns", "rel")
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if err := d.Verify(ctx, pvcs[0]); err != nil {
+		t.Fatalf("Verify() of an unchanged PVC: %v", err)
+	}
+
+	pv.Spec.HostPath.Path = "/data/other"
+	if _, err := client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Verify(ctx, pvcs[0]); err == nil || !strings.Contains(err.Error(), `"/data/other"`) {
+		t.Errorf("Verify() after the path changed = %v, want the new path reported", err)
+	}
+
+	pvc.Spec.VolumeName = "pv-other"
+	if _, err := client.CoreV1().PersistentVolumeClaims("ns").Update(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Verify(ctx, pvcs[0]); err == nil || !strings.Contains(err.Error(), `now bound to PV "pv-other"`) {
+		t.Errorf("Verify() after a rebind = %v, want the new PV reported", err)
+	}
+}
+
+func TestResolvePV(t *testing.T) {
+	ctx := context.Background()
+	released := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-old"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource:        corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/data/pv-old"}},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              "local-path",
+			ClaimRef:                      &corev1.ObjectReference{Namespace: "ns", Name: "data"},
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeReleased},
+	}
+	bound := released.DeepCopy()
+	bound.Name = "pv-live"
+	bound.Status.Phase = corev1.VolumeBound
+	d := New(fake.NewSimpleClientset(released, bound), false)
+
+	info, err := d.ResolvePV(ctx, "ns", "pv-old")
+	if err != nil {
+		t.Fatalf("ResolvePV: %v", err)
+	}
+	want := types.PVCInfo{Namespace: "ns", PVCName: "pv-old", PVName: "pv-old", HostPath: "/data/pv-old", StorageClass: "local-path"}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("ResolvePV() = %+v, want %+v", *info, want)
+	}
+
+	if _, err := d.ResolvePV(ctx, "ns", "pv-live"); err == nil || !strings.Contains(err.Error(), "bound to PVC ns/data") {
+		t.Errorf("ResolvePV() of a bound PV = %v, want it refused", err)
+	}
+	if _, err := d.ResolvePV(ctx, "ns", "pv-missing"); err == nil {
+		t.Error("ResolvePV() of a missing PV succeeded")
+	}
+}
+
+func TestOrdinal(t *testing.T) {
+	db := &types.WorkloadInfo{Kind: "StatefulSet", Name: "db"}
+	tests := []struct {
+		pvc      string
+		workload *types.WorkloadInfo
+		want     int
+		ok       bool
+	}{
+		{"data-db-0", db, 0, true},
+		{"data-db-12", db, 12, true},
+		{"data-my-db-3", &types.WorkloadInfo{Kind: "StatefulSet", Name: "my-db"}, 3, true},
+		{"data-db-01", db, 0, false},
+		{"data-db-+1", db, 0, false},
+		{"data-db", db, 0, false},
+		{"data-other-0", db, 0, false},
+		{"data-db-0", &types.WorkloadInfo{Kind: "Deployment", Name: "db"}, 0, false},
+		{"data-db-0", nil, 0, false},
+	}
+	for _, tc := range tests {
+		got, ok := Ordinal(types.PVCInfo{PVCName: tc.pvc, Workload: tc.workload})
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Ordinal(%s, %+v) = %d, %v; want %d, %v", tc.pvc, tc.workload, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestPinnedNode(t *testing.T) {
+	affinity := func(values ...string) *corev1.VolumeNodeAffinity {
+		return &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      corev1.LabelHostname,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   values,
+				}},
+			}},
+		}}
+	}
+	tests := []struct {
+		name     string
+		affinity *corev1.VolumeNodeAffinity
+		want     string
+	}{
+		{"pinned", affinity("node-1"), "node-1"},
+		{"no affinity", nil, ""},
+		{"several nodes", affinity("node-1", "node-2"), ""},
+	}
+	for _, tt := range tests {
+		pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{NodeAffinity: tt.affinity}}
+		if got := pinnedNode(pv); got != tt.want {
+			t.Errorf("%s: pinnedNode() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMountProblems(t *testing.T) {
+	volumes := []corev1.Volume{
+		{Name: "data", VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "db-data"},
+		}},
+		{Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	}
+	pod := func(mounts ...corev1.VolumeMount) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-0"},
+			Spec: corev1.PodSpec{
+				Volumes:    volumes,
+				Containers: []corev1.Container{{Name: "db", VolumeMounts: mounts}},
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		expect string
+	}{
+		{"PVC mounted", pod(
+			corev1.VolumeMount{Name: "data", MountPath: "/var/lib/db"},
+			corev1.VolumeMount{Name: "scratch", MountPath: "/tmp"},
+		), ""},
+		{"emptyDir beside a similar path", pod(
+			corev1.VolumeMount{Name: "data", MountPath: "/data"},
+			corev1.VolumeMount{Name: "scratch", MountPath: "/database"},
+		), ""},
+		{"emptyDir below the PVC", pod(
+			corev1.VolumeMount{Name: "data", MountPath: "/var/lib/db"},
+			corev1.VolumeMount{Name: "scratch", MountPath: "/var/lib/db/pgdata/"},
+		), "mounts emptyDir scratch at /var/lib/db/pgdata/, over the PVC at /var/lib/db"},
+		{"PVC never mounted", pod(
+			corev1.VolumeMount{Name: "scratch", MountPath: "/var/lib/db"},
+		), "declares volume data for it, but no container mounts it"},
+	}
+	for _, tt := range tests {
+		problems := mountProblems(tt.pod, "db-data")
+		switch {
+		case tt.expect == "" && len(problems) > 0:
+			t.Errorf("%s: mountProblems() = %q, want none", tt.name, problems)
+		case tt.expect != "" && (len(problems) != 1 || !strings.Contains(problems[0], tt.expect)):
+			t.Errorf("%s: mountProblems() = %q, want %q", tt.name, problems, tt.expect)
+		}
+	}
+}
+
+func TestDiscover_WarnsAboutEmptyDirOverPVC(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-data",
+			Namespace: "default",
+			Labels:    map[string]string{"app.kubernetes.io/instance": "db"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{VolumeName: "pv-db"},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-db"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/mnt/db"},
+			},
+		},
+	}
+	// A chart bug: the database writes to an emptyDir mounted over its data directory
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "db-data"},
+				}},
+				{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+			Containers: []corev1.Container{{
+				Name: "postgres",
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "data", MountPath: "/var/lib/postgresql"},
+					{Name: "cache", MountPath: "/var/lib/postgresql"},
+				},
+			}},
+		},
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	if _, err := New(fake.NewSimpleClientset(pvc, pv, pod), false).Discover(context.Background(), "default", "db"); err != nil {
+		t.Fatalf("Discover() error: %v", err)
+	}
+	if want := "WARNING: PVC default/db-data may not hold the data: container postgres of pod db-0 mounts emptyDir cache"; !strings.Contains(buf.String(), want) {
+		t.Errorf("log lacks %q:\n%s", want, buf.String())
+	}
+}
+
+func TestDiscover_LabelKeys(t *testing.T) {
+	newPVC := func(name string, labels map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns", Labels: labels},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-" + name},
+		}
+	}
+	newPV := func(name string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-" + name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: "/data/" + name},
+				},
+			},
+		}
+	}
+	// A chart upgrade left the release labelled two ways; "both" carries both labels
+	client := fake.NewSimpleClientset(
+		newPVC("new", map[string]string{"app.kubernetes.io/instance": "shop"}),
+		newPVC("old", map[string]string{"release": "shop"}),
+		newPVC("both", map[string]string{"app.kubernetes.io/instance": "shop", "release": "shop"}),
+		newPVC("other", map[string]string{"release": "blog"}),
+		newPV("new"), newPV("old"), newPV("both"), newPV("other"),
+	)
+
+	names := func(pvcs []types.PVCInfo) []string {
+		var names []string
+		for _, pvc := range pvcs {
+			names = append(names, pvc.PVCName)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	// The default key alone misses the PVC labelled the old way
+	pvcs, err := New(client, false).Discover(context.Background(), "ns", "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(pvcs); !slices.Equal(got, []string{"both", "new"}) {
+		t.Errorf("default key found %v, want [both new]", got)
+	}
+
+	// A single key replaces the default, for platforms that never set it
+	pvcs, err = New(client, false, WithLabelKeys("release")).Discover(context.Background(), "ns", "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(pvcs); !slices.Equal(got, []string{"both", "old"}) {
+		t.Errorf("release key found %v, want [both old]", got)
+	}
+
+	disc := New(client, false, WithLabelKeys("app.kubernetes.io/instance", "release"))
+	pvcs, err = disc.Discover(context.Background(), "ns", "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(pvcs); !slices.Equal(got, []string{"both", "new", "old"}) {
+		t.Errorf("both keys found %v, want [both new old], each once", got)
+	}
+
+	all, err := disc.DiscoverAll(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases := make(map[string]string)
+	for _, pvc := range all {
+		releases[pvc.PVCName] = pvc.Release
+	}
+	if want := map[string]string{"new": "shop", "old": "shop", "both": "shop", "other": "blog"}; !maps.Equal(releases, want) {
+		t.Errorf("DiscoverAll releases = %v, want %v", releases, want)
+	}
+}
+
+func TestDiscover_VolumeClaimTemplatePVCsWithoutLabel(t *testing.T) {
+	ns := "test-ns"
+	newPVC := func(name, pv string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: pv},
+		}
+	}
+	newPV := func(name string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: "/data/" + name},
+				},
+			},
+		}
+	}
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-app",
+			Namespace: ns,
+			Labels:    map[string]string{"app.kubernetes.io/instance": "my-app"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: ptr.To(int32(1)),
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{ObjectMeta: metav1.ObjectMeta{Name: "data"}},
+			},
+		},
+	}
+	// Another release's StatefulSet with a similar name must not claim anything
+	other := ss.DeepCopy()
+	other.Name, other.Labels = "other", map[string]string{"app.kubernetes.io/instance": "other"}
+
+	labelled := newPVC("config", "pv-config")
+	labelled.Labels = map[string]string{"app.kubernetes.io/instance": "my-app"}
+	client := fake.NewSimpleClientset(ss, other, labelled,
+		newPVC("data-my-app-0", "pv-0"),
+		newPVC("data-my-app-1", "pv-1"), // ordinal 1 is scaled away: no pod mounts it
+		newPVC("data-my-app-01", "pv-x"),
+		newPVC("data-my-app-backup", "pv-x"),
+		newPVC("data-other-0", "pv-x"),
+		newPV("pv-config"), newPV("pv-0"), newPV("pv-1"),
+	)
+
+	results, err := New(client, false).Discover(context.Background(), ns, "my-app")
+	if err != nil {
+		t.Fatalf("Discover() error: %v", err)
+	}
+	var names []string
+	for _, info := range results {
+		names = append(names, info.PVCName)
+		if info.PVCName == "config" {
+			continue
+		}
+		if w := info.Workload; w == nil || w.Kind != "StatefulSet" || w.Name != "my-app" || w.OriginalReplicas != 1 {
+			t.Errorf("%s workload = %+v, want StatefulSet/my-app", info.PVCName, w)
+		}
+		if n, ok := Ordinal(info); !ok || info.PVCName != "data-my-app-"+strconv.Itoa(n) {
+			t.Errorf("Ordinal(%s) = %d, %v", info.PVCName, n, ok)
+		}
+	}
+	if want := []string{"config", "data-my-app-0", "data-my-app-1"}; !slices.Equal(names, want) {
+		t.Errorf("PVCs = %v, want %v", names, want)
+	}
+
+	// Cluster-wide, the unlabelled PVCs take the StatefulSet's release
+	all, err := New(client, false).DiscoverAll(context.Background(), "my-app")
+	if err != nil {
+		t.Fatalf("DiscoverAll() error: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("DiscoverAll() found %d PVC(s), want 3", len(all))
+	}
+	for _, info := range all {
+		if info.Release != "my-app" {
+			t.Errorf("%s release = %q, want my-app", info.PVCName, info.Release)
+		}
+	}
 }
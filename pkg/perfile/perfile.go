@@ -0,0 +1,435 @@
+// Package perfile stores a volume as one gzip-compressed object per file instead of a
+// single archive. A snapshot is every object under a prefix plus a manifest, written last,
+// that records the directories, symlinks, permissions and modification times the objects
+// cannot carry. It is an alternative storage layout to the archives of package backup and
+// shares nothing with it but the destination. With UploadDedup, files are instead stored
+// once, content-addressed, under BlobPrefix, and shared by every snapshot holding them.
+package perfile
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+// ManifestName is the key, below the snapshot prefix, of the manifest. A snapshot without
+// one was interrupted and is not restorable.
+const ManifestName = "k8s-cf-backup-manifest.json"
+
+// FileSuffix is appended to the key of every file object, which holds the file gzipped.
+const FileSuffix = ".gz"
+
+// BlobPrefix is the key prefix of the file objects UploadDedup stores, each named after the
+// hex SHA-256 of the file's content plus FileSuffix.
+const BlobPrefix = "blobs/sha256/"
+
+// Entry types in a Manifest.
+const (
+	TypeDir     = "dir"
+	TypeFile    = "file"
+	TypeSymlink = "symlink"
+)
+
+// Store is the part of a destination a snapshot needs. store.Store satisfies it.
+type Store interface {
+	Upload(ctx context.Context, localPath, key string) error
+	Download(ctx context.Context, key, destPath string) error
+	ListByPrefix(ctx context.Context, prefix string) ([]r2.ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Entry is one directory, file or symlink of a snapshot.
+type Entry struct {
+	Path    string      `json:"path"` // slash-separated, relative to the volume root
+	Type    string      `json:"type"`
+	Mode    fs.FileMode `json:"mode"` // permission bits
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+	Link    string      `json:"link,omitempty"` // symlink target
+	Blob    string      `json:"blob,omitempty"` // key of the shared object holding a deduplicated file
+}
+
+// fileKey returns the key of the object holding the file e of the snapshot under prefix.
+func fileKey(prefix string, e Entry) string {
+	if e.Blob != "" {
+		return e.Blob
+	}
+	return prefix + e.Path + FileSuffix
+}
+
+// Manifest lists the entries of a snapshot, parents before their children.
+type Manifest struct {
+	Entries []Entry `json:"entries"`
+}
+
+// IsManifest reports whether key is the manifest of a snapshot.
+func IsManifest(key string) bool {
+	return path.Base(key) == ManifestName
+}
+
+// Prefix returns the snapshot prefix of a manifest key.
+func Prefix(manifestKey string) string {
+	return strings.TrimSuffix(manifestKey, ManifestName)
+}
+
+// Upload stores the tree at srcDir under prefix, which should end in "/", and returns the
+// number of bytes stored. Files are uploaded one by one and the manifest last, so an
+// interrupted upload leaves no manifest behind. Entries other than directories, regular
+// files and symlinks (sockets, devices) are skipped.
+func Upload(ctx context.Context, s Store, srcDir, prefix string, verbose bool) (int64, error) {
+	return upload(ctx, s, srcDir, prefix, nil, verbose)
+}
+
+// UploadDedup is Upload with every file stored under BlobPrefix by the SHA-256 of its
+// content instead of under prefix. A file whose blob is already stored, by this or any
+// other snapshot, is not uploaded again, so the returned size only counts new blobs and
+// the manifest. Deleting the snapshot leaves its blobs in place.
+func UploadDedup(ctx context.Context, s Store, srcDir, prefix string, verbose bool) (int64, error) {
+	objects, err := s.ListByPrefix(ctx, BlobPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("listing blobs: %w", err)
+	}
+	blobs := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		blobs[obj.Key] = true
+	}
+	return upload(ctx, s, srcDir, prefix, blobs, verbose)
+}
+
+// upload implements Upload, and UploadDedup when blobs, the set of blob keys already
+// stored, is not nil.
+func upload(ctx context.Context, s Store, srcDir, prefix string, blobs map[string]bool, verbose bool) (int64, error) {
+	var m Manifest
+	var stored int64
+	err := filepath.WalkDir(srcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == srcDir {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := Entry{Path: filepath.ToSlash(rel), Mode: info.Mode().Perm(), ModTime: info.ModTime()}
+
+		switch {
+		case info.IsDir():
+			e.Type = TypeDir
+		case info.Mode()&fs.ModeSymlink != 0:
+			e.Type = TypeSymlink
+			if e.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			e.Type, e.Size = TypeFile, info.Size()
+			if blobs != nil {
+				sum, err := fileSHA256(p)
+				if err != nil {
+					return fmt.Errorf("hashing %s: %w", e.Path, err)
+				}
+				e.Blob = BlobPrefix + sum + FileSuffix
+				if blobs[e.Blob] {
+					logf(verbose, "Reusing %s for %s", e.Blob, e.Path)
+					break
+				}
+				blobs[e.Blob] = true
+			}
+			n, err := uploadFile(ctx, s, p, fileKey(prefix, e))
+			if err != nil {
+				return fmt.Errorf("uploading %s: %w", e.Path, err)
+			}
+			stored += n
+			logf(verbose, "Uploaded %s (%d bytes)", e.Path, n)
+		default:
+			logf(verbose, "Skipping %s: not a regular file, directory or symlink", e.Path)
+			return nil
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return stored, err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return stored, err
+	}
+	n, err := uploadBytes(ctx, s, data, prefix+ManifestName)
+	if err != nil {
+		return stored, fmt.Errorf("uploading manifest: %w", err)
+	}
+	return stored + n, nil
+}
+
+// uploadFile gzips the file at p into a temporary file and uploads that to key, returning
+// the compressed size.
+func uploadFile(ctx context.Context, s Store, p, key string) (int64, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-perfile-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := gzip.NewWriter(tmp)
+	if _, err := io.Copy(zw, src); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return size, s.Upload(ctx, tmp.Name(), key)
+}
+
+// fileSHA256 returns the hex SHA-256 of the content of the file at p.
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func uploadBytes(ctx context.Context, s Store, data []byte, key string) (int64, error) {
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-perfile-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), s.Upload(ctx, tmp.Name(), key)
+}
+
+// ReadManifest downloads and parses the manifest of the snapshot under prefix, rejecting
+// entries whose paths would land outside the volume.
+func ReadManifest(ctx context.Context, s Store, prefix string) (Manifest, error) {
+	var m Manifest
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-perfile-*")
+	if err != nil {
+		return m, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := s.Download(ctx, prefix+ManifestName, tmp.Name()); err != nil {
+		return m, fmt.Errorf("downloading manifest: %w", err)
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("parsing manifest: %w", err)
+	}
+	for _, e := range m.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return m, fmt.Errorf("manifest entry %q escapes the target directory", e.Path)
+		}
+		switch e.Type {
+		case TypeDir, TypeFile, TypeSymlink:
+		default:
+			return m, fmt.Errorf("manifest entry %q has unknown type %q", e.Path, e.Type)
+		}
+		if e.Blob != "" && (e.Type != TypeFile || !strings.HasPrefix(e.Blob, BlobPrefix)) {
+			return m, fmt.Errorf("manifest entry %q has blob %q outside %s", e.Path, e.Blob, BlobPrefix)
+		}
+	}
+	return m, nil
+}
+
+// Restore replaces the contents of dstDir with the snapshot under prefix and returns the
+// number and total size of the files it wrote. The manifest is read before anything is
+// cleared, so a missing or broken snapshot leaves dstDir intact.
+func Restore(ctx context.Context, s Store, prefix, dstDir string, verbose bool) (int, int64, error) {
+	m, err := ReadManifest(ctx, s, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	entries, err := os.ReadDir(dstDir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading target dir: %w", err)
+	}
+	for _, entry := range entries {
+		logf(verbose, "Removing %s", filepath.Join(dstDir, entry.Name()))
+		if err := os.RemoveAll(filepath.Join(dstDir, entry.Name())); err != nil {
+			return 0, 0, fmt.Errorf("clearing %s: %w", entry.Name(), err)
+		}
+	}
+
+	var files int
+	var size int64
+	var dirs []Entry
+	for _, e := range m.Entries {
+		if err := ctx.Err(); err != nil {
+			return files, size, err
+		}
+		target := filepath.Join(dstDir, filepath.FromSlash(e.Path))
+		switch e.Type {
+		case TypeDir:
+			// Permissions are applied once the directory is filled, in case it is read-only
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return files, size, err
+			}
+			dirs = append(dirs, e)
+		case TypeSymlink:
+			if err := os.Symlink(e.Link, target); err != nil {
+				return files, size, err
+			}
+		case TypeFile:
+			if err := downloadFile(ctx, s, fileKey(prefix, e), target, e); err != nil {
+				return files, size, fmt.Errorf("restoring %s: %w", e.Path, err)
+			}
+			files++
+			size += e.Size
+		}
+	}
+
+	// Children first, so setting a parent's time is not undone by changes below it
+	for _, e := range slices.Backward(dirs) {
+		target := filepath.Join(dstDir, filepath.FromSlash(e.Path))
+		if err := os.Chmod(target, e.Mode); err != nil {
+			return files, size, err
+		}
+		if err := os.Chtimes(target, e.ModTime, e.ModTime); err != nil {
+			return files, size, err
+		}
+	}
+	return files, size, nil
+}
+
+// downloadFile fetches the gzipped object at key and writes it uncompressed to target with
+// the permissions and modification time of e.
+func downloadFile(ctx context.Context, s Store, key, target string, e Entry) error {
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-perfile-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := s.Download(ctx, key, tmp.Name()); err != nil {
+		return err
+	}
+	src, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, zr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != e.Size {
+		return fmt.Errorf("object holds %d bytes, manifest says %d", n, e.Size)
+	}
+	// OpenFile is subject to the umask
+	if err := os.Chmod(target, e.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, e.ModTime, e.ModTime)
+}
+
+// Delete removes the snapshot under prefix and returns the keys it deleted. The manifest
+// goes first, so a snapshot that is only partly deleted is no longer offered for restore.
+// The objects it names are deleted along with whatever else is listed under prefix, since
+// some stores leave dotfiles out of listings. Blobs may be shared with other snapshots and
+// are never deleted.
+func Delete(ctx context.Context, s Store, prefix string) ([]string, error) {
+	keys := []string{prefix + ManifestName}
+	seen := map[string]bool{keys[0]: true}
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	// An interrupted snapshot has no manifest; the listing still finds its objects
+	if m, err := ReadManifest(ctx, s, prefix); err == nil {
+		for _, e := range m.Entries {
+			if e.Type == TypeFile && e.Blob == "" {
+				add(prefix + e.Path + FileSuffix)
+			}
+		}
+	}
+	objects, err := s.ListByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		add(obj.Key)
+	}
+
+	var deleted []string
+	for _, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			return deleted, fmt.Errorf("deleting %s: %w", key, err)
+		}
+		deleted = append(deleted, key)
+	}
+	return deleted, nil
+}
+
+func logf(verbose bool, format string, args ...interface{}) {
+	if verbose {
+		log.Printf("[perfile] "+format, args...)
+	}
+}
@@ -0,0 +1,275 @@
+package perfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+// dirStore is a minimal Store keeping objects as files below a directory.
+type dirStore struct{ root string }
+
+func (s dirStore) path(key string) string { return filepath.Join(s.root, filepath.FromSlash(key)) }
+
+func (s dirStore) Upload(ctx context.Context, localPath, key string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path(key)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(key), data, 0644)
+}
+
+func (s dirStore) Download(ctx context.Context, key, destPath string) error {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(destPath, data, 0644)
+}
+
+func (s dirStore) ListByPrefix(ctx context.Context, prefix string) ([]r2.ObjectInfo, error) {
+	var objects []r2.ObjectInfo
+	err := filepath.WalkDir(s.root, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(s.root, p)
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			objects = append(objects, r2.ObjectInfo{Key: key})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (s dirStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s dirStore) keys(t *testing.T) []string {
+	t.Helper()
+	objects, err := s.ListByPrefix(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func writeTree(t *testing.T) string {
+	t.Helper()
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "secret"), []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "sub", "secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/secret", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestUploadRestore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := dirStore{t.TempDir()}
+	src := writeTree(t)
+
+	if _, err := Upload(ctx, s, src, "snap/", false); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	want := []string{"snap/a.txt.gz", "snap/" + ManifestName, "snap/sub/secret.gz"}
+	if got := s.keys(t); !slices.Equal(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, "stale"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, size, err := Restore(ctx, s, "snap/", dst, false)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if files != 2 || size != 11 {
+		t.Errorf("Restore() = %d file(s), %d bytes; want 2, 11", files, size)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "stale")); !os.IsNotExist(err) {
+		t.Errorf("stale file survived the restore: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "link")); err != nil || string(data) != "s3cret" {
+		t.Errorf("link reads %q, %v; want s3cret", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "sub", "secret")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("sub/secret = %v, %v; want mode 0600", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "sub", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("sub/empty = %v, %v; want a directory", info, err)
+	}
+}
+
+func TestRestore_NoManifestKeepsTarget(t *testing.T) {
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Restore(context.Background(), dirStore{t.TempDir()}, "missing/", dst, false); err == nil {
+		t.Fatal("Restore succeeded without a manifest")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "keep")); err != nil {
+		t.Errorf("target was cleared: %v", err)
+	}
+}
+
+func TestReadManifest_RejectsEscapingPaths(t *testing.T) {
+	s := dirStore{t.TempDir()}
+	manifest := filepath.Join(t.TempDir(), ManifestName)
+	if err := os.WriteFile(manifest, []byte(`{"entries":[{"path":"../evil","type":"file"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Upload(context.Background(), manifest, "snap/"+ManifestName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(context.Background(), s, "snap/"); err == nil || !strings.Contains(err.Error(), "escapes") {
+		t.Errorf("ReadManifest() error = %v, want an escaping path", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	s := dirStore{t.TempDir()}
+	src := writeTree(t)
+	for _, prefix := range []string{"old/", "new/"} {
+		if _, err := Upload(ctx, s, src, prefix, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := Delete(ctx, s, "old/")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(deleted) != 3 || deleted[0] != "old/"+ManifestName {
+		t.Errorf("deleted = %v, want the manifest first and 3 keys", deleted)
+	}
+	for _, key := range s.keys(t) {
+		if !strings.HasPrefix(key, "new/") {
+			t.Errorf("%s left behind", key)
+		}
+	}
+}
+
+func TestIsManifest(t *testing.T) {
+	if !IsManifest("ns/rel/data/20240101-000000/" + ManifestName) {
+		t.Error("manifest key not recognised")
+	}
+	if IsManifest("snap/" + ManifestName + FileSuffix) {
+		t.Error("file object taken for a manifest")
+	}
+	if got := Prefix("a/b/" + ManifestName); got != "a/b/" {
+		t.Errorf("Prefix() = %q, want a/b/", got)
+	}
+}
+
+func TestUploadDedup_ReusesBlobs(t *testing.T) {
+	ctx := context.Background()
+	s := dirStore{t.TempDir()}
+	first := writeTree(t)
+	second := writeTree(t)
+	if err := os.WriteFile(filepath.Join(second, "b.txt"), []byte("only in the second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UploadDedup(ctx, s, first, "one/", false); err != nil {
+		t.Fatalf("UploadDedup(first): %v", err)
+	}
+	blobs := func() []string {
+		var keys []string
+		for _, key := range s.keys(t) {
+			if strings.HasPrefix(key, BlobPrefix) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	if got := blobs(); len(got) != 2 {
+		t.Fatalf("blobs after the first backup = %v, want 2", got)
+	}
+	stored, err := UploadDedup(ctx, s, second, "two/", false)
+	if err != nil {
+		t.Fatalf("UploadDedup(second): %v", err)
+	}
+	if got := blobs(); len(got) != 3 {
+		t.Errorf("blobs after the second backup = %v, want only b.txt added", got)
+	}
+	m, err := ReadManifest(ctx, s, "two/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(m.Entries, func(e Entry) bool { return e.Path == "b.txt" })
+	blob, err := os.Stat(s.path(m.Entries[i].Blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := os.Stat(s.path("two/" + ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != blob.Size()+manifest.Size() {
+		t.Errorf("second backup stored %d bytes, want only the manifest and the new blob", stored)
+	}
+	for _, key := range s.keys(t) {
+		if strings.HasPrefix(key, "two/") && key != "two/"+ManifestName {
+			t.Errorf("%s stored outside the blobs", key)
+		}
+	}
+
+	// Deleting the first snapshot keeps the blobs the second still needs
+	if _, err := Delete(ctx, s, "one/"); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	files, _, err := Restore(ctx, s, "two/", dst, false)
+	if err != nil || files != 3 {
+		t.Fatalf("Restore() = %d file(s), %v; want 3", files, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "sub", "secret")); err != nil || string(data) != "s3cret" {
+		t.Errorf("sub/secret reads %q, %v; want s3cret", data, err)
+	}
+}
+
+func TestReadManifest_RejectsForeignBlobs(t *testing.T) {
+	s := dirStore{t.TempDir()}
+	manifest := filepath.Join(t.TempDir(), ManifestName)
+	if err := os.WriteFile(manifest, []byte(`{"entries":[{"path":"a","type":"file","blob":"ns/rel/other.tar.gz"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Upload(context.Background(), manifest, "snap/"+ManifestName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(context.Background(), s, "snap/"); err == nil || !strings.Contains(err.Error(), "outside "+BlobPrefix) {
+		t.Errorf("ReadManifest() error = %v, want a blob outside %s", err, BlobPrefix)
+	}
+}
@@ -0,0 +1,70 @@
+package r2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// LatestName is the name of the pointer object a backup leaves next to a release's
+// archives.
+const LatestName = "latest.json"
+
+// Latest points at the newest verified backup of each PVC of a release, so restore does
+// not have to trust LastModified, which clock skew or a stub left by an interrupted
+// upload can get wrong.
+type Latest struct {
+	PVCs    map[string]string `json:"pvcs"` // PVC name -> archive key
+	Updated time.Time         `json:"updated"`
+}
+
+// Marshal encodes l as the pointer object's content.
+func (l Latest) Marshal() ([]byte, error) {
+	return json.MarshalIndent(l, "", "  ")
+}
+
+// ParseLatest decodes the content of a pointer object.
+func ParseLatest(data []byte) (*Latest, error) {
+	var l Latest
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", LatestName, err)
+	}
+	return &l, nil
+}
+
+// SetLatest writes the pointer object at key, replacing any earlier one.
+func (c *Client) SetLatest(ctx context.Context, key string, latest Latest) error {
+	data, err := latest.Marshal()
+	if err != nil {
+		return err
+	}
+	c.logf("Updating r2://%s/%s", c.bucket, key)
+	if _, err := c.mc.PutObject(ctx, c.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	}); err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetLatest reads the pointer object at key. It returns nil when there is none yet.
+func (c *Client) GetLatest(ctx context.Context, key string) (*Latest, error) {
+	r, err := c.mc.OpenObject(ctx, c.bucket, key, 0, "")
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	return ParseLatest(data)
+}
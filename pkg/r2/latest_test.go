@@ -0,0 +1,39 @@
+package r2
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatest_SetAndGet(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeBucket()
+	c := newFakeClient(f)
+	key := "ns/rel/" + LatestName
+
+	if got, err := c.GetLatest(ctx, key); err != nil || got != nil {
+		t.Fatalf("GetLatest before any backup = %+v, %v; want nil", got, err)
+	}
+
+	updated := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := c.SetLatest(ctx, key, Latest{PVCs: map[string]string{"data": "ns/rel/a.tar.gz"}, Updated: updated}); err != nil {
+		t.Fatalf("SetLatest: %v", err)
+	}
+	if err := c.SetLatest(ctx, key, Latest{PVCs: map[string]string{"data": "ns/rel/b.tar.gz"}, Updated: updated}); err != nil {
+		t.Fatalf("SetLatest: %v", err)
+	}
+	got, err := c.GetLatest(ctx, key)
+	if err != nil {
+		t.Fatalf("GetLatest: %v", err)
+	}
+	if got.PVCs["data"] != "ns/rel/b.tar.gz" || !got.Updated.Equal(updated) {
+		t.Errorf("GetLatest = %+v, want data -> ns/rel/b.tar.gz", got)
+	}
+}
+
+func TestParseLatest_Rejects(t *testing.T) {
+	if _, err := ParseLatest([]byte("not json")); err == nil {
+		t.Error("ParseLatest(not json) succeeded")
+	}
+}
@@ -4,21 +4,29 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 // Credentials holds Cloudflare R2 authentication details.
 type Credentials struct {
-	AccountID      string `json:"account_id"`
-	AccessKeyID    string `json:"access_key_id"`
+	AccountID       string `json:"account_id"`
+	AccessKeyID     string `json:"access_key_id"`
 	SecretAccessKey string `json:"secret_access_key"`
-	Bucket         string `json:"bucket"`
+	Bucket          string `json:"bucket"`
+	// SessionToken goes with temporary (STS-style) keys; static keys have none.
+	SessionToken string `json:"session_token,omitempty"`
+	// Endpoint points at another S3-compatible store, such as MinIO or Ceph RGW, as
+	// host[:port] or an http(s):// URL. AccountID is not needed with it.
+	Endpoint string `json:"endpoint,omitempty"`
 }
 
 // ObjectInfo describes an object in R2.
@@ -26,13 +34,147 @@ type ObjectInfo struct {
 	Key          string
 	Size         int64
 	LastModified time.Time
+	SHA256       string    // from object metadata; only set by Stat
+	Labels       Labels    // from object metadata; only set by Stat
+	RetainUntil  time.Time // object-lock retention; only set by Stat
+	LegalHold    bool      // object-lock legal hold; only set by Stat
 }
 
+// Locked reports whether object lock keeps the object from being deleted at now.
+func (o ObjectInfo) Locked(now time.Time) bool {
+	return o.LegalHold || o.RetainUntil.After(now)
+}
+
+// Labels record which PVC an archive was taken of, as object metadata. They survive a
+// release rename, which changes the keys new backups are written under.
+type Labels struct {
+	Namespace string
+	Release   string
+	PVC       string
+}
+
+// IsZero reports whether l records nothing, as for archives uploaded without labels.
+func (l Labels) IsZero() bool {
+	return l == Labels{}
+}
+
+// metadata returns the object metadata that records l, leaving out empty labels.
+func (l Labels) metadata() map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range map[string]string{
+		namespaceMetadataKey: l.Namespace,
+		releaseMetadataKey:   l.Release,
+		pvcMetadataKey:       l.PVC,
+	} {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// ChecksumMode selects where the SHA-256 of an uploaded archive is recorded.
+type ChecksumMode string
+
+const (
+	ChecksumNone     ChecksumMode = "none"
+	ChecksumSidecar  ChecksumMode = "sidecar"  // separate <key>.sha256 object
+	ChecksumMetadata ChecksumMode = "metadata" // x-amz-meta-sha256 on the archive object
+	ChecksumEmbedded ChecksumMode = "embedded" // manifest inside the archive; nothing extra in R2
+)
+
+// SidecarSuffix is appended to an archive key to name its checksum sidecar object.
+const SidecarSuffix = ".sha256"
+
+const checksumMetadataKey = "Sha256"
+
+// Metadata keys of the Labels, in the canonical case S3 returns them in.
+const (
+	namespaceMetadataKey = "Namespace"
+	releaseMetadataKey   = "Release"
+	pvcMetadataKey       = "Pvc"
+)
+
+// ParseChecksumMode validates a --checksum-mode value.
+func ParseChecksumMode(s string) (ChecksumMode, error) {
+	switch m := ChecksumMode(s); m {
+	case ChecksumNone, ChecksumSidecar, ChecksumMetadata, ChecksumEmbedded:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid checksum mode %q (want none, sidecar, metadata or embedded)", s)
+}
+
+// IsSidecar reports whether key names a checksum sidecar rather than an archive.
+func IsSidecar(key string) bool {
+	return strings.HasSuffix(key, SidecarSuffix)
+}
+
+// SidecarSum returns the SHA-256 in the content of a checksum sidecar, the first field of
+// its "<hex>  <file name>" line, or "" when it is empty.
+func SidecarSum(data []byte) string {
+	if fields := strings.Fields(string(data)); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// objectAPI is the subset of *minio.Client used by Client, so tests can substitute it.
+type objectAPI interface {
+	FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error
+	CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error)
+	// OpenObject starts reading an object at offset, failing if its ETag no longer matches
+	// etag (unless empty). *minio.Object cannot be faked, hence not GetObject.
+	OpenObject(ctx context.Context, bucketName, objectName string, offset int64, etag string) (io.ReadCloser, error)
+}
+
+// minioAPI is the objectAPI of a real *minio.Client.
+type minioAPI struct{ *minio.Client }
+
+// OpenObject calls GetObject, which is lazy, and Stat to send the request, so a missing
+// object fails here rather than on the first Read.
+func (m minioAPI) OpenObject(ctx context.Context, bucketName, objectName string, offset int64, etag string) (io.ReadCloser, error) {
+	var opts minio.GetObjectOptions
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	if etag != "" {
+		if err := opts.SetMatchETag(etag); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := m.GetObject(ctx, bucketName, objectName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+const (
+	downloadAttempts   = 5
+	downloadRetryDelay = time.Second
+)
+
 // Client wraps a minio client configured for Cloudflare R2.
 type Client struct {
-	mc      *minio.Client
-	bucket  string
-	verbose bool
+	mc               objectAPI
+	endpoint         string
+	bucket           string
+	accessKeyID      string
+	verbose          bool
+	downloadAttempts int
+	retryDelay       time.Duration // before the first resumed attempt; doubles after each
+	lockDays         int           // object-lock retention of uploads; 0 = none
+	archiveSuffix    string        // trimmed from keys before picking their content type
 }
 
 // LoadCredentials reads and validates R2 credentials from a JSON file.
@@ -41,7 +183,11 @@ func LoadCredentials(path string) (*Credentials, error) {
 	if err != nil {
 		return nil, fmt.Errorf("reading credentials file: %w", err)
 	}
+	return ParseCredentials(data)
+}
 
+// ParseCredentials parses and validates credentials JSON, as found in a --r2-credentials file.
+func ParseCredentials(data []byte) (*Credentials, error) {
 	var creds Credentials
 	if err := json.Unmarshal(data, &creds); err != nil {
 		return nil, fmt.Errorf("parsing credentials JSON: %w", err)
@@ -53,8 +199,38 @@ func LoadCredentials(path string) (*Credentials, error) {
 	return &creds, nil
 }
 
+// CredentialsFromSecretData reads credentials from the data of a Kubernetes Secret. The
+// Secret either has one key per field (account_id, access_key_id, secret_access_key,
+// bucket and optionally session_token and endpoint) or a single key holding the same JSON as a
+// --r2-credentials file.
+func CredentialsFromSecretData(data map[string][]byte) (*Credentials, error) {
+	creds := Credentials{
+		AccountID:       string(data["account_id"]),
+		AccessKeyID:     string(data["access_key_id"]),
+		SecretAccessKey: string(data["secret_access_key"]),
+		Bucket:          string(data["bucket"]),
+		SessionToken:    string(data["session_token"]),
+		Endpoint:        string(data["endpoint"]),
+	}
+	if creds != (Credentials{}) {
+		if err := creds.validate(); err != nil {
+			return nil, err
+		}
+		return &creds, nil
+	}
+
+	if len(data) != 1 {
+		return nil, fmt.Errorf("credentials: secret needs the keys account_id, access_key_id, secret_access_key and bucket, or a single key with credentials JSON")
+	}
+	var raw []byte
+	for _, v := range data {
+		raw = v
+	}
+	return ParseCredentials(raw)
+}
+
 func (c *Credentials) validate() error {
-	if c.AccountID == "" {
+	if c.AccountID == "" && c.Endpoint == "" {
 		return fmt.Errorf("credentials: account_id is required")
 	}
 	if c.AccessKeyID == "" {
@@ -69,28 +245,179 @@ func (c *Credentials) validate() error {
 	return nil
 }
 
+// endpoint returns the host[:port] creds connect to and whether to use TLS: the R2
+// endpoint of their account, or their Endpoint.
+func (c *Credentials) endpoint() (string, bool) {
+	if c.Endpoint == "" {
+		return fmt.Sprintf("%s.r2.cloudflarestorage.com", c.AccountID), true
+	}
+	if host, ok := strings.CutPrefix(c.Endpoint, "http://"); ok {
+		return strings.TrimSuffix(host, "/"), false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(c.Endpoint, "https://"), "/"), true
+}
+
+// Option adjusts how a Client addresses an S3-compatible endpoint other than R2.
+type Option func(*minio.Options)
+
+// WithRegion signs requests for region instead of the one the endpoint reports.
+func WithRegion(region string) Option {
+	return func(o *minio.Options) { o.Region = region }
+}
+
+// WithPathStyle addresses buckets as host/bucket rather than bucket.host, which stores
+// without wildcard DNS need.
+func WithPathStyle() Option {
+	return func(o *minio.Options) { o.BucketLookup = minio.BucketLookupPath }
+}
+
 // New creates an R2 client from the given credentials.
-func New(creds *Credentials, verbose bool) (*Client, error) {
-	endpoint := fmt.Sprintf("%s.r2.cloudflarestorage.com", creds.AccountID)
+func New(creds *Credentials, verbose bool, opts ...Option) (*Client, error) {
+	endpoint, _ := creds.endpoint()
 
-	mc, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(creds.AccessKeyID, creds.SecretAccessKey, ""),
-		Secure: true,
-	})
+	mc, err := minio.New(endpoint, minioOptions(creds, opts...))
 	if err != nil {
 		return nil, fmt.Errorf("creating R2 client: %w", err)
 	}
 
-	return &Client{mc: mc, bucket: creds.Bucket, verbose: verbose}, nil
+	return &Client{
+		mc:               minioAPI{mc},
+		endpoint:         endpoint,
+		bucket:           creds.Bucket,
+		accessKeyID:      creds.AccessKeyID,
+		verbose:          verbose,
+		downloadAttempts: downloadAttempts,
+		retryDelay:       downloadRetryDelay,
+	}, nil
+}
+
+// minioOptions returns the client options for creds, signing with their session token
+// when they have one.
+func minioOptions(creds *Credentials, opts ...Option) *minio.Options {
+	_, secure := creds.endpoint()
+	o := &minio.Options{
+		Creds:  credentials.NewStaticV4(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken),
+		Secure: secure,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// SetObjectLock makes every later upload of an archive or sidecar immutable for days, in
+// compliance mode, which not even the bucket owner can shorten. The bucket must have
+// object lock enabled, or uploads fail. 0 turns it off.
+func (c *Client) SetObjectLock(days int) {
+	c.lockDays = days
+}
+
+// SetArchiveSuffix tells the client the archive suffix backups append to their keys (see
+// backup.ArchiveOptions.Suffix), so uploads of suffixed archives get the content type of
+// their format.
+func (c *Client) SetArchiveSuffix(suffix string) {
+	c.archiveSuffix = suffix
+}
+
+// lock sets the object-lock retention of an upload.
+func (c *Client) lock(opts *minio.PutObjectOptions) {
+	if c.lockDays > 0 {
+		opts.Mode = minio.Compliance
+		opts.RetainUntilDate = time.Now().AddDate(0, 0, c.lockDays).UTC()
+	}
+}
+
+// ObjectURL returns a copy-pasteable location for key: r2://bucket/key for Cloudflare R2,
+// or s3://host/bucket/key for other S3-compatible endpoints.
+func (c *Client) ObjectURL(key string) string {
+	if strings.HasSuffix(c.endpoint, ".r2.cloudflarestorage.com") {
+		return fmt.Sprintf("r2://%s/%s", c.bucket, key)
+	}
+	return fmt.Sprintf("s3://%s/%s/%s", c.endpoint, c.bucket, key)
 }
 
 // Upload sends a local file to R2 under the given key.
 func (c *Client) Upload(ctx context.Context, archivePath, key string) error {
+	return c.upload(ctx, archivePath, key, nil)
+}
+
+// UploadWithChecksum uploads an archive and records its hex SHA-256 according to mode:
+// as a sidecar object next to it, as object metadata, or not at all (none/embedded).
+func (c *Client) UploadWithChecksum(ctx context.Context, archivePath, key, sum string, mode ChecksumMode) error {
+	return c.UploadLabeled(ctx, archivePath, key, sum, mode, Labels{})
+}
+
+// UploadLabeled is UploadWithChecksum that also stores labels as object metadata.
+func (c *Client) UploadLabeled(ctx context.Context, archivePath, key, sum string, mode ChecksumMode, labels Labels) error {
+	metadata := labels.metadata()
+	if mode == ChecksumMetadata {
+		metadata[checksumMetadataKey] = sum
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	if err := c.upload(ctx, archivePath, key, metadata); err != nil {
+		return err
+	}
+	if mode != ChecksumSidecar {
+		return nil
+	}
+
+	// sha256sum -c compatible: "<hex>  <file name>"
+	line := fmt.Sprintf("%s  %s\n", sum, key[strings.LastIndex(key, "/")+1:])
+	sidecar := key + SidecarSuffix
+	c.logf("Uploading checksum -> r2://%s/%s", c.bucket, sidecar)
+	opts := minio.PutObjectOptions{ContentType: "text/plain"}
+	c.lock(&opts)
+	if _, err := c.mc.PutObject(ctx, c.bucket, sidecar, strings.NewReader(line), int64(len(line)), opts); err != nil {
+		return fmt.Errorf("uploading %s: %w", sidecar, err)
+	}
+	return nil
+}
+
+// streamPartSize is the part size of streamed uploads. minio-go buffers one part in memory
+// and an upload has at most 10000 parts, so streamed archives can reach 640 GiB.
+const streamPartSize = 64 << 20
+
+// UploadStream sends the content of r to R2 under key as it is read, for archives that are
+// never written to disk. size is -1 when it is not known up front, as for an archive still
+// being created; r is then uploaded in parts of streamPartSize.
+func (c *Client) UploadStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	return c.uploadStream(ctx, key, r, size, nil)
+}
+
+// UploadStreamLabeled is UploadStream that also stores labels as object metadata.
+func (c *Client) UploadStreamLabeled(ctx context.Context, key string, r io.Reader, size int64, labels Labels) error {
+	return c.uploadStream(ctx, key, r, size, labels.metadata())
+}
+
+func (c *Client) uploadStream(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string) error {
+	c.logf("Streaming -> r2://%s/%s", c.bucket, key)
+
+	opts := minio.PutObjectOptions{
+		ContentType:  contentType(key, c.archiveSuffix),
+		UserMetadata: metadata,
+		PartSize:     streamPartSize,
+	}
+	c.lock(&opts)
+	info, err := c.mc.PutObject(ctx, c.bucket, key, r, size, opts)
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+
+	c.logf("Uploaded %s (%d bytes)", key, info.Size)
+	return nil
+}
+
+func (c *Client) upload(ctx context.Context, archivePath, key string, metadata map[string]string) error {
 	c.logf("Uploading %s -> r2://%s/%s", archivePath, c.bucket, key)
 
-	info, err := c.mc.FPutObject(ctx, c.bucket, key, archivePath, minio.PutObjectOptions{
-		ContentType: "application/gzip",
-	})
+	opts := minio.PutObjectOptions{
+		ContentType:  contentType(key, c.archiveSuffix),
+		UserMetadata: metadata,
+	}
+	c.lock(&opts)
+	info, err := c.mc.FPutObject(ctx, c.bucket, key, archivePath, opts)
 	if err != nil {
 		return fmt.Errorf("uploading %s: %w", key, err)
 	}
@@ -99,18 +426,164 @@ func (c *Client) Upload(ctx context.Context, archivePath, key string) error {
 	return nil
 }
 
-// Download fetches an object from R2 and saves it to destPath.
+// contentType returns the MIME type for an archive key based on its extension, looking
+// through the archive suffix.
+func contentType(key, suffix string) string {
+	_, ext := backup.SplitArchiveExtension(backup.TrimArchiveSuffix(key, suffix))
+	switch strings.ToLower(ext) {
+	case ".tar.gz", ".tgz":
+		return "application/gzip"
+	case ".tar.zst", ".tzst":
+		return "application/zstd"
+	case ".tar":
+		return "application/x-tar"
+	case ".zip":
+		return "application/zip"
+	}
+	return "application/octet-stream"
+}
+
+// Stat returns the metadata of a single object as stored in R2.
+func (c *Client) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := c.mc.StatObject(ctx, c.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat %s: %w", key, err)
+	}
+	obj := ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		SHA256:       info.UserMetadata[checksumMetadataKey],
+		Labels: Labels{
+			Namespace: info.UserMetadata[namespaceMetadataKey],
+			Release:   info.UserMetadata[releaseMetadataKey],
+			PVC:       info.UserMetadata[pvcMetadataKey],
+		},
+		LegalHold: info.Metadata.Get("X-Amz-Object-Lock-Legal-Hold") == string(minio.LegalHoldEnabled),
+	}
+	if until := info.Metadata.Get("X-Amz-Object-Lock-Retain-Until-Date"); until != "" {
+		if obj.RetainUntil, err = time.Parse(time.RFC3339, until); err != nil {
+			return ObjectInfo{}, fmt.Errorf("stat %s: parsing object-lock retention: %w", key, err)
+		}
+	}
+	return obj, nil
+}
+
+// Download fetches an object from R2 and saves it to destPath. It is written to
+// destPath.part first, and a transfer that breaks off resumes where it stopped with a
+// ranged request, pinned to the object's ETag so a replaced object is not spliced in.
+// Between attempts it waits retryDelay, doubling. The file must have the size R2 reports,
+// and the SHA-256 in the object's metadata or else its checksum sidecar if it has either,
+// before it is renamed to destPath, so a corrupted archive never reaches a restore.
 func (c *Client) Download(ctx context.Context, key, destPath string) error {
 	c.logf("Downloading r2://%s/%s -> %s", c.bucket, key, destPath)
 
-	if err := c.mc.FGetObject(ctx, c.bucket, key, destPath, minio.GetObjectOptions{}); err != nil {
+	info, err := c.mc.StatObject(ctx, c.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
 		return fmt.Errorf("downloading %s: %w", key, err)
 	}
+	part := destPath + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+
+	var written int64
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		n, err := c.downloadFrom(ctx, key, info, written, f)
+		written += n
+		if err == nil {
+			break
+		}
+		if attempt >= c.downloadAttempts || ctx.Err() != nil {
+			f.Close()
+			return fmt.Errorf("downloading %s: %w", key, err)
+		}
+		log.Printf("WARNING: download of %s broke off at %d of %d bytes, resuming in %s: %v", key, written, info.Size, delay, err)
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
 
-	c.logf("Downloaded %s", key)
+	want, from := info.UserMetadata[checksumMetadataKey], "stored with the object"
+	if want == "" {
+		if want, err = c.sidecarSum(ctx, key); err != nil {
+			return fmt.Errorf("downloading %s: %w", key, err)
+		}
+		from = "in " + key + SidecarSuffix
+	}
+	if want != "" {
+		sum, err := backup.FileSHA256(part)
+		if err != nil {
+			return err
+		}
+		if sum != want {
+			return fmt.Errorf("downloading %s: SHA-256 %s does not match %s %s", key, sum, want, from)
+		}
+	}
+	if err := os.Rename(part, destPath); err != nil {
+		return err
+	}
+	c.logf("Downloaded %s (%d bytes)", key, written)
 	return nil
 }
 
+// sidecarSum returns the SHA-256 in the checksum sidecar of key, or "" when it has none.
+func (c *Client) sidecarSum(ctx context.Context, key string) (string, error) {
+	r, err := c.mc.OpenObject(ctx, c.bucket, key+SidecarSuffix, 0, "")
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return SidecarSum(data), nil
+}
+
+// downloadFrom appends the object described by info to w from offset on. It returns the
+// bytes written, and an error unless they reached the end of the object.
+func (c *Client) downloadFrom(ctx context.Context, key string, info minio.ObjectInfo, offset int64, w io.Writer) (int64, error) {
+	if offset == info.Size {
+		return 0, nil
+	}
+	r, err := c.mc.OpenObject(ctx, c.bucket, key, offset, info.ETag)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	if err == nil && offset+n != info.Size {
+		err = fmt.Errorf("got %d of %d bytes: %w", offset+n, info.Size, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// Open streams an object from R2 without saving it, for reading it once front to back.
+// The caller closes the returned reader.
+func (c *Client) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	c.logf("Streaming r2://%s/%s", c.bucket, key)
+
+	r, err := c.mc.OpenObject(ctx, c.bucket, key, 0, "")
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	return r, nil
+}
+
 // ListByPrefix returns objects whose key starts with prefix, sorted by LastModified descending (newest first).
 func (c *Client) ListByPrefix(ctx context.Context, prefix string) ([]ObjectInfo, error) {
 	c.logf("Listing objects with prefix %q in bucket %s", prefix, c.bucket)
@@ -138,6 +611,26 @@ func (c *Client) ListByPrefix(ctx context.Context, prefix string) ([]ObjectInfo,
 	return objects, nil
 }
 
+// SameAccount reports whether c and other use the same endpoint and access key, so that c
+// can read other's bucket and CopyFrom works between them.
+func (c *Client) SameAccount(other *Client) bool {
+	return c.endpoint == other.endpoint && c.accessKeyID == other.accessKeyID
+}
+
+// CopyFrom copies srcKey from src's bucket to key in c's bucket server-side, keeping its
+// metadata. src must be on the same account (see SameAccount).
+func (c *Client) CopyFrom(ctx context.Context, src *Client, srcKey, key string) error {
+	c.logf("Copying r2://%s/%s -> r2://%s/%s", src.bucket, srcKey, c.bucket, key)
+
+	if _, err := c.mc.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: c.bucket, Object: key},
+		minio.CopySrcOptions{Bucket: src.bucket, Object: srcKey},
+	); err != nil {
+		return fmt.Errorf("copying %s to %s: %w", srcKey, key, err)
+	}
+	return nil
+}
+
 // Delete removes a single object from R2.
 func (c *Client) Delete(ctx context.Context, key string) error {
 	c.logf("Deleting r2://%s/%s", c.bucket, key)
@@ -148,35 +641,6 @@ func (c *Client) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
-// Rotate keeps only the keepLast newest objects matching prefix and deletes the rest.
-// Returns the keys that were deleted.
-func (c *Client) Rotate(ctx context.Context, prefix string, keepLast int) ([]string, error) {
-	if keepLast <= 0 {
-		return nil, nil
-	}
-
-	objects, err := c.ListByPrefix(ctx, prefix)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(objects) <= keepLast {
-		return nil, nil
-	}
-
-	toDelete := objects[keepLast:]
-	var deleted []string
-	for _, obj := range toDelete {
-		if err := c.Delete(ctx, obj.Key); err != nil {
-			return deleted, fmt.Errorf("rotating %s: %w", obj.Key, err)
-		}
-		deleted = append(deleted, obj.Key)
-	}
-
-	c.logf("Rotated prefix %q: kept %d, deleted %d", prefix, keepLast, len(deleted))
-	return deleted, nil
-}
-
 func (c *Client) logf(format string, args ...interface{}) {
 	if c.verbose {
 		log.Printf("[r2] "+format, args...)
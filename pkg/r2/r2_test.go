@@ -1,9 +1,24 @@
 package r2
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/minio/minio-go/v7"
 )
 
 func TestLoadCredentials_Valid(t *testing.T) {
@@ -112,3 +127,575 @@ func TestLoadCredentials_MissingBucket(t *testing.T) {
 		t.Error("expected error for missing bucket")
 	}
 }
+
+func TestCredentialsFromSecretData(t *testing.T) {
+	want := Credentials{AccountID: "acc", AccessKeyID: "key", SecretAccessKey: "secret", Bucket: "bucket"}
+
+	fields := map[string][]byte{
+		"account_id":        []byte("acc"),
+		"access_key_id":     []byte("key"),
+		"secret_access_key": []byte("secret"),
+		"bucket":            []byte("bucket"),
+	}
+	if got, err := CredentialsFromSecretData(fields); err != nil || *got != want {
+		t.Errorf("individual keys: %+v, %v", got, err)
+	}
+
+	asJSON := map[string][]byte{
+		"credentials.json": []byte(`{"account_id":"acc","access_key_id":"key","secret_access_key":"secret","bucket":"bucket"}`),
+	}
+	if got, err := CredentialsFromSecretData(asJSON); err != nil || *got != want {
+		t.Errorf("JSON key: %+v, %v", got, err)
+	}
+
+	delete(fields, "bucket")
+	if _, err := CredentialsFromSecretData(fields); err == nil || !strings.Contains(err.Error(), "bucket is required") {
+		t.Errorf("missing field: %v", err)
+	}
+	if _, err := CredentialsFromSecretData(map[string][]byte{"a": nil, "b": nil}); err == nil {
+		t.Error("expected an error for unrelated keys")
+	}
+}
+
+func TestLoadCredentials_SessionToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	data := `{
+		"account_id": "abc123",
+		"access_key_id": "ASIATEMP",
+		"secret_access_key": "SECRET",
+		"bucket": "my-backups",
+		"session_token": "TOKEN"
+	}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.SessionToken != "TOKEN" {
+		t.Errorf("SessionToken = %q, want TOKEN", creds.SessionToken)
+	}
+
+	value, err := minioOptions(creds).Creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "ASIATEMP" || value.SessionToken != "TOKEN" {
+		t.Errorf("client credentials = %+v, want the key with its session token", value)
+	}
+	if _, err := New(creds, false); err != nil {
+		t.Errorf("New() error: %v", err)
+	}
+
+	// A token does not stand in for the keys it belongs to
+	if _, err := ParseCredentials([]byte(`{"account_id":"abc123","bucket":"b","session_token":"TOKEN"}`)); err == nil || !strings.Contains(err.Error(), "access_key_id is required") {
+		t.Errorf("token without keys: %v", err)
+	}
+	fields := map[string][]byte{
+		"account_id":        []byte("acc"),
+		"access_key_id":     []byte("key"),
+		"secret_access_key": []byte("secret"),
+		"bucket":            []byte("bucket"),
+		"session_token":     []byte("TOKEN"),
+	}
+	if got, err := CredentialsFromSecretData(fields); err != nil || got.SessionToken != "TOKEN" {
+		t.Errorf("secret with session_token: %+v, %v", got, err)
+	}
+}
+
+func TestObjectURL_R2(t *testing.T) {
+	c, err := New(&Credentials{AccountID: "abc123", AccessKeyID: "AKID", SecretAccessKey: "SECRET", Bucket: "my-backups"}, false)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	got := c.ObjectURL("ns_rel_20240101-120000_data.tar.gz")
+	want := "r2://my-backups/ns_rel_20240101-120000_data.tar.gz"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestNew_Endpoint(t *testing.T) {
+	creds, err := ParseCredentials([]byte(`{"endpoint":"http://minio.example.com:9000/","access_key_id":"AKID","secret_access_key":"SECRET","bucket":"backups"}`))
+	if err != nil {
+		t.Fatalf("credentials without account_id but with an endpoint: %v", err)
+	}
+
+	o := minioOptions(creds, WithRegion("us-east-1"), WithPathStyle())
+	if o.Region != "us-east-1" || o.BucketLookup != minio.BucketLookupPath || o.Secure {
+		t.Errorf("options = region %q, lookup %v, secure %v; want us-east-1, path style, plain http", o.Region, o.BucketLookup, o.Secure)
+	}
+	c, err := New(creds, false, WithRegion("us-east-1"), WithPathStyle())
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if got := c.ObjectURL("data.tar.gz"); got != "s3://minio.example.com:9000/backups/data.tar.gz" {
+		t.Errorf("ObjectURL() = %q", got)
+	}
+
+	// R2 keeps its defaults
+	o = minioOptions(&Credentials{AccountID: "acc", AccessKeyID: "AKID", SecretAccessKey: "SECRET", Bucket: "b"})
+	if o.Region != "" || o.BucketLookup != minio.BucketLookupAuto || !o.Secure {
+		t.Errorf("R2 options = region %q, lookup %v, secure %v", o.Region, o.BucketLookup, o.Secure)
+	}
+	if _, err := ParseCredentials([]byte(`{"access_key_id":"AKID","secret_access_key":"SECRET","bucket":"b"}`)); err == nil || !strings.Contains(err.Error(), "account_id is required") {
+		t.Errorf("credentials without account_id or endpoint: %v", err)
+	}
+}
+
+func TestObjectURL_GenericEndpoint(t *testing.T) {
+	c := &Client{endpoint: "minio.example.com:9000", bucket: "backups"}
+	got := c.ObjectURL("data.tar.gz")
+	want := "s3://minio.example.com:9000/backups/data.tar.gz"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+// fakeBucket is an in-memory objectAPI. Objects listed later get newer timestamps.
+type fakeBucket struct {
+	objects map[string]minio.ObjectInfo
+	data    map[string][]byte
+	clock   time.Time
+	breaks  []int   // each OpenObject breaks off after the next count of bytes, while any are left
+	offsets []int64 // offsets OpenObject was called with
+}
+
+func newFakeBucket(keys ...string) *fakeBucket {
+	f := &fakeBucket{
+		objects: make(map[string]minio.ObjectInfo),
+		data:    make(map[string][]byte),
+		clock:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for _, key := range keys {
+		f.put(key, nil, nil)
+	}
+	return f
+}
+
+func (f *fakeBucket) put(key string, data []byte, meta map[string]string) {
+	f.clock = f.clock.Add(time.Minute)
+	f.objects[key] = minio.ObjectInfo{Key: key, Size: int64(len(data)), LastModified: f.clock, UserMetadata: meta}
+	f.data[key] = data
+}
+
+func (f *fakeBucket) FPutObject(_ context.Context, _, key, path string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	f.put(key, data, opts.UserMetadata)
+	f.lock(key, opts)
+	return minio.UploadInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+// lock records the object-lock retention of an upload as S3 returns it on Stat.
+func (f *fakeBucket) lock(key string, opts minio.PutObjectOptions) {
+	if opts.RetainUntilDate.IsZero() {
+		return
+	}
+	obj := f.objects[key]
+	obj.Metadata = http.Header{}
+	obj.Metadata.Set("X-Amz-Object-Lock-Mode", string(opts.Mode))
+	obj.Metadata.Set("X-Amz-Object-Lock-Retain-Until-Date", opts.RetainUntilDate.Format(time.RFC3339))
+	f.objects[key] = obj
+}
+
+func (f *fakeBucket) PutObject(_ context.Context, _, key string, r io.Reader, _ int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	f.put(key, data, opts.UserMetadata)
+	f.lock(key, opts)
+	return minio.UploadInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+func (f *fakeBucket) StatObject(_ context.Context, _, key string, _ minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	obj, ok := f.objects[key]
+	if !ok {
+		return minio.ObjectInfo{}, fmt.Errorf("not found: %s", key)
+	}
+	// Like S3, user metadata comes back with canonical header casing
+	meta := make(map[string]string)
+	for k, v := range obj.UserMetadata {
+		meta[strings.ToUpper(k[:1])+strings.ToLower(k[1:])] = v
+	}
+	obj.UserMetadata = meta
+	return obj, nil
+}
+
+func (f *fakeBucket) OpenObject(_ context.Context, _, key string, offset int64, _ string) (io.ReadCloser, error) {
+	data, ok := f.data[key]
+	if !ok {
+		return nil, minio.ErrorResponse{Code: "NoSuchKey", Key: key}
+	}
+	f.offsets = append(f.offsets, offset)
+	data = data[offset:]
+	if len(f.breaks) > 0 {
+		n := f.breaks[0]
+		f.breaks = f.breaks[1:]
+		return io.NopCloser(io.MultiReader(bytes.NewReader(data[:n]), iotest.ErrReader(errors.New("connection reset")))), nil
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (f *fakeBucket) ListObjects(_ context.Context, _ string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo, len(f.objects))
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, opts.Prefix) {
+			ch <- obj
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func (f *fakeBucket) RemoveObject(_ context.Context, _, key string, _ minio.RemoveObjectOptions) error {
+	if until := f.objects[key].Metadata.Get("X-Amz-Object-Lock-Retain-Until-Date"); until != "" {
+		return minio.ErrorResponse{Code: "AccessDenied", Key: key, Message: "object is locked until " + until}
+	}
+	delete(f.objects, key)
+	delete(f.data, key)
+	return nil
+}
+
+func (f *fakeBucket) CopyObject(_ context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	obj, ok := f.objects[src.Object]
+	if !ok {
+		return minio.UploadInfo{}, fmt.Errorf("not found: %s", src.Object)
+	}
+	f.put(dst.Object, f.data[src.Object], obj.UserMetadata)
+	return minio.UploadInfo{Key: dst.Object, Size: obj.Size}, nil
+}
+
+func (f *fakeBucket) keys() []string {
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newFakeClient(f *fakeBucket) *Client {
+	return &Client{mc: f, endpoint: "acc.r2.cloudflarestorage.com", bucket: "backups", downloadAttempts: downloadAttempts, retryDelay: time.Millisecond}
+}
+
+func writeArchive(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ns_rel_20240101-120000_data.tar.gz")
+	if err := os.WriteFile(path, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testSum = "ab12cd34"
+
+func TestUploadWithChecksum_Modes(t *testing.T) {
+	const key = "backups/ns_rel_20240101-120000_data.tar.gz"
+
+	t.Run("none", func(t *testing.T) {
+		f := newFakeBucket()
+		if err := newFakeClient(f).UploadWithChecksum(context.Background(), writeArchive(t), key, testSum, ChecksumNone); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := f.keys(); !reflect.DeepEqual(got, []string{key}) {
+			t.Errorf("objects = %v, want only the archive", got)
+		}
+	})
+
+	t.Run("sidecar", func(t *testing.T) {
+		f := newFakeBucket()
+		if err := newFakeClient(f).UploadWithChecksum(context.Background(), writeArchive(t), key, testSum, ChecksumSidecar); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := f.keys(); !reflect.DeepEqual(got, []string{key, key + SidecarSuffix}) {
+			t.Errorf("objects = %v, want archive and sidecar", got)
+		}
+		want := testSum + "  ns_rel_20240101-120000_data.tar.gz\n"
+		if got := string(f.data[key+SidecarSuffix]); got != want {
+			t.Errorf("sidecar = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		f := newFakeBucket()
+		c := newFakeClient(f)
+		if err := c.UploadWithChecksum(context.Background(), writeArchive(t), key, testSum, ChecksumMetadata); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := f.keys(); !reflect.DeepEqual(got, []string{key}) {
+			t.Errorf("objects = %v, want only the archive", got)
+		}
+		obj, err := c.Stat(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Stat() error: %v", err)
+		}
+		if obj.SHA256 != testSum {
+			t.Errorf("SHA256 = %q, want %q", obj.SHA256, testSum)
+		}
+	})
+
+	t.Run("embedded", func(t *testing.T) {
+		f := newFakeBucket()
+		c := newFakeClient(f)
+		if err := c.UploadWithChecksum(context.Background(), writeArchive(t), key, testSum, ChecksumEmbedded); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		obj, err := c.Stat(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Stat() error: %v", err)
+		}
+		if len(f.objects) != 1 || obj.SHA256 != "" {
+			t.Errorf("embedded mode stored extra data in R2: objects=%v sha=%q", f.keys(), obj.SHA256)
+		}
+	})
+}
+
+func TestParseChecksumMode(t *testing.T) {
+	for _, s := range []string{"none", "sidecar", "metadata", "embedded"} {
+		if m, err := ParseChecksumMode(s); err != nil || string(m) != s {
+			t.Errorf("ParseChecksumMode(%q) = %q, %v", s, m, err)
+		}
+	}
+	if _, err := ParseChecksumMode("md5"); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := map[string]string{
+		"a.tar.gz":  "application/gzip",
+		"a.tgz":     "application/gzip",
+		"a.tar.zst": "application/zstd",
+		"a.tar":     "application/x-tar",
+		"a.zip":     "application/zip",
+		"a.bin":     "application/octet-stream",
+		"a.zip.bak": "application/zip",
+	}
+	for key, want := range tests {
+		if got := contentType(key, ".bak"); got != want {
+			t.Errorf("contentType(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if got := contentType("a.zip.bak", ""); got != "application/octet-stream" {
+		t.Errorf("contentType(a.zip.bak) without a suffix = %q", got)
+	}
+}
+
+func TestCopyFrom_KeepsMetadata(t *testing.T) {
+	f := newFakeBucket()
+	f.put("old/data.tar.gz", []byte("archive"), map[string]string{checksumMetadataKey: testSum})
+	src := newFakeClient(f)
+	dst := &Client{mc: f, endpoint: src.endpoint, bucket: "new-backups"}
+
+	if err := dst.CopyFrom(context.Background(), src, "old/data.tar.gz", "new/data.tar.gz"); err != nil {
+		t.Fatalf("CopyFrom() error: %v", err)
+	}
+	info, err := dst.Stat(context.Background(), "new/data.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SHA256 != testSum || info.Size != int64(len("archive")) {
+		t.Errorf("copied object = %+v, want size 7 and sha256 %s", info, testSum)
+	}
+	if _, ok := f.objects["old/data.tar.gz"]; !ok {
+		t.Error("CopyFrom removed the source object")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	f := newFakeBucket()
+	f.put("ns/data.tar.gz", []byte("archive"), nil)
+	c := newFakeClient(f)
+
+	r, err := c.Open(context.Background(), "ns/data.tar.gz")
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || string(data) != "archive" {
+		t.Errorf("Open() read %q, %v; want archive", data, err)
+	}
+	if _, err := c.Open(context.Background(), "ns/missing.tar.gz"); err == nil {
+		t.Error("Open() of a missing key succeeded")
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownload_ResumesAfterBreak(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	f := newFakeBucket()
+	f.put("ns/data.tar.gz", data, map[string]string{checksumMetadataKey: sha256Hex(data)})
+	f.breaks = []int{40, 25}
+	c := newFakeClient(f)
+
+	dst := filepath.Join(t.TempDir(), "data.tar.gz")
+	if err := c.Download(context.Background(), "ns/data.tar.gz", dst); err != nil {
+		t.Fatalf("Download() error: %v", err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded %q, %v; want the whole object", got, err)
+	}
+	if want := []int64{0, 40, 65}; !reflect.DeepEqual(f.offsets, want) {
+		t.Errorf("requested offsets %v, want %v", f.offsets, want)
+	}
+	if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestDownload_GivesUpAndVerifies(t *testing.T) {
+	data := []byte("archive")
+	f := newFakeBucket()
+	f.put("ns/data.tar.gz", data, nil)
+	f.breaks = []int{1, 1, 1, 1, 1}
+	c := newFakeClient(f)
+	dst := filepath.Join(t.TempDir(), "data.tar.gz")
+	if err := c.Download(context.Background(), "ns/data.tar.gz", dst); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("Download() error = %v, want the last break after %d attempts", err, downloadAttempts)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("incomplete download left at %s: %v", dst, err)
+	}
+
+	f.breaks = nil
+	f.put("ns/bad.tar.gz", data, map[string]string{checksumMetadataKey: sha256Hex([]byte("other"))})
+	if err := c.Download(context.Background(), "ns/bad.tar.gz", dst); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Download() of a corrupt object error = %v, want a checksum mismatch", err)
+	}
+}
+
+func TestDownload_VerifiesSidecar(t *testing.T) {
+	data := []byte("archive")
+	f := newFakeBucket()
+	f.put("ns/data.tar.gz", data, nil)
+	f.put("ns/data.tar.gz"+SidecarSuffix, []byte(sha256Hex([]byte("other"))+"  data.tar.gz\n"), nil)
+	c := newFakeClient(f)
+	dst := filepath.Join(t.TempDir(), "data.tar.gz")
+	if err := c.Download(context.Background(), "ns/data.tar.gz", dst); err == nil || !strings.Contains(err.Error(), "ns/data.tar.gz.sha256") {
+		t.Errorf("Download() error = %v, want a mismatch with the sidecar", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("corrupt download left at %s: %v", dst, err)
+	}
+
+	f.put("ns/data.tar.gz"+SidecarSuffix, []byte(sha256Hex(data)+"  data.tar.gz\n"), nil)
+	if err := c.Download(context.Background(), "ns/data.tar.gz", dst); err != nil {
+		t.Errorf("Download() with a matching sidecar: %v", err)
+	}
+}
+
+func TestSameAccount(t *testing.T) {
+	a := &Client{endpoint: "acc.r2.cloudflarestorage.com", accessKeyID: "key", bucket: "one"}
+	for _, tc := range []struct {
+		other *Client
+		want  bool
+	}{
+		{&Client{endpoint: "acc.r2.cloudflarestorage.com", accessKeyID: "key", bucket: "two"}, true},
+		{&Client{endpoint: "acc.r2.cloudflarestorage.com", accessKeyID: "other", bucket: "one"}, false},
+		{&Client{endpoint: "other.r2.cloudflarestorage.com", accessKeyID: "key", bucket: "one"}, false},
+	} {
+		if got := a.SameAccount(tc.other); got != tc.want {
+			t.Errorf("SameAccount(%s, %s) = %v, want %v", tc.other.endpoint, tc.other.accessKeyID, got, tc.want)
+		}
+	}
+}
+
+func TestUploadLabeled(t *testing.T) {
+	const key = "ns_rel_20240101-120000_data.tar.gz"
+	labels := Labels{Namespace: "ns", Release: "rel", PVC: "data"}
+	f := newFakeBucket()
+	c := newFakeClient(f)
+	if err := c.UploadLabeled(context.Background(), writeArchive(t), key, testSum, ChecksumMetadata, labels); err != nil {
+		t.Fatalf("UploadLabeled() error: %v", err)
+	}
+	obj, err := c.Stat(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Labels != labels || obj.SHA256 != testSum {
+		t.Errorf("Stat() = %+v, want labels %+v and sha256 %s", obj, labels, testSum)
+	}
+
+	// Archives uploaded without labels have none
+	if err := c.UploadWithChecksum(context.Background(), writeArchive(t), "plain.tar.gz", testSum, ChecksumNone); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := c.Stat(context.Background(), "plain.tar.gz"); err != nil || !obj.Labels.IsZero() {
+		t.Errorf("Stat(plain) = %+v, %v; want no labels", obj, err)
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	const key = "ns_rel_20240101-120000_data.tar.gz"
+	ctx := context.Background()
+	f := newFakeBucket()
+	c := newFakeClient(f)
+	if err := c.UploadStream(ctx, key, strings.NewReader("archive"), -1); err != nil {
+		t.Fatalf("UploadStream() error: %v", err)
+	}
+	if string(f.data[key]) != "archive" {
+		t.Errorf("stored %q, want archive", f.data[key])
+	}
+
+	labels := Labels{Namespace: "ns", Release: "rel", PVC: "data"}
+	if err := c.UploadStreamLabeled(ctx, key, strings.NewReader("archive"), -1, labels); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := c.Stat(ctx, key); err != nil || obj.Labels != labels || obj.Size != 7 {
+		t.Errorf("Stat() = %+v, %v; want 7 bytes labelled %+v", obj, err, labels)
+	}
+
+	broken := iotest.ErrReader(errors.New("archiver failed"))
+	if err := c.UploadStream(ctx, "broken.tar.gz", broken, -1); err == nil || !strings.Contains(err.Error(), "archiver failed") {
+		t.Errorf("UploadStream(broken) error = %v", err)
+	}
+}
+
+func TestUpload_ObjectLock(t *testing.T) {
+	const key = "ns_rel_20240101-120000_data.tar.gz"
+	ctx := context.Background()
+	f := newFakeBucket()
+	c := newFakeClient(f)
+	c.SetObjectLock(30)
+	if err := c.UploadWithChecksum(ctx, writeArchive(t), key, testSum, ChecksumSidecar); err != nil {
+		t.Fatalf("UploadWithChecksum() error: %v", err)
+	}
+
+	now := time.Now()
+	for _, k := range []string{key, key + SidecarSuffix} {
+		obj, err := c.Stat(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := now.AddDate(0, 0, 30); obj.RetainUntil.Sub(want).Abs() > time.Minute {
+			t.Errorf("Stat(%s).RetainUntil = %v, want about %v", k, obj.RetainUntil, want)
+		}
+		if !obj.Locked(now) || obj.Locked(now.AddDate(0, 0, 31)) {
+			t.Errorf("Stat(%s).Locked() wrong for retention until %v", k, obj.RetainUntil)
+		}
+	}
+	if f.objects[key].Metadata.Get("X-Amz-Object-Lock-Mode") != string(minio.Compliance) {
+		t.Errorf("upload mode = %q, want COMPLIANCE", f.objects[key].Metadata.Get("X-Amz-Object-Lock-Mode"))
+	}
+	if err := c.Delete(ctx, key); err == nil {
+		t.Error("Delete() of a locked object succeeded")
+	}
+
+	// Without a lock, uploads carry no retention
+	c.SetObjectLock(0)
+	if err := c.Upload(ctx, writeArchive(t), "plain.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := c.Stat(ctx, "plain.tar.gz"); err != nil || obj.Locked(now) {
+		t.Errorf("Stat(plain) = %+v, %v; want it unlocked", obj, err)
+	}
+}
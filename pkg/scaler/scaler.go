@@ -4,41 +4,155 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
 
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	pollInterval = 2 * time.Second
-	waitTimeout  = 5 * time.Minute
+	// Waits poll after pollInterval, then back off by doubling the interval up to
+	// maxPollInterval: quick scale-downs are noticed early, and a workload that takes
+	// minutes to drain costs a few Gets rather than one every couple of seconds.
+	pollInterval    = 500 * time.Millisecond
+	maxPollInterval = 30 * time.Second
+	waitTimeout     = 5 * time.Minute
+
+	// maxPollFailures is how many consecutive failed status reads a wait tolerates before
+	// giving up, so a brief apiserver blip doesn't abort a long scale-down.
+	maxPollFailures = 5
 )
 
 // Scaler scales workloads down and back up.
 type Scaler struct {
-	client  kubernetes.Interface
-	verbose bool
+	client          kubernetes.Interface
+	verbose         bool
+	pollInterval    time.Duration
+	maxPollInterval time.Duration
+	handleHPAs      bool
+	targets         map[string]int32 // replicas ScaleDown leaves, by workload name; 0 when absent
+	readyKey        string           // WithReadyAnnotation; empty when not waited for
+	readyValue      string
+	postReadyDelay  time.Duration
+
+	// paused holds the original behavior of each HPA paused by ScaleDown, by namespace/name
+	paused map[string]*autoscalingv2.HorizontalPodAutoscalerBehavior
+}
+
+// Option configures a Scaler.
+type Option func(*Scaler)
+
+// WithHPAHandling makes ScaleDown pause the HorizontalPodAutoscaler of each workload that
+// has one (WorkloadInfo.HPA), so it cannot scale the workload back up during the backup,
+// and ScaleBack restore it.
+func WithHPAHandling() Option {
+	return func(s *Scaler) { s.handleHPAs = true }
+}
+
+// WithScaleTargets makes ScaleDown scale the workloads in targets, keyed by TargetKey, to
+// the given number of replicas instead of 0, e.g. leaving the primary of a StatefulSet
+// whose read replicas are the only pods that have to stop. A target at or above a
+// workload's replicas leaves it alone. Pods that keep running can write to their volumes
+// during the backup or restore.
+func WithScaleTargets(targets map[string]int32) Option {
+	return func(s *Scaler) { s.targets = targets }
 }
 
-func New(client kubernetes.Interface, verbose bool) *Scaler {
-	return &Scaler{client: client, verbose: verbose}
+// WithReadyAnnotation makes WaitReady also wait until every pod of each workload carries
+// the annotation key=value, which an application can set once it has loaded its data.
+func WithReadyAnnotation(key, value string) Option {
+	return func(s *Scaler) { s.readyKey, s.readyValue = key, value }
 }
 
-// ScaleDown scales all given workloads to 0 replicas and waits for pods to terminate.
+// WithPostReadyDelay makes WaitReady wait d more once every workload is ready, for
+// applications whose readiness probe passes before they have settled.
+func WithPostReadyDelay(d time.Duration) Option {
+	return func(s *Scaler) { s.postReadyDelay = d }
+}
+
+// TargetKey identifies w in WithScaleTargets: its kind and name, like StatefulSet/db, so
+// a Deployment and a StatefulSet of the same name get targets of their own.
+func TargetKey(w *types.WorkloadInfo) string {
+	return w.Kind + "/" + w.Name
+}
+
+// ParseScaleTargets parses --scale-to values given as kind/name=replicas, keyed by
+// TargetKey. The kind is Deployment or StatefulSet, in any case.
+func ParseScaleTargets(values []string) (map[string]int32, error) {
+	targets := make(map[string]int32, len(values))
+	for _, v := range values {
+		workload, n, ok := strings.Cut(v, "=")
+		kind, name, _ := strings.Cut(workload, "/")
+		replicas, err := strconv.ParseInt(n, 10, 32)
+		switch {
+		case !ok || name == "" || strings.Contains(name, "/"):
+			return nil, fmt.Errorf("%q is not kind/name=replicas", v)
+		case strings.EqualFold(kind, "Deployment"):
+			kind = "Deployment"
+		case strings.EqualFold(kind, "StatefulSet"):
+			kind = "StatefulSet"
+		default:
+			return nil, fmt.Errorf("%q: kind must be Deployment or StatefulSet", v)
+		}
+		if err != nil || replicas < 0 {
+			return nil, fmt.Errorf("%q: replicas must be a non-negative number", v)
+		}
+		key := kind + "/" + name
+		if _, dup := targets[key]; dup {
+			return nil, fmt.Errorf("%s is given twice", key)
+		}
+		targets[key] = int32(replicas)
+	}
+	return targets, nil
+}
+
+func New(client kubernetes.Interface, verbose bool, opts ...Option) *Scaler {
+	s := &Scaler{
+		client:          client,
+		verbose:         verbose,
+		pollInterval:    pollInterval,
+		maxPollInterval: maxPollInterval,
+		paused:          make(map[string]*autoscalingv2.HorizontalPodAutoscalerBehavior),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ScaleDown scales all given workloads to 0 replicas (or their WithScaleTargets target) and
+// waits for pods to terminate. Workloads that are already stopped (scaled to 0 with no pods
+// left, e.g. by an operator ahead of a restore) are left alone and not waited for.
 func (s *Scaler) ScaleDown(ctx context.Context, workloads []*types.WorkloadInfo) error {
+	var pending []*types.WorkloadInfo
 	for _, w := range workloads {
-		s.logf("Scaling %s/%s to 0 (was %d)", w.Kind, w.Name, w.OriginalReplicas)
-		if err := s.setReplicas(ctx, w, 0); err != nil {
+		if s.handleHPAs && w.HPA != "" {
+			if err := s.pauseHPA(ctx, w); err != nil {
+				return fmt.Errorf("pausing HPA %s of %s/%s: %w", w.HPA, w.Kind, w.Name, err)
+			}
+		}
+		target := s.targets[TargetKey(w)]
+		s.logf("Scaling %s/%s to %d (was %d)", w.Kind, w.Name, target, w.OriginalReplicas)
+		stopped, err := s.scaleTo(ctx, w, target)
+		if err != nil {
 			return fmt.Errorf("scaling down %s/%s: %w", w.Kind, w.Name, err)
 		}
+		if stopped {
+			s.logf("%s/%s is already at %d replicas or fewer, skipping", w.Kind, w.Name, target)
+			continue
+		}
+		pending = append(pending, w)
 	}
 
 	// Wait for all pods to terminate
-	for _, w := range workloads {
-		if err := s.waitForScale(ctx, w, 0); err != nil {
+	for _, w := range pending {
+		if err := s.waitForScale(ctx, w, s.targets[TargetKey(w)], true); err != nil {
 			return fmt.Errorf("waiting for %s/%s to scale down: %w", w.Kind, w.Name, err)
 		}
 		s.logf("%s/%s scaled down", w.Kind, w.Name)
@@ -47,21 +161,171 @@ func (s *Scaler) ScaleDown(ctx context.Context, workloads []*types.WorkloadInfo)
 	return nil
 }
 
-// ScaleBack restores all workloads to their original replica counts.
+// ScaleBack restores all workloads to their original replica counts, then resumes the HPAs
+// ScaleDown paused. A workload or HPA deleted in the meantime, e.g. by a helm uninstall
+// racing the backup, has nothing to restore and only gets a warning.
 func (s *Scaler) ScaleBack(ctx context.Context, workloads []*types.WorkloadInfo) error {
 	var firstErr error
 	for _, w := range workloads {
 		s.logf("Restoring %s/%s to %d replicas", w.Kind, w.Name, w.OriginalReplicas)
-		if err := s.setReplicas(ctx, w, w.OriginalReplicas); err != nil {
+		err := s.setReplicas(ctx, w, w.OriginalReplicas)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Printf("WARNING: %s %s/%s was deleted, not restoring its replicas", w.Kind, w.Namespace, w.Name)
+		case err != nil:
 			log.Printf("ERROR: failed to restore %s/%s: %v", w.Kind, w.Name, err)
 			if firstErr == nil {
 				firstErr = err
 			}
 		}
+		if _, ok := s.paused[hpaKey(w)]; !ok {
+			continue
+		}
+		err = s.resumeHPA(ctx, w)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Printf("WARNING: HPA %s/%s was deleted, not resuming it", w.Namespace, w.HPA)
+			delete(s.paused, hpaKey(w))
+		case err != nil:
+			log.Printf("ERROR: failed to resume HPA %s of %s/%s: %v", w.HPA, w.Kind, w.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
 	return firstErr
 }
 
+// WaitReady waits until each workload has its original replica count ready, for use after
+// ScaleBack. Workloads that were at 0 replicas are not waited for. Pod readiness gates
+// count already, as a pod is not ready until they pass. With WithReadyAnnotation it also
+// waits for the annotation on the pods, and with WithPostReadyDelay for the delay after.
+func (s *Scaler) WaitReady(ctx context.Context, workloads []*types.WorkloadInfo) error {
+	for _, w := range workloads {
+		if w.OriginalReplicas == 0 {
+			continue
+		}
+		if err := s.waitForScale(ctx, w, w.OriginalReplicas, false); err != nil {
+			return fmt.Errorf("waiting for %s/%s to become ready: %w", w.Kind, w.Name, err)
+		}
+		if s.readyKey != "" {
+			if err := s.waitForAnnotation(ctx, w); err != nil {
+				return fmt.Errorf("waiting for %s/%s to become ready: %w", w.Kind, w.Name, err)
+			}
+		}
+		s.logf("%s/%s is ready", w.Kind, w.Name)
+	}
+	if s.postReadyDelay > 0 {
+		s.logf("Waiting %s after the workloads became ready", s.postReadyDelay)
+		timer := time.NewTimer(s.postReadyDelay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// waitForAnnotation waits until w runs its original replica count of pods and all of them
+// carry the WithReadyAnnotation annotation. Terminating pods are not counted.
+func (s *Scaler) waitForAnnotation(ctx context.Context, w *types.WorkloadInfo) error {
+	selector, err := s.podSelector(ctx, w)
+	if err != nil {
+		return err
+	}
+	goal := fmt.Sprintf("have %d pod(s) annotated %s=%s", w.OriginalReplicas, s.readyKey, s.readyValue)
+	return s.poll(ctx, w, goal, func() (bool, error) {
+		pods, err := s.client.CoreV1().Pods(w.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		var running, annotated int32
+		for _, pod := range pods.Items {
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+			running++
+			if pod.Annotations[s.readyKey] == s.readyValue {
+				annotated++
+			}
+		}
+		s.logf("%s/%s: %d of %d pod(s) annotated %s=%s", w.Kind, w.Name, annotated, running, s.readyKey, s.readyValue)
+		return running >= w.OriginalReplicas && annotated == running, nil
+	})
+}
+
+// podSelector returns the label selector of the pods of w.
+func (s *Scaler) podSelector(ctx context.Context, w *types.WorkloadInfo) (string, error) {
+	var selector *metav1.LabelSelector
+	switch w.Kind {
+	case "Deployment":
+		dep, err := s.client.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		selector = dep.Spec.Selector
+	case "StatefulSet":
+		ss, err := s.client.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		selector = ss.Spec.Selector
+	default:
+		return "", fmt.Errorf("unsupported workload kind: %s", w.Kind)
+	}
+	sel, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return "", fmt.Errorf("pod selector of %s/%s: %w", w.Kind, w.Name, err)
+	}
+	return sel.String(), nil
+}
+
+// pauseHPA disables scaling up by the HPA of w, remembering its original behavior. An HPA
+// cannot have fewer than one minReplicas, so instead of zeroing its bounds its scale-up
+// policy is set to Disabled, which leaves its spec valid and stops it from undoing the
+// scale-down.
+func (s *Scaler) pauseHPA(ctx context.Context, w *types.WorkloadInfo) error {
+	hpas := s.client.AutoscalingV2().HorizontalPodAutoscalers(w.Namespace)
+	hpa, err := hpas.Get(ctx, w.HPA, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	original := hpa.Spec.Behavior.DeepCopy()
+	disabled := autoscalingv2.DisabledPolicySelect
+	if hpa.Spec.Behavior == nil {
+		hpa.Spec.Behavior = &autoscalingv2.HorizontalPodAutoscalerBehavior{}
+	}
+	hpa.Spec.Behavior.ScaleUp = &autoscalingv2.HPAScalingRules{SelectPolicy: &disabled}
+	s.logf("Pausing scale-up of HPA %s/%s", w.Namespace, w.HPA)
+	if _, err := hpas.Update(ctx, hpa, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	s.paused[hpaKey(w)] = original
+	return nil
+}
+
+// resumeHPA puts back the behavior pauseHPA replaced.
+func (s *Scaler) resumeHPA(ctx context.Context, w *types.WorkloadInfo) error {
+	hpas := s.client.AutoscalingV2().HorizontalPodAutoscalers(w.Namespace)
+	hpa, err := hpas.Get(ctx, w.HPA, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	hpa.Spec.Behavior = s.paused[hpaKey(w)]
+	s.logf("Resuming HPA %s/%s", w.Namespace, w.HPA)
+	if _, err := hpas.Update(ctx, hpa, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	delete(s.paused, hpaKey(w))
+	return nil
+}
+
+func hpaKey(w *types.WorkloadInfo) string {
+	return w.Namespace + "/" + w.HPA
+}
+
 func (s *Scaler) setReplicas(ctx context.Context, w *types.WorkloadInfo, replicas int32) error {
 	switch w.Kind {
 	case "Deployment":
@@ -87,51 +351,130 @@ func (s *Scaler) setReplicas(ctx context.Context, w *types.WorkloadInfo, replica
 	}
 }
 
-func (s *Scaler) waitForScale(ctx context.Context, w *types.WorkloadInfo, target int32) error {
+// scaleTo sets w to target replicas unless it already runs no more than that, which it
+// reports.
+func (s *Scaler) scaleTo(ctx context.Context, w *types.WorkloadInfo, target int32) (bool, error) {
+	switch w.Kind {
+	case "Deployment":
+		dep, err := s.client.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if isScaledTo(dep.Spec.Replicas, dep.Status.Replicas, target) {
+			return true, nil
+		}
+		dep.Spec.Replicas = &target
+		_, err = s.client.AppsV1().Deployments(w.Namespace).Update(ctx, dep, metav1.UpdateOptions{})
+		return false, err
+
+	case "StatefulSet":
+		ss, err := s.client.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if isScaledTo(ss.Spec.Replicas, ss.Status.Replicas, target) {
+			return true, nil
+		}
+		ss.Spec.Replicas = &target
+		_, err = s.client.AppsV1().StatefulSets(w.Namespace).Update(ctx, ss, metav1.UpdateOptions{})
+		return false, err
+
+	default:
+		return false, fmt.Errorf("unsupported workload kind: %s", w.Kind)
+	}
+}
+
+// isScaledTo reports whether a workload asks for at most target replicas and has no more
+// pods than that. A nil spec means the default of one replica.
+func isScaledTo(specReplicas *int32, statusReplicas, target int32) bool {
+	spec := int32(1)
+	if specReplicas != nil {
+		spec = *specReplicas
+	}
+	return spec <= target && statusReplicas <= target
+}
+
+// waitForScale polls w until it has target ready replicas, backing off between polls.
+// Scaling down to a nonzero target waits instead until no more than target pods are left,
+// which the ready count cannot tell while the surplus pods terminate.
+func (s *Scaler) waitForScale(ctx context.Context, w *types.WorkloadInfo, target int32, down bool) error {
+	return s.poll(ctx, w, fmt.Sprintf("reach %d replicas", target), func() (bool, error) {
+		ready, current, err := s.getReplicas(ctx, w)
+		if err != nil {
+			return false, err
+		}
+		s.logf("%s/%s: %d ready replicas (target: %d)", w.Kind, w.Name, ready, target)
+		switch {
+		case target == 0 && ready == 0:
+			return true, nil
+		case target > 0 && down && current <= target:
+			return true, nil
+		case target > 0 && !down && ready >= target:
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// poll calls check, backing off between calls, until it reports that w has reached goal.
+// It tolerates maxPollFailures-1 failed checks in a row and gives up after waitTimeout.
+func (s *Scaler) poll(ctx context.Context, w *types.WorkloadInfo, goal string, check func() (bool, error)) error {
 	deadline := time.After(waitTimeout)
-	ticker := time.NewTicker(pollInterval)
-	defer ticker.Stop()
+	interval := s.pollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
+	var failures int
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-deadline:
-			return fmt.Errorf("timed out waiting for %s/%s to reach %d replicas", w.Kind, w.Name, target)
-		case <-ticker.C:
-			ready, err := s.getReadyReplicas(ctx, w)
+			return fmt.Errorf("timed out waiting for %s/%s to %s", w.Kind, w.Name, goal)
+		case <-timer.C:
+			interval = nextPollInterval(interval, s.maxPollInterval)
+			timer.Reset(interval)
+			done, err := check()
 			if err != nil {
-				return err
+				failures++
+				if failures >= maxPollFailures {
+					return fmt.Errorf("reading status of %s/%s failed %d times in a row: %w", w.Kind, w.Name, failures, err)
+				}
+				s.logf("%s/%s: transient error reading status (%d/%d): %v", w.Kind, w.Name, failures, maxPollFailures, err)
+				continue
 			}
-			s.logf("%s/%s: %d ready replicas (target: %d)", w.Kind, w.Name, ready, target)
-			if target == 0 && ready == 0 {
-				return nil
-			}
-			if target > 0 && ready >= target {
+			failures = 0
+			if done {
 				return nil
 			}
 		}
 	}
 }
 
-func (s *Scaler) getReadyReplicas(ctx context.Context, w *types.WorkloadInfo) (int32, error) {
+// nextPollInterval doubles interval, capped at max.
+func nextPollInterval(interval, max time.Duration) time.Duration {
+	return min(2*interval, max)
+}
+
+// getReplicas returns the ready replicas of w and the number of its pods.
+func (s *Scaler) getReplicas(ctx context.Context, w *types.WorkloadInfo) (int32, int32, error) {
 	switch w.Kind {
 	case "Deployment":
 		dep, err := s.client.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
-		return dep.Status.ReadyReplicas, nil
+		return dep.Status.ReadyReplicas, dep.Status.Replicas, nil
 
 	case "StatefulSet":
 		ss, err := s.client.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
-		return ss.Status.ReadyReplicas, nil
+		return ss.Status.ReadyReplicas, ss.Status.Replicas, nil
 
 	default:
-		return 0, fmt.Errorf("unsupported workload kind: %s", w.Kind)
+		return 0, 0, fmt.Errorf("unsupported workload kind: %s", w.Kind)
 	}
 }
 
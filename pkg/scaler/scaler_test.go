@@ -2,13 +2,20 @@ package scaler
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
 
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/utils/ptr"
 )
 
@@ -194,3 +201,460 @@ func TestScaleBack_MultipleWorkloads(t *testing.T) {
 		t.Errorf("statefulset replicas = %d, want 1", *gotSS.Spec.Replicas)
 	}
 }
+
+func TestScaleBack_ToleratesDeletedWorkload(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(2))},
+	}
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(1))},
+	}
+	client := fake.NewSimpleClientset(dep, ss)
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 2},
+		{Kind: "StatefulSet", Name: "db", Namespace: "default", OriginalReplicas: 1},
+	}
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+	// helm uninstall removes the Deployment while the backup runs
+	if err := client.AppsV1().Deployments("default").Delete(context.Background(), "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ScaleBack(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleBack() error = %v, want a deleted workload to be skipped", err)
+	}
+	gotSS, _ := client.AppsV1().StatefulSets("default").Get(context.Background(), "db", metav1.GetOptions{})
+	if *gotSS.Spec.Replicas != 1 {
+		t.Errorf("statefulset replicas = %d, want 1", *gotSS.Spec.Replicas)
+	}
+
+	// Any other error still fails the scale-back
+	client.PrependReactor("update", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	if err := s.ScaleBack(context.Background(), workloads); err == nil {
+		t.Error("ScaleBack() succeeded despite a failed update")
+	}
+}
+
+func TestScaleDown_ToleratesTransientGetErrors(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(3))},
+	}
+
+	client := fake.NewSimpleClientset(dep)
+
+	// The first Get (from setReplicas) succeeds; the next few polls hit a flaky apiserver.
+	var gets int
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		if gets >= 2 && gets <= maxPollFailures {
+			return true, nil, errors.New("connection reset by peer")
+		}
+		return false, nil, nil
+	})
+
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 3},
+	}
+
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+	if gets != maxPollFailures+1 {
+		t.Errorf("Get called %d times, want %d", gets, maxPollFailures+1)
+	}
+}
+
+func TestScaleDown_FailsAfterConsecutiveGetErrors(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(3))},
+	}
+
+	client := fake.NewSimpleClientset(dep)
+
+	var gets int
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		if gets >= 2 {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 3},
+	}
+
+	err := s.ScaleDown(context.Background(), workloads)
+	if err == nil {
+		t.Fatal("expected error after repeated Get failures")
+	}
+	if polls := gets - 1; polls != maxPollFailures {
+		t.Errorf("polled %d times before giving up, want %d", polls, maxPollFailures)
+	}
+}
+
+func TestScaleDown_BacksOffBetweenPolls(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(1))},
+	}
+	client := fake.NewSimpleClientset(dep)
+
+	// The first Get is scaleTo's; the next 5 polls still see a ready pod
+	var polls []time.Time
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		polls = append(polls, time.Now())
+		if len(polls) > 1 && len(polls) <= 6 {
+			draining := dep.DeepCopy()
+			draining.Status.ReadyReplicas = 1
+			return true, draining, nil
+		}
+		return false, nil, nil
+	})
+
+	s := New(client, false)
+	s.pollInterval = 2 * time.Millisecond
+	s.maxPollInterval = 16 * time.Millisecond
+
+	workloads := []*types.WorkloadInfo{{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 1}}
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+	if len(polls) != 7 {
+		t.Fatalf("Get called %d times, want 7", len(polls))
+	}
+	// Timers never fire early, so each gap between polls is at least its interval
+	for i, want := range []time.Duration{4, 8, 16, 16, 16} {
+		if gap := polls[i+2].Sub(polls[i+1]); gap < want*time.Millisecond {
+			t.Errorf("poll %d came %v after the previous one, want at least %v", i+2, gap, want*time.Millisecond)
+		}
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	for _, tt := range []struct{ in, want time.Duration }{
+		{time.Second, 2 * time.Second},
+		{10 * time.Second, 20 * time.Second},
+		{20 * time.Second, maxPollInterval},
+		{maxPollInterval, maxPollInterval},
+	} {
+		if got := nextPollInterval(tt.in, maxPollInterval); got != tt.want {
+			t.Errorf("nextPollInterval(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScaleDown_SkipsWorkloadsAlreadyAtZero(t *testing.T) {
+	stopped := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(0))},
+	}
+	// Scaled to 0 but a pod is still terminating: it must still be waited for
+	draining := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(0))},
+		Status:     appsv1.DeploymentStatus{Replicas: 1},
+	}
+
+	client := fake.NewSimpleClientset(stopped, draining)
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{
+		{Kind: "StatefulSet", Name: "db", Namespace: "default", OriginalReplicas: 0},
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 0},
+	}
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+
+	var ssGets, ssUpdates, depGets int
+	for _, a := range client.Actions() {
+		switch {
+		case a.GetResource().Resource == "statefulsets" && a.GetVerb() == "get":
+			ssGets++
+		case a.GetResource().Resource == "statefulsets" && a.GetVerb() == "update":
+			ssUpdates++
+		case a.GetResource().Resource == "deployments" && a.GetVerb() == "get":
+			depGets++
+		}
+	}
+	if ssGets != 1 || ssUpdates != 0 {
+		t.Errorf("stopped StatefulSet: %d gets, %d updates; want 1 get and no update or wait", ssGets, ssUpdates)
+	}
+	if depGets < 2 {
+		t.Errorf("draining Deployment was not waited for (%d gets)", depGets)
+	}
+
+	// Scale-back still applies the original replicas
+	if err := s.ScaleBack(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleBack() error: %v", err)
+	}
+}
+
+func TestScaleDown_PausesAndResumesHPA(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(3))},
+	}
+	scaleDown := &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: ptr.To(int32(60))}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-hpa", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{Kind: "Deployment", Name: "web"},
+			MinReplicas:    ptr.To(int32(2)),
+			MaxReplicas:    5,
+			Behavior:       &autoscalingv2.HorizontalPodAutoscalerBehavior{ScaleDown: scaleDown},
+		},
+	}
+
+	client := fake.NewSimpleClientset(dep, hpa)
+	s := New(client, false, WithHPAHandling())
+	workloads := []*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 3, HPA: "web-hpa"},
+	}
+	hpas := client.AutoscalingV2().HorizontalPodAutoscalers("default")
+
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+	got, err := hpas.Get(context.Background(), "web-hpa", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up := got.Spec.Behavior.ScaleUp; up == nil || up.SelectPolicy == nil || *up.SelectPolicy != autoscalingv2.DisabledPolicySelect {
+		t.Errorf("scale-up behavior = %+v, want it disabled", up)
+	}
+
+	if err := s.ScaleBack(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleBack() error: %v", err)
+	}
+	got, err = hpas.Get(context.Background(), "web-hpa", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := got.Spec.Behavior; b == nil || b.ScaleUp != nil || b.ScaleDown == nil || *b.ScaleDown.StabilizationWindowSeconds != 60 {
+		t.Errorf("behavior after ScaleBack = %+v, want the original", b)
+	}
+	if *got.Spec.MinReplicas != 2 || got.Spec.MaxReplicas != 5 {
+		t.Errorf("bounds = %d..%d, want 2..5", *got.Spec.MinReplicas, got.Spec.MaxReplicas)
+	}
+}
+
+func TestScaleDown_LeavesHPAWithoutHandling(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(3))},
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-hpa", Namespace: "default"},
+	}
+
+	client := fake.NewSimpleClientset(dep, hpa)
+	s := New(client, false)
+	workloads := []*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 3, HPA: "web-hpa"},
+	}
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+	if err := s.ScaleBack(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleBack() error: %v", err)
+	}
+	for _, a := range client.Actions() {
+		if a.GetResource().Resource == "horizontalpodautoscalers" {
+			t.Errorf("unexpected %s of an HPA without WithHPAHandling", a.GetVerb())
+		}
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(2))},
+	}
+	client := fake.NewSimpleClientset(dep)
+	// Pods become ready on the third poll
+	var polls int
+	client.PrependReactor("get", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		polls++
+		d := dep.DeepCopy()
+		if polls >= 3 {
+			d.Status.ReadyReplicas = 2
+		}
+		return true, d, nil
+	})
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{
+		{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 2},
+		// Was at 0 before the run, so there is nothing to wait for (and it does not exist)
+		{Kind: "StatefulSet", Name: "idle", Namespace: "default", OriginalReplicas: 0},
+	}
+	if err := s.WaitReady(context.Background(), workloads); err != nil {
+		t.Fatalf("WaitReady() error: %v", err)
+	}
+	if polls != 3 {
+		t.Errorf("polled %d times, want 3", polls)
+	}
+}
+
+func TestWaitReady_PostReadyDelay(t *testing.T) {
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(1))},
+		Status:     appsv1.DeploymentStatus{ReadyReplicas: 1},
+	}
+	workloads := []*types.WorkloadInfo{{Kind: "Deployment", Name: "web", Namespace: "default", OriginalReplicas: 1}}
+
+	s := New(fake.NewSimpleClientset(dep), false, WithPostReadyDelay(50*time.Millisecond))
+	s.pollInterval = time.Millisecond
+	start := time.Now()
+	if err := s.WaitReady(context.Background(), workloads); err != nil {
+		t.Fatalf("WaitReady() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("WaitReady() returned after %s, before the delay", elapsed)
+	}
+
+	// A cancelled run does not sit out the delay
+	s = New(fake.NewSimpleClientset(dep), false, WithPostReadyDelay(time.Hour))
+	s.pollInterval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.WaitReady(ctx, workloads); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitReady() with an expiring context = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestWaitReady_ReadyAnnotation(t *testing.T) {
+	labels := map[string]string{"app": "db"}
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: ptr.To(int32(2)),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+		},
+		Status: appsv1.StatefulSetStatus{ReadyReplicas: 2},
+	}
+	pod := func(name string, annotated bool) *corev1.Pod {
+		p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+		if annotated {
+			p.Annotations = map[string]string{"example.com/data-loaded": "true"}
+		}
+		return p
+	}
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", Labels: map[string]string{"app": "web"}}}
+	client := fake.NewSimpleClientset(ss, pod("db-0", true), pod("db-1", false), other)
+	// db-1 finishes loading on the third poll
+	var polls int
+	client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		polls++
+		if polls == 3 {
+			client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("pods"), pod("db-1", true), "default")
+		}
+		return false, nil, nil
+	})
+	s := New(client, false, WithReadyAnnotation("example.com/data-loaded", "true"))
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{{Kind: "StatefulSet", Name: "db", Namespace: "default", OriginalReplicas: 2}}
+	if err := s.WaitReady(context.Background(), workloads); err != nil {
+		t.Fatalf("WaitReady() error: %v", err)
+	}
+	if polls != 3 {
+		t.Errorf("listed pods %d times, want 3", polls)
+	}
+}
+
+func TestScaleDown_ToNonzeroTarget(t *testing.T) {
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To(int32(3))},
+	}
+	// A Deployment of the same name is no read replica: its target is still 0
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(int32(2))},
+	}
+	client := fake.NewSimpleClientset(ss, deploy)
+	gvr := appsv1.SchemeGroupVersion.WithResource("statefulsets")
+	// The two read replicas are gone from the third Get on; the primary stays ready
+	var polls int
+	client.PrependReactor("get", "statefulsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		polls++
+		obj, err := client.Tracker().Get(gvr, "default", "db")
+		if err != nil {
+			return true, nil, err
+		}
+		got := obj.(*appsv1.StatefulSet).DeepCopy()
+		got.Status.Replicas, got.Status.ReadyReplicas = 3, 3
+		if polls >= 3 {
+			got.Status.Replicas, got.Status.ReadyReplicas = 1, 1
+		}
+		return true, got, nil
+	})
+	s := New(client, false, WithScaleTargets(map[string]int32{"StatefulSet/db": 1}))
+	s.pollInterval = time.Millisecond
+
+	workloads := []*types.WorkloadInfo{
+		{Kind: "StatefulSet", Name: "db", Namespace: "default", OriginalReplicas: 3},
+		{Kind: "Deployment", Name: "db", Namespace: "default", OriginalReplicas: 2},
+	}
+	if err := s.ScaleDown(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleDown() error: %v", err)
+	}
+	if polls != 3 {
+		t.Errorf("polled %d times, want 3", polls)
+	}
+	obj, _ := client.Tracker().Get(gvr, "default", "db")
+	if got := *obj.(*appsv1.StatefulSet).Spec.Replicas; got != 1 {
+		t.Errorf("replicas after ScaleDown = %d, want 1", got)
+	}
+	d, _ := client.AppsV1().Deployments("default").Get(context.Background(), "db", metav1.GetOptions{})
+	if got := *d.Spec.Replicas; got != 0 {
+		t.Errorf("Deployment replicas after ScaleDown = %d, want 0", got)
+	}
+
+	if err := s.ScaleBack(context.Background(), workloads); err != nil {
+		t.Fatalf("ScaleBack() error: %v", err)
+	}
+	obj, _ = client.Tracker().Get(gvr, "default", "db")
+	if got := *obj.(*appsv1.StatefulSet).Spec.Replicas; got != 3 {
+		t.Errorf("replicas after ScaleBack = %d, want 3", got)
+	}
+}
+
+func TestParseScaleTargets(t *testing.T) {
+	got, err := ParseScaleTargets([]string{"StatefulSet/db=1", "deployment/db=0", "Deployment/web=2"})
+	want := map[string]int32{"StatefulSet/db": 1, "Deployment/db": 0, "Deployment/web": 2}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseScaleTargets() = %v, %v; want %v", got, err, want)
+	}
+	for _, bad := range [][]string{
+		{"db=1"}, {"StatefulSet/db"}, {"StatefulSet/=1"}, {"Job/db=1"}, {"StatefulSet/a/b=1"},
+		{"StatefulSet/db=-1"}, {"StatefulSet/db=x"}, {"StatefulSet/db=1", "statefulset/db=2"},
+	} {
+		if _, err := ParseScaleTargets(bad); err == nil {
+			t.Errorf("ParseScaleTargets(%q) succeeded", bad)
+		}
+	}
+}
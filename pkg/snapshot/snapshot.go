@@ -0,0 +1,114 @@
+// Package snapshot takes CSI VolumeSnapshots (snapshot.storage.k8s.io/v1) of PVCs. The
+// snapshot CRDs have no typed client in client-go, so it goes through the dynamic client.
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Resource is the VolumeSnapshot resource.
+var Resource = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+
+const (
+	pollInterval = 2 * time.Second
+	waitTimeout  = 5 * time.Minute
+)
+
+// Snapshotter creates VolumeSnapshots and waits for them to become ready.
+type Snapshotter struct {
+	client       dynamic.Interface
+	verbose      bool
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+func New(client dynamic.Interface, verbose bool) *Snapshotter {
+	return &Snapshotter{client: client, verbose: verbose, pollInterval: pollInterval, timeout: waitTimeout}
+}
+
+// Name returns the VolumeSnapshot name for a snapshot of pvc taken at t, e.g.
+// data-20240101-000000.
+func Name(pvc string, t time.Time) string {
+	return pvc + "-" + t.Format("20060102-150405")
+}
+
+// Create creates a VolumeSnapshot called name of pvc, using the cluster's default
+// VolumeSnapshotClass for its driver, and waits until it is ready to use. A snapshot that
+// reports an error or is not ready in time is deleted again, so a failed attempt leaves
+// nothing behind.
+func (s *Snapshotter) Create(ctx context.Context, pvc types.PVCInfo, name string) error {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Resource.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": pvc.Namespace,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/instance":   pvc.Release,
+				"app.kubernetes.io/managed-by": "k8s-cf-backup",
+			},
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"persistentVolumeClaimName": pvc.PVCName},
+		},
+	}}
+
+	snapshots := s.client.Resource(Resource).Namespace(pvc.Namespace)
+	s.logf("Creating VolumeSnapshot %s/%s of PVC %s", pvc.Namespace, name, pvc.PVCName)
+	if _, err := snapshots.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating VolumeSnapshot: %w", err)
+	}
+	if err := s.waitReady(ctx, pvc.Namespace, name); err != nil {
+		s.logf("Deleting VolumeSnapshot %s/%s: %v", pvc.Namespace, name, err)
+		if derr := snapshots.Delete(context.WithoutCancel(ctx), name, metav1.DeleteOptions{}); derr != nil {
+			log.Printf("WARNING: could not delete failed VolumeSnapshot %s/%s: %v", pvc.Namespace, name, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// waitReady polls the snapshot until its status.readyToUse is true or it reports an error.
+func (s *Snapshotter) waitReady(ctx context.Context, namespace, name string) error {
+	deadline := time.After(s.timeout)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		obj, err := s.client.Resource(Resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("reading VolumeSnapshot: %w", err)
+		}
+		if msg, ok, _ := unstructured.NestedString(obj.Object, "status", "error", "message"); ok {
+			return fmt.Errorf("VolumeSnapshot failed: %s", msg)
+		}
+		if ready, _, _ := unstructured.NestedBool(obj.Object, "status", "readyToUse"); ready {
+			s.logf("VolumeSnapshot %s/%s is ready", namespace, name)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for VolumeSnapshot %s/%s to become ready", namespace, name)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Snapshotter) logf(format string, args ...interface{}) {
+	if s.verbose {
+		log.Printf("[snapshot] "+format, args...)
+	}
+}
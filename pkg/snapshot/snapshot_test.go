@@ -0,0 +1,86 @@
+package snapshot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeClient returns a dynamic client whose created VolumeSnapshots get status set as
+// the snapshot controller would.
+func newFakeClient(status map[string]interface{}) *dynamicfake.FakeDynamicClient {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{Resource: "VolumeSnapshotList"})
+	client.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		obj.Object["status"] = status
+		return false, nil, nil
+	})
+	return client
+}
+
+var pvc = types.PVCInfo{Namespace: "ns", Release: "rel", PVCName: "data"}
+
+func TestCreate_WaitsUntilReady(t *testing.T) {
+	client := newFakeClient(map[string]interface{}{"readyToUse": true})
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	if err := s.Create(context.Background(), pvc, "data-20240101-000000"); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	obj, err := client.Resource(Resource).Namespace("ns").Get(context.Background(), "data-20240101-000000", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("snapshot not created: %v", err)
+	}
+	if src, _, _ := unstructured.NestedString(obj.Object, "spec", "source", "persistentVolumeClaimName"); src != "data" {
+		t.Errorf("source PVC = %q, want data", src)
+	}
+	if rel := obj.GetLabels()["app.kubernetes.io/instance"]; rel != "rel" {
+		t.Errorf("release label = %q, want rel", rel)
+	}
+}
+
+func TestCreate_DeletesFailedSnapshot(t *testing.T) {
+	client := newFakeClient(map[string]interface{}{
+		"readyToUse": false,
+		"error":      map[string]interface{}{"message": "driver does not support snapshots"},
+	})
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+
+	err := s.Create(context.Background(), pvc, "data-20240101-000000")
+	if err == nil || !strings.Contains(err.Error(), "does not support snapshots") {
+		t.Fatalf("Create() error = %v, want the snapshot's error", err)
+	}
+	if _, err := client.Resource(Resource).Namespace("ns").Get(context.Background(), "data-20240101-000000", metav1.GetOptions{}); err == nil {
+		t.Error("failed snapshot was left behind")
+	}
+}
+
+func TestCreate_TimesOut(t *testing.T) {
+	client := newFakeClient(map[string]interface{}{"readyToUse": false})
+	s := New(client, false)
+	s.pollInterval = time.Millisecond
+	s.timeout = 10 * time.Millisecond
+
+	if err := s.Create(context.Background(), pvc, "data-20240101-000000"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Create() error = %v, want a timeout", err)
+	}
+}
+
+func TestName(t *testing.T) {
+	if got := Name("data", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)); got != "data-20240102-030405" {
+		t.Errorf("Name() = %q", got)
+	}
+}
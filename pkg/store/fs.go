@@ -0,0 +1,306 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+// FS stores archives as files below a root directory, typically an NFS or SMB mount.
+// Keys map to paths relative to the root, so a "/" in a key creates subdirectories.
+type FS struct {
+	root    string
+	verbose bool
+}
+
+// NewFS returns a store rooted at root, which must be an existing directory.
+func NewFS(root string, verbose bool) (*FS, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("destination %q: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("destination %q is not a directory", root)
+	}
+	return &FS{root: filepath.Clean(root), verbose: verbose}, nil
+}
+
+func (s *FS) path(key string) (string, error) {
+	p := filepath.Join(s.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, s.root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("key %q escapes destination %s", key, s.root)
+	}
+	return p, nil
+}
+
+// ObjectURL returns the fs:// URI of key.
+func (s *FS) ObjectURL(key string) string {
+	return "fs://" + filepath.ToSlash(filepath.Join(s.root, filepath.FromSlash(key)))
+}
+
+// Upload copies archivePath to key. The copy is written to a temporary name and renamed,
+// so an interrupted copy never looks like a complete archive.
+func (s *FS) Upload(ctx context.Context, archivePath, key string) error {
+	s.logf("Copying %s -> %s", archivePath, s.ObjectURL(key))
+
+	src, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	defer src.Close()
+
+	if err := s.write(key, src); err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+// UploadStream writes the content of r to key as it is read. Like Upload it goes through a
+// temporary name, so an archive whose stream broke off never appears. size is ignored.
+func (s *FS) UploadStream(ctx context.Context, key string, r io.Reader, size int64) error {
+	s.logf("Streaming -> %s", s.ObjectURL(key))
+	if err := s.write(key, r); err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+// UploadWithChecksum copies the archive and, for the sidecar and metadata modes, writes a
+// <key>.sha256 file next to it. Files have no object metadata, so metadata mode also uses
+// the sidecar.
+func (s *FS) UploadWithChecksum(ctx context.Context, archivePath, key, sum string, mode r2.ChecksumMode) error {
+	if err := s.Upload(ctx, archivePath, key); err != nil {
+		return err
+	}
+	if mode != r2.ChecksumSidecar && mode != r2.ChecksumMetadata {
+		return nil
+	}
+
+	line := fmt.Sprintf("%s  %s\n", sum, key[strings.LastIndex(key, "/")+1:])
+	sidecar := key + r2.SidecarSuffix
+	if err := s.write(sidecar, strings.NewReader(line)); err != nil {
+		return fmt.Errorf("uploading %s: %w", sidecar, err)
+	}
+	return nil
+}
+
+func (s *FS) write(key string, r io.Reader) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Make sure the data is on the share before it becomes visible under its final name
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Download copies key to destPath. When key has a checksum sidecar the copy must match it;
+// otherwise destPath is removed again.
+func (s *FS) Download(ctx context.Context, key, destPath string) error {
+	s.logf("Copying %s -> %s", s.ObjectURL(key), destPath)
+
+	src, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", key, err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		out.Close()
+		return fmt.Errorf("downloading %s: %w", key, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(src + r2.SidecarSuffix); err == nil {
+		if want, sum := r2.SidecarSum(data), hex.EncodeToString(h.Sum(nil)); want != "" && sum != want {
+			os.Remove(destPath)
+			return fmt.Errorf("downloading %s: SHA-256 %s does not match %s in %s", key, sum, want, key+r2.SidecarSuffix)
+		}
+	}
+	return nil
+}
+
+// Open opens key for reading. The caller closes the returned reader.
+func (s *FS) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	src, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// SetLatest writes the pointer object at key, replacing any earlier one.
+func (s *FS) SetLatest(ctx context.Context, key string, latest r2.Latest) error {
+	data, err := latest.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := s.write(key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetLatest reads the pointer object at key. It returns nil when there is none yet.
+func (s *FS) GetLatest(ctx context.Context, key string) (*r2.Latest, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s: %w", key, err)
+	}
+	return r2.ParseLatest(data)
+}
+
+// Stat returns the size and modification time of key. SHA256 is read from the sidecar
+// when there is one, standing in for the object metadata R2 would return.
+func (s *FS) Stat(ctx context.Context, key string) (r2.ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return r2.ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return r2.ObjectInfo{}, fmt.Errorf("stat %s: %w", key, err)
+	}
+	obj := r2.ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}
+	if data, err := os.ReadFile(p + r2.SidecarSuffix); err == nil {
+		obj.SHA256 = r2.SidecarSum(data)
+	}
+	return obj, nil
+}
+
+// ListByPrefix returns files whose key starts with prefix, newest first. In-progress
+// temporary copies are skipped.
+func (s *FS) ListByPrefix(ctx context.Context, prefix string) ([]r2.ObjectInfo, error) {
+	s.logf("Listing files with prefix %q in %s", prefix, s.root)
+
+	// Only walk the directory the prefix points into
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = filepath.Join(s.root, filepath.FromSlash(prefix[:i]))
+	}
+
+	var objects []r2.ObjectInfo
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, r2.ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", dir, err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].LastModified.After(objects[j].LastModified)
+	})
+
+	s.logf("Found %d file(s) with prefix %q", len(objects), prefix)
+	return objects, nil
+}
+
+// Delete removes key and any directories that leaves empty, as object stores have no
+// directories to leave behind. Deleting a missing key is not an error, matching object
+// stores.
+func (s *FS) Delete(ctx context.Context, key string) error {
+	s.logf("Deleting %s", s.ObjectURL(key))
+
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("deleting %s: %w", key, err)
+	}
+	for dir := filepath.Dir(p); dir != s.root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *FS) logf(format string, args ...interface{}) {
+	if s.verbose {
+		log.Printf("[store] "+format, args...)
+	}
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+func writeArchive(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFS_UploadListStatDownloadDelete(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewFS(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := writeArchive(t, "payload")
+	if err := s.Upload(ctx, src, "ns/rel/a.tar.gz"); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if err := s.Upload(ctx, src, "ns/other/b.tar.gz"); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	objects, err := s.ListByPrefix(ctx, "ns/rel/")
+	if err != nil {
+		t.Fatalf("ListByPrefix: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key != "ns/rel/a.tar.gz" || objects[0].Size != 7 {
+		t.Fatalf("ListByPrefix = %+v", objects)
+	}
+
+	info, err := s.Stat(ctx, "ns/rel/a.tar.gz")
+	if err != nil || info.Size != 7 {
+		t.Fatalf("Stat = %+v, %v", info, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "out.tar.gz")
+	if err := s.Download(ctx, "ns/rel/a.tar.gz", dst); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "payload" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	if err := s.Delete(ctx, "ns/rel/a.tar.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "ns/rel/a.tar.gz"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+	if objects, _ := s.ListByPrefix(ctx, "ns/rel/"); len(objects) != 0 {
+		t.Errorf("after Delete: %+v", objects)
+	}
+}
+
+func TestFS_ListSkipsTemporaryCopiesAndSortsNewestFirst(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, _ := NewFS(root, false)
+
+	src := writeArchive(t, "x")
+	for _, key := range []string{"p/old.tar.gz", "p/new.tar.gz"} {
+		if err := s.Upload(ctx, src, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(root, "p", "old.tar.gz"), old, old)
+	os.WriteFile(filepath.Join(root, "p", ".new.tar.gz.tmp-123"), []byte("partial"), 0644)
+
+	objects, err := s.ListByPrefix(ctx, "p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "p/new.tar.gz" || objects[1].Key != "p/old.tar.gz" {
+		t.Errorf("ListByPrefix = %+v", objects)
+	}
+
+	if objects, err := s.ListByPrefix(ctx, "missing/"); err != nil || len(objects) != 0 {
+		t.Errorf("missing prefix = %+v, %v", objects, err)
+	}
+}
+
+func TestFS_UploadWithChecksumWritesSidecar(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, _ := NewFS(root, false)
+	src := writeArchive(t, "x")
+
+	for _, mode := range []r2.ChecksumMode{r2.ChecksumSidecar, r2.ChecksumMetadata} {
+		key := "p/" + string(mode) + ".tar.gz"
+		if err := s.UploadWithChecksum(ctx, src, key, "abc123", mode); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(key)+r2.SidecarSuffix))
+		if err != nil {
+			t.Fatalf("%s: sidecar: %v", mode, err)
+		}
+		if want := "abc123  " + string(mode) + ".tar.gz\n"; string(data) != want {
+			t.Errorf("%s: sidecar = %q, want %q", mode, data, want)
+		}
+		if info, err := s.Stat(ctx, key); err != nil || info.SHA256 != "abc123" {
+			t.Errorf("%s: Stat = %+v, %v", mode, info, err)
+		}
+	}
+
+	if err := s.UploadWithChecksum(ctx, src, "p/none.tar.gz", "abc123", r2.ChecksumNone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "p", "none.tar.gz"+r2.SidecarSuffix)); !os.IsNotExist(err) {
+		t.Errorf("ChecksumNone wrote a sidecar: %v", err)
+	}
+}
+
+func TestFS_UploadStream(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, _ := NewFS(root, false)
+
+	if err := s.UploadStream(ctx, "p/a.tar.gz", strings.NewReader("streamed"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "p", "a.tar.gz")); err != nil || string(data) != "streamed" {
+		t.Errorf("a.tar.gz = %q, %v", data, err)
+	}
+
+	// A stream that breaks off leaves nothing under the key, not even a temporary file
+	broken := io.MultiReader(strings.NewReader("part"), iotest.ErrReader(errors.New("archiver failed")))
+	if err := s.UploadStream(ctx, "p/b.tar.gz", broken, -1); err == nil {
+		t.Fatal("UploadStream(broken) succeeded")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "p")); len(entries) != 1 {
+		t.Errorf("entries after a broken stream = %v, want only a.tar.gz", entries)
+	}
+}
+
+func TestFS_DownloadVerifiesSidecar(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, _ := NewFS(root, false)
+	if err := s.UploadWithChecksum(ctx, writeArchive(t, "payload"), "a.tar.gz", "0000", r2.ChecksumSidecar); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := s.Download(ctx, "a.tar.gz", dst); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Download() error = %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("corrupt copy left at %s: %v", dst, err)
+	}
+}
+
+func TestFS_SetAndGetLatest(t *testing.T) {
+	ctx := context.Background()
+	s, _ := NewFS(t.TempDir(), false)
+	key := "ns/rel/" + r2.LatestName
+
+	if got, err := s.GetLatest(ctx, key); err != nil || got != nil {
+		t.Fatalf("GetLatest before any backup = %+v, %v; want nil", got, err)
+	}
+	if err := s.SetLatest(ctx, key, r2.Latest{PVCs: map[string]string{"data": "ns/rel/a.tar.gz"}}); err != nil {
+		t.Fatalf("SetLatest: %v", err)
+	}
+	got, err := s.GetLatest(ctx, key)
+	if err != nil || got.PVCs["data"] != "ns/rel/a.tar.gz" {
+		t.Errorf("GetLatest = %+v, %v", got, err)
+	}
+}
+
+func TestFS_RejectsKeysOutsideRoot(t *testing.T) {
+	s, _ := NewFS(t.TempDir(), false)
+	if err := s.Upload(context.Background(), writeArchive(t, "x"), "../escape.tar.gz"); err == nil {
+		t.Error("expected an error for a key outside the root")
+	}
+}
+
+func TestNewFS_RequiresDirectory(t *testing.T) {
+	if _, err := NewFS(filepath.Join(t.TempDir(), "missing"), false); err == nil {
+		t.Error("expected an error for a missing root")
+	}
+	if _, err := NewFS(writeArchive(t, "x"), false); err == nil {
+		t.Error("expected an error for a file root")
+	}
+}
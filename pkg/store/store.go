@@ -0,0 +1,352 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/backup"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/perfile"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+// Store is a destination that archives are copied to after backup and fetched from on
+// restore. *r2.Client and *FS implement it.
+type Store interface {
+	Upload(ctx context.Context, archivePath, key string) error
+	// UploadWithChecksum uploads an archive and records its hex SHA-256 according to mode.
+	UploadWithChecksum(ctx context.Context, archivePath, key, sum string, mode r2.ChecksumMode) error
+	// Download saves an object to destPath, failing when it does not match the checksum
+	// recorded for it, so a corrupted archive is never restored.
+	Download(ctx context.Context, key, destPath string) error
+	// UploadStream uploads the content of r to key as it is read, for archives that are
+	// never written to disk. size is -1 when unknown.
+	UploadStream(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open streams an object without saving it.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (r2.ObjectInfo, error)
+	// ListByPrefix returns objects whose key starts with prefix, newest first.
+	ListByPrefix(ctx context.Context, prefix string) ([]r2.ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	ObjectURL(key string) string
+	// SetLatest and GetLatest write and read the pointer to a release's newest backups.
+	SetLatest(ctx context.Context, key string, latest r2.Latest) error
+	GetLatest(ctx context.Context, key string) (*r2.Latest, error)
+}
+
+// Labeler is a Store that can tag archives with the PVC they were taken of. *r2.Client
+// implements it; files have no metadata to hold the labels.
+type Labeler interface {
+	UploadLabeled(ctx context.Context, archivePath, key, sum string, mode r2.ChecksumMode, labels r2.Labels) error
+}
+
+// StreamLabeler is a Store that can tag the archives it is streamed. *r2.Client implements
+// it.
+type StreamLabeler interface {
+	UploadStreamLabeled(ctx context.Context, key string, r io.Reader, size int64, labels r2.Labels) error
+}
+
+var (
+	_ Store   = (*r2.Client)(nil)
+	_ Store   = (*FS)(nil)
+	_ Labeler = (*r2.Client)(nil)
+
+	_ StreamLabeler = (*r2.Client)(nil)
+)
+
+// UploadArchive uploads an archive with UploadWithChecksum, adding labels when s is a
+// Labeler.
+func UploadArchive(ctx context.Context, s Store, archivePath, key, sum string, mode r2.ChecksumMode, labels r2.Labels) error {
+	if l, ok := s.(Labeler); ok && !labels.IsZero() {
+		return l.UploadLabeled(ctx, archivePath, key, sum, mode, labels)
+	}
+	return s.UploadWithChecksum(ctx, archivePath, key, sum, mode)
+}
+
+// StreamArchive uploads an archive as it is created with UploadStream, adding labels when s
+// is a StreamLabeler.
+func StreamArchive(ctx context.Context, s Store, key string, r io.Reader, labels r2.Labels) error {
+	if l, ok := s.(StreamLabeler); ok && !labels.IsZero() {
+		return l.UploadStreamLabeled(ctx, key, r, -1, labels)
+	}
+	return s.UploadStream(ctx, key, r, -1)
+}
+
+// Open returns the Store for a --dest URI. Only fs:///<path> is supported; R2 is configured
+// with --r2-credentials instead.
+func Open(uri string, verbose bool) (Store, error) {
+	path, ok := strings.CutPrefix(uri, "fs://")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid destination %q (want fs:///absolute/path)", uri)
+	}
+	return NewFS(path, verbose)
+}
+
+// PermCheckPrefix is where ProbeWrite puts its test objects.
+const PermCheckPrefix = ".permcheck/"
+
+// ProbeWrite uploads a tiny object under PermCheckPrefix and deletes it again, proving that
+// s accepts the writes a backup makes and the deletes rotation makes. It returns the key it
+// used. The object is left behind only when the delete fails.
+func ProbeWrite(ctx context.Context, s Store) (string, error) {
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-permcheck-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("k8s-cf-backup write check\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s%d", PermCheckPrefix, time.Now().UnixNano())
+	if err := s.Upload(ctx, tmp.Name(), key); err != nil {
+		return key, fmt.Errorf("writing: %w", err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		return key, fmt.Errorf("deleting: %w", err)
+	}
+	return key, nil
+}
+
+// Copy copies srcKey from src to dstKey in dst. Two R2 clients on the same account copy
+// server-side; otherwise the object goes through a temporary local file. A checksum and
+// labels kept in R2 object metadata are carried over either way.
+func Copy(ctx context.Context, src, dst Store, srcKey, dstKey string) error {
+	rs, srcR2 := src.(*r2.Client)
+	if rd, ok := dst.(*r2.Client); ok && srcR2 && rd.SameAccount(rs) {
+		return rd.CopyFrom(ctx, rs, srcKey, dstKey)
+	}
+
+	tmp, err := os.CreateTemp("", "k8s-cf-backup-copy-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := src.Download(ctx, srcKey, tmp.Name()); err != nil {
+		return err
+	}
+	if srcR2 {
+		info, err := src.Stat(ctx, srcKey)
+		if err != nil {
+			return err
+		}
+		if info.SHA256 != "" {
+			return UploadArchive(ctx, dst, tmp.Name(), dstKey, info.SHA256, r2.ChecksumMetadata, info.Labels)
+		}
+		if !info.Labels.IsZero() {
+			return UploadArchive(ctx, dst, tmp.Name(), dstKey, "", r2.ChecksumNone, info.Labels)
+		}
+	}
+	return dst.Upload(ctx, tmp.Name(), dstKey)
+}
+
+// ListGrouped lists everything under basePrefix with a single listing and groups it by the
+// next path segment: the text between basePrefix and the following delimiter. With
+// basePrefix "ns/rel/" and delimiter "/", "ns/rel/data/x.tar.gz" lands in group "data".
+// Keys without a delimiter after basePrefix belong to no group and are left out. Each group
+// keeps the newest-first order of ListByPrefix.
+//
+// Grouping only lines up with PVCs when the key layout puts each PVC in its own "directory"
+// (e.g. {namespace}/{release}/{pvc}/{date}.tar.gz); flat layouts such as
+// {namespace}_{release}_{date}_{pvc} have no segment to group by.
+func ListGrouped(ctx context.Context, s Store, basePrefix, delimiter string) (map[string][]r2.ObjectInfo, error) {
+	objects, err := s.ListByPrefix(ctx, basePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]r2.ObjectInfo)
+	for _, obj := range objects {
+		rest := strings.TrimPrefix(obj.Key, basePrefix)
+		group, _, ok := strings.Cut(rest, delimiter)
+		if !ok {
+			continue
+		}
+		groups[group] = append(groups[group], obj)
+	}
+	return groups, nil
+}
+
+// Retention decides which archives rotation keeps. An archive survives if any rule keeps
+// it; with no rules set nothing is deleted.
+type Retention struct {
+	KeepLast int // keep the N newest archives
+	KeepDays int // keep archives modified within the last N days
+	GFS
+}
+
+// GFS is grandfather-father-son retention: for each tier, the newest archive of each of
+// the N most recent calendar days, ISO weeks or months that have a backup is kept.
+type GFS struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+func (g GFS) enabled() bool {
+	return g.Daily > 0 || g.Weekly > 0 || g.Monthly > 0
+}
+
+// Enabled reports whether any retention rule is set.
+func (r Retention) Enabled() bool {
+	return r.KeepLast > 0 || r.KeepDays > 0 || r.GFS.enabled()
+}
+
+func (r Retention) String() string {
+	var parts []string
+	if r.KeepLast > 0 {
+		parts = append(parts, fmt.Sprintf("keep last %d", r.KeepLast))
+	}
+	if r.KeepDays > 0 {
+		parts = append(parts, fmt.Sprintf("keep %d day(s)", r.KeepDays))
+	}
+	if r.Daily > 0 {
+		parts = append(parts, fmt.Sprintf("%d daily", r.Daily))
+	}
+	if r.Weekly > 0 {
+		parts = append(parts, fmt.Sprintf("%d weekly", r.Weekly))
+	}
+	if r.Monthly > 0 {
+		parts = append(parts, fmt.Sprintf("%d monthly", r.Monthly))
+	}
+	if len(parts) == 0 {
+		return "keep all"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Plan returns the keys rotation would delete from objects, which must be sorted newest
+// first. Only archives, and the manifests of per-file snapshots, count toward the rules;
+// each deleted archive is followed by its checksum sidecar when one is listed. The newest
+// archive is never deleted, so a stale schedule with --keep-days cannot empty a prefix.
+// GFS tiers go by BackupTime. suffix is the archive suffix keys may end with.
+func Plan(objects []r2.ObjectInfo, r Retention, suffix string, now time.Time) []string {
+	if !r.Enabled() {
+		return nil
+	}
+
+	listed := make(map[string]bool, len(objects))
+	var archives []r2.ObjectInfo
+	for _, obj := range objects {
+		listed[obj.Key] = true
+		if backup.IsArchive(backup.TrimArchiveSuffix(obj.Key, suffix)) || perfile.IsManifest(obj.Key) {
+			archives = append(archives, obj)
+		}
+	}
+
+	gfs := r.GFS.keep(archives)
+	cutoff := now.Add(-time.Duration(r.KeepDays) * 24 * time.Hour)
+	var keys []string
+	for i, obj := range archives {
+		keep := i == 0 ||
+			(r.KeepLast > 0 && i < r.KeepLast) ||
+			(r.KeepDays > 0 && !obj.LastModified.Before(cutoff)) ||
+			gfs[obj.Key]
+		if keep {
+			continue
+		}
+		keys = append(keys, obj.Key)
+		if sidecar := obj.Key + r2.SidecarSuffix; listed[sidecar] {
+			keys = append(keys, sidecar)
+		}
+	}
+	return keys
+}
+
+// keep returns the keys of the archives the GFS tiers keep.
+func (g GFS) keep(archives []r2.ObjectInfo) map[string]bool {
+	kept := make(map[string]bool)
+	if !g.enabled() {
+		return kept
+	}
+
+	byTime := slices.Clone(archives)
+	slices.SortStableFunc(byTime, func(a, b r2.ObjectInfo) int { return BackupTime(b).Compare(BackupTime(a)) })
+
+	tiers := []struct {
+		count  int
+		bucket func(time.Time) string
+	}{
+		{g.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{g.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{g.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, tier := range tiers {
+		seen := make(map[string]bool)
+		for _, obj := range byTime {
+			if len(seen) >= tier.count {
+				break
+			}
+			// Newest first, so the first archive of each bucket is the one to keep
+			if b := tier.bucket(BackupTime(obj)); !seen[b] {
+				seen[b] = true
+				kept[obj.Key] = true
+			}
+		}
+	}
+	return kept
+}
+
+// dateInKey matches the {date} placeholder as backup.FormatName renders it.
+var dateInKey = regexp.MustCompile(`\d{8}-\d{6}`)
+
+// BackupTime is when the backup in obj was taken: the {date} in its key, read in local time
+// as it was written, or its modification time when the key has none.
+func BackupTime(obj r2.ObjectInfo) time.Time {
+	if m := dateInKey.FindString(obj.Key); m != "" {
+		if t, err := time.ParseInLocation("20060102-150405", m, time.Local); err == nil {
+			return t
+		}
+	}
+	return obj.LastModified
+}
+
+// SkipLocked drops the backups that object lock keeps from being deleted at now from keys,
+// a rotation plan, and returns the rest and the locked ones. A locked archive keeps its
+// sidecar, so it can still be verified. Keys that cannot be stat'ed are kept for the
+// delete to report. Files are never locked.
+func SkipLocked(ctx context.Context, s Store, keys []string, now time.Time) ([]string, []r2.ObjectInfo) {
+	var locked []r2.ObjectInfo
+	held := make(map[string]bool)
+	for _, key := range keys {
+		if r2.IsSidecar(key) {
+			continue
+		}
+		if obj, err := s.Stat(ctx, key); err == nil && obj.Locked(now) {
+			locked = append(locked, obj)
+			held[key] = true
+		}
+	}
+	if len(locked) == 0 {
+		return keys, nil
+	}
+	return slices.DeleteFunc(slices.Clone(keys), func(key string) bool {
+		return held[key] || held[strings.TrimSuffix(key, r2.SidecarSuffix)]
+	}), locked
+}
+
+// DeleteBackup deletes the backup at key and returns the keys it deleted: the key itself
+// for an archive or sidecar, every object of the snapshot for a per-file manifest.
+func DeleteBackup(ctx context.Context, s Store, key string) ([]string, error) {
+	if perfile.IsManifest(key) {
+		return perfile.Delete(ctx, s, perfile.Prefix(key))
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		return nil, err
+	}
+	return []string{key}, nil
+}
@@ -0,0 +1,496 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/perfile"
+	"github.com/bitia-ru/k8s-hostpath-cloudflare-backup/pkg/r2"
+)
+
+func TestOpen(t *testing.T) {
+	root := t.TempDir()
+	if _, err := Open("fs://"+root, false); err != nil {
+		t.Errorf("Open(fs://%s): %v", root, err)
+	}
+	for _, uri := range []string{root, "fs://relative/path", "s3://bucket"} {
+		if _, err := Open(uri, false); err == nil {
+			t.Errorf("Open(%q) succeeded", uri)
+		}
+	}
+}
+
+func TestRetention_String(t *testing.T) {
+	tests := map[Retention]string{
+		{}:                         "keep all",
+		{KeepLast: 3}:              "keep last 3",
+		{KeepDays: 7}:              "keep 7 day(s)",
+		{KeepLast: 3, KeepDays: 7}: "keep last 3, keep 7 day(s)",
+	}
+	for r, want := range tests {
+		if got := r.String(); got != want {
+			t.Errorf("%+v.String() = %q, want %q", r, got, want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	objects := []r2.ObjectInfo{
+		{Key: "p/d0.tar.gz", LastModified: now.Add(-1 * time.Hour)},
+		{Key: "p/d0.tar.gz.sha256", LastModified: now.Add(-1 * time.Hour)},
+		{Key: "p/d2.tar.gz", LastModified: now.Add(-2 * day)},
+		{Key: "p/d5.tar.gz", LastModified: now.Add(-5 * day)},
+		{Key: "p/d5.tar.gz.sha256", LastModified: now.Add(-5 * day)},
+		{Key: "p/d9.tar.gz", LastModified: now.Add(-9 * day)},
+	}
+
+	tests := []struct {
+		name string
+		r    Retention
+		want []string
+	}{
+		{"disabled", Retention{}, nil},
+		{"keep last", Retention{KeepLast: 2}, []string{"p/d5.tar.gz", "p/d5.tar.gz.sha256", "p/d9.tar.gz"}},
+		{"keep days", Retention{KeepDays: 3}, []string{"p/d5.tar.gz", "p/d5.tar.gz.sha256", "p/d9.tar.gz"}},
+		{"union", Retention{KeepLast: 1, KeepDays: 6}, []string{"p/d9.tar.gz"}},
+		{"union keep last wins", Retention{KeepLast: 3, KeepDays: 1}, []string{"p/d9.tar.gz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Plan(objects, tt.r, "", now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Plan = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlan_NeverDeletesNewest(t *testing.T) {
+	now := time.Now()
+	objects := []r2.ObjectInfo{
+		{Key: "p/a.tar.gz", LastModified: now.Add(-30 * 24 * time.Hour)},
+		{Key: "p/b.tar.gz", LastModified: now.Add(-40 * 24 * time.Hour)},
+	}
+	got := Plan(objects, Retention{KeepDays: 7}, "", now)
+	if want := []string{"p/b.tar.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan = %v, want %v", got, want)
+	}
+}
+
+func TestPlan_SidecarsFollowArchives(t *testing.T) {
+	// Newest first, as ListByPrefix returns them. Sidecars are uploaded just after their
+	// archive, so they interleave; a4 has no sidecar and another object shares the prefix.
+	objects := []r2.ObjectInfo{
+		{Key: "p/a5.tar.zst.sha256"},
+		{Key: "p/a5.tar.zst"},
+		{Key: "p/notes.json"},
+		{Key: "p/a4.zip"},
+		{Key: "p/a3.tar.gz.sha256"},
+		{Key: "p/a3.tar.gz"},
+		{Key: "p/a2.tar.gz.sha256"},
+		{Key: "p/a2.tar.gz"},
+		{Key: "p/a1.tar.gz"},
+		{Key: "p/a1.tar.gz.sha256"},
+	}
+
+	tests := []struct {
+		keepLast int
+		want     []string
+	}{
+		{5, nil},
+		{4, []string{"p/a1.tar.gz", "p/a1.tar.gz.sha256"}},
+		{2, []string{"p/a3.tar.gz", "p/a3.tar.gz.sha256", "p/a2.tar.gz", "p/a2.tar.gz.sha256", "p/a1.tar.gz", "p/a1.tar.gz.sha256"}},
+		{1, []string{"p/a4.zip", "p/a3.tar.gz", "p/a3.tar.gz.sha256", "p/a2.tar.gz", "p/a2.tar.gz.sha256", "p/a1.tar.gz", "p/a1.tar.gz.sha256"}},
+	}
+	for _, tc := range tests {
+		if got := Plan(objects, Retention{KeepLast: tc.keepLast}, "", time.Now()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Plan(keep last %d) = %v, want %v", tc.keepLast, got, tc.want)
+		}
+	}
+}
+
+func TestPlan_ArchiveSuffix(t *testing.T) {
+	objects := []r2.ObjectInfo{
+		{Key: "p/a3.tar.gz.bak"},
+		{Key: "p/a2.tar.gz.bak.sha256"},
+		{Key: "p/a2.tar.gz.bak"},
+		{Key: "p/a1.tar.gz"},
+	}
+	want := []string{"p/a2.tar.gz.bak", "p/a2.tar.gz.bak.sha256", "p/a1.tar.gz"}
+	if got := Plan(objects, Retention{KeepLast: 1}, ".bak", time.Now()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() = %v, want %v", got, want)
+	}
+	if got := Plan(objects, Retention{KeepLast: 1}, "", time.Now()); len(got) != 0 {
+		t.Errorf("Plan() without the suffix = %v, want nothing, as a1 is the only archive", got)
+	}
+}
+
+func TestDeleteBackup_PerFileSnapshots(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, _ := NewFS(root, false)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "data.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for _, prefix := range []string{"ns/rel/old/", "ns/rel/new/"} {
+		if _, err := perfile.Upload(ctx, s, src, prefix, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chtimes(filepath.Join(root, "ns", "rel", "old", perfile.ManifestName), old, old)
+
+	// The manifests stand for their snapshots in the plan, and each takes its files with it
+	objects, _ := s.ListByPrefix(ctx, "ns/rel/")
+	var deleted []string
+	for _, key := range Plan(objects, Retention{KeepLast: 1}, "", time.Now()) {
+		keys, err := DeleteBackup(ctx, s, key)
+		if err != nil {
+			t.Fatalf("DeleteBackup(%s): %v", key, err)
+		}
+		deleted = append(deleted, keys...)
+	}
+	want := []string{"ns/rel/old/" + perfile.ManifestName, "ns/rel/old/data.txt.gz"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+	objects, _ = s.ListByPrefix(ctx, "ns/rel/")
+	if len(objects) != 2 {
+		t.Errorf("remaining = %+v, want the new snapshot", objects)
+	}
+}
+
+func TestListGrouped(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, _ := NewFS(root, false)
+	src := writeArchive(t, "x")
+
+	keys := []string{
+		"ns/rel/data/20240101.tar.gz",
+		"ns/rel/data/20240102.tar.gz",
+		"ns/rel/wal/20240101.tar.gz",
+		"ns/rel/stray.tar.gz",
+		"ns/other/data/20240101.tar.gz",
+	}
+	now := time.Now()
+	for i, key := range keys {
+		if err := s.Upload(ctx, src, key); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), mtime, mtime)
+	}
+
+	groups, err := ListGrouped(ctx, s, "ns/rel/", "/")
+	if err != nil {
+		t.Fatalf("ListGrouped: %v", err)
+	}
+	got := make(map[string][]string)
+	for group, objects := range groups {
+		for _, obj := range objects {
+			got[group] = append(got[group], obj.Key)
+		}
+	}
+	want := map[string][]string{
+		"data": {"ns/rel/data/20240102.tar.gz", "ns/rel/data/20240101.tar.gz"},
+		"wal":  {"ns/rel/wal/20240101.tar.gz"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListGrouped = %v, want %v", got, want)
+	}
+}
+
+func TestBackupTime(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	got := BackupTime(r2.ObjectInfo{Key: "ns/rel/ns_rel_20240315-143000_data.tar.gz", LastModified: mtime})
+	if want := time.Date(2024, 3, 15, 14, 30, 0, 0, time.Local); !got.Equal(want) {
+		t.Errorf("BackupTime = %v, want %v", got, want)
+	}
+	if got := BackupTime(r2.ObjectInfo{Key: "ns/rel/data.tar.gz", LastModified: mtime}); !got.Equal(mtime) {
+		t.Errorf("BackupTime without a date = %v, want the mtime %v", got, mtime)
+	}
+}
+
+// dailyBackups returns one archive per day at 02:00 from first to last inclusive, newest
+// first, with mtimes that disagree with the key dates to show that the key wins.
+func dailyBackups(first, last time.Time) []r2.ObjectInfo {
+	var objects []r2.ObjectInfo
+	for d := last; !d.Before(first); d = d.AddDate(0, 0, -1) {
+		objects = append(objects, r2.ObjectInfo{
+			Key:          "p/ns_rel_" + d.Format("20060102") + "-020000_data.tar.gz",
+			LastModified: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	return objects
+}
+
+func keptKeys(objects []r2.ObjectInfo, deleted []string) []string {
+	gone := make(map[string]bool)
+	for _, key := range deleted {
+		gone[key] = true
+	}
+	var kept []string
+	for _, obj := range objects {
+		if !gone[obj.Key] {
+			kept = append(kept, obj.Key)
+		}
+	}
+	return kept
+}
+
+func dateKeys(dates ...string) []string {
+	keys := make([]string, len(dates))
+	for i, d := range dates {
+		keys[i] = "p/ns_rel_" + d + "-020000_data.tar.gz"
+	}
+	return keys
+}
+
+func TestPlan_GFS(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.Local) }
+	// 2024-01-01 .. 2024-03-31, newest is Sunday 2024-03-31
+	objects := dailyBackups(day(2024, 1, 1), day(2024, 3, 31))
+	now := day(2024, 4, 1)
+
+	tests := []struct {
+		name   string
+		policy GFS
+		want   []string
+	}{
+		{"daily", GFS{Daily: 3}, dateKeys("20240331", "20240330", "20240329")},
+		// ISO weeks end on Sunday; the newest backup of each week is its Sunday
+		{"weekly", GFS{Weekly: 3}, dateKeys("20240331", "20240324", "20240317")},
+		{"monthly", GFS{Monthly: 3}, dateKeys("20240331", "20240229", "20240131")},
+		{"tiers overlap", GFS{Daily: 2, Weekly: 2, Monthly: 2}, dateKeys("20240331", "20240330", "20240324", "20240229")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := Plan(objects, Retention{GFS: tt.policy}, "", now)
+			if got := keptKeys(objects, deleted); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlan_GFSGapsAndSameDay(t *testing.T) {
+	// Two backups on the same day, then a gap: buckets count days that have a backup
+	at := func(s string) r2.ObjectInfo {
+		return r2.ObjectInfo{Key: "p/ns_rel_" + s + "_data.tar.gz"}
+	}
+	objects := []r2.ObjectInfo{
+		at("20240310-180000"),
+		at("20240310-060000"),
+		at("20240301-060000"),
+		at("20240215-060000"),
+	}
+	deleted := Plan(objects, Retention{GFS: GFS{Daily: 2}}, "", time.Now())
+	want := []string{"p/ns_rel_20240310-060000_data.tar.gz", "p/ns_rel_20240215-060000_data.tar.gz"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
+
+func TestPlan_GFSUnionWithKeepLast(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.Local) }
+	objects := dailyBackups(day(2024, 1, 1), day(2024, 3, 31))
+	deleted := Plan(objects, Retention{KeepLast: 5, GFS: GFS{Monthly: 3}}, "", day(2024, 4, 1))
+	want := dateKeys("20240331", "20240330", "20240329", "20240328", "20240327", "20240229", "20240131")
+	if got := keptKeys(objects, deleted); !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestRetention_StringGFS(t *testing.T) {
+	r := Retention{KeepLast: 2, GFS: GFS{Daily: 7, Weekly: 4, Monthly: 12}}
+	if got, want := r.String(), "keep last 2, 7 daily, 4 weekly, 12 monthly"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if !(Retention{GFS: GFS{Weekly: 1}}).Enabled() {
+		t.Error("GFS-only retention should be enabled")
+	}
+}
+
+func TestCopy_FS(t *testing.T) {
+	ctx := context.Background()
+	src, _ := NewFS(t.TempDir(), false)
+	dst, _ := NewFS(t.TempDir(), false)
+	if err := src.Upload(ctx, writeArchive(t, "payload"), "old/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Copy(ctx, src, dst, "old/a.tar.gz", "new/b.tar.gz"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := dst.Download(ctx, "new/b.tar.gz", out); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out); string(data) != "payload" {
+		t.Errorf("copied content = %q, want %q", data, "payload")
+	}
+	if _, err := src.Stat(ctx, "old/a.tar.gz"); err != nil {
+		t.Errorf("source was removed: %v", err)
+	}
+}
+
+// labelingFS is an FS that records the labels it is asked to upload with.
+type labelingFS struct {
+	*FS
+	labels map[string]r2.Labels
+}
+
+func (s *labelingFS) UploadLabeled(ctx context.Context, archivePath, key, sum string, mode r2.ChecksumMode, labels r2.Labels) error {
+	s.labels[key] = labels
+	return s.UploadWithChecksum(ctx, archivePath, key, sum, mode)
+}
+
+func (s *labelingFS) UploadStreamLabeled(ctx context.Context, key string, r io.Reader, size int64, labels r2.Labels) error {
+	s.labels[key] = labels
+	return s.UploadStream(ctx, key, r, size)
+}
+
+func TestUploadArchive(t *testing.T) {
+	ctx := context.Background()
+	fs, err := NewFS(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := r2.Labels{Namespace: "ns", Release: "rel", PVC: "data"}
+
+	// Files hold no labels, so FS uploads without them
+	if err := UploadArchive(ctx, fs, writeArchive(t, "x"), "a.tar.gz", "sum", r2.ChecksumSidecar, labels); err != nil {
+		t.Fatalf("UploadArchive(FS) error: %v", err)
+	}
+	objects, err := fs.ListByPrefix(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"a.tar.gz", "a.tar.gz.sha256"}) {
+		t.Errorf("FS keys = %v, want the archive and its sidecar", keys)
+	}
+
+	l := &labelingFS{FS: fs, labels: make(map[string]r2.Labels)}
+	if err := UploadArchive(ctx, l, writeArchive(t, "x"), "b.tar.gz", "sum", r2.ChecksumNone, labels); err != nil {
+		t.Fatalf("UploadArchive(Labeler) error: %v", err)
+	}
+	if got := l.labels["b.tar.gz"]; got != labels {
+		t.Errorf("labels = %+v, want %+v", got, labels)
+	}
+
+	if err := StreamArchive(ctx, l, "c.tar.gz", strings.NewReader("x"), labels); err != nil {
+		t.Fatalf("StreamArchive(StreamLabeler) error: %v", err)
+	}
+	if got := l.labels["c.tar.gz"]; got != labels {
+		t.Errorf("streamed labels = %+v, want %+v", got, labels)
+	}
+}
+
+// lockingFS is an FS whose objects in locked are under object lock until the time given,
+// refusing deletion like a locked bucket.
+type lockingFS struct {
+	*FS
+	locked map[string]time.Time
+}
+
+func (s *lockingFS) Stat(ctx context.Context, key string) (r2.ObjectInfo, error) {
+	obj, err := s.FS.Stat(ctx, key)
+	obj.RetainUntil = s.locked[key]
+	return obj, err
+}
+
+func (s *lockingFS) Delete(ctx context.Context, key string) error {
+	if s.locked[key].After(time.Now()) {
+		return errors.New("AccessDenied: object is under object lock")
+	}
+	return s.FS.Delete(ctx, key)
+}
+
+// deleteDeniedFS is an FS whose credentials may write but not delete.
+type deleteDeniedFS struct {
+	*FS
+}
+
+func (deleteDeniedFS) Delete(ctx context.Context, key string) error {
+	return errors.New("AccessDenied")
+}
+
+func TestProbeWrite(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs, _ := NewFS(root, false)
+
+	key, err := ProbeWrite(ctx, fs)
+	if err != nil || !strings.HasPrefix(key, PermCheckPrefix) {
+		t.Fatalf("ProbeWrite() = %q, %v", key, err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("probe left %v behind", entries)
+	}
+
+	key, err = ProbeWrite(ctx, deleteDeniedFS{fs})
+	if err == nil || !strings.Contains(err.Error(), "deleting: AccessDenied") {
+		t.Errorf("ProbeWrite(no delete permission) error = %v", err)
+	}
+	if _, err := fs.Stat(ctx, key); err != nil {
+		t.Errorf("the object the delete failed on is gone: %v", err)
+	}
+}
+
+func TestSkipLocked(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fs, _ := NewFS(root, false)
+	src := writeArchive(t, "x")
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		key := "ns/rel/" + name + ".tar.gz"
+		if err := fs.UploadWithChecksum(ctx, src, key, "sum", r2.ChecksumSidecar); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-time.Duration(i) * time.Hour)
+		os.Chtimes(filepath.Join(root, "ns", "rel", name+".tar.gz"), mtime, mtime)
+		os.Chtimes(filepath.Join(root, "ns", "rel", name+".tar.gz.sha256"), mtime, mtime)
+	}
+	s := &lockingFS{FS: fs, locked: map[string]time.Time{
+		"ns/rel/b.tar.gz":        now.Add(24 * time.Hour),
+		"ns/rel/b.tar.gz.sha256": now.Add(24 * time.Hour),
+		"ns/rel/c.tar.gz":        now.Add(-time.Hour), // expired
+	}}
+
+	// b is locked, so rotation keeps it and its sidecar instead of failing on them
+	objects, _ := s.ListByPrefix(ctx, "ns/rel/")
+	keys, locked := SkipLocked(ctx, s, Plan(objects, Retention{KeepLast: 1}, "", now), now)
+	if want := []string{"ns/rel/c.tar.gz", "ns/rel/c.tar.gz.sha256"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("SkipLocked() kept %v to delete, want %v", keys, want)
+	}
+	if len(locked) != 1 || locked[0].Key != "ns/rel/b.tar.gz" {
+		t.Errorf("SkipLocked() locked %+v, want b", locked)
+	}
+	for _, key := range keys {
+		if _, err := DeleteBackup(ctx, s, key); err != nil {
+			t.Errorf("DeleteBackup(%s): %v", key, err)
+		}
+	}
+	// Once the lock expires it goes like any other backup
+	if keys, _ := SkipLocked(ctx, s, []string{"ns/rel/b.tar.gz", "ns/rel/b.tar.gz.sha256"}, now.Add(48*time.Hour)); len(keys) != 2 {
+		t.Errorf("SkipLocked() after expiry kept %v, want both keys", keys)
+	}
+}
@@ -1,12 +1,18 @@
 package types
 
+import "time"
+
 // PVCInfo holds information about a PersistentVolumeClaim and its backing PV.
 type PVCInfo struct {
-	Namespace string
-	PVCName   string
-	PVName    string
-	HostPath  string
-	Workload  *WorkloadInfo
+	Namespace    string
+	Release      string
+	PVCName      string
+	PVName       string
+	HostPath     string
+	StorageClass string // the PVC's spec.storageClassName; empty when it has none
+	CSIDriver    string // driver of a CSI-provisioned PV; empty for other volume types
+	Node         string // node the PV's node affinity pins it to; empty when it has none
+	Workload     *WorkloadInfo
 }
 
 // WorkloadInfo describes a Deployment or StatefulSet that uses a PVC.
@@ -15,6 +21,7 @@ type WorkloadInfo struct {
 	Name             string
 	Namespace        string
 	OriginalReplicas int32
+	HPA              string // HorizontalPodAutoscaler targeting the workload, if any
 }
 
 // BackupResult holds the outcome of backing up a single PVC.
@@ -22,5 +29,21 @@ type BackupResult struct {
 	PVCName     string
 	ArchivePath string
 	Size        int64
+	SHA256      string   // hex digest of the archive; empty unless checksums are enabled
+	Warnings    []string // non-fatal issues, e.g. a host path that is a symlink
+	Resumed     bool     // completed by an earlier, interrupted run and not archived again
+	Unchanged   bool     // same fingerprint as at the last backup, so not archived at all
+	Fingerprint string   // DirFingerprint of the host path; empty unless fingerprints are enabled
+	Err         error
+}
+
+// RestoreResult holds the outcome of restoring a single PVC.
+type RestoreResult struct {
+	PVCName     string
+	ArchivePath string
+	TargetDir   string        // host path the archive was extracted into
+	Files       int           // regular files in TargetDir after the restore
+	Bytes       int64         // total size of those files
+	Duration    time.Duration // time spent clearing TargetDir and extracting
 	Err         error
 }